@@ -15,31 +15,32 @@ import (
 	"runtime/pprof"
 	"strconv"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 
 	"github.com/c9s/goprocinfo/linux"
-	"github.com/untangle/packetd/plugins/certfetch"
-	"github.com/untangle/packetd/plugins/certsniff"
+	_ "github.com/untangle/packetd/plugins/certfetch"
+	_ "github.com/untangle/packetd/plugins/certsniff"
 	"github.com/untangle/packetd/plugins/classify"
-	"github.com/untangle/packetd/plugins/dns"
-	"github.com/untangle/packetd/plugins/example"
-	"github.com/untangle/packetd/plugins/geoip"
-	"github.com/untangle/packetd/plugins/predicttraffic"
-	"github.com/untangle/packetd/plugins/reporter"
-	"github.com/untangle/packetd/plugins/revdns"
-	"github.com/untangle/packetd/plugins/sni"
-	"github.com/untangle/packetd/plugins/stats"
+	_ "github.com/untangle/packetd/plugins/dns"
+	_ "github.com/untangle/packetd/plugins/example"
+	_ "github.com/untangle/packetd/plugins/geoip"
+	_ "github.com/untangle/packetd/plugins/predicttraffic"
+	_ "github.com/untangle/packetd/plugins/reporter"
+	_ "github.com/untangle/packetd/plugins/revdns"
+	_ "github.com/untangle/packetd/plugins/sni"
+	_ "github.com/untangle/packetd/plugins/stats"
 	"github.com/untangle/packetd/services/appclassmanager"
 	"github.com/untangle/packetd/services/certcache"
 	"github.com/untangle/packetd/services/certmanager"
+	"github.com/untangle/packetd/services/clock"
 	"github.com/untangle/packetd/services/dict"
 	"github.com/untangle/packetd/services/dispatch"
 	"github.com/untangle/packetd/services/kernel"
 	"github.com/untangle/packetd/services/logger"
 	"github.com/untangle/packetd/services/netspace"
 	"github.com/untangle/packetd/services/overseer"
+	"github.com/untangle/packetd/services/pluginmanager"
 	"github.com/untangle/packetd/services/predicttrafficsvc"
 	"github.com/untangle/packetd/services/reports"
 	"github.com/untangle/packetd/services/restd"
@@ -87,7 +88,7 @@ func main() {
 
 	// Start the plugins
 	logger.Info("Starting plugins...\n")
-	startPlugins()
+	pluginmanager.StartPlugins()
 
 	// Start the callbacks AFTER all services and plugins are initialized
 	logger.Info("Starting kernel callbacks...\n")
@@ -165,7 +166,7 @@ func main() {
 
 	// Stop all plugins
 	logger.Info("Stopping plugins...\n")
-	stopPlugins()
+	pluginmanager.StopPlugins()
 
 	// Stop services
 	logger.Info("Stopping services...\n")
@@ -188,13 +189,20 @@ func parseArguments() {
 	timestampPtr := flag.Bool("no-timestamp", false, "disable timestamp in logging")
 	playbackFilePtr := flag.String("playback", "", "playback traffic from specified file")
 	captureFilePtr := flag.String("capture", "", "capture traffic to specified file")
-	playSpeedPtr := flag.Int("playspeed", 100, "traffic playback speed percentage")
+	playSpeedPtr := flag.Int("playspeed", 100, "traffic playback speed percentage (0 = as fast as possible)")
+	virtualClockPtr := flag.Bool("virtual-clock", false, "use the playback timestamps instead of the system clock")
 	logFilePtr := flag.String("logfile", "", "file to redirect stdout/stderr")
 	cpuCountPtr := flag.Int("cpucount", cpuCount, "override the cpucount manually")
+	nfqueueWorkersPtr := flag.Int("nfqueue-workers", 4, "number of packet workers for each nfqueue")
+	subscriberWorkersPtr := flag.Int("subscriber-workers", 64, "number of workers for calling nfqueue subscribers")
+	defragPtr := flag.Bool("defrag", false, "reassemble fragmented packets that reach the queue before calling nfqueue subscribers")
+	overloadLatencyPtr := flag.Int("overload-latency", 500, "verdict latency in milliseconds that enables the traffic bypass (0 = disabled)")
 	noNfqueuePtr := flag.Bool("no-nfqueue", false, "disable the nfqueue callback hook")
 	noConntrackPtr := flag.Bool("no-conntrack", false, "disable the conntrack callback hook")
 	noNetloggerPtr := flag.Bool("no-netlogger", false, "disable the netlogger callback hook")
 	noCloudPtr := flag.Bool("no-cloud", false, "disable all cloud services")
+	pluginsPtr := flag.String("plugins", "", "comma separated list of the only plugins to start")
+	disablePluginsPtr := flag.String("disable-plugins", "", "comma separated list of plugins to disable")
 
 	flag.Parse()
 
@@ -239,10 +247,19 @@ func parseArguments() {
 		kernel.SetWarehouseSpeed(*playSpeedPtr)
 	}
 
+	if *virtualClockPtr {
+		clock.EnableVirtual(clock.Epoch)
+	}
+
 	if cpuCountPtr != nil {
 		cpuCount = *cpuCountPtr
 	}
 
+	kernel.SetNfqueueWorkers(*nfqueueWorkersPtr)
+	dispatch.SetSubscriberWorkers(*subscriberWorkersPtr)
+	dispatch.SetDefragmentation(*defragPtr)
+	kernel.SetOverloadLatency(time.Duration(*overloadLatencyPtr) * time.Millisecond)
+
 	if *logFilePtr != "" {
 		logFile, err := os.OpenFile(*logFilePtr, os.O_WRONLY|os.O_CREATE|os.O_SYNC|os.O_TRUNC, 0755)
 		if err != nil {
@@ -271,6 +288,26 @@ func parseArguments() {
 		kernel.FlagNoCloud = true
 		logger.Alert("!!!!! The no-cloud flag was passed on the command line !!!!!\n")
 	}
+
+	selected := splitPluginList(*pluginsPtr)
+	disabled := splitPluginList(*disablePluginsPtr)
+	if kernel.FlagNoCloud {
+		disabled = append(disabled, "predicttraffic")
+	}
+	pluginmanager.SetSelection(selected, disabled)
+}
+
+// splitPluginList returns the plugin names from a comma separated list
+func splitPluginList(value string) []string {
+	var list []string
+
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			list = append(list, name)
+		}
+	}
+	return list
 }
 
 // startServices starts all the services
@@ -328,82 +365,6 @@ func stopServices() {
 	}
 }
 
-// startPlugins starts all the plugins (in parallel)
-func startPlugins() {
-	var wg sync.WaitGroup
-
-	// Start Plugins
-	startups := []func(){
-		example.PluginStartup,
-		classify.PluginStartup,
-		geoip.PluginStartup,
-		certfetch.PluginStartup,
-		certsniff.PluginStartup,
-		dns.PluginStartup,
-		revdns.PluginStartup,
-		sni.PluginStartup,
-		stats.PluginStartup,
-		reporter.PluginStartup}
-	if !kernel.FlagNoCloud {
-		startups = append(startups, predicttraffic.PluginStartup)
-	}
-	for _, f := range startups {
-		wg.Add(1)
-		go func(f func()) {
-			f()
-			wg.Done()
-		}(f)
-	}
-
-	wg.Wait()
-}
-
-// stopPlugins stops all the plugins (in parallel)
-func stopPlugins() {
-	var wg sync.WaitGroup
-
-	shutdowns := []func(){
-		example.PluginShutdown,
-		classify.PluginShutdown,
-		geoip.PluginShutdown,
-		certfetch.PluginShutdown,
-		certsniff.PluginShutdown,
-		dns.PluginShutdown,
-		revdns.PluginShutdown,
-		sni.PluginShutdown,
-		stats.PluginShutdown,
-		reporter.PluginShutdown}
-	if !kernel.FlagNoCloud {
-		shutdowns = append(shutdowns, predicttraffic.PluginShutdown)
-	}
-	for _, f := range shutdowns {
-		wg.Add(1)
-		go func(f func()) {
-			f()
-			wg.Done()
-		}(f)
-	}
-
-	wg.Wait()
-}
-
-// signalPlugins signals all plugins with a handler (in parallel)
-func signalPlugins(message syscall.Signal) {
-	var wg sync.WaitGroup
-
-	targets := []func(syscall.Signal){
-		stats.PluginSignal}
-	for _, f := range targets {
-		wg.Add(1)
-		go func(f func(syscall.Signal)) {
-			f(message)
-			wg.Done()
-		}(f)
-	}
-
-	wg.Wait()
-}
-
 // Add signal handlers
 func handleSignals() {
 	// Add SIGINT & SIGTERM handler (exit)
@@ -435,7 +396,7 @@ func handleSignals() {
 		for {
 			sig := <-hupch
 			logger.Info("Received signal [%v]. Calling handlers\n", sig)
-			signalPlugins(syscall.SIGHUP)
+			pluginmanager.SignalPlugins(syscall.SIGHUP)
 		}
 	}()
 }
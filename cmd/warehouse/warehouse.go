@@ -0,0 +1,471 @@
+// warehouse inspects and edits packetd warehouse capture files without running packetd
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/untangle/packetd/services/warehouse"
+)
+
+// command is a warehouse subcommand
+type command struct {
+	name    string
+	usage   string
+	handler func(arguments []string) error
+}
+
+// errUsage is returned by a subcommand when the arguments are not valid
+var errUsage = errors.New("invalid arguments")
+
+var commands = []command{
+	{"info", "info <capture>...", infoCommand},
+	{"dump", "dump [-hex] [filters] <capture>", dumpCommand},
+	{"filter", "filter [filters] <input> <output>", filterCommand},
+	{"merge", "merge <output> <input>...", mergeCommand},
+	{"split", "split [-records count] [-size bytes] <input> <prefix>", splitCommand},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	for _, item := range commands {
+		if item.name != os.Args[1] {
+			continue
+		}
+		err := item.handler(os.Args[2:])
+		if err == errUsage {
+			usage()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", item.name, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	usage()
+}
+
+// usage prints the list of subcommands and exits
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage:\n")
+	for _, item := range commands {
+		fmt.Fprintf(os.Stderr, "  %s %s\n", os.Args[0], item.usage)
+	}
+	fmt.Fprintf(os.Stderr, "Filters: -types nfqueue,conntrack,netlogger -host address -port number -protocol name|number -ctid id\n")
+	os.Exit(2)
+}
+
+// filterFlags adds the record filter flags to a flag set and returns a function that
+// creates the filter once the flags are parsed
+func filterFlags(flags *flag.FlagSet) func() (*warehouse.Filter, error) {
+	types := flags.String("types", "", "comma separated record types to keep (nfqueue,conntrack,netlogger)")
+	host := flags.String("host", "", "keep only traffic to or from this address")
+	port := flags.Uint("port", 0, "keep only traffic to or from this port")
+	protocol := flags.String("protocol", "", "keep only this IP protocol name or number")
+	ctid := flags.Uint("ctid", 0, "keep only this conntrack ID")
+
+	return func() (*warehouse.Filter, error) {
+		var err error
+		filter := new(warehouse.Filter)
+
+		if *types != "" {
+			if filter.Origins, err = warehouse.ParseOrigins(*types); err != nil {
+				return nil, err
+			}
+		}
+		if *host != "" {
+			if filter.Host = net.ParseIP(*host); filter.Host == nil {
+				return nil, fmt.Errorf("Invalid host: %s", *host)
+			}
+		}
+		if *port > 0xFFFF {
+			return nil, fmt.Errorf("Invalid port: %d", *port)
+		}
+		filter.Port = uint16(*port)
+		if *protocol != "" {
+			if filter.Protocol, err = warehouse.ParseProtocol(*protocol); err != nil {
+				return nil, err
+			}
+		}
+		filter.Ctid = uint32(*ctid)
+		return filter, nil
+	}
+}
+
+// openCapture opens a capture file and reads the file header
+func openCapture(filename string) (*os.File, *warehouse.Reader, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	reader, err := warehouse.NewReader(bufio.NewReader(file))
+	if err != nil {
+		file.Close()
+		return nil, nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return file, reader, nil
+}
+
+// captureWriter writes records to a new capture file
+type captureWriter struct {
+	file   *os.File
+	buffer *bufio.Writer
+	writer *warehouse.Writer
+	size   int
+}
+
+// createCapture creates a capture file with the argumented description
+func createCapture(filename string, description string) (*captureWriter, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	capture := &captureWriter{file: file, buffer: bufio.NewWriter(file), size: warehouse.FileHeaderSize}
+	if capture.writer, err = warehouse.NewWriter(capture.buffer, description); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return capture, nil
+}
+
+// write writes a record to the capture file
+func (capture *captureWriter) write(record *warehouse.Record) error {
+	capture.size += record.Size()
+	return capture.writer.Write(record)
+}
+
+// close flushes and closes the capture file
+func (capture *captureWriter) close() error {
+	if err := capture.buffer.Flush(); err != nil {
+		capture.file.Close()
+		return err
+	}
+	return capture.file.Close()
+}
+
+// infoCommand prints a summary of each capture file
+func infoCommand(arguments []string) error {
+	if len(arguments) == 0 {
+		return errUsage
+	}
+
+	for _, filename := range arguments {
+		file, reader, err := openCapture(filename)
+		if err != nil {
+			return err
+		}
+
+		var count, bytes int
+		var first, last uint64
+		origins := make(map[byte]int)
+		sessions := make(map[uint32]bool)
+
+		for {
+			record, err := reader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				file.Close()
+				return fmt.Errorf("%s: record %d: %v", filename, count+1, err)
+			}
+
+			if count == 0 {
+				first = record.Stamp()
+			}
+			last = record.Stamp()
+			count++
+			bytes += record.Size()
+			origins[record.Origin]++
+
+			if record.Origin == warehouse.Nfqueue {
+				sessions[record.Ctid] = true
+			} else if record.Origin == warehouse.Conntrack {
+				if info, err := warehouse.ParseConntrackInfo(record.Data); err == nil {
+					sessions[info.ConnID] = true
+				}
+			}
+		}
+		file.Close()
+
+		fmt.Printf("File:        %s\n", filename)
+		fmt.Printf("Description: %s\n", reader.Description)
+		fmt.Printf("Version:     %d.%d\n", reader.MajorVersion, reader.MinorVersion)
+		fmt.Printf("Records:     %d (%d bytes)\n", count, bytes)
+		fmt.Printf("Nfqueue:     %d\n", origins[warehouse.Nfqueue])
+		fmt.Printf("Conntrack:   %d\n", origins[warehouse.Conntrack])
+		fmt.Printf("Netlogger:   %d\n", origins[warehouse.Netlogger])
+		if other := count - origins[warehouse.Nfqueue] - origins[warehouse.Conntrack] - origins[warehouse.Netlogger]; other != 0 {
+			fmt.Printf("Unknown:     %d\n", other)
+		}
+		fmt.Printf("Sessions:    %d\n", len(sessions))
+		fmt.Printf("Duration:    %v\n", time.Duration(last-first))
+	}
+	return nil
+}
+
+// dumpCommand prints the records in a capture file that pass the filters
+func dumpCommand(arguments []string) error {
+	flags := flag.NewFlagSet("dump", flag.ExitOnError)
+	dumpHex := flags.Bool("hex", false, "include a hex dump of the record data")
+	createFilter := filterFlags(flags)
+	flags.Parse(arguments)
+
+	if flags.NArg() != 1 {
+		return errUsage
+	}
+	filter, err := createFilter()
+	if err != nil {
+		return err
+	}
+
+	file, reader, err := openCapture(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var first uint64
+	for index := 1; ; index++ {
+		record, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("record %d: %v", index, err)
+		}
+
+		// the timestamps are monotonic so we show them relative to the first record
+		if index == 1 {
+			first = record.Stamp()
+		}
+		if !filter.Match(record) {
+			continue
+		}
+
+		fmt.Printf("%6d %14.6f %s\n", index, float64(record.Stamp()-first)/1e9, record)
+		if *dumpHex {
+			fmt.Print(hex.Dump(record.Data))
+		}
+	}
+}
+
+// filterCommand copies the records that pass the filters to a new capture file
+func filterCommand(arguments []string) error {
+	flags := flag.NewFlagSet("filter", flag.ExitOnError)
+	createFilter := filterFlags(flags)
+	flags.Parse(arguments)
+
+	if flags.NArg() != 2 {
+		return errUsage
+	}
+	filter, err := createFilter()
+	if err != nil {
+		return err
+	}
+
+	file, reader, err := openCapture(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	output, err := createCapture(flags.Arg(1), reader.Description)
+	if err != nil {
+		return err
+	}
+
+	var count, total int
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			output.close()
+			return fmt.Errorf("record %d: %v", total+1, err)
+		}
+		total++
+		if !filter.Match(record) {
+			continue
+		}
+		if err = output.write(record); err != nil {
+			output.close()
+			return err
+		}
+		count++
+	}
+
+	if err = output.close(); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %d of %d records\n", count, total)
+	return nil
+}
+
+// mergeInput is a capture file being merged along with the next record to write
+type mergeInput struct {
+	filename string
+	file     *os.File
+	reader   *warehouse.Reader
+	record   *warehouse.Record
+}
+
+// advance reads the next record or sets record to nil at the end of the file
+func (input *mergeInput) advance() error {
+	record, err := input.reader.Next()
+	if err == io.EOF {
+		input.record = nil
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", input.filename, err)
+	}
+	input.record = record
+	return nil
+}
+
+// mergeCommand combines capture files into a single file ordered by timestamp.
+// This only makes sense for captures from the same boot of the same system
+// since the timestamps come from the monotonic clock.
+func mergeCommand(arguments []string) error {
+	if len(arguments) < 2 {
+		return errUsage
+	}
+
+	var inputs []*mergeInput
+	defer func() {
+		for _, input := range inputs {
+			input.file.Close()
+		}
+	}()
+
+	for _, filename := range arguments[1:] {
+		file, reader, err := openCapture(filename)
+		if err != nil {
+			return err
+		}
+		input := &mergeInput{filename: filename, file: file, reader: reader}
+		inputs = append(inputs, input)
+		if err = input.advance(); err != nil {
+			return err
+		}
+	}
+
+	output, err := createCapture(arguments[0], warehouse.DefaultDescription)
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	for {
+		// write the oldest record and keep the original order for equal timestamps
+		sort.SliceStable(inputs, func(i, j int) bool {
+			if inputs[i].record == nil || inputs[j].record == nil {
+				return inputs[j].record == nil && inputs[i].record != nil
+			}
+			return inputs[i].record.Stamp() < inputs[j].record.Stamp()
+		})
+		next := inputs[0]
+		if next.record == nil {
+			break
+		}
+
+		if err = output.write(next.record); err != nil {
+			output.close()
+			return err
+		}
+		count++
+
+		if err = next.advance(); err != nil {
+			output.close()
+			return err
+		}
+	}
+
+	if err = output.close(); err != nil {
+		return err
+	}
+	fmt.Printf("Merged %d records from %d files\n", count, len(inputs))
+	return nil
+}
+
+// splitCommand divides a capture file into files named prefix.1, prefix.2 and so on
+// holding at most the argumented number of records or bytes
+func splitCommand(arguments []string) error {
+	flags := flag.NewFlagSet("split", flag.ExitOnError)
+	records := flags.Int("records", 0, "maximum number of records in each file")
+	size := flags.Int("size", 0, "maximum size of each file in bytes")
+	flags.Parse(arguments)
+
+	if flags.NArg() != 2 || (*records <= 0 && *size <= 0) {
+		return errUsage
+	}
+
+	file, reader, err := openCapture(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var output *captureWriter
+	var files, count int
+
+	for index := 1; ; index++ {
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if output != nil {
+				output.close()
+			}
+			return fmt.Errorf("record %d: %v", index, err)
+		}
+
+		// start a new file when the record would go past a limit but always put at least one record in each file
+		if output != nil && count > 0 && ((*records > 0 && count >= *records) || (*size > 0 && output.size+record.Size() > *size)) {
+			if err = output.close(); err != nil {
+				return err
+			}
+			output = nil
+		}
+
+		if output == nil {
+			files++
+			count = 0
+			if output, err = createCapture(flags.Arg(1)+"."+strconv.Itoa(files), reader.Description); err != nil {
+				return err
+			}
+		}
+
+		if err = output.write(record); err != nil {
+			output.close()
+			return err
+		}
+		count++
+	}
+
+	if output != nil {
+		if err = output.close(); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Created %d files\n", files)
+	return nil
+}
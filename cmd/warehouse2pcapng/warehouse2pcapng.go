@@ -0,0 +1,46 @@
+// warehouse2pcapng converts a packetd warehouse capture file to pcapng so it can be
+// opened in Wireshark and other standard tools
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+
+	"github.com/untangle/packetd/services/kernel"
+)
+
+func main() {
+	if len(os.Args) != 3 {
+		fmt.Fprintf(os.Stderr, "Usage: %s <warehouse capture> <pcapng file>\n", os.Args[0])
+		os.Exit(2)
+	}
+
+	input, err := os.Open(os.Args[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to open %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+	defer input.Close()
+
+	output, err := os.Create(os.Args[2])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to create %s: %v\n", os.Args[2], err)
+		os.Exit(1)
+	}
+
+	buffer := bufio.NewWriter(output)
+	count, err := kernel.ConvertWarehouseToPcapng(bufio.NewReader(input), buffer)
+	if err == nil {
+		err = buffer.Flush()
+	}
+	if err == nil {
+		err = output.Close()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Conversion failed after %d records: %v\n", count, err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Converted %d records\n", count)
+}
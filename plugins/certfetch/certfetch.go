@@ -5,11 +5,14 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/untangle/packetd/services/certcache"
+	"github.com/untangle/packetd/services/clock"
 	"github.com/untangle/packetd/services/dispatch"
 	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/pluginmanager"
 )
 
 const pluginName = "certfetch"
@@ -17,10 +20,19 @@ const fetchTimeout = 10 * time.Second
 
 var localMutex sync.RWMutex
 
+// init registers the plugin with the plugin manager
+func init() {
+	pluginmanager.Register(&pluginmanager.PluginFunctions{
+		PluginName:   pluginName,
+		StartupFunc:  PluginStartup,
+		ShutdownFunc: PluginShutdown,
+	})
+}
+
 // PluginStartup function is called to allow plugin specific initialization.
 func PluginStartup() {
 	logger.Info("PluginStartup(%s) has been called\n", pluginName)
-	dispatch.InsertNfqueueSubscription(pluginName, dispatch.CertfetchPriority, PluginNfqueueHandler)
+	dispatch.InsertSessionStartSubscription(pluginName, dispatch.CertfetchPriority, PluginSessionStartHandler)
 }
 
 // PluginShutdown function called when the daemon is shutting down.
@@ -28,27 +40,28 @@ func PluginShutdown() {
 	logger.Info("PluginShutdown(%s) has been called\n", pluginName)
 }
 
-// PluginNfqueueHandler is called to handle nfqueue packet data. We only
-// look at TCP traffic with port 443 as destination. When detected, we load
+// PluginSessionStartHandler is called once for every new session. We only
+// look at TCP sessions with port 443 as destination. When detected, we load
 // the server certificate from the cache or fetch it from the server and
 // store it in the cache. Once we have the cert, we attach it to the session,
 // extract the interesting subject fields, and put them in the session table.
-func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession bool) dispatch.NfqueueResult {
-	var result dispatch.NfqueueResult
-	result.SessionRelease = true
-
-	// release immediately as we only care about the first packet
-	dispatch.ReleaseSession(mess.Session, pluginName)
-	if !newSession {
-		return result
-	}
+func PluginSessionStartHandler(mess *dispatch.SessionStartMessage) {
+	tuple := mess.Session.GetClientSideTuple()
 
-	// we only need to fetch certs for TCP traffic going to port 443
-	if mess.TCPLayer == nil || mess.MsgTuple.ServerPort != 443 {
-		return result
+	// we only need to fetch certs for TCP sessions going to port 443
+	if tuple.Protocol != syscall.IPPROTO_TCP || tuple.ServerPort != 443 {
+		return
 	}
 
-	findkey := fmt.Sprintf("%s:%d", mess.MsgTuple.ServerAddress, mess.MsgTuple.ServerPort)
+	// the fetch can take up to fetchTimeout so it is done in the background to keep it off the packet path
+	go fetchCertificate(mess.Session, tuple)
+}
+
+// fetchCertificate loads the server certificate for a session from the cache or
+// fetches it from the server and attaches it to the session
+func fetchCertificate(session *dispatch.Session, tuple dispatch.Tuple) {
+	ctid := session.GetConntrackID()
+	findkey := fmt.Sprintf("%s:%d", tuple.ServerAddress, tuple.ServerPort)
 
 	var holder *certcache.CertificateHolder
 	var target string
@@ -75,10 +88,10 @@ func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession
 			Timeout: fetchTimeout,
 		}
 
-		if mess.IP6Layer != nil {
-			target = fmt.Sprintf("[%s]:443", mess.MsgTuple.ServerAddress.String())
+		if tuple.ServerAddress.To4() == nil {
+			target = fmt.Sprintf("[%s]:443", tuple.ServerAddress.String())
 		} else {
-			target = fmt.Sprintf("%s:443", mess.MsgTuple.ServerAddress.String())
+			target = fmt.Sprintf("%s:443", tuple.ServerAddress.String())
 		}
 
 		conn, err := tls.DialWithDialer(dialer, "tcp", target, conf)
@@ -101,7 +114,7 @@ func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession
 			logger.Debug("Could not fetch certificate from %s ctid:%d\n", findkey, ctid)
 			holder.Available = false
 		}
-		holder.CreationTime = time.Now()
+		holder.CreationTime = clock.Now()
 		holder.CertLocker.Unlock()
 		holder.WaitGroup.Done()
 	}
@@ -109,7 +122,7 @@ func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession
 	// At this point the holder has either been retrieved or created
 	if holder == nil {
 		logger.Err("Constraint failed: nil cert holder\n")
-		return result
+		return
 	}
 
 	// wait until the cert has been retrieved
@@ -123,10 +136,8 @@ func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession
 	// if the cert is available for this server attach the cert to the session
 	// and put the details in the dictionary
 	if holder.Available {
-		certcache.AttachCertificateToSession(mess.Session, holder.Certificate)
+		certcache.AttachCertificateToSession(session, holder.Certificate)
 	}
 
 	holder.CertLocker.Unlock()
-
-	return result
 }
@@ -1,88 +1,43 @@
 package certsniff
 
 import (
-	"bytes"
 	"crypto/x509"
 	"fmt"
-	"sync"
-	"time"
+	"syscall"
 
 	"github.com/untangle/packetd/services/certcache"
+	"github.com/untangle/packetd/services/clock"
 	"github.com/untangle/packetd/services/dispatch"
 	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/pluginmanager"
 )
 
 const pluginName = "certsniff"
 const maxClientCount = 5  // number of packets to sniff for ClientHello before giving up
 const maxServerCount = 20 // number of packets to sniff for the server certificate before giving up
-const maxPacketCount = 10 // maximum number of packets we'll store and re-assemble while looking for the server certificate
 
-type dataCollector struct {
-	databuff [maxPacketCount][]byte
-	sequence [maxPacketCount]uint32
-	locker   sync.RWMutex
-	total    int
+// we only look for certs in TCP traffic not going to server port 443
+// since those sessions will be handled by the certfetch plugin, and we
+// use the reassembled stream to find the certificate in the server data
+var nfqueueFilter = &dispatch.NfqueueFilter{
+	Protocols:          []uint8{syscall.IPPROTO_TCP},
+	ExcludeServerPorts: []uint16{443},
+	ReassembleStream:   true,
 }
 
-// addPacket adds a packet of server data to the a dataCollector
-func (ME *dataCollector) addPacket(buffer []byte, netseq uint32) {
-	// hold the lock long enough to get and increment the current buffer counter
-	ME.locker.Lock()
-	defer ME.locker.Unlock()
-
-	if ME.total == maxPacketCount {
-		logger.Warn("Unable to add more data to collector\n")
-		return
-	}
-
-	spot := ME.total
-	ME.total++
-
-	// copy the argumented buffer and netseq value
-	ME.databuff[spot] = make([]byte, len(buffer))
-	copy(ME.databuff[spot], buffer)
-	ME.sequence[spot] = netseq
-}
-
-// getBuffer assembles all the data packets into a single buffer in the correct order
-func (ME *dataCollector) getBuffer() []byte {
-	var holdData []byte
-	var holdSpot uint32
-	var fullbuff bytes.Buffer
-	var total int
-
-	// hold the lock long enough to gt the current buffer counter
-	ME.locker.Lock()
-	defer ME.locker.Unlock()
-	total = ME.total
-
-	// sort the buffers using the TCP sequence number
-	for j := 0; j < total-1; j++ {
-		for k := (j + 1); k < total; k++ {
-			if ME.sequence[j] > ME.sequence[k] {
-				holdData = ME.databuff[j]
-				holdSpot = ME.sequence[j]
-				ME.databuff[j] = ME.databuff[k]
-				ME.sequence[j] = ME.sequence[k]
-				ME.databuff[k] = holdData
-				ME.sequence[k] = holdSpot
-			}
-		}
-	}
-
-	// combine the data packets in a single buffer
-	for i := 0; i < total; i++ {
-		fullbuff.Write(ME.databuff[i])
-	}
-
-	// return the buffer as an array of bytes
-	return fullbuff.Bytes()
+// init registers the plugin with the plugin manager
+func init() {
+	pluginmanager.Register(&pluginmanager.PluginFunctions{
+		PluginName:   pluginName,
+		StartupFunc:  PluginStartup,
+		ShutdownFunc: PluginShutdown,
+	})
 }
 
 // PluginStartup function is called to allow plugin specific initialization.
 func PluginStartup() {
 	logger.Info("PluginStartup(%s) has been called\n", pluginName)
-	dispatch.InsertNfqueueSubscription(pluginName, dispatch.CertsniffPriority, PluginNfqueueHandler)
+	dispatch.InsertNfqueueSubscription(pluginName, dispatch.CertsniffPriority, nfqueueFilter, PluginNfqueueHandler)
 }
 
 // PluginShutdown function called when the daemon is shutting down.
@@ -102,18 +57,10 @@ func PluginShutdown() {
 func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession bool) dispatch.NfqueueResult {
 	var result dispatch.NfqueueResult
 	var certHolder *certcache.CertificateHolder
-	var dataBucket *dataCollector
 	var found bool
 
 	result.SessionRelease = false
 
-	// we only look for certs in TCP traffic not going to server port 443
-	// since those session will be handled by the certfetch plugin
-	if mess.TCPLayer == nil || mess.Session.GetClientSideTuple().ServerPort == 443 {
-		result.SessionRelease = true
-		return result
-	}
-
 	// if the session already has a certificate attached we are done
 	check := mess.Session.GetAttachment("certificate")
 	if check != nil {
@@ -136,31 +83,17 @@ func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession
 		return result
 	}
 
-	// the session doesn't have a cert and we didn't find in cache
-	// so get the tls_collector from the session attachments
-	dataBucket, found = mess.Session.GetAttachment("tls_collector").(*dataCollector)
-
-	// if we don't have a collector yet we are still looking for ClientHello
-	if found == false {
-		status := findClientHello(mess.Payload)
-
-		// if we find the ClientHello create and attach a collector and return
-		if status == true {
-			logger.Debug("Found ClientHello for ctid:%d\n", ctid)
-			dataBucket = new(dataCollector)
-			mess.Session.PutAttachment("tls_collector", dataBucket)
-			return result
-		}
-
+	// the session doesn't have a cert and we didn't find in cache so
+	// we look for the ClientHello in the reassembled client data
+	if mess.Stream == nil || !findClientHello(mess.Stream.Data(dispatch.StreamClientToServer)) {
 		// if we don't find ClientHello after a while just give up
 		if mess.Session.GetPacketCount() > maxClientCount {
 			result.SessionRelease = true
 		}
-
 		return result
 	}
 
-	// we found the collector so now we only care about data from the server
+	// we found the ClientHello so now we only care about data from the server
 	if mess.ClientToServer {
 		return result
 	}
@@ -170,15 +103,11 @@ func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession
 		return result
 	}
 
-	// add the packet to our data collector
-	dataBucket.addPacket(mess.Payload, mess.TCPLayer.Seq)
-
-	// look for the server certificate in the collector
-	status := findCertificates(dataBucket.getBuffer(), mess)
+	// look for the server certificate in the reassembled server data
+	status := findCertificates(mess.Stream.Data(dispatch.StreamServerToClient), mess)
 
-	// if we find the certificate remove the collector attachment and release
-	if status == true {
-		mess.Session.DeleteAttachment("tls_collector")
+	// if we find the certificate or the stream is full we are done
+	if status == true || mess.Stream.Full(dispatch.StreamServerToClient) {
 		result.SessionRelease = true
 	}
 
@@ -356,7 +285,7 @@ func findCertificates(buffer []byte, mess dispatch.NfqueueMessage) bool {
 					findkey := fmt.Sprintf("%s:%d", clientSideTuple.ServerAddress, clientSideTuple.ServerPort)
 					logger.Debug("Creating cached certificate for %s [%v]\n", findkey, cert.Subject)
 					holder := new(certcache.CertificateHolder)
-					holder.CreationTime = time.Now()
+					holder.CreationTime = clock.Now()
 					holder.Certificate = *cert
 					holder.Available = true
 					certcache.AttachCertificateToSession(mess.Session, *cert)
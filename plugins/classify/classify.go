@@ -9,6 +9,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/gopacket"
@@ -18,6 +19,7 @@ import (
 	"github.com/untangle/packetd/services/dispatch"
 	"github.com/untangle/packetd/services/kernel"
 	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/pluginmanager"
 	"github.com/untangle/packetd/services/reports"
 )
 
@@ -51,6 +53,15 @@ var controlChannel = make(chan bool)
 var classdHostPort = "127.0.0.1:8123"
 var daemonAvailable = false
 
+// init registers the plugin with the plugin manager
+func init() {
+	pluginmanager.Register(&pluginmanager.PluginFunctions{
+		PluginName:   pluginName,
+		StartupFunc:  PluginStartup,
+		ShutdownFunc: PluginShutdown,
+	})
+}
+
 // PluginStartup is called to allow plugin specific initialization
 func PluginStartup() {
 	var err error
@@ -71,8 +82,9 @@ func PluginStartup() {
 		return
 	}
 
-	// we found the daemon so set our flag
+	// we found the daemon so set our flag and clear any shutdown from a previous stop
 	daemonAvailable = true
+	atomic.StoreInt32(&shutdownFlag, 0)
 
 	// start the daemon manager to handle running the daemon process
 	go daemonProcessManager(controlChannel)
@@ -104,7 +116,15 @@ func PluginStartup() {
 	}
 
 	// insert our nfqueue subscription
-	dispatch.InsertNfqueueSubscription(pluginName, dispatch.ClassifyPriority, PluginNfqueueHandler)
+	dispatch.DeclareAttachment(pluginName, "application_id", "", "classd application identifier")
+	dispatch.DeclareAttachment(pluginName, "application_name", "", "application name")
+	dispatch.DeclareAttachment(pluginName, "application_protochain", "", "protocol chain")
+	dispatch.DeclareAttachment(pluginName, "application_detail", "", "application detail")
+	dispatch.DeclareAttachment(pluginName, "application_confidence", int32(0), "classification confidence")
+	dispatch.DeclareAttachment(pluginName, "application_category", "", "application category")
+	dispatch.DeclareAttachment(pluginName, "application_productivity", uint8(0), "application productivity rating")
+	dispatch.DeclareAttachment(pluginName, "application_risk", uint8(0), "application risk rating")
+	dispatch.InsertNfqueueSubscription(pluginName, dispatch.ClassifyPriority, nil, PluginNfqueueHandler)
 }
 
 // PluginShutdown is called when the daemon is shutting down
@@ -220,11 +240,9 @@ func classifyTraffic(mess *dispatch.NfqueueMessage) string {
 	// to generate accurate results (e.g.: the server side didn't know the SNI passed by the client).
 	// The approach here is to always replace the src and dst in the packet with values from the client
 	// side tuple, using the ClientToServer flag to determine which info goes on which side.
-	// TODO - We currently create a copy of the packet and make our changes there. It would be more
-	// efficient to modify the shared packet, but deeper analysis of all potentially affected consumers
-	// would have happen before making that change. For now this is probably fine.
+	// We make our changes to a private copy of the packet so other subscribers are not affected.
+	fixer = dispatch.ClonePacket(mess.Packet)
 	if mess.IP4Layer != nil {
-		fixer = gopacket.NewPacket(mess.Packet.Data(), layers.LayerTypeIPv4, gopacket.Lazy)
 		IP4Layer = fixer.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
 		proto = "IP4"
 		if mess.ClientToServer {
@@ -239,7 +257,6 @@ func classifyTraffic(mess *dispatch.NfqueueMessage) string {
 			dstport = mess.Session.GetClientSideTuple().ClientPort
 		}
 	} else if mess.IP6Layer != nil {
-		fixer = gopacket.NewPacket(mess.Packet.Data(), layers.LayerTypeIPv6, gopacket.Lazy)
 		IP6Layer = fixer.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
 		proto = "IP6"
 		if mess.ClientToServer {
@@ -267,16 +284,23 @@ func classifyTraffic(mess *dispatch.NfqueueMessage) string {
 	}
 
 	// if we have a UDP layer update with the ports we saved above
-	udpPtr := mess.Packet.Layer(layers.LayerTypeUDP)
+	udpPtr := fixer.Layer(layers.LayerTypeUDP)
 	if udpPtr != nil {
 		UDPlayer := udpPtr.(*layers.UDP)
 		UDPlayer.SrcPort = layers.UDPPort(srcport)
 		UDPlayer.DstPort = layers.UDPPort(dstport)
 	}
 
+	// put the modified ports back into the packet data
+	data, err := dispatch.SerializePacket(fixer)
+	if err != nil {
+		logger.Debug("Unable to serialize packet for %d: %v\n", mess.Session.GetConntrackID(), err)
+		data = fixer.Data()
+	}
+
 	// send the packet to the daemon for classification
-	command = fmt.Sprintf("PACKET|%d|%s|%d\r\n", mess.Session.GetSessionID(), proto, len(fixer.Data()))
-	reply = daemonClassifyPacket(command, fixer.Data())
+	command = fmt.Sprintf("PACKET|%d|%s|%d\r\n", mess.Session.GetSessionID(), proto, len(data))
+	reply = daemonClassifyPacket(command, data)
 	return reply
 }
 
@@ -291,68 +315,66 @@ func processReply(reply string, mess dispatch.NfqueueMessage, ctid uint32) (int,
 	var productivity uint8
 	var state int
 	var risk uint8
-	var attachments map[string]interface{}
 
 	// parse update classd information from reply
 	appid, name, protochain, detail, confidence, category, state, productivity, risk = parseReply(reply)
 
-	// WARNING - DO NOT USE Session GetAttachment or SetAttachment in this function
 	// Because we make decisions based on existing attachments and update multiple
-	// attachments, we lock the attachments and access them directly for efficiency.
-	// Other calls that lock the attachment mutex will hang forever if called from here.
-	attachments = mess.Session.LockAttachments()
-	defer mess.Session.UnlockAttachments()
-
-	// We look at the confidence and ignore any reply where the value is less
-	// than the confidence currently attached to the session. Because of the
-	// unpredictable nature of gorouting scheduling, we sometimes get confidence = 0
-	// if NAVL didn't give us any classification. This can happen if packets are
-	// processed out of order and NAVL gets data for a session that has already
-	// encountered a FIN packet. In this case it generates a no connection error
-	// and classd gives us the generic /IP defaults. We also don't want to apply
-	// a lower confidence reply on top of a higher confidence reply which can
-	// happen if the lower confidence reply is received and parsed after the
-	// higher confidence reply has already been handled.
-
-	checkdata := attachments["application_confidence"]
-	if checkdata != nil {
-		checkval := checkdata.(int32)
-		if confidence < checkval {
-			logger.Debug("%OC|Ignoring update with confidence %d < %d STATE:%d\n", "classify_confidence_regression", 0, confidence, checkval, state)
-			return state, confidence
+	// attachments, we update them together while the attachments are locked.
+	// WARNING - DO NOT USE Session GetAttachment or PutAttachment in the update function
+	// because they will hang forever waiting for the lock.
+	mess.Session.UpdateAttachments(func(attachments map[string]interface{}) {
+		// We look at the confidence and ignore any reply where the value is less
+		// than the confidence currently attached to the session. Because of the
+		// unpredictable nature of gorouting scheduling, we sometimes get confidence = 0
+		// if NAVL didn't give us any classification. This can happen if packets are
+		// processed out of order and NAVL gets data for a session that has already
+		// encountered a FIN packet. In this case it generates a no connection error
+		// and classd gives us the generic /IP defaults. We also don't want to apply
+		// a lower confidence reply on top of a higher confidence reply which can
+		// happen if the lower confidence reply is received and parsed after the
+		// higher confidence reply has already been handled.
+
+		checkdata := attachments["application_confidence"]
+		if checkdata != nil {
+			checkval := checkdata.(int32)
+			if confidence < checkval {
+				logger.Debug("%OC|Ignoring update with confidence %d < %d STATE:%d\n", "classify_confidence_regression", 0, confidence, checkval, state)
+				return
+			}
 		}
-	}
 
-	var changed []string
-	if updateClassifyDetail(attachments, ctid, "application_id", appid) {
-		changed = append(changed, "application_id")
-	}
-	if updateClassifyDetail(attachments, ctid, "application_name", name) {
-		changed = append(changed, "application_name")
-	}
-	if updateClassifyDetail(attachments, ctid, "application_protochain", protochain) {
-		changed = append(changed, "application_protochain")
-	}
-	if updateClassifyDetail(attachments, ctid, "application_detail", detail) {
-		changed = append(changed, "application_detail")
-	}
-	if updateClassifyDetail(attachments, ctid, "application_confidence", confidence) {
-		changed = append(changed, "application_confidence")
-	}
-	if updateClassifyDetail(attachments, ctid, "application_category", category) {
-		changed = append(changed, "application_category")
-	}
-	if updateClassifyDetail(attachments, ctid, "application_productivity", productivity) {
-		changed = append(changed, "application_productivity")
-	}
-	if updateClassifyDetail(attachments, ctid, "application_risk", risk) {
-		changed = append(changed, "application_risk")
-	}
+		var changed []string
+		if updateClassifyDetail(attachments, ctid, "application_id", appid) {
+			changed = append(changed, "application_id")
+		}
+		if updateClassifyDetail(attachments, ctid, "application_name", name) {
+			changed = append(changed, "application_name")
+		}
+		if updateClassifyDetail(attachments, ctid, "application_protochain", protochain) {
+			changed = append(changed, "application_protochain")
+		}
+		if updateClassifyDetail(attachments, ctid, "application_detail", detail) {
+			changed = append(changed, "application_detail")
+		}
+		if updateClassifyDetail(attachments, ctid, "application_confidence", confidence) {
+			changed = append(changed, "application_confidence")
+		}
+		if updateClassifyDetail(attachments, ctid, "application_category", category) {
+			changed = append(changed, "application_category")
+		}
+		if updateClassifyDetail(attachments, ctid, "application_productivity", productivity) {
+			changed = append(changed, "application_productivity")
+		}
+		if updateClassifyDetail(attachments, ctid, "application_risk", risk) {
+			changed = append(changed, "application_risk")
+		}
 
-	// if something changed, log a new event
-	if len(changed) > 0 {
-		logEvent(mess.Session, attachments, changed)
-	}
+		// if something changed, log a new event
+		if len(changed) > 0 {
+			logEvent(mess.Session, attachments, changed)
+		}
+	})
 
 	return state, confidence
 }
@@ -422,15 +444,15 @@ func parseReply(replyString string) (string, string, string, string, int32, stri
 // determined by the prediction plugin. If different the actual details
 // are added to a list that will be pushed to the cloud.
 func analyzePrediction(session *dispatch.Session) {
-	matchAppid := session.GetAttachment("application_id")
+	matchAppid, found := session.GetAttachmentString("application_id")
 	// if match not found just return
-	if matchAppid == nil {
+	if !found {
 		return
 	}
 
-	inferAppid := session.GetAttachment("application_id_inferred")
+	inferAppid, found := session.GetAttachmentString("application_id_inferred")
 	// if we have infer and match and infer are the same just return
-	if inferAppid != nil && strings.Compare(matchAppid.(string), inferAppid.(string)) == 0 {
+	if found && strings.Compare(matchAppid, inferAppid) == 0 {
 		return
 	}
 
@@ -442,17 +464,9 @@ func analyzePrediction(session *dispatch.Session) {
 	report.ServerAddr = fmt.Sprintf("%v", session.GetClientSideTuple().ServerAddress)
 	report.ServerPort = session.GetClientSideTuple().ServerPort
 
-	if ptr := session.GetAttachment("application_id"); ptr != nil {
-		report.Application = ptr.(string)
-	}
-
-	if ptr := session.GetAttachment("application_protochain"); ptr != nil {
-		report.Protochain = ptr.(string)
-	}
-
-	if ptr := session.GetAttachment("application_detail"); ptr != nil {
-		report.Detail = ptr.(string)
-	}
+	report.Application = matchAppid
+	report.Protochain, _ = session.GetAttachmentString("application_protochain")
+	report.Detail, _ = session.GetAttachmentString("application_detail")
 
 	storeCloudReport(report)
 }
@@ -6,9 +6,11 @@ import (
 	"time"
 
 	"github.com/google/gopacket/layers"
+	"github.com/untangle/packetd/services/clock"
 	"github.com/untangle/packetd/services/dict"
 	"github.com/untangle/packetd/services/dispatch"
 	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/pluginmanager"
 	"github.com/untangle/packetd/services/reports"
 )
 
@@ -26,6 +28,15 @@ var shutdownChannel = make(chan bool)
 var addressTable map[string]*AddressHolder
 var addressMutex sync.RWMutex
 
+// init registers the plugin with the plugin manager
+func init() {
+	pluginmanager.Register(&pluginmanager.PluginFunctions{
+		PluginName:   pluginName,
+		StartupFunc:  PluginStartup,
+		ShutdownFunc: PluginShutdown,
+	})
+}
+
 // PluginStartup function is called to allow plugin specific initialization. We
 // increment the argumented WaitGroup so the main process can wait for
 // our shutdown function to return during shutdown.
@@ -33,7 +44,10 @@ func PluginStartup() {
 	logger.Info("PluginStartup(%s) has been called\n", pluginName)
 	addressTable = make(map[string]*AddressHolder)
 	go cleanupTask()
-	dispatch.InsertNfqueueSubscription(pluginName, dispatch.DNSPriority, PluginNfqueueHandler)
+	dispatch.DeclareAttachment(pluginName, "client_dns_hint", "", "client name from the DNS cache")
+	dispatch.DeclareAttachment(pluginName, "server_dns_hint", "", "server name from the DNS cache")
+	dispatch.DeclareAttachment(pluginName, "dns_query", "", "name in the DNS query")
+	dispatch.InsertNfqueueSubscription(pluginName, dispatch.DNSPriority, nil, PluginNfqueueHandler)
 }
 
 // PluginShutdown function called when the daemon is shutting down. We call Done
@@ -114,10 +128,10 @@ func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession
 		mess.Session.PutAttachment("dns_query", string(query.Name))
 		result.SessionRelease = false
 	} else {
-		qname := mess.Session.GetAttachment("dns_query")
+		qname, found := mess.Session.GetAttachmentString("dns_query")
 
 		// make sure we have the query name
-		if qname == nil {
+		if !found {
 			return result
 		}
 
@@ -131,7 +145,7 @@ func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession
 				continue
 			}
 			logger.Debug("DNS REPLY DETECTED NAME:%s TTL:%d IP:%v ctid:%d\n", qname, val.TTL, val.IP, ctid)
-			insertAddress(val.IP, qname.(string), val.TTL)
+			insertAddress(val.IP, qname, val.TTL)
 		}
 	}
 
@@ -153,8 +167,8 @@ func FindAddress(finder net.IP) string {
 // insertAddress adds an address and name to the cache
 func insertAddress(finder net.IP, name string, ttl uint32) {
 	holder := new(AddressHolder)
-	holder.CreationTime = time.Now()
-	holder.ExpireTime = time.Now()
+	holder.CreationTime = clock.Now()
+	holder.ExpireTime = clock.Now()
 	holder.ExpireTime.Add(time.Second * time.Duration(ttl))
 	holder.Address = make(net.IP, len(finder))
 	copy(holder.Address, finder)
@@ -177,7 +191,7 @@ func removeAddress(finder net.IP) {
 // cleanAddressTable cleans the address table by removing stale entries
 func cleanAddressTable() {
 	var counter int
-	nowtime := time.Now()
+	nowtime := clock.Now()
 
 	addressMutex.Lock()
 	defer addressMutex.Unlock()
@@ -202,7 +216,7 @@ func cleanupTask() {
 		case <-shutdownChannel:
 			shutdownChannel <- true
 			return
-		case <-time.After(60 * time.Second):
+		case <-clock.After(60 * time.Second):
 			cleanAddressTable()
 		}
 	}
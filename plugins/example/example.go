@@ -5,16 +5,26 @@ import (
 
 	"github.com/untangle/packetd/services/dispatch"
 	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/pluginmanager"
 )
 
 const pluginName = "example"
 
+// init registers the plugin with the plugin manager
+func init() {
+	pluginmanager.Register(&pluginmanager.PluginFunctions{
+		PluginName:   pluginName,
+		StartupFunc:  PluginStartup,
+		ShutdownFunc: PluginShutdown,
+	})
+}
+
 // PluginStartup function is called to allow plugin specific initialization. We
 // increment the argumented WaitGroup so the main process can wait for
 // our shutdown function to return during shutdown.
 func PluginStartup() {
 	logger.Info("PluginStartup(%s) has been called\n", pluginName)
-	dispatch.InsertNfqueueSubscription(pluginName, dispatch.ExamplePriority, PluginNfqueueHandler)
+	dispatch.InsertNfqueueSubscription(pluginName, dispatch.ExamplePriority, nil, PluginNfqueueHandler)
 	dispatch.InsertConntrackSubscription(pluginName, 2, PluginConntrackHandler)
 	dispatch.InsertNetloggerSubscription(pluginName, 2, PluginNetloggerHandler)
 }
@@ -28,8 +38,8 @@ func PluginShutdown() {
 // PluginNfqueueHandler receives a NfqueueMessage which includes a Tuple and
 // a gopacket.Packet, along with the IP and TCP or UDP layer already extracted.
 // We do whatever we like with the data, and when finished, we return an
-// integer via the argumented channel with any bits set that we want added to
-// the packet mark.
+// NfqueueResult with the verdict for the packet and any bits we want set in
+// the packet mark or the connmark.
 func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession bool) dispatch.NfqueueResult {
 	// our example simply dumps the raw message to the console
 	if mess.IP4Layer != nil {
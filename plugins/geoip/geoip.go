@@ -16,6 +16,7 @@ import (
 	"github.com/untangle/packetd/services/dict"
 	"github.com/untangle/packetd/services/dispatch"
 	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/pluginmanager"
 	"github.com/untangle/packetd/services/reports"
 	"github.com/untangle/packetd/services/settings"
 )
@@ -27,6 +28,15 @@ var geoDatabaseReader *geoip2.Reader
 var geoMutex sync.Mutex
 var privateIPBlocks []*net.IPNet
 
+// init registers the plugin with the plugin manager
+func init() {
+	pluginmanager.Register(&pluginmanager.PluginFunctions{
+		PluginName:   pluginName,
+		StartupFunc:  PluginStartup,
+		ShutdownFunc: PluginShutdown,
+	})
+}
+
 // PluginStartup is called to allow plugin specific initialization.
 // We initialize an instance of the GeoIP engine using any existing
 // database we can find, or we download if needed. We increment the
@@ -53,6 +63,7 @@ func PluginStartup() {
 		geoDatabaseReader = db
 	}
 
+	privateIPBlocks = nil
 	for _, cidr := range []string{
 		"127.0.0.0/8",    // IPv4 loopback
 		"10.0.0.0/8",     // RFC1918
@@ -67,7 +78,9 @@ func PluginStartup() {
 	}
 
 	go downloadTask()
-	dispatch.InsertNfqueueSubscription(pluginName, dispatch.GeoipPriority, PluginNfqueueHandler)
+	dispatch.DeclareAttachment(pluginName, "client_country", "", "client country code")
+	dispatch.DeclareAttachment(pluginName, "server_country", "", "server country code")
+	dispatch.InsertSessionStartSubscription(pluginName, dispatch.GeoipPriority, PluginSessionStartHandler)
 }
 
 // PluginShutdown is called when the daemon is shutting down. We close our
@@ -94,38 +107,20 @@ func PluginShutdown() {
 	}
 }
 
-// PluginNfqueueHandler is called to handle nfqueue packet data. We extract
-// the source and destination IP address from the packet, lookup the GeoIP
+// PluginSessionStartHandler is called once for every new session. We take
+// the client and server IP address from the session, lookup the GeoIP
 // country code for each, and store them in the conntrack dictionary.
-func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession bool) dispatch.NfqueueResult {
-	var result dispatch.NfqueueResult
-
-	// release immediately as we only care about the first packet
-	dispatch.ReleaseSession(mess.Session, pluginName)
-
-	// we only do the lookup for new sessions
-	if !newSession {
-		return result
-	}
-
+func PluginSessionStartHandler(mess *dispatch.SessionStartMessage) {
 	geoMutex.Lock()
 	defer geoMutex.Unlock()
 
 	// we start by setting both the client and server country to XU for unknown
 	var clientCountry = "XU"
 	var serverCountry = "XU"
-	var srcAddr net.IP
-	var dstAddr net.IP
-
-	if mess.IP6Layer != nil {
-		srcAddr = mess.IP6Layer.SrcIP
-		dstAddr = mess.IP6Layer.DstIP
-	}
-
-	if mess.IP4Layer != nil {
-		srcAddr = mess.IP4Layer.SrcIP
-		dstAddr = mess.IP4Layer.DstIP
-	}
+	ctid := mess.Session.GetConntrackID()
+	tuple := mess.Session.GetClientSideTuple()
+	srcAddr := tuple.ClientAddress
+	dstAddr := tuple.ServerAddress
 
 	// first we check to see if the source or destination addresses are
 	// in private address blocks and if so assign the XL local country code
@@ -164,8 +159,6 @@ func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession
 	mess.Session.PutAttachment("server_country", serverCountry)
 
 	logEvent(mess.Session, clientCountry, serverCountry)
-
-	return result
 }
 
 func isPrivateIP(ip net.IP) bool {
@@ -4,18 +4,35 @@ import (
 	"github.com/untangle/packetd/services/dict"
 	"github.com/untangle/packetd/services/dispatch"
 	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/pluginmanager"
 	"github.com/untangle/packetd/services/predicttrafficsvc"
 	"github.com/untangle/packetd/services/reports"
 )
 
 const pluginName = "predicttraffic"
 
+// init registers the plugin with the plugin manager
+func init() {
+	pluginmanager.Register(&pluginmanager.PluginFunctions{
+		PluginName:   pluginName,
+		StartupFunc:  PluginStartup,
+		ShutdownFunc: PluginShutdown,
+	})
+}
+
 // PluginStartup function is called to allow plugin specific initialization. We
 // increment the argumented WaitGroup so the main process can wait for
 // our shutdown function to return during shutdown.
 func PluginStartup() {
 	logger.Info("PluginStartup(%s) has been called\n", pluginName)
-	dispatch.InsertNfqueueSubscription(pluginName, dispatch.PredictPriority, PluginNfqueueHandler)
+	dispatch.DeclareAttachment(pluginName, "application_id_inferred", "", "predicted application identifier")
+	dispatch.DeclareAttachment(pluginName, "application_name_inferred", "", "predicted application name")
+	dispatch.DeclareAttachment(pluginName, "application_confidence_inferred", uint8(0), "prediction confidence")
+	dispatch.DeclareAttachment(pluginName, "application_protochain_inferred", "", "predicted protocol chain")
+	dispatch.DeclareAttachment(pluginName, "application_productivity_inferred", uint8(0), "predicted application productivity rating")
+	dispatch.DeclareAttachment(pluginName, "application_risk_inferred", uint8(0), "predicted application risk rating")
+	dispatch.DeclareAttachment(pluginName, "application_category_inferred", "", "predicted application category")
+	dispatch.InsertNfqueueSubscription(pluginName, dispatch.PredictPriority, nil, PluginNfqueueHandler)
 }
 
 // PluginShutdown function called when the daemon is shutting down. We call Done
@@ -5,22 +5,34 @@ package reporter
 import (
 	"encoding/json"
 	"net"
-	"time"
 
+	"github.com/untangle/packetd/services/clock"
 	"github.com/untangle/packetd/services/dict"
 	"github.com/untangle/packetd/services/dispatch"
 	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/pluginmanager"
 	"github.com/untangle/packetd/services/reports"
 )
 
 const pluginName = "reporter"
 
+// init registers the plugin with the plugin manager
+func init() {
+	pluginmanager.Register(&pluginmanager.PluginFunctions{
+		PluginName:   pluginName,
+		StartupFunc:  PluginStartup,
+		ShutdownFunc: PluginShutdown,
+	})
+}
+
 // PluginStartup starts the reporter
 func PluginStartup() {
 	logger.Info("PluginStartup(%s) has been called\n", pluginName)
-	dispatch.InsertNfqueueSubscription(pluginName, dispatch.ReporterPriority, PluginNfqueueHandler)
+	dispatch.InsertSessionStartSubscription(pluginName, dispatch.ReporterPriority, PluginSessionStartHandler)
 	dispatch.InsertConntrackSubscription(pluginName, 1, PluginConntrackHandler)
 	dispatch.InsertNetloggerSubscription(pluginName, 1, PluginNetloggerHandler)
+	dispatch.InsertSessionEndSubscription(pluginName, 1, PluginSessionEndHandler)
+	dispatch.InsertAttachmentSubscription(pluginName, 1, []string{dispatch.KilledByAttachment}, PluginAttachmentHandler)
 }
 
 // PluginShutdown stops the reporter
@@ -28,24 +40,10 @@ func PluginShutdown() {
 	logger.Info("PluginShutdown(%s) has been called\n", pluginName)
 }
 
-// PluginNfqueueHandler handles the first packet of a session
+// PluginSessionStartHandler handles the start of a session
 // Logs a new session_new event
-func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession bool) dispatch.NfqueueResult {
-	var result dispatch.NfqueueResult
-	result.SessionRelease = true
-
-	var session *dispatch.Session
-	session = mess.Session
-	if session == nil {
-		logger.Err("Missing session on NFQueue packet!")
-		return result
-	}
-	dispatch.ReleaseSession(session, pluginName)
-
-	// We only care about new sessions
-	if !newSession {
-		return result
-	}
+func PluginSessionStartHandler(mess *dispatch.SessionStartMessage) {
+	session := mess.Session
 
 	// this is the first packet so source interface = client interface
 	// we don't know the server interface information yet - nfqueue is prerouting
@@ -65,7 +63,7 @@ func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession
 	}
 	clientSideTuple := session.GetClientSideTuple()
 	columns := map[string]interface{}{
-		"time_stamp":            time.Now(),
+		"time_stamp":            mess.StartTime,
 		"session_id":            session.GetSessionID(),
 		"ip_protocol":           clientSideTuple.Protocol,
 		"client_interface_id":   session.GetClientInterfaceID(),
@@ -86,7 +84,6 @@ func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession
 		}
 		dict.AddSessionEntry(session.GetConntrackID(), k, v)
 	}
-	return result
 }
 
 // PluginConntrackHandler receives conntrack events
@@ -137,6 +134,38 @@ func PluginConntrackHandler(message int, entry *dispatch.Conntrack) {
 	}
 }
 
+// PluginSessionEndHandler receives session end events
+// Logs a session_end event with the end time and final totals
+func PluginSessionEndHandler(mess *dispatch.SessionEndMessage) {
+	columns := map[string]interface{}{
+		"session_id": mess.Session.GetSessionID(),
+	}
+	modifiedColumns := map[string]interface{}{
+		"end_time":       mess.EndTime,
+		"bytes":          mess.TotalBytes,
+		"client_bytes":   mess.ClientBytes,
+		"server_bytes":   mess.ServerBytes,
+		"packets":        mess.TotalPackets,
+		"client_packets": mess.ClientPackets,
+		"server_packets": mess.ServerPackets,
+	}
+	reports.LogEvent(reports.CreateEvent("session_end", "sessions", 2, columns, modifiedColumns))
+}
+
+// PluginAttachmentHandler logs a session_kill event when a session is killed
+func PluginAttachmentHandler(mess *dispatch.AttachmentChangeMessage) {
+	if mess.Value == nil {
+		return
+	}
+	columns := map[string]interface{}{
+		"session_id": mess.Session.GetSessionID(),
+	}
+	modifiedColumns := map[string]interface{}{
+		"killed_by": mess.Value,
+	}
+	reports.LogEvent(reports.CreateEvent("session_kill", "sessions", 2, columns, modifiedColumns))
+}
+
 // TrafficEvent defines the prefix passed in Netlogger events
 type TrafficEvent struct {
 	Type   string
@@ -202,7 +231,7 @@ func doAccounting(entry *dispatch.Conntrack, sessionID int64, ctid uint32) {
 	// build the values interface array by appending the columns in the same
 	// order they are defined in services/reports/events.go so it can be passed
 	// directly to the prepared INSERT statement created from that array
-	values = append(values, time.Now().UnixNano()/1000000)
+	values = append(values, clock.Now().UnixNano()/1000000)
 	values = append(values, sessionID)
 	values = append(values, entry.TotalBytesDiff)
 	values = append(values, int32(entry.TotalByteRate))
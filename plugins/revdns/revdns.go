@@ -5,9 +5,11 @@ import (
 	"sync"
 	"time"
 
+	"github.com/untangle/packetd/services/clock"
 	"github.com/untangle/packetd/services/dict"
 	"github.com/untangle/packetd/services/dispatch"
 	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/pluginmanager"
 )
 
 // ReverseHolder is used to cache a list of DNS names for an IP address
@@ -32,13 +34,24 @@ var reverseMutex sync.RWMutex
 var clientMutex sync.RWMutex
 var serverMutex sync.RWMutex
 
+// init registers the plugin with the plugin manager
+func init() {
+	pluginmanager.Register(&pluginmanager.PluginFunctions{
+		PluginName:   pluginName,
+		StartupFunc:  PluginStartup,
+		ShutdownFunc: PluginShutdown,
+	})
+}
+
 // PluginStartup function is called to allow plugin specific initialization.
 func PluginStartup() {
 	logger.Info("PluginStartup(%s) has been called\n", pluginName)
 	reverseTable = make(map[string]*ReverseHolder)
 	go cleanupTask()
-	dispatch.InsertNfqueueSubscription(pluginName+clientSuffix, dispatch.RevDNSPriority, PluginNfqueueClientHandler)
-	dispatch.InsertNfqueueSubscription(pluginName+serverSuffix, dispatch.RevDNSPriority, PluginNfqueueServerHandler)
+	dispatch.DeclareAttachment(pluginName, "client_reverse_dns", "", "client reverse DNS names")
+	dispatch.DeclareAttachment(pluginName, "server_reverse_dns", "", "server reverse DNS names")
+	dispatch.InsertSessionStartSubscription(pluginName+clientSuffix, dispatch.RevDNSPriority, PluginSessionStartClientHandler)
+	dispatch.InsertSessionStartSubscription(pluginName+serverSuffix, dispatch.RevDNSPriority, PluginSessionStartServerHandler)
 }
 
 // PluginShutdown function called when the daemon is shutting down.
@@ -56,23 +69,19 @@ func PluginShutdown() {
 
 }
 
-// PluginNfqueueClientHandler is called to handle nfqueue packet data. We look
-// at the first packet of every connection, and put the reverse DNS name
+// PluginSessionStartClientHandler is called once for every new session, and puts the reverse DNS name
 // for the client address in the session and the dictionary. We get the names
 // from cache if they are available, otherwise we do the reverse lookup and
 // store them in the cache.
-func PluginNfqueueClientHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession bool) dispatch.NfqueueResult {
-	var result dispatch.NfqueueResult
-	result.SessionRelease = true
-
-	// release immediately as we only care about the first packet
-	dispatch.ReleaseSession(mess.Session, pluginName+clientSuffix)
-
-	if !newSession {
-		return result
-	}
+func PluginSessionStartClientHandler(mess *dispatch.SessionStartMessage) {
+	// the lookup can take a while so it is done in the background to keep it off the packet path
+	go attachClientNames(mess.Session)
+}
 
-	findkey := mess.MsgTuple.ClientAddress.String()
+// attachClientNames puts the reverse DNS names for the client address in the session and the dictionary
+func attachClientNames(session *dispatch.Session) {
+	ctid := session.GetConntrackID()
+	findkey := session.GetClientSideTuple().ClientAddress.String()
 
 	var holder *ReverseHolder
 
@@ -102,7 +111,7 @@ func PluginNfqueueClientHandler(mess dispatch.NfqueueMessage, ctid uint32, newSe
 			holder.Available = false
 		}
 
-		holder.AccessTime = time.Now()
+		holder.AccessTime = clock.Now()
 		holder.DataMutex.Unlock()
 		holder.WaitGroup.Done()
 	}
@@ -110,7 +119,7 @@ func PluginNfqueueClientHandler(mess dispatch.NfqueueMessage, ctid uint32, newSe
 	// At this point the holder has either been retrieved or created
 	if holder == nil {
 		logger.Err("Constraint failed: nil reverse holder\n")
-		return result
+		return
 	}
 
 	// wait until the reverse names have been retrieved
@@ -122,29 +131,23 @@ func PluginNfqueueClientHandler(mess dispatch.NfqueueMessage, ctid uint32, newSe
 	// if the holder is available for this server attach the names to the session
 	// and put the details in the dictionary
 	if holder.Available {
-		attachReverseNamesToSession("client_reverse_dns", mess.Session, holder.NameList)
+		attachReverseNamesToSession("client_reverse_dns", session, holder.NameList)
 	}
-
-	return result
 }
 
-// PluginNfqueueServerHandler is called to handle nfqueue packet data. We look
-// at the first packet of every connection, and put the reverse DNS name
+// PluginSessionStartServerHandler is called once for every new session, and puts the reverse DNS name
 // for the server address in the session and the dictionary. We get the names
 // from cache if they are available, otherwise we do the reverse lookup and
 // store them in the cache.
-func PluginNfqueueServerHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession bool) dispatch.NfqueueResult {
-	var result dispatch.NfqueueResult
-	result.SessionRelease = true
-
-	// release immediately as we only care about the first packet
-	dispatch.ReleaseSession(mess.Session, pluginName+serverSuffix)
-
-	if !newSession {
-		return result
-	}
+func PluginSessionStartServerHandler(mess *dispatch.SessionStartMessage) {
+	// the lookup can take a while so it is done in the background to keep it off the packet path
+	go attachServerNames(mess.Session)
+}
 
-	findkey := mess.MsgTuple.ServerAddress.String()
+// attachServerNames puts the reverse DNS names for the server address in the session and the dictionary
+func attachServerNames(session *dispatch.Session) {
+	ctid := session.GetConntrackID()
+	findkey := session.GetClientSideTuple().ServerAddress.String()
 
 	var holder *ReverseHolder
 
@@ -174,7 +177,7 @@ func PluginNfqueueServerHandler(mess dispatch.NfqueueMessage, ctid uint32, newSe
 			holder.Available = false
 		}
 
-		holder.AccessTime = time.Now()
+		holder.AccessTime = clock.Now()
 		holder.DataMutex.Unlock()
 		holder.WaitGroup.Done()
 	}
@@ -182,7 +185,7 @@ func PluginNfqueueServerHandler(mess dispatch.NfqueueMessage, ctid uint32, newSe
 	// At this point the holder has either been retrieved or created
 	if holder == nil {
 		logger.Err("Constraint failed: nil reverse holder\n")
-		return result
+		return
 	}
 
 	// wait until the reverse names have been retrieved
@@ -194,10 +197,8 @@ func PluginNfqueueServerHandler(mess dispatch.NfqueueMessage, ctid uint32, newSe
 	// if the holder is available for this server attach the names to the session
 	// and put the details in the dictionary
 	if holder.Available {
-		attachReverseNamesToSession("server_reverse_dns", mess.Session, holder.NameList)
+		attachReverseNamesToSession("server_reverse_dns", session, holder.NameList)
 	}
-
-	return result
 }
 
 // attachReverseNamesToSession is called to attach the reverse DNS names to a
@@ -244,7 +245,7 @@ func removeReverse(finder string) {
 // cleanReverseTable cleans the address table by removing stale entries
 func cleanReverseTable() {
 	var counter int
-	nowtime := time.Now()
+	nowtime := clock.Now()
 
 	reverseMutex.Lock()
 	defer reverseMutex.Unlock()
@@ -272,7 +273,7 @@ func cleanupTask() {
 		case <-shutdownChannel:
 			shutdownChannel <- true
 			return
-		case <-time.After(60 * time.Second):
+		case <-clock.After(60 * time.Second):
 			cleanReverseTable()
 		}
 	}
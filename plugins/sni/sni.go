@@ -1,19 +1,41 @@
 package sni
 
 import (
+	"syscall"
+
 	"github.com/untangle/packetd/services/dict"
 	"github.com/untangle/packetd/services/dispatch"
 	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/pluginmanager"
 	"github.com/untangle/packetd/services/reports"
 )
 
 const pluginName = "sni"
 const maxPacketCount = 10
 
+// we only search for SNI in TCP traffic to port 443 and we use the reassembled
+// stream so we can find a ClientHello that is split across multiple packets
+var nfqueueFilter = &dispatch.NfqueueFilter{
+	Protocols:        []uint8{syscall.IPPROTO_TCP},
+	ServerPorts:      []uint16{443},
+	Direction:        dispatch.DirectionClientToServer,
+	ReassembleStream: true,
+}
+
+// init registers the plugin with the plugin manager
+func init() {
+	pluginmanager.Register(&pluginmanager.PluginFunctions{
+		PluginName:   pluginName,
+		StartupFunc:  PluginStartup,
+		ShutdownFunc: PluginShutdown,
+	})
+}
+
 // PluginStartup function is called to allow plugin specific initialization.
 func PluginStartup() {
 	logger.Info("PluginStartup(%s) has been called\n", pluginName)
-	dispatch.InsertNfqueueSubscription(pluginName, dispatch.SniPriority, PluginNfqueueHandler)
+	dispatch.DeclareAttachment(pluginName, "ssl_sni", "", "TLS server name indication")
+	dispatch.InsertNfqueueSubscription(pluginName, dispatch.SniPriority, nfqueueFilter, PluginNfqueueHandler)
 }
 
 // PluginShutdown function called when the daemon is shutting down.
@@ -28,29 +50,22 @@ func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession
 	var result dispatch.NfqueueResult
 	result.SessionRelease = false
 
-	// We only search for SNI in TCP traffic
-	if mess.TCPLayer == nil {
-		result.SessionRelease = true
-		return result
+	// use the reassembled client data if we have it or the packet payload if not
+	buffer := mess.Payload
+	if mess.Stream != nil {
+		buffer = mess.Stream.Data(dispatch.StreamClientToServer)
 	}
 
-	// We only search for SNI in port 443 traffic. Since the client and server ports
-	// flip back and forth depending on traffic direction, we check both while waiting
-	// for the handshake to finish and the ClientHello packet to arrive.
-	if mess.MsgTuple.ServerPort != 443 && mess.MsgTuple.ClientPort != 443 {
-		result.SessionRelease = true
-		return result
-	}
-
-	// Look for SNI hostname in the packet and get the release flag
-	// The extract function will set the release once it finds a valid
+	// Look for SNI hostname in the data and get the release flag
+	// The extract function will set the release once it finds a complete
 	// ClientHello, but hostname could still be nil if SNI isn't found
-	release, hostname := extractSNIhostname(mess.Payload)
+	release, hostname := extractSNIhostname(buffer)
 
 	// if we found the hostname write to the dictionary and release the session
 	if hostname != "" {
 		logger.Debug("Extracted SNI %s ctid:%d\n", hostname, ctid)
 		dict.AddSessionEntry(ctid, "ssl_sni", hostname)
+		mess.Session.PutAttachment("ssl_sni", hostname)
 		logEvent(mess.Session, hostname)
 		result.SessionRelease = true
 		return result
@@ -62,6 +77,11 @@ func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession
 		release = true
 	}
 
+	// release the session if the stream is full since we will never get more data
+	if mess.Stream != nil && mess.Stream.Full(dispatch.StreamClientToServer) {
+		release = true
+	}
+
 	// set the session release from the extractor return
 	result.SessionRelease = release
 	return result
@@ -125,6 +145,16 @@ func extractSNIhostname(buffer []byte) (bool, string) {
 		return false, hostname
 	}
 
+	// wait for the rest of the record if the ClientHello is split across packets
+	recordLength := (int(buffer[3]) << 8) + int(buffer[4])
+	if maxlen < recordLength+5 {
+		return false, hostname
+	}
+
+	// ignore anything after the record
+	buffer = buffer[:recordLength+5]
+	maxlen = len(buffer)
+
 	// adjust the offset to the session ID length field
 	current = 43
 
@@ -142,6 +172,9 @@ func extractSNIhostname(buffer []byte) (bool, string) {
 	}
 
 	// skip over the cipher suites
+	if current+2 > maxlen {
+		return true, hostname
+	}
 	cipherSuiteLength := (int(buffer[current]) << 8) + int(buffer[current+1])
 	current += 2
 	current += cipherSuiteLength
@@ -158,6 +191,9 @@ func extractSNIhostname(buffer []byte) (bool, string) {
 	}
 
 	// get the length of all extensions
+	if current+2 > maxlen {
+		return true, hostname
+	}
 	extensionsLength := (int(buffer[current]) << 8) + int(buffer[current+1])
 	current += 2
 
@@ -165,7 +201,7 @@ func extractSNIhostname(buffer []byte) (bool, string) {
 		return true, hostname
 	}
 
-	for current < len(buffer) {
+	for current+4 <= maxlen {
 		// get the extension type
 		extensionType := (int(buffer[current]) << 8) + int(buffer[current+1])
 		current += 2
@@ -184,6 +220,11 @@ func extractSNIhostname(buffer []byte) (bool, string) {
 		// intact making it easy to skip over the extension if we find something to doesn't make sense
 		spot := current + 2
 
+		// make sure the name type and length are in the buffer
+		if spot+3 > maxlen {
+			break
+		}
+
 		// get the name type
 		nameType := buffer[spot]
 		spot++
@@ -192,6 +233,9 @@ func extractSNIhostname(buffer []byte) (bool, string) {
 		if nameType == 0 {
 			nameLen := (int(buffer[spot]) << 8) + int(buffer[spot+1])
 			spot += 2
+			if spot+nameLen > maxlen {
+				break
+			}
 			hostname = string(buffer[spot : spot+nameLen])
 			break
 		}
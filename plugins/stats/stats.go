@@ -11,10 +11,12 @@ import (
 	"time"
 
 	"github.com/c9s/goprocinfo/linux"
+	"github.com/untangle/packetd/services/clock"
 	"github.com/untangle/packetd/services/dict"
 	"github.com/untangle/packetd/services/dispatch"
 	"github.com/untangle/packetd/services/logger"
 	"github.com/untangle/packetd/services/overseer"
+	"github.com/untangle/packetd/services/pluginmanager"
 	"github.com/untangle/packetd/services/reports"
 	"github.com/untangle/packetd/services/settings"
 )
@@ -62,6 +64,16 @@ type interfaceMetric struct {
 	lastPingTimeout uint64
 }
 
+// init registers the plugin with the plugin manager
+func init() {
+	pluginmanager.Register(&pluginmanager.PluginFunctions{
+		PluginName:   pluginName,
+		StartupFunc:  PluginStartup,
+		ShutdownFunc: PluginShutdown,
+		SignalFunc:   PluginSignal,
+	})
+}
+
 // PluginStartup function is called to allow plugin specific initialization.
 func PluginStartup() {
 	logger.Info("PluginStartup(%s) has been called\n", pluginName)
@@ -86,7 +98,10 @@ func PluginStartup() {
 	go interfaceTask()
 	go pingerTask()
 
-	dispatch.InsertNfqueueSubscription(pluginName, dispatch.StatsPriority, PluginNfqueueHandler)
+	dispatch.DeclareAttachment(pluginName, "stats_timer", time.Time{}, "time of the first client packet")
+	dispatch.DeclareAttachment(pluginName, "client_hops", uint8(0), "estimated hop count to the client")
+	dispatch.DeclareAttachment(pluginName, "server_hops", uint8(0), "estimated hop count to the server")
+	dispatch.InsertNfqueueSubscription(pluginName, dispatch.StatsPriority, nil, PluginNfqueueHandler)
 }
 
 // PluginShutdown function called when the daemon is shutting down.
@@ -132,7 +147,7 @@ func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession
 
 	// if this is a new session attach the current time
 	if newSession {
-		mess.Session.PutAttachment("stats_timer", time.Now())
+		mess.Session.PutAttachment("stats_timer", clock.Now())
 		logHopCount(ctid, mess, "client_hops")
 	}
 
@@ -147,15 +162,15 @@ func PluginNfqueueHandler(mess dispatch.NfqueueMessage, ctid uint32, newSession
 
 	// We have a packet from the server so we calculate the latency as the
 	// time elapsed since the first client packet was transmitted
-	xmittime := mess.Session.GetAttachment("stats_timer")
-	if xmittime == nil {
+	xmittime, found := mess.Session.GetAttachmentTime("stats_timer")
+	if !found {
 		logger.Warn("Missing stats_timer for session %d\n", ctid)
 		return result
 	}
 
 	// We have a packet from the server so we calculate the latency as the
 	// time elapsed sincethe first client packet was transmitted
-	duration := time.Since(xmittime.(time.Time))
+	duration := clock.Since(xmittime)
 	interfaceID := mess.Session.GetServerInterfaceID()
 
 	// ignore local traffic
@@ -648,8 +663,9 @@ func logHopCount(ctid uint32, mess dispatch.NfqueueMessage, name string) {
 		hops = (255 - ttl)
 	}
 
-	// put the hop count in the dictionary
+	// put the hop count in the dictionary and the session attachments
 	dict.AddSessionEntry(ctid, name, hops)
+	mess.Session.PutAttachment(name, hops)
 
 	columns := map[string]interface{}{
 		"session_id": mess.Session.GetSessionID(),
@@ -6,6 +6,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/untangle/packetd/services/clock"
 	"github.com/untangle/packetd/services/dict"
 	"github.com/untangle/packetd/services/dispatch"
 	"github.com/untangle/packetd/services/logger"
@@ -31,6 +32,13 @@ var certificateMutex sync.RWMutex
 // Startup function is called to allow service specific initialization.
 func Startup() {
 	certificateTable = make(map[string]*CertificateHolder)
+
+	dispatch.DeclareAttachment("certcache", "certificate", x509.Certificate{}, "server certificate")
+	dispatch.DeclareAttachment("certcache", "cert_dns_names", "", "certificate common name and alternative names")
+	for _, field := range certificateFields {
+		dispatch.DeclareAttachment("certcache", field, "", "certificate field")
+	}
+
 	go cleanupTask()
 }
 
@@ -45,6 +53,16 @@ func Shutdown() {
 	}
 }
 
+// certificateFields are the certificate subject and issuer fields attached to sessions
+var certificateFields = []string{
+	"certificate_subject_cn", "certificate_subject_sn", "certificate_subject_c", "certificate_subject_o",
+	"certificate_subject_ou", "certificate_subject_l", "certificate_subject_p", "certificate_subject_sa",
+	"certificate_subject_pc", "certificate_subject_san",
+	"certificate_issuer_cn", "certificate_issuer_sn", "certificate_issuer_c", "certificate_issuer_o",
+	"certificate_issuer_ou", "certificate_issuer_l", "certificate_issuer_p", "certificate_issuer_sa",
+	"certificate_issuer_pc",
+}
+
 // AttachCertificateToSession is called to attach a certificate to a session entry and
 // to populate the dictionary with details about the certificate
 func AttachCertificateToSession(session *dispatch.Session, certificate x509.Certificate) {
@@ -152,7 +170,7 @@ func RemoveCertificate(finder string) {
 // cleanCertificateTable cleans the certificate table by removing stale entries
 func cleanCertificateTable() {
 	var counter int
-	nowtime := time.Now()
+	nowtime := clock.Now()
 
 	certificateMutex.Lock()
 	defer certificateMutex.Unlock()
@@ -177,7 +195,7 @@ func cleanupTask() {
 		case <-shutdownChannel:
 			shutdownChannel <- true
 			return
-		case <-time.After(cleanInterval * time.Second):
+		case <-clock.After(cleanInterval * time.Second):
 			cleanCertificateTable()
 		}
 	}
@@ -0,0 +1,156 @@
+// Package clock provides the time used by dispatch and the plugins. Normally this
+// is the system clock but it can be switched to a virtual clock that only moves
+// when a traffic playback advances it using the record timestamps. This lets the
+// same capture be played back twice with the same results regardless of the
+// playback speed or when it happens.
+package clock
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Epoch is the starting time of the virtual clock. Each playback resets the
+// virtual clock to the epoch and moves it by the time since the first record.
+var Epoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// virtualTimer is a pending After call on the virtual clock
+type virtualTimer struct {
+	deadline time.Time
+	sequence uint64
+	channel  chan time.Time
+}
+
+// virtualEnabled is always accessed atomically so the system clock path never takes
+// the mutex. It is only changed while holding clockMutex which protects the rest of
+// the virtual clock state.
+var virtualEnabled int32
+var clockMutex sync.Mutex
+var virtualNow time.Time
+var virtualTimers []*virtualTimer
+var timerSequence uint64
+
+// Now returns the current time from the system or virtual clock
+func Now() time.Time {
+	if atomic.LoadInt32(&virtualEnabled) == 0 {
+		return time.Now()
+	}
+
+	clockMutex.Lock()
+	defer clockMutex.Unlock()
+
+	if atomic.LoadInt32(&virtualEnabled) == 0 {
+		return time.Now()
+	}
+	return virtualNow
+}
+
+// Since returns the time elapsed since t using the system or virtual clock
+func Since(t time.Time) time.Duration {
+	return Now().Sub(t)
+}
+
+// After waits for the duration to elapse on the system or virtual clock and then
+// sends the current time on the returned channel. Virtual timers only fire when
+// the virtual clock is advanced.
+func After(d time.Duration) <-chan time.Time {
+	if atomic.LoadInt32(&virtualEnabled) == 0 {
+		return time.After(d)
+	}
+
+	clockMutex.Lock()
+	defer clockMutex.Unlock()
+
+	if atomic.LoadInt32(&virtualEnabled) == 0 {
+		return time.After(d)
+	}
+
+	timerSequence++
+	timer := &virtualTimer{deadline: virtualNow.Add(d), sequence: timerSequence, channel: make(chan time.Time, 1)}
+	virtualTimers = append(virtualTimers, timer)
+	return timer.channel
+}
+
+// IsVirtual returns true if the virtual clock is enabled
+func IsVirtual() bool {
+	return atomic.LoadInt32(&virtualEnabled) != 0
+}
+
+// EnableVirtual switches to the virtual clock starting at the argumented time
+func EnableVirtual(start time.Time) {
+	clockMutex.Lock()
+	defer clockMutex.Unlock()
+
+	virtualNow = start
+	atomic.StoreInt32(&virtualEnabled, 1)
+}
+
+// DisableVirtual switches back to the system clock. Pending virtual timers are
+// moved to the system clock with the time they had left.
+func DisableVirtual() {
+	clockMutex.Lock()
+	defer clockMutex.Unlock()
+
+	if atomic.LoadInt32(&virtualEnabled) == 0 {
+		return
+	}
+
+	for _, timer := range virtualTimers {
+		go func(timer *virtualTimer, remaining time.Duration) {
+			timer.channel <- <-time.After(remaining)
+		}(timer, timer.deadline.Sub(virtualNow))
+	}
+
+	atomic.StoreInt32(&virtualEnabled, 0)
+	virtualTimers = nil
+}
+
+// Reset sets the virtual clock to the argumented time so every playback starts from
+// the same state. Pending timers are kept with the time they had left since the
+// tasks waiting on them would otherwise never wake up. Nothing happens if the
+// virtual clock is not enabled.
+func Reset(start time.Time) {
+	clockMutex.Lock()
+	defer clockMutex.Unlock()
+
+	if atomic.LoadInt32(&virtualEnabled) == 0 {
+		return
+	}
+
+	for _, timer := range virtualTimers {
+		timer.deadline = start.Add(timer.deadline.Sub(virtualNow))
+	}
+	virtualNow = start
+}
+
+// Advance moves the virtual clock forward to the argumented time and fires the
+// timers that are due in deadline order. Earlier times are ignored since the
+// clock never goes backwards. Nothing happens if the virtual clock is not enabled.
+func Advance(now time.Time) {
+	clockMutex.Lock()
+	defer clockMutex.Unlock()
+
+	if atomic.LoadInt32(&virtualEnabled) == 0 || !now.After(virtualNow) {
+		return
+	}
+	virtualNow = now
+
+	sort.Slice(virtualTimers, func(i, j int) bool {
+		if virtualTimers[i].deadline.Equal(virtualTimers[j].deadline) {
+			return virtualTimers[i].sequence < virtualTimers[j].sequence
+		}
+		return virtualTimers[i].deadline.Before(virtualTimers[j].deadline)
+	})
+
+	var count int
+	for _, timer := range virtualTimers {
+		if timer.deadline.After(now) {
+			break
+		}
+		timer.channel <- now
+		count++
+	}
+	virtualTimers = virtualTimers[count:]
+}
@@ -0,0 +1,89 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+// TestVirtualClock checks that the virtual clock only moves and fires timers when advanced
+func TestVirtualClock(t *testing.T) {
+	EnableVirtual(Epoch)
+	defer DisableVirtual()
+
+	if !Now().Equal(Epoch) {
+		t.Fatalf("Wrong starting time: %v", Now())
+	}
+
+	long := After(10 * time.Second)
+	short := After(5 * time.Second)
+
+	Advance(Epoch.Add(6 * time.Second))
+	select {
+	case <-short:
+	default:
+		t.Errorf("Timer did not fire after advancing past the deadline")
+	}
+	select {
+	case <-long:
+		t.Errorf("Timer fired before the deadline")
+	default:
+	}
+
+	// the clock never goes backwards
+	Advance(Epoch.Add(time.Second))
+	if Since(Epoch) != 6*time.Second {
+		t.Errorf("Wrong time after advancing backwards: %v", Now())
+	}
+
+	Advance(Epoch.Add(10 * time.Second))
+	select {
+	case stamp := <-long:
+		if !stamp.Equal(Epoch.Add(10 * time.Second)) {
+			t.Errorf("Wrong timer time: %v", stamp)
+		}
+	default:
+		t.Errorf("Timer did not fire at the deadline")
+	}
+
+}
+
+// TestVirtualReset checks that a task waiting on a timer across a reset still wakes up
+// with the time it had left when the clock was reset
+func TestVirtualReset(t *testing.T) {
+	EnableVirtual(Epoch)
+	defer DisableVirtual()
+
+	Advance(Epoch.Add(time.Hour))
+
+	waiting := make(chan struct{})
+	woken := make(chan time.Time)
+	go func() {
+		channel := After(10 * time.Second)
+		close(waiting)
+		woken <- <-channel
+	}()
+	<-waiting
+
+	Advance(Epoch.Add(time.Hour + 4*time.Second))
+	Reset(Epoch)
+	if !Now().Equal(Epoch) {
+		t.Errorf("Wrong time after reset: %v", Now())
+	}
+
+	Advance(Epoch.Add(5 * time.Second))
+	select {
+	case <-woken:
+		t.Errorf("Timer fired before the remaining time elapsed")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	Advance(Epoch.Add(6 * time.Second))
+	select {
+	case stamp := <-woken:
+		if !stamp.Equal(Epoch.Add(6 * time.Second)) {
+			t.Errorf("Wrong timer time: %v", stamp)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Timer waiting across the reset never fired")
+	}
+}
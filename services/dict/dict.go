@@ -12,6 +12,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/untangle/packetd/services/clock"
 	"github.com/untangle/packetd/services/logger"
 )
 
@@ -776,7 +777,7 @@ func cleanupTask() {
 		case <-shutdownChannel:
 			shutdownChannel <- true
 			return
-		case <-time.After(cleanCycleSeconds * time.Second):
+		case <-clock.After(cleanCycleSeconds * time.Second):
 			cleanDictionary()
 		}
 	}
@@ -787,7 +788,7 @@ func cleanupTask() {
 // routed, blocked, or otherwise handled by nft without us ever seeing them.
 func cleanDictionary() {
 	// get the current time
-	currtime := time.Now().Unix()
+	currtime := clock.Now().Unix()
 
 	// get the list of unique items in the sessions table from the dictionary
 	cmd := "cat /proc/net/dict/all | awk '{ if($2 ==  \"sessions\") print $4 }' | uniq"
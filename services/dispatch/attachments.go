@@ -0,0 +1,320 @@
+package dispatch
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+)
+
+// AttachmentSchema describes a session attachment declared by a plugin
+type AttachmentSchema struct {
+	Namespace   string `json:"namespace"`
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Description string `json:"description"`
+	valueType   reflect.Type
+}
+
+// AttachmentChangeMessage is passed to attachment subscribers when the value of an
+// attachment changes. Value is nil when the attachment has been deleted.
+type AttachmentChangeMessage struct {
+	Session  *Session
+	Name     string
+	Previous interface{}
+	Value    interface{}
+}
+
+// AttachmentHandlerFunction defines a pointer to an attachment change callback function
+type AttachmentHandlerFunction func(*AttachmentChangeMessage)
+
+var attachmentSchema = make(map[string]*AttachmentSchema)
+var attachmentSchemaMutex sync.RWMutex
+
+// DeclareAttachment declares an attachment in the namespace of a plugin. The type of the
+// example value becomes the type of the attachment and values of any other type are
+// rejected. An attachment name can only belong to a single namespace.
+func DeclareAttachment(namespace string, name string, example interface{}, description string) {
+	schema := new(AttachmentSchema)
+	schema.Namespace = namespace
+	schema.Name = name
+	schema.Description = description
+	schema.valueType = reflect.TypeOf(example)
+	schema.Type = schema.valueType.String()
+
+	attachmentSchemaMutex.Lock()
+	defer attachmentSchemaMutex.Unlock()
+
+	previous := attachmentSchema[name]
+	if previous != nil && previous.Namespace != namespace {
+		logger.Err("%OC|Attachment %s for %s already declared by %s\n", "attachment_namespace_conflict", 0, name, namespace, previous.Namespace)
+		return
+	}
+	attachmentSchema[name] = schema
+}
+
+// GetAttachmentSchema returns all of the declared attachments sorted by namespace and name
+func GetAttachmentSchema() []AttachmentSchema {
+	attachmentSchemaMutex.RLock()
+	list := make([]AttachmentSchema, 0, len(attachmentSchema))
+	for _, schema := range attachmentSchema {
+		list = append(list, *schema)
+	}
+	attachmentSchemaMutex.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Namespace != list[j].Namespace {
+			return list[i].Namespace < list[j].Namespace
+		}
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// IsAttachmentDeclared returns true if an attachment with the argumented name has been declared
+func IsAttachmentDeclared(name string) bool {
+	attachmentSchemaMutex.RLock()
+	defer attachmentSchemaMutex.RUnlock()
+	return attachmentSchema[name] != nil
+}
+
+// checkAttachment returns false if the value does not match the declared type of the attachment
+func checkAttachment(name string, value interface{}) bool {
+	if value == nil {
+		return true
+	}
+
+	attachmentSchemaMutex.RLock()
+	schema := attachmentSchema[name]
+	attachmentSchemaMutex.RUnlock()
+
+	if schema == nil || reflect.TypeOf(value) == schema.valueType {
+		return true
+	}
+
+	logger.Warn("%OC|Ignoring attachment %s with type %T instead of %s\n", "attachment_type_mismatch", 0, name, value, schema.Type)
+	return false
+}
+
+// attachmentEqual returns true if two attachment values are the same
+func attachmentEqual(first interface{}, second interface{}) bool {
+	if first == nil || second == nil {
+		return first == nil && second == nil
+	}
+
+	kind := reflect.TypeOf(first)
+	if kind != reflect.TypeOf(second) {
+		return false
+	}
+	if kind.Comparable() {
+		return first == second
+	}
+	return reflect.DeepEqual(first, second)
+}
+
+// PutAttachment is used to safely add an attachment to a session object
+func (sess *Session) PutAttachment(name string, value interface{}) {
+	if !checkAttachment(name, value) {
+		return
+	}
+
+	sess.attachmentLock.Lock()
+	previous := sess.attachments[name]
+	sess.attachments[name] = value
+	sess.attachmentLock.Unlock()
+
+	if !attachmentEqual(previous, value) {
+		callAttachmentSubscribers(&AttachmentChangeMessage{Session: sess, Name: name, Previous: previous, Value: value})
+	}
+}
+
+// GetAttachment is used to safely get an attachment from a session object
+func (sess *Session) GetAttachment(name string) interface{} {
+	sess.attachmentLock.RLock()
+	value := sess.attachments[name]
+	sess.attachmentLock.RUnlock()
+	return value
+}
+
+// GetAttachmentString returns a string attachment and true if it exists and is a string
+func (sess *Session) GetAttachmentString(name string) (string, bool) {
+	value, ok := sess.GetAttachment(name).(string)
+	return value, ok
+}
+
+// GetAttachmentBool returns a bool attachment and true if it exists and is a bool
+func (sess *Session) GetAttachmentBool(name string) (bool, bool) {
+	value, ok := sess.GetAttachment(name).(bool)
+	return value, ok
+}
+
+// GetAttachmentTime returns a time attachment and true if it exists and is a time
+func (sess *Session) GetAttachmentTime(name string) (time.Time, bool) {
+	value, ok := sess.GetAttachment(name).(time.Time)
+	return value, ok
+}
+
+// GetAttachmentInt returns an integer attachment of any size as an int64
+// and true if it exists and is an integer
+func (sess *Session) GetAttachmentInt(name string) (int64, bool) {
+	switch value := sess.GetAttachment(name).(type) {
+	case int:
+		return int64(value), true
+	case int8:
+		return int64(value), true
+	case int16:
+		return int64(value), true
+	case int32:
+		return int64(value), true
+	case int64:
+		return value, true
+	case uint:
+		return int64(value), true
+	case uint8:
+		return int64(value), true
+	case uint16:
+		return int64(value), true
+	case uint32:
+		return int64(value), true
+	case uint64:
+		return int64(value), true
+	}
+	return 0, false
+}
+
+// GetAllAttachments returns a copy of all of the session attachments
+func (sess *Session) GetAllAttachments() map[string]interface{} {
+	sess.attachmentLock.RLock()
+	result := make(map[string]interface{}, len(sess.attachments))
+	for name, value := range sess.attachments {
+		result[name] = value
+	}
+	sess.attachmentLock.RUnlock()
+	return result
+}
+
+// GetAttachments returns a copy of the attachments declared in the argumented namespace
+func (sess *Session) GetAttachments(namespace string) map[string]interface{} {
+	var names []string
+
+	attachmentSchemaMutex.RLock()
+	for name, schema := range attachmentSchema {
+		if schema.Namespace == namespace {
+			names = append(names, name)
+		}
+	}
+	attachmentSchemaMutex.RUnlock()
+
+	result := make(map[string]interface{})
+	sess.attachmentLock.RLock()
+	for _, name := range names {
+		if value, found := sess.attachments[name]; found {
+			result[name] = value
+		}
+	}
+	sess.attachmentLock.RUnlock()
+	return result
+}
+
+// DeleteAttachment is used to safely delete an attachment from a session object
+func (sess *Session) DeleteAttachment(name string) bool {
+	sess.attachmentLock.Lock()
+	value := sess.attachments[name]
+	delete(sess.attachments, name)
+	sess.attachmentLock.Unlock()
+
+	if value == nil {
+		return false
+	}
+
+	callAttachmentSubscribers(&AttachmentChangeMessage{Session: sess, Name: name, Previous: value})
+	return true
+}
+
+// UpdateAttachments calls the argumented function with the attachments locked so a group of
+// attachments can be examined and changed together. The function must not call any of the other
+// attachment functions. Values that don't match the declared type are reverted and the
+// attachment subscribers are called for each change after the lock is released.
+func (sess *Session) UpdateAttachments(function func(attachments map[string]interface{})) {
+	var changes []*AttachmentChangeMessage
+
+	sess.attachmentLock.Lock()
+	previous := make(map[string]interface{}, len(sess.attachments))
+	for name, value := range sess.attachments {
+		previous[name] = value
+	}
+
+	function(sess.attachments)
+
+	for name, value := range sess.attachments {
+		old := previous[name]
+		if attachmentEqual(old, value) {
+			continue
+		}
+		if !checkAttachment(name, value) {
+			if old == nil {
+				delete(sess.attachments, name)
+			} else {
+				sess.attachments[name] = old
+			}
+			continue
+		}
+		changes = append(changes, &AttachmentChangeMessage{Session: sess, Name: name, Previous: old, Value: value})
+	}
+	for name, old := range previous {
+		if _, found := sess.attachments[name]; !found && old != nil {
+			changes = append(changes, &AttachmentChangeMessage{Session: sess, Name: name, Previous: old})
+		}
+	}
+	sess.attachmentLock.Unlock()
+
+	for _, mess := range changes {
+		callAttachmentSubscribers(mess)
+	}
+}
+
+// wantsAttachment returns true if an attachment subscriber wants changes to the argumented attachment
+func (holder *SubscriptionHolder) wantsAttachment(name string) bool {
+	if len(holder.AttachmentNames) == 0 {
+		return true
+	}
+	for _, item := range holder.AttachmentNames {
+		if item == name {
+			return true
+		}
+	}
+	return false
+}
+
+// callAttachmentSubscribers calls the attachment subscribers that want the change in priority order.
+// The subscribers are called directly by the goroutine that changed the attachment so they
+// should return quickly.
+func callAttachmentSubscribers(mess *AttachmentChangeMessage) {
+	var sublist []SubscriptionHolder
+
+	attachmentSubMutex.Lock()
+	for _, val := range attachmentSubList {
+		if val.wantsAttachment(mess.Name) {
+			sublist = append(sublist, val)
+		}
+	}
+	attachmentSubMutex.Unlock()
+
+	if len(sublist) == 0 {
+		return
+	}
+
+	sort.Slice(sublist, func(i, j int) bool {
+		if sublist[i].Priority != sublist[j].Priority {
+			return sublist[i].Priority < sublist[j].Priority
+		}
+		return sublist[i].Owner < sublist[j].Owner
+	})
+
+	for _, val := range sublist {
+		call := &subscriberCall{owner: val.Owner}
+		callSubscriber(MetricsAttachment, call, func() { val.AttachmentFunc(mess) })
+	}
+}
@@ -0,0 +1,64 @@
+package dispatch
+
+import (
+	"testing"
+
+	"github.com/untangle/packetd/services/overseer"
+)
+
+// TestAttachmentChanges checks the declared types and the change notifications
+func TestAttachmentChanges(t *testing.T) {
+	overseer.Startup()
+	attachmentSubList = make(map[string]SubscriptionHolder)
+	defer func() { attachmentSubList = nil }()
+
+	DeclareAttachment("test", "test_name", "", "test name")
+	DeclareAttachment("test", "test_count", int32(0), "test count")
+	DeclareAttachment("other", "test_name", 0, "conflicting declaration")
+
+	var changes []AttachmentChangeMessage
+	InsertAttachmentSubscription("watcher", 1, []string{"test_name", "test_count"}, func(mess *AttachmentChangeMessage) {
+		changes = append(changes, *mess)
+	})
+
+	sess := new(Session)
+	sess.attachments = make(map[string]interface{})
+
+	sess.PutAttachment("test_name", "first")
+	sess.PutAttachment("test_name", "first")
+	sess.PutAttachment("test_name", 12)
+	sess.PutAttachment("test_other", "ignored")
+
+	if value, found := sess.GetAttachmentString("test_name"); !found || value != "first" {
+		t.Errorf("Wrong test_name attachment: %v %v", value, found)
+	}
+	if len(changes) != 1 || changes[0].Previous != nil || changes[0].Value != "first" {
+		t.Fatalf("Wrong changes after PutAttachment: %v", changes)
+	}
+
+	sess.UpdateAttachments(func(attachments map[string]interface{}) {
+		attachments["test_name"] = "second"
+		attachments["test_count"] = "wrong type"
+	})
+	if _, found := sess.GetAttachmentInt("test_count"); found {
+		t.Errorf("Attachment with the wrong type was not reverted")
+	}
+	if len(changes) != 2 || changes[1].Previous != "first" || changes[1].Value != "second" {
+		t.Fatalf("Wrong changes after UpdateAttachments: %v", changes)
+	}
+
+	sess.PutAttachment("test_count", int32(5))
+	if value, found := sess.GetAttachmentInt("test_count"); !found || value != 5 {
+		t.Errorf("Wrong test_count attachment: %v %v", value, found)
+	}
+
+	sess.DeleteAttachment("test_name")
+	if len(changes) != 4 || changes[3].Name != "test_name" || changes[3].Value != nil {
+		t.Errorf("Wrong changes after DeleteAttachment: %v", changes)
+	}
+
+	values := sess.GetAttachments("test")
+	if len(values) != 1 || values["test_count"] != int32(5) {
+		t.Errorf("Wrong namespace attachments: %v", values)
+	}
+}
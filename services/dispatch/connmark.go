@@ -0,0 +1,77 @@
+package dispatch
+
+import (
+	"fmt"
+
+	"github.com/untangle/packetd/services/kernel"
+)
+
+// ConnLabelCount is the number of conntrack label bits
+const ConnLabelCount = kernel.ConnLabelBytes * 8
+
+// findKernelTuple returns the family and original direction tuple for the argumented ctid
+// from the session table or the conntrack table
+func findKernelTuple(ctid uint32) (uint8, Tuple, error) {
+	if session := findSession(ctid); session != nil {
+		return session.GetFamily(), session.GetClientSideTuple(), nil
+	}
+
+	if conntrack, found := findConntrack(ctid); found {
+		conntrack.Guardian.RLock()
+		defer conntrack.Guardian.RUnlock()
+		return conntrack.Family, conntrack.ClientSideTuple, nil
+	}
+
+	return 0, Tuple{}, fmt.Errorf("Unable to find session or conntrack for ctid %d", ctid)
+}
+
+// UpdateConnmark replaces the bits in mask of the connmark for the argumented ctid with
+// the bits from value. The ConnMark of the conntrack entry is updated with the new mark
+// right away instead of waiting for the next conntrack update event.
+func UpdateConnmark(ctid uint32, mask uint32, value uint32) error {
+	family, tuple, err := findKernelTuple(ctid)
+	if err != nil {
+		return err
+	}
+
+	mark, err := kernel.UpdateConnmark(ctid, family, tuple.Protocol, tuple.ClientAddress, tuple.ServerAddress, tuple.ClientPort, tuple.ServerPort, mask, value)
+	if err != nil {
+		return err
+	}
+
+	if conntrack, found := findConntrack(ctid); found {
+		conntrack.Guardian.Lock()
+		conntrack.ConnMark = mark
+		conntrack.Guardian.Unlock()
+	}
+	return nil
+}
+
+// UpdateConnlabels sets and clears conntrack label bits for the argumented ctid. Labels
+// that are in neither list are not changed. A label in both lists is set.
+func UpdateConnlabels(ctid uint32, set []uint, clear []uint) error {
+	var mask [kernel.ConnLabelBytes]byte
+	var value [kernel.ConnLabelBytes]byte
+
+	for _, label := range clear {
+		if label >= ConnLabelCount {
+			return fmt.Errorf("Invalid conntrack label %d", label)
+		}
+		mask[label/8] |= 1 << (label % 8)
+	}
+
+	for _, label := range set {
+		if label >= ConnLabelCount {
+			return fmt.Errorf("Invalid conntrack label %d", label)
+		}
+		mask[label/8] |= 1 << (label % 8)
+		value[label/8] |= 1 << (label % 8)
+	}
+
+	family, tuple, err := findKernelTuple(ctid)
+	if err != nil {
+		return err
+	}
+
+	return kernel.UpdateConnlabels(ctid, family, tuple.Protocol, tuple.ClientAddress, tuple.ServerAddress, tuple.ClientPort, tuple.ServerPort, mask, value)
+}
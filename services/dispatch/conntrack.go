@@ -6,6 +6,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/untangle/packetd/services/clock"
 	"github.com/untangle/packetd/services/dict"
 	"github.com/untangle/packetd/services/logger"
 )
@@ -51,8 +52,8 @@ type Conntrack struct {
 	Guardian          sync.RWMutex
 }
 
-var conntrackTable map[uint32]*Conntrack
-var conntrackTableMutex sync.RWMutex
+// conntrackTable is the global conntrack table
+var conntrackTable conntrackShardTable
 
 // String returns string representation of conntrack
 func (ct *Conntrack) String() string {
@@ -98,8 +99,8 @@ func conntrackCallback(ctid uint32, connmark uint32, family uint8, eventType uin
 			logger.Err("Old:\n")
 			logger.Err("ClientSideTuple: %v\n", conntrack.ClientSideTuple)
 			logger.Err("ServerSideTuple: %v\n", conntrack.ServerSideTuple)
-			logger.Err("CreationTime: %v ago\n", time.Now().Sub(conntrack.CreationTime))
-			logger.Err("LastActivityTime: %v ago\n", time.Now().Sub(conntrack.LastActivityTime))
+			logger.Err("CreationTime: %v ago\n", clock.Since(conntrack.CreationTime))
+			logger.Err("LastActivityTime: %v ago\n", clock.Since(conntrack.LastActivityTime))
 			logger.Err("ConntrackID: %v\n", conntrack.ConntrackID)
 			logger.Err("SessionID: %v\n", conntrack.SessionID)
 			if conntrack.Session != nil {
@@ -133,12 +134,27 @@ func conntrackCallback(ctid uint32, connmark uint32, family uint8, eventType uin
 			return
 		}
 
+		// save the final counters for the session end subscribers but leave the
+		// rates alone since the delete does not arrive on the update interval
+		conntrack.Guardian.Lock()
+		conntrack.TimestampStop = timestampStop
+		if clientBytes != 0 || serverBytes != 0 {
+			conntrack.ClientBytes = clientBytes
+			conntrack.ServerBytes = serverBytes
+			conntrack.TotalBytes = clientBytes + serverBytes
+			conntrack.ClientPackets = clientPackets
+			conntrack.ServerPackets = serverPackets
+			conntrack.TotalPackets = clientPackets + serverPackets
+		}
+		conntrack.Guardian.Unlock()
+
 		removeConntrackStale(ctid, conntrack)
 
 		// just return now, we don't pass DELETE events to subscribers
 		// DELETE events are not reliable (they can be missed)
 		// As such, for now, we don't pass them to subscribers so that plugins
-		// will not rely on DELETE events for cleanup
+		// will not rely on DELETE events for cleanup. Plugins that need to know
+		// when a session is finished should use a session end subscription.
 		return
 	} // end of handle DELETE events
 
@@ -202,7 +218,7 @@ func conntrackCallback(ctid uint32, connmark uint32, family uint8, eventType uin
 			session.SetServerInterfaceType(uint8((conntrack.ConnMark & 0x0C000000) >> 26))
 			session.SetConntrackConfirmed(true)
 			session.SetConntrackPointer(conntrack)
-			session.SetLastActivity(time.Now())
+			session.SetLastActivity(clock.Now())
 			session.AddEventCount(1)
 			conntrack.Session = session
 			conntrack.SessionID = session.GetSessionID()
@@ -226,11 +242,16 @@ func conntrackCallback(ctid uint32, connmark uint32, family uint8, eventType uin
 				clientBytes, serverBytes, clientPackets, serverPackets,
 				timestampStart, timestampStop, timeout, tcpState)
 			insertConntrack(ctid, conntrack)
+
+			// this may be a session that was saved before a restart
+			if session := restoreSession(ctid, conntrack.ClientSideTuple); session != nil {
+				linkRestoredSession(session, conntrack)
+			}
 		}
 
 		conntrack.Guardian.Lock()
 		previousUpdateTime := conntrack.LastUpdateTime
-		conntrack.LastActivityTime = time.Now()
+		conntrack.LastActivityTime = clock.Now()
 		conntrack.LastUpdateTime = conntrack.LastActivityTime
 		var secondsSinceLastUpdate float32
 		if previousUpdateTime.IsZero() {
@@ -245,7 +266,7 @@ func conntrackCallback(ctid uint32, connmark uint32, family uint8, eventType uin
 			conntrack.ConnMark = connmark
 		}
 		if conntrack.Session != nil {
-			conntrack.Session.SetLastActivity(time.Now())
+			conntrack.Session.SetLastActivity(clock.Now())
 			conntrack.Session.AddEventCount(1)
 		}
 
@@ -259,7 +280,13 @@ func conntrackCallback(ctid uint32, connmark uint32, family uint8, eventType uin
 	}
 
 	// We loop and increment the priority until all subscriptions have been called
-	sublist := conntrackSubList
+	conntrackSubMutex.Lock()
+	sublist := make(map[string]SubscriptionHolder)
+	for key, val := range conntrackSubList {
+		sublist[key] = val
+	}
+	conntrackSubMutex.Unlock()
+
 	subtotal := len(sublist)
 	subcount := 0
 	priority := 0
@@ -267,6 +294,7 @@ func conntrackCallback(ctid uint32, connmark uint32, family uint8, eventType uin
 	for subcount != subtotal {
 		timeoutTimer := time.NewTimer(maxSubscriberTime)
 		var wg sync.WaitGroup
+		var calls []*subscriberCall
 
 		// Call all of the subscribed handlers for the current priority
 		for key, val := range sublist {
@@ -274,12 +302,14 @@ func conntrackCallback(ctid uint32, connmark uint32, family uint8, eventType uin
 				continue
 			}
 			logger.Debug("Calling conntrack APP:%s PRIORITY:%d\n", key, priority)
+			call := &subscriberCall{owner: key}
+			calls = append(calls, call)
 			wg.Add(1)
-			go func(val SubscriptionHolder) {
-				val.ConntrackFunc(int(eventType), conntrack)
+			go func(val SubscriptionHolder, call *subscriberCall) {
+				callSubscriber(MetricsConntrack, call, func() { val.ConntrackFunc(int(eventType), conntrack) })
 				wg.Done()
 				logger.Debug("Finished conntrack APP:%s PRIORITY:%d\n", val.Owner, val.Priority)
-			}(val)
+			}(val, call)
 			subcount++
 		}
 
@@ -292,7 +322,7 @@ func conntrackCallback(ctid uint32, connmark uint32, family uint8, eventType uin
 		}()
 		select {
 		case <-timeoutTimer.C:
-			logger.Crit("%OC|Timeout while waiting for conntrack subcriber:%s\n", "timeout_conntrack", 0)
+			logger.Crit("%OC|Timeout while waiting for conntrack subscribers:%v\n", "timeout_conntrack", 0, recordTimeouts(MetricsConntrack, calls))
 		case <-c:
 			timeoutTimer.Stop()
 		}
@@ -308,29 +338,20 @@ func conntrackCallback(ctid uint32, connmark uint32, family uint8, eventType uin
 
 // findConntrack finds an entry in the conntrack table
 func findConntrack(ctid uint32) (*Conntrack, bool) {
-	conntrackTableMutex.RLock()
-	entry, status := conntrackTable[ctid]
-	conntrackTableMutex.RUnlock()
-	return entry, status
+	entry := conntrackTable.find(ctid)
+	return entry, entry != nil
 }
 
 // insertConntrack adds an entry to the conntrack table
 func insertConntrack(ctid uint32, entry *Conntrack) {
 	logger.Trace("Insert conntrack entry %d\n", ctid)
-	conntrackTableMutex.Lock()
-	if conntrackTable[ctid] != nil {
-		delete(conntrackTable, ctid)
-	}
-	conntrackTable[ctid] = entry
-	conntrackTableMutex.Unlock()
+	conntrackTable.insert(ctid, entry)
 }
 
 // removeConntrack removes an entry from the conntrack table
 func removeConntrack(ctid uint32) {
 	logger.Trace("Remove conntrack entry %d\n", ctid)
-	conntrackTableMutex.Lock()
-	delete(conntrackTable, ctid)
-	conntrackTableMutex.Unlock()
+	conntrackTable.remove(ctid)
 }
 
 // removeConntrackStale remove an entry from the conntrackTable that is obsolete/dead/invalid
@@ -347,14 +368,22 @@ func removeConntrackStale(ctid uint32, conntrack *Conntrack) {
 }
 
 // cleanConntrackTable cleans the conntrack table by removing stale entries
+// Each shard is cleaned separately so only a small part of the table is locked at a time
 func cleanConntrackTable() {
-	conntrackTableMutex.Lock()
-	defer conntrackTableMutex.Unlock()
+	for x := range conntrackTable.shards {
+		cleanConntrackShard(&conntrackTable.shards[x])
+	}
+}
 
-	for ctid, conntrack := range conntrackTable {
+// cleanConntrackShard removes the stale entries from a conntrack table shard
+func cleanConntrackShard(shard *conntrackShard) {
+	var stale []*Conntrack
+
+	shard.locker.Lock()
+	for ctid, conntrack := range shard.table {
 		conntrack.Guardian.RLock()
 		// We use 10000 seconds because 7440 is the established idle tcp timeout default
-		if time.Now().Sub(conntrack.LastActivityTime) > 10000*time.Second {
+		if clock.Since(conntrack.LastActivityTime) > 10000*time.Second {
 			// In theory this should never happen,
 			// entries should be removed by DELETE events
 			// otherwise they should be getting UPDATE events and the LastActivityTime
@@ -363,15 +392,21 @@ func cleanConntrackTable() {
 			// some constraint has failed
 			// In reality sometimes we miss DELETE events (if the buffer fills)
 			// so sometimes we do see this happen in the real world under heavy load
-			logger.Warn("Removing stale (%v) conntrack entry [%d] %v\n", time.Now().Sub(conntrack.LastActivityTime), ctid, conntrack.ClientSideTuple)
-			if conntrack != nil && conntrack.Session != nil {
-				conntrack.Session.flushDict()
-				conntrack.Session.removeFromSessionTable()
-			}
-			delete(conntrackTable, ctid)
+			logger.Warn("Removing stale (%v) conntrack entry [%d] %v\n", clock.Since(conntrack.LastActivityTime), ctid, conntrack.ClientSideTuple)
+			delete(shard.table, ctid)
+			stale = append(stale, conntrack)
 		}
 		conntrack.Guardian.RUnlock()
 	}
+	shard.locker.Unlock()
+
+	// the sessions are cleaned up after we release the shard lock
+	for _, conntrack := range stale {
+		if conntrack.Session != nil {
+			conntrack.Session.flushDict()
+			conntrack.Session.removeFromSessionTable()
+		}
+	}
 }
 
 // createConntrack creates a new conntrack entry
@@ -383,9 +418,9 @@ func createConntrack(ctid uint32, connmark uint32, family uint8, eventType uint8
 	conntrack := new(Conntrack)
 	conntrack.ConntrackID = ctid
 	conntrack.ConnMark = connmark
-	conntrack.CreationTime = time.Now()
+	conntrack.CreationTime = clock.Now()
 	conntrack.Family = family
-	conntrack.LastActivityTime = time.Now()
+	conntrack.LastActivityTime = clock.Now()
 	conntrack.EventCount = 1
 	conntrack.ClientSideTuple.Protocol = protocol
 	conntrack.ClientSideTuple.ClientAddress = dupIP(client)
@@ -0,0 +1,258 @@
+package dispatch
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/untangle/packetd/services/clock"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
+)
+
+// defragTimeout is how long we wait for all of the fragments of a packet
+const defragTimeout = 30 * time.Second
+
+// defragMemoryLimit is the maximum number of bytes we hold for all incomplete packets
+const defragMemoryLimit = 4 * 1024 * 1024
+
+// defragFragmentLimit is the maximum number of fragments we accept for a single packet
+const defragFragmentLimit = 64
+
+// defragMaxPacket is the largest packet we can reassemble
+const defragMaxPacket = 65535
+
+// fragmentKey identifies the fragments that belong to the same packet
+type fragmentKey struct {
+	family   uint8
+	protocol uint8
+	id       uint32
+	source   [16]byte
+	dest     [16]byte
+}
+
+// fragmentPart holds the payload of a single fragment
+type fragmentPart struct {
+	offset int
+	data   []byte
+}
+
+// fragmentList holds the fragments received for a packet
+type fragmentList struct {
+	created time.Time
+	first   gopacket.Packet
+	mark    uint32
+	parts   []fragmentPart
+	total   int
+	size    int
+}
+
+// defragEnabled controls the defragmentation of packets before calling subscribers
+var defragEnabled bool
+
+var fragmentTable = make(map[fragmentKey]*fragmentList)
+var fragmentMemory int
+var fragmentSweep time.Time
+var fragmentMutex sync.Mutex
+
+// SetDefragmentation enables or disables the reassembly of fragmented packets. When enabled
+// the fragments of a packet are held until the last one arrives and then the subscribers
+// are called with the reassembled packet. Every fragment still gets a verdict and the
+// verdict for the reassembled packet is applied to the fragment that completed it.
+// Live traffic is normally reassembled by nf_defrag before the conntrack hooks so our
+// queue only sees fragments for traffic that skips conntrack defragmentation, such as
+// a queue rule with a priority before nf_defrag, and in the playback of pcap files.
+func SetDefragmentation(enabled bool) {
+	defragEnabled = enabled
+}
+
+// defragmentPacket returns the packet unchanged if it is not a fragment, nil if it is
+// a fragment but we don't have all of the others yet, or the reassembled packet along
+// with the mark of the first fragment since that is the one that starts the session
+func defragmentPacket(packet gopacket.Packet, mark uint32) (gopacket.Packet, uint32) {
+	var key fragmentKey
+	var offset int
+	var more bool
+	var payload []byte
+
+	if ip4, ok := packet.NetworkLayer().(*layers.IPv4); ok {
+		if ip4.Flags&layers.IPv4MoreFragments == 0 && ip4.FragOffset == 0 {
+			return packet, mark
+		}
+		key.family = 4
+		key.protocol = uint8(ip4.Protocol)
+		key.id = uint32(ip4.Id)
+		copy(key.source[:], ip4.SrcIP.To16())
+		copy(key.dest[:], ip4.DstIP.To16())
+		offset = int(ip4.FragOffset) * 8
+		more = (ip4.Flags&layers.IPv4MoreFragments != 0)
+		payload = ip4.Payload
+	} else if ip6, ok := packet.NetworkLayer().(*layers.IPv6); ok {
+		layer := packet.Layer(layers.LayerTypeIPv6Fragment)
+		if layer == nil {
+			return packet, mark
+		}
+		frag := layer.(*layers.IPv6Fragment)
+		key.family = 6
+		key.protocol = uint8(frag.NextHeader)
+		key.id = frag.Identification
+		copy(key.source[:], ip6.SrcIP.To16())
+		copy(key.dest[:], ip6.DstIP.To16())
+		offset = int(frag.FragmentOffset) * 8
+		more = frag.MoreFragments
+		payload = frag.Payload
+	} else {
+		return packet, mark
+	}
+
+	fragmentMutex.Lock()
+	defer fragmentMutex.Unlock()
+
+	if clock.Since(fragmentSweep) > time.Second {
+		expireFragments()
+	}
+
+	list := fragmentTable[key]
+	if list == nil {
+		list = &fragmentList{created: clock.Now(), total: -1}
+		fragmentTable[key] = list
+	}
+
+	if offset+len(payload) > defragMaxPacket || len(list.parts) >= defragFragmentLimit || fragmentMemory+len(payload) > defragMemoryLimit {
+		logger.Debug("%OC|Discarding fragments for %v\n", "defrag_discarded", 0, key.id)
+		removeFragments(key, list)
+		return nil, 0
+	}
+
+	// the packet data belongs to the kernel so we keep a copy of each fragment
+	part := fragmentPart{offset: offset, data: append([]byte(nil), payload...)}
+	list.parts = append(list.parts, part)
+	list.size += len(part.data)
+	fragmentMemory += len(part.data)
+
+	if offset == 0 {
+		list.first = gopacket.NewPacket(append([]byte(nil), packet.Data()...), packet.Layers()[0].LayerType(), gopacket.DecodeOptions{Lazy: true})
+		list.mark = mark
+	}
+	if !more {
+		list.total = offset + len(payload)
+	}
+
+	data := list.assemble()
+	if data == nil {
+		return nil, 0
+	}
+
+	removeFragments(key, list)
+
+	whole, err := rebuildPacket(list.first, data)
+	if err != nil {
+		logger.Warn("%OC|Unable to rebuild fragmented packet: %v\n", "defrag_failed", 0, err)
+		return nil, 0
+	}
+	overseer.AddCounter("defrag_packets", 1)
+	return whole, list.mark
+}
+
+// assemble returns the reassembled payload or nil if we don't have all of the fragments
+func (list *fragmentList) assemble() []byte {
+	if list.total < 0 || list.first == nil {
+		return nil
+	}
+
+	sort.Slice(list.parts, func(i, j int) bool { return list.parts[i].offset < list.parts[j].offset })
+
+	// make sure there are no holes
+	covered := 0
+	for _, part := range list.parts {
+		if part.offset > covered {
+			return nil
+		}
+		if part.offset+len(part.data) > covered {
+			covered = part.offset + len(part.data)
+		}
+	}
+	if covered < list.total {
+		return nil
+	}
+
+	// overlapping data is taken from the first fragment that covered it
+	data := make([]byte, list.total)
+	covered = 0
+	for _, part := range list.parts {
+		end := part.offset + len(part.data)
+		if end > list.total {
+			end = list.total
+		}
+		if end <= covered {
+			continue
+		}
+		copy(data[covered:end], part.data[covered-part.offset:end-part.offset])
+		covered = end
+	}
+	return data
+}
+
+// rebuildPacket creates an unfragmented packet from the headers of the first fragment
+// and the reassembled payload
+func rebuildPacket(first gopacket.Packet, payload []byte) (gopacket.Packet, error) {
+	var network gopacket.SerializableLayer
+
+	if ip4, ok := first.NetworkLayer().(*layers.IPv4); ok {
+		header := *ip4
+		header.Flags &^= layers.IPv4MoreFragments
+		header.FragOffset = 0
+		network = &header
+	} else if ip6, ok := first.NetworkLayer().(*layers.IPv6); ok {
+		frag := first.Layer(layers.LayerTypeIPv6Fragment).(*layers.IPv6Fragment)
+		header := *ip6
+		header.NextHeader = frag.NextHeader
+		header.HopByHop = nil
+		network = &header
+	}
+
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	err := gopacket.SerializeLayers(buffer, options, network, gopacket.Payload(payload))
+	if err != nil {
+		return nil, err
+	}
+	return decodePacket(buffer.Bytes()), nil
+}
+
+// removeFragments removes a fragment list from the table
+func removeFragments(key fragmentKey, list *fragmentList) {
+	fragmentMemory -= list.size
+	delete(fragmentTable, key)
+}
+
+// expireFragments removes the fragments of packets that didn't arrive in time
+// The caller must hold the fragmentMutex
+func expireFragments() {
+	fragmentSweep = clock.Now()
+	for key, list := range fragmentTable {
+		if clock.Since(list.created) > defragTimeout {
+			logger.Debug("%OC|Expired fragments for %v\n", "defrag_expired", 0, key.id)
+			removeFragments(key, list)
+		}
+	}
+}
+
+// resetFragmentTable discards all of the fragments waiting to be reassembled
+func resetFragmentTable() {
+	fragmentMutex.Lock()
+	for key, list := range fragmentTable {
+		removeFragments(key, list)
+	}
+	fragmentSweep = time.Time{}
+	fragmentMutex.Unlock()
+}
+
+// cleanFragmentTable removes expired fragments
+func cleanFragmentTable() {
+	fragmentMutex.Lock()
+	expireFragments()
+	fragmentMutex.Unlock()
+}
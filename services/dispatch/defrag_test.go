@@ -0,0 +1,123 @@
+package dispatch
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/untangle/packetd/services/overseer"
+)
+
+// fragmentSize is the payload size of the test fragments
+const fragmentSize = 1000
+
+// createFragments creates an IPv4 or IPv6 UDP packet and splits it into fragments
+func createFragments(t *testing.T, family int, payload []byte) [][]byte {
+	var list [][]byte
+
+	udp := &layers.UDP{SrcPort: 5353, DstPort: 53}
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+
+	if family == 4 {
+		ip4 := &layers.IPv4{Version: 4, TTL: 64, Id: 1234, Protocol: layers.IPProtocolUDP, SrcIP: net.IP{192, 168, 1, 100}, DstIP: net.IP{8, 8, 8, 8}}
+		udp.SetNetworkLayerForChecksum(ip4)
+		gopacket.SerializeLayers(buffer, options, udp, gopacket.Payload(payload))
+		data := buffer.Bytes()
+		for offset := 0; offset < len(data); offset += fragmentSize {
+			end := offset + fragmentSize
+			header := *ip4
+			header.FragOffset = uint16(offset / 8)
+			if end < len(data) {
+				header.Flags = layers.IPv4MoreFragments
+			} else {
+				end = len(data)
+			}
+			frag := gopacket.NewSerializeBuffer()
+			if err := gopacket.SerializeLayers(frag, options, &header, gopacket.Payload(data[offset:end])); err != nil {
+				t.Fatal(err)
+			}
+			list = append(list, append([]byte(nil), frag.Bytes()...))
+		}
+		return list
+	}
+
+	ip6 := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolIPv6Fragment, SrcIP: net.ParseIP("2001:db8::1"), DstIP: net.ParseIP("2001:db8::2")}
+	udp.SetNetworkLayerForChecksum(ip6)
+	gopacket.SerializeLayers(buffer, options, udp, gopacket.Payload(payload))
+	data := buffer.Bytes()
+	for offset := 0; offset < len(data); offset += fragmentSize {
+		end := offset + fragmentSize
+		more := true
+		if end >= len(data) {
+			end = len(data)
+			more = false
+		}
+		header := make([]byte, 8)
+		header[0] = byte(layers.IPProtocolUDP)
+		header[2] = byte((offset >> 8) & 0xFF)
+		header[3] = byte(offset & 0xF8)
+		if more {
+			header[3] |= 1
+		}
+		header[7] = 99
+		frag := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(frag, options, ip6, gopacket.Payload(append(header, data[offset:end]...))); err != nil {
+			t.Fatal(err)
+		}
+		list = append(list, append([]byte(nil), frag.Bytes()...))
+	}
+	return list
+}
+
+// TestDefragment reassembles fragments that arrive out of order
+func TestDefragment(t *testing.T) {
+	overseer.Startup()
+
+	payload := make([]byte, 2500)
+	for x := range payload {
+		payload[x] = byte(x)
+	}
+
+	for _, family := range []int{4, 6} {
+		fragments := createFragments(t, family, payload)
+		if len(fragments) != 3 {
+			t.Fatalf("Expected 3 fragments but got %d", len(fragments))
+		}
+
+		// the first fragment carries the new session mark so the subscribers must see it with the reassembled packet
+		var whole gopacket.Packet
+		var mark uint32
+		for index, item := range []int{2, 0, 1} {
+			var fragmentMark uint32
+			if item == 0 {
+				fragmentMark = 0x10000000
+			}
+			whole, mark = defragmentPacket(decodePacket(fragments[item]), fragmentMark)
+			if index < 2 && whole != nil {
+				t.Fatalf("IPv%d packet reassembled before all fragments arrived", family)
+			}
+		}
+		if whole == nil {
+			t.Fatalf("IPv%d packet not reassembled", family)
+		}
+		if mark != 0x10000000 {
+			t.Errorf("IPv%d reassembled packet has mark 0x%08x instead of the first fragment mark", family, mark)
+		}
+
+		var mess NfqueueMessage
+		mess.Packet = whole
+		if !decodeNfqueueMessage(&mess) || mess.UDPLayer == nil {
+			t.Fatalf("IPv%d reassembled packet has no UDP layer", family)
+		}
+		if !bytes.Equal(mess.UDPLayer.Payload, payload) {
+			t.Errorf("IPv%d reassembled payload does not match", family)
+		}
+	}
+
+	if len(fragmentTable) != 0 || fragmentMemory != 0 {
+		t.Errorf("Fragment table not empty after reassembly: %d %d", len(fragmentTable), fragmentMemory)
+	}
+}
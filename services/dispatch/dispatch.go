@@ -9,20 +9,29 @@ package dispatch
 
 import (
 	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/untangle/packetd/services/clock"
 	"github.com/untangle/packetd/services/kernel"
 	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/overseer"
 )
 
 // SubscriptionHolder stores the details of a data callback subscription
 type SubscriptionHolder struct {
-	Owner         string
-	Priority      int
-	NfqueueFunc   NfqueueHandlerFunction
-	ConntrackFunc ConntrackHandlerFunction
-	NetloggerFunc NetloggerHandlerFunction
+	Owner            string
+	Priority         int
+	NfqueueFilter    *NfqueueFilter
+	NfqueueFunc      NfqueueHandlerFunction
+	ConntrackFunc    ConntrackHandlerFunction
+	NetloggerFunc    NetloggerHandlerFunction
+	SessionStartFunc SessionStartHandlerFunction
+	SessionEndFunc   SessionEndHandlerFunction
+	AttachmentFunc   AttachmentHandlerFunction
+	AttachmentNames  []string
 }
 
 // maxSubscriberTime sets the maximum amount time a subscriber is allowed to process a packet
@@ -77,15 +86,25 @@ const RevDNSPriority = 2
 // SniPriority ...
 const SniPriority = 2
 
+// EventStreamPriority ... We want this to be called after all the plugins
+// so the session events include everything they attached to the session
+const EventStreamPriority = 5
+
 // list of subscribers to each of the three data sources
 var nfqueueSubList map[string]SubscriptionHolder
 var conntrackSubList map[string]SubscriptionHolder
 var netloggerSubList map[string]SubscriptionHolder
+var sessionStartSubList map[string]SubscriptionHolder
+var sessionEndSubList map[string]SubscriptionHolder
+var attachmentSubList map[string]SubscriptionHolder
 
 // mutexes to protect each of the subscription lists
 var nfqueueSubMutex sync.Mutex
 var conntrackSubMutex sync.Mutex
 var netloggerSubMutex sync.Mutex
+var sessionStartSubMutex sync.Mutex
+var sessionEndSubMutex sync.Mutex
+var attachmentSubMutex sync.Mutex
 
 // maps to hold the netfilter and conntrack cleanup lists returned from warehouse playback
 var nfCleanupList map[uint32]bool
@@ -103,13 +122,19 @@ func Startup(ctInterval int) {
 	conntrackIntervalSeconds = ctInterval
 
 	// create the session, conntrack, and certificate tables
-	sessionTable = make(map[uint32]*Session)
-	conntrackTable = make(map[uint32]*Conntrack)
+	sessionTable.initialize()
+	conntrackTable.initialize()
 
-	// create the nfqueue, conntrack, and netlogger subscription tables
+	// create the nfqueue, conntrack, netlogger, session start, and session end subscription tables
 	nfqueueSubList = make(map[string]SubscriptionHolder)
 	conntrackSubList = make(map[string]SubscriptionHolder)
 	netloggerSubList = make(map[string]SubscriptionHolder)
+	sessionStartSubList = make(map[string]SubscriptionHolder)
+	sessionEndSubList = make(map[string]SubscriptionHolder)
+	attachmentSubList = make(map[string]SubscriptionHolder)
+
+	DeclareAttachment("dispatch", KilledByAttachment, "", "who killed the session")
+	DeclareAttachment("dispatch", BypassAttachment, false, "packetd no longer queues the session traffic")
 
 	// initialize the sessionIndex counter
 	// highest 16 bits are zero
@@ -117,18 +142,29 @@ func Startup(ctInterval int) {
 	// lowest  16 bits are zero
 	// this means that sessionIndex should be ever increasing despite restarts
 	// (unless there are more than 16 bits or 65k sessions per sec on average)
-	sessionIndex = ((int64(time.Now().Unix()) & 0xFFFFFFFF) << 16)
+	resetSessionIndex(clock.Now())
+
+	// load the sessions saved before the last shutdown
+	loadSessions()
+
+	// start the workers that call the nfqueue subscribers
+	startSubscriberWorkers(subscriberWorkerCount)
 
 	kernel.RegisterConntrackCallback(conntrackCallback)
 	kernel.RegisterNfqueueCallback(nfqueueCallback)
 	kernel.RegisterNetloggerCallback(netloggerCallback)
 
+	// add the subscriber metrics to the overseer report
+	overseer.RegisterReport("dispatch", GenerateMetricsReport)
+
 	// start cleaner tasks to clean tables
 	go cleanerTask()
 }
 
 // Shutdown stops the event handling service
 func Shutdown() {
+	overseer.UnregisterReport("dispatch")
+
 	// Send shutdown signal to periodicTask and wait for it to return
 	shutdownCleanerTask <- true
 	select {
@@ -136,6 +172,8 @@ func Shutdown() {
 	case <-time.After(10 * time.Second):
 		logger.Err("Failed to properly shutdown cleanerTask\n")
 	}
+
+	saveSessions()
 }
 
 // cleanerTask is a periodic task to cleanup conntrack and session tables
@@ -147,11 +185,20 @@ func cleanerTask() {
 		case <-shutdownCleanerTask:
 			shutdownCleanerTask <- true
 			return
-		case <-time.After(60 * time.Second):
+		case <-clock.After(60 * time.Second):
 			counter++
 			logger.Debug("Calling cleaner task %d\n", counter)
 			cleanSessionTable()
 			cleanConntrackTable()
+			cleanFragmentTable()
+
+			// the conntrack dump has matched all the saved sessions that still exist by now
+			if counter == 1 {
+				discardRestoredSessions()
+			}
+			if counter%sessionSaveInterval == 0 {
+				saveSessions()
+			}
 		}
 	}
 }
@@ -164,12 +211,14 @@ func dupIP(ip net.IP) net.IP {
 }
 
 // InsertNfqueueSubscription adds a subscription for receiving nfqueue messages
-func InsertNfqueueSubscription(owner string, priority int, function NfqueueHandlerFunction) {
+// The filter limits the traffic passed to the subscriber or nil to receive everything
+func InsertNfqueueSubscription(owner string, priority int, filter *NfqueueFilter, function NfqueueHandlerFunction) {
 	var holder SubscriptionHolder
 	logger.Info("Adding NFQueue Event Subscription (%s, %d)\n", owner, priority)
 
 	holder.Owner = owner
 	holder.Priority = priority
+	holder.NfqueueFilter = filter
 	holder.NfqueueFunc = function
 	nfqueueSubMutex.Lock()
 	_, existing := nfqueueSubList[owner]
@@ -186,9 +235,11 @@ func AttachNfqueueSubscriptions(session *Session) {
 	session.subLocker.Lock()
 	session.subscriptions = make(map[string]SubscriptionHolder)
 
+	nfqueueSubMutex.Lock()
 	for index, element := range nfqueueSubList {
 		session.subscriptions[index] = element
 	}
+	nfqueueSubMutex.Unlock()
 	session.subLocker.Unlock()
 }
 
@@ -231,13 +282,123 @@ func InsertNetloggerSubscription(owner string, priority int, function NetloggerH
 	netloggerSubMutex.Unlock()
 }
 
+// InsertSessionStartSubscription adds a subscription for receiving session start messages
+// The handlers are called before the first packet of the session gets a verdict so they must not block
+func InsertSessionStartSubscription(owner string, priority int, function SessionStartHandlerFunction) {
+	var holder SubscriptionHolder
+	logger.Info("Adding Session Start Subscription (%s, %d)\n", owner, priority)
+
+	holder.Owner = owner
+	holder.Priority = priority
+	holder.SessionStartFunc = function
+	sessionStartSubMutex.Lock()
+	sessionStartSubList[owner] = holder
+	sessionStartSubMutex.Unlock()
+}
+
+// InsertSessionEndSubscription adds a subscription for receiving session end messages
+func InsertSessionEndSubscription(owner string, priority int, function SessionEndHandlerFunction) {
+	var holder SubscriptionHolder
+	logger.Info("Adding Session End Subscription (%s, %d)\n", owner, priority)
+
+	holder.Owner = owner
+	holder.Priority = priority
+	holder.SessionEndFunc = function
+	sessionEndSubMutex.Lock()
+	sessionEndSubList[owner] = holder
+	sessionEndSubMutex.Unlock()
+}
+
+// InsertAttachmentSubscription adds a subscription for receiving attachment change messages
+// for the argumented attachment names, or for all attachments if the list is empty
+func InsertAttachmentSubscription(owner string, priority int, names []string, function AttachmentHandlerFunction) {
+	var holder SubscriptionHolder
+	logger.Info("Adding Attachment Subscription (%s, %d, %v)\n", owner, priority, names)
+
+	holder.Owner = owner
+	holder.Priority = priority
+	holder.AttachmentNames = names
+	holder.AttachmentFunc = function
+	attachmentSubMutex.Lock()
+	attachmentSubList[owner] = holder
+	attachmentSubMutex.Unlock()
+}
+
+// RemoveSubscriptions removes all subscriptions for the argumented owner, including
+// those registered with an owner_suffix name, and releases the owner from all active sessions
+func RemoveSubscriptions(owner string) {
+	var removed []string
+
+	logger.Info("Removing Event Subscriptions (%s)\n", owner)
+
+	nfqueueSubMutex.Lock()
+	removed = removeOwnerSubscriptions(nfqueueSubList, owner)
+	nfqueueSubMutex.Unlock()
+
+	conntrackSubMutex.Lock()
+	removeOwnerSubscriptions(conntrackSubList, owner)
+	conntrackSubMutex.Unlock()
+
+	netloggerSubMutex.Lock()
+	removeOwnerSubscriptions(netloggerSubList, owner)
+	netloggerSubMutex.Unlock()
+
+	sessionStartSubMutex.Lock()
+	removeOwnerSubscriptions(sessionStartSubList, owner)
+	sessionStartSubMutex.Unlock()
+
+	sessionEndSubMutex.Lock()
+	removeOwnerSubscriptions(sessionEndSubList, owner)
+	sessionEndSubMutex.Unlock()
+
+	attachmentSubMutex.Lock()
+	removeOwnerSubscriptions(attachmentSubList, owner)
+	attachmentSubMutex.Unlock()
+
+	if len(removed) == 0 {
+		return
+	}
+
+	for _, session := range sessionTable.list() {
+		for _, name := range removed {
+			ReleaseSession(session, name)
+		}
+	}
+}
+
+// removeOwnerSubscriptions removes the owner subscriptions from the argumented list
+// and returns the names that were removed. The caller must hold the list mutex.
+func removeOwnerSubscriptions(sublist map[string]SubscriptionHolder, owner string) []string {
+	var removed []string
+
+	for name := range sublist {
+		if name == owner || strings.HasPrefix(name, owner+"_") {
+			delete(sublist, name)
+			removed = append(removed, name)
+		}
+	}
+	return removed
+}
+
+// resetSessionIndex seeds the session ID counter from the argumented time
+func resetSessionIndex(now time.Time) {
+	atomic.StoreInt64(&sessionIndex, (now.Unix()&0xFFFFFFFF)<<16)
+}
+
 // HandleWarehousePlayback spins up a goroutine that will playback a warehouse capture
 // file, wait until the playback is finished, and save the netfilter and conntrack
-// cleanup lists that are returned from the playback function
+// cleanup lists that are returned from the playback function. With the virtual clock
+// the sessions and fragments left by the previous playback are removed and the session
+// IDs start over from the clock epoch so replaying a capture gives the same results.
 func HandleWarehousePlayback() {
 	go func() {
 		cleanupMutex.Lock()
 		defer cleanupMutex.Unlock()
+		if clock.IsVirtual() {
+			cleanupPlayback()
+			resetFragmentTable()
+			resetSessionIndex(clock.Epoch)
+		}
 		nfCleanupList = make(map[uint32]bool)
 		ctCleanupList = make(map[uint32]bool)
 		kernel.WarehousePlaybackFile(nfCleanupList, ctCleanupList)
@@ -249,7 +410,12 @@ func HandleWarehousePlayback() {
 func HandleWarehouseCleanup() {
 	cleanupMutex.Lock()
 	defer cleanupMutex.Unlock()
+	cleanupPlayback()
+}
 
+// cleanupPlayback removes the sessions and conntrack entries in the cleanup lists
+// The caller must hold the cleanupMutex
+func cleanupPlayback() {
 	if nfCleanupList != nil {
 		for ctid := range nfCleanupList {
 			logger.Debug("Removing playback session for %d\n", ctid)
@@ -275,13 +441,5 @@ func HandleWarehouseCleanup() {
 // Note: this returns a copy of the table, but with the same pointers
 // do not modify the values in the conntrack entries
 func GetConntrackTable() map[uint32]*Conntrack {
-	newMap := make(map[uint32]*Conntrack)
-
-	conntrackTableMutex.RLock()
-	defer conntrackTableMutex.RUnlock()
-
-	for k, v := range conntrackTable {
-		newMap[k] = v
-	}
-	return newMap
+	return conntrackTable.copy()
 }
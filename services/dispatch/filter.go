@@ -0,0 +1,84 @@
+package dispatch
+
+// DirectionAny matches packets in both directions
+const DirectionAny = 0
+
+// DirectionClientToServer matches only packets from the client to the server
+const DirectionClientToServer = 1
+
+// DirectionServerToClient matches only packets from the server to the client
+const DirectionServerToClient = 2
+
+// NfqueueFilter describes the traffic an nfqueue subscriber wants to receive. The filter
+// is checked before the subscriber is called. Sessions that can never match the family,
+// protocol, or port criteria are released on behalf of the subscriber, as are sessions
+// that are not new when NewSessionOnly is set. Packets that don't match the Direction
+// are skipped without releasing the session. Empty fields match everything. Subscribers
+// that set ReassembleStream get the reassembled TCP data for the session in the Stream
+// of each message until they release the session.
+type NfqueueFilter struct {
+	Family             uint8 // syscall.AF_INET or syscall.AF_INET6 like Session.GetFamily
+	Protocols          []uint8
+	ServerPorts        []uint16
+	ExcludeServerPorts []uint16
+	Direction          int
+	NewSessionOnly     bool
+	ReassembleStream   bool
+}
+
+// checkFilter returns true if the subscriber should be called for the argumented packet
+// and true for release if the subscriber will never be interested in the session
+func (filter *NfqueueFilter) checkFilter(session *Session, mess NfqueueMessage, newSession bool) (match bool, release bool) {
+	if filter.NewSessionOnly && !newSession {
+		return false, true
+	}
+
+	if filter.Family != 0 && filter.Family != session.GetFamily() {
+		return false, true
+	}
+
+	tuple := session.GetClientSideTuple()
+
+	if len(filter.Protocols) != 0 && !findProtocol(filter.Protocols, tuple.Protocol) {
+		return false, true
+	}
+
+	if len(filter.ServerPorts) != 0 && !findPort(filter.ServerPorts, tuple.ServerPort) {
+		return false, true
+	}
+
+	if findPort(filter.ExcludeServerPorts, tuple.ServerPort) {
+		return false, true
+	}
+
+	if filter.Direction == DirectionClientToServer && !mess.ClientToServer {
+		return false, false
+	}
+
+	if filter.Direction == DirectionServerToClient && mess.ClientToServer {
+		return false, false
+	}
+
+	// when only interested in new sessions the subscriber is released after the first packet
+	return true, filter.NewSessionOnly
+}
+
+// findProtocol returns true if the protocol is in the list
+func findProtocol(list []uint8, protocol uint8) bool {
+	for _, item := range list {
+		if item == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// findPort returns true if the port is in the list
+func findPort(list []uint16, port uint16) bool {
+	for _, item := range list {
+		if item == port {
+			return true
+		}
+	}
+	return false
+}
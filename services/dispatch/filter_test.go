@@ -0,0 +1,48 @@
+package dispatch
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+// TestCheckFilter checks the match and release decisions for the nfqueue subscriber filters
+func TestCheckFilter(t *testing.T) {
+	sess := new(Session)
+	sess.SetFamily(syscall.AF_INET)
+	sess.SetClientSideTuple(Tuple{Protocol: 6, ClientAddress: net.ParseIP("192.168.1.100"), ClientPort: 40000, ServerAddress: net.ParseIP("10.1.1.1"), ServerPort: 443})
+
+	tests := []struct {
+		filter         NfqueueFilter
+		clientToServer bool
+		newSession     bool
+		match          bool
+		release        bool
+	}{
+		{NfqueueFilter{}, true, true, true, false},
+		{NfqueueFilter{}, false, false, true, false},
+		{NfqueueFilter{NewSessionOnly: true}, true, true, true, true},
+		{NfqueueFilter{NewSessionOnly: true}, true, false, false, true},
+		{NfqueueFilter{Family: syscall.AF_INET}, true, false, true, false},
+		{NfqueueFilter{Family: syscall.AF_INET6}, true, false, false, true},
+		{NfqueueFilter{Protocols: []uint8{17, 6}}, true, false, true, false},
+		{NfqueueFilter{Protocols: []uint8{17}}, true, false, false, true},
+		{NfqueueFilter{ServerPorts: []uint16{80, 443}}, true, false, true, false},
+		{NfqueueFilter{ServerPorts: []uint16{80}}, true, false, false, true},
+		{NfqueueFilter{ExcludeServerPorts: []uint16{443}}, true, false, false, true},
+		{NfqueueFilter{ExcludeServerPorts: []uint16{80}}, true, false, true, false},
+		{NfqueueFilter{Direction: DirectionClientToServer}, true, false, true, false},
+		{NfqueueFilter{Direction: DirectionClientToServer}, false, false, false, false},
+		{NfqueueFilter{Direction: DirectionServerToClient}, false, false, true, false},
+		{NfqueueFilter{Direction: DirectionServerToClient}, true, false, false, false},
+		{NfqueueFilter{Direction: DirectionServerToClient, NewSessionOnly: true}, true, true, false, false},
+		{NfqueueFilter{Protocols: []uint8{6}, ServerPorts: []uint16{443}, Direction: DirectionClientToServer}, true, true, true, false},
+	}
+
+	for _, test := range tests {
+		match, release := test.filter.checkFilter(sess, NfqueueMessage{ClientToServer: test.clientToServer}, test.newSession)
+		if match != test.match || release != test.release {
+			t.Errorf("Filter %+v client:%v new:%v returned %v %v", test.filter, test.clientToServer, test.newSession, match, release)
+		}
+	}
+}
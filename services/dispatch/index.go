@@ -0,0 +1,159 @@
+package dispatch
+
+import (
+	"sync"
+)
+
+// tupleIndexShard is a single shard of a session tuple index
+type tupleIndexShard struct {
+	table  map[string]*Session
+	locker sync.RWMutex
+}
+
+// tupleIndex is a secondary session table index keyed by the tuple string
+type tupleIndex struct {
+	shards [tableShardCount]tupleIndexShard
+}
+
+// sessionIDShard is a single shard of the session ID index
+type sessionIDShard struct {
+	table  map[int64]*Session
+	locker sync.RWMutex
+}
+
+// sessionIDIndex is a secondary session table index keyed by session ID
+type sessionIDIndex struct {
+	shards [tableShardCount]sessionIDShard
+}
+
+// tupleKey returns the index key for a tuple or an empty string if the tuple is not set
+func tupleKey(tuple Tuple) string {
+	if tuple.ClientAddress == nil || tuple.ServerAddress == nil {
+		return ""
+	}
+	return tuple.String()
+}
+
+// stringShardIndex returns the shard for an index key using the FNV-1a hash
+func stringShardIndex(key string) uint32 {
+	var hash uint32 = 2166136261
+	for x := 0; x < len(key); x++ {
+		hash ^= uint32(key[x])
+		hash *= 16777619
+	}
+	return hash >> (32 - tableShardBits)
+}
+
+// initialize creates empty maps for all of the tuple index shards
+func (ti *tupleIndex) initialize() {
+	for x := range ti.shards {
+		ti.shards[x].locker.Lock()
+		ti.shards[x].table = make(map[string]*Session)
+		ti.shards[x].locker.Unlock()
+	}
+}
+
+// find returns the session for the argumented key or nil if not found
+func (ti *tupleIndex) find(key string) *Session {
+	shard := &ti.shards[stringShardIndex(key)]
+	shard.locker.RLock()
+	sess := shard.table[key]
+	shard.locker.RUnlock()
+	return sess
+}
+
+// insert adds a session to the index
+func (ti *tupleIndex) insert(key string, sess *Session) {
+	if key == "" {
+		return
+	}
+	shard := &ti.shards[stringShardIndex(key)]
+	shard.locker.Lock()
+	shard.table[key] = sess
+	shard.locker.Unlock()
+}
+
+// remove removes the key from the index but only if it still points to the argumented session
+func (ti *tupleIndex) remove(key string, sess *Session) {
+	if key == "" {
+		return
+	}
+	shard := &ti.shards[stringShardIndex(key)]
+	shard.locker.Lock()
+	if shard.table[key] == sess {
+		delete(shard.table, key)
+	}
+	shard.locker.Unlock()
+}
+
+// initialize creates empty maps for all of the session ID index shards
+func (si *sessionIDIndex) initialize() {
+	for x := range si.shards {
+		si.shards[x].locker.Lock()
+		si.shards[x].table = make(map[int64]*Session)
+		si.shards[x].locker.Unlock()
+	}
+}
+
+// getShard returns the shard for the argumented session ID
+func (si *sessionIDIndex) getShard(id int64) *sessionIDShard {
+	return &si.shards[shardIndex(uint32(id)^uint32(id>>32))]
+}
+
+// find returns the session for the argumented session ID or nil if not found
+func (si *sessionIDIndex) find(id int64) *Session {
+	shard := si.getShard(id)
+	shard.locker.RLock()
+	sess := shard.table[id]
+	shard.locker.RUnlock()
+	return sess
+}
+
+// insert adds a session to the index
+func (si *sessionIDIndex) insert(id int64, sess *Session) {
+	shard := si.getShard(id)
+	shard.locker.Lock()
+	shard.table[id] = sess
+	shard.locker.Unlock()
+}
+
+// remove removes the session ID from the index but only if it still points to the argumented session
+func (si *sessionIDIndex) remove(id int64, sess *Session) {
+	shard := si.getShard(id)
+	shard.locker.Lock()
+	if shard.table[id] == sess {
+		delete(shard.table, id)
+	}
+	shard.locker.Unlock()
+}
+
+// addIndexes adds a session to all of the secondary indexes. The caller must
+// hold the lock for the session table shard that contains the session.
+func (st *sessionShardTable) addIndexes(sess *Session) {
+	st.byClient.insert(tupleKey(sess.GetClientSideTuple()), sess)
+	st.byServer.insert(tupleKey(sess.GetServerSideTuple()), sess)
+	st.byID.insert(sess.GetSessionID(), sess)
+}
+
+// removeIndexes removes a session from all of the secondary indexes
+func (st *sessionShardTable) removeIndexes(sess *Session) {
+	st.byClient.remove(tupleKey(sess.GetClientSideTuple()), sess)
+	st.byServer.remove(tupleKey(sess.GetServerSideTuple()), sess)
+	st.byID.remove(sess.GetSessionID(), sess)
+}
+
+// updateIndex moves a session in a tuple index when one of its tuples changes. Nothing
+// is changed for sessions that are not in the table so the indexes never reference a
+// session after it has been removed.
+func (st *sessionShardTable) updateIndex(index *tupleIndex, sess *Session, previous Tuple, current Tuple) {
+	ctid := sess.GetConntrackID()
+	shard := st.getShard(ctid)
+	shard.locker.RLock()
+	defer shard.locker.RUnlock()
+
+	if shard.table == nil || shard.table[ctid] != sess {
+		return
+	}
+	index.remove(tupleKey(previous), sess)
+	index.insert(tupleKey(current), sess)
+}
@@ -0,0 +1,154 @@
+package dispatch
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/untangle/packetd/services/kernel"
+	"github.com/untangle/packetd/services/logger"
+)
+
+// KilledByAttachment is the attachment set to the name of whoever killed a session
+const KilledByAttachment = "killed_by"
+
+// KillFilter selects the sessions killed by KillSessions. Empty fields match any session.
+type KillFilter struct {
+	ClientAddress net.IP
+	Application   string
+}
+
+// tcpSequence holds the last sequence numbers seen in each direction of a TCP session
+type tcpSequence struct {
+	seen  [2]bool
+	next  [2]uint32
+	acked [2]bool
+	ack   [2]uint32
+}
+
+// updateSequence records the sequence numbers of a TCP packet so we can reset the session
+func (sess *Session) updateSequence(mess *NfqueueMessage) {
+	if mess.TCPLayer == nil {
+		return
+	}
+
+	direction := StreamServerToClient
+	if mess.ClientToServer {
+		direction = StreamClientToServer
+	}
+
+	tcp := mess.TCPLayer
+	next := tcp.Seq + uint32(len(tcp.Payload))
+	if tcp.SYN || tcp.FIN {
+		next++
+	}
+
+	sess.sequenceLock.Lock()
+	sess.sequence.seen[direction] = true
+	sess.sequence.next[direction] = next
+	if tcp.ACK {
+		sess.sequence.acked[direction] = true
+		sess.sequence.ack[direction] = tcp.Ack
+	}
+	sess.sequenceLock.Unlock()
+}
+
+// resetSequence returns the sequence number the receiver in the argumented direction expects
+// next, which is either the next sequence number from the sender or the last acknowledgement
+// from the receiver, and false if we haven't seen either
+func (sess *Session) resetSequence(direction int) (uint32, bool) {
+	sess.sequenceLock.Lock()
+	defer sess.sequenceLock.Unlock()
+
+	if sess.sequence.seen[direction] {
+		return sess.sequence.next[direction], true
+	}
+	if sess.sequence.acked[1-direction] {
+		return sess.sequence.ack[1-direction], true
+	}
+	return 0, false
+}
+
+// sendResets sends a TCP reset to the client and the server of a session. The sequence
+// numbers are the last ones seen by nfqueue so the resets are only accepted if no traffic
+// has passed since the session was released by the nfqueue subscribers.
+func (sess *Session) sendResets() {
+	client := sess.GetClientSideTuple()
+	server := sess.GetServerSideTuple()
+	if server.ClientAddress == nil || server.ServerAddress == nil {
+		server = client
+	}
+
+	if seq, found := sess.resetSequence(StreamClientToServer); found {
+		err := kernel.SendReset(server.ClientAddress, server.ServerAddress, server.ClientPort, server.ServerPort, seq)
+		if err != nil {
+			logger.Warn("Unable to send reset to server for session %d: %v\n", sess.GetSessionID(), err)
+		}
+	}
+
+	if seq, found := sess.resetSequence(StreamServerToClient); found {
+		err := kernel.SendReset(client.ServerAddress, client.ClientAddress, client.ServerPort, client.ClientPort, seq)
+		if err != nil {
+			logger.Warn("Unable to send reset to client for session %d: %v\n", sess.GetSessionID(), err)
+		}
+	}
+}
+
+// KillSession deletes the conntrack entry of a session so the kernel stops passing its traffic,
+// and for TCP sessions sends a reset to both ends when reset is true. When the conntrack entry is
+// deleted the killer is put in the killed_by attachment so attachment subscribers can record who
+// killed the session.
+func KillSession(sess *Session, reset bool, killer string) error {
+	tuple := sess.GetClientSideTuple()
+
+	if reset && tuple.Protocol == syscall.IPPROTO_TCP {
+		sess.sendResets()
+	}
+
+	err := kernel.DeleteConntrack(sess.GetConntrackID(), sess.GetFamily(), tuple.Protocol, tuple.ClientAddress, tuple.ServerAddress, tuple.ClientPort, tuple.ServerPort)
+	if err != nil {
+		return fmt.Errorf("Unable to kill session %d: %v", sess.GetSessionID(), err)
+	}
+
+	// only record the killer once the session is really gone
+	sess.PutAttachment(KilledByAttachment, killer)
+
+	logger.Info("%OC|Session %d %v killed by %s\n", "session_killed", 0, sess.GetSessionID(), tuple, killer)
+	return nil
+}
+
+// KillSessions kills all of the sessions that match the filter and returns the IDs of the killed sessions
+func KillSessions(filter KillFilter, reset bool, killer string) []int64 {
+	var killed []int64
+
+	for _, sess := range sessionTable.list() {
+		if !filter.matches(sess) {
+			continue
+		}
+		if err := KillSession(sess, reset, killer); err != nil {
+			logger.Warn("%v\n", err)
+			continue
+		}
+		killed = append(killed, sess.GetSessionID())
+	}
+
+	return killed
+}
+
+// matches returns true if the session matches the filter
+func (filter *KillFilter) matches(sess *Session) bool {
+	if filter.ClientAddress != nil && !filter.ClientAddress.Equal(sess.GetClientSideTuple().ClientAddress) {
+		return false
+	}
+
+	if len(filter.Application) != 0 {
+		id, _ := sess.GetAttachmentString("application_id")
+		name, _ := sess.GetAttachmentString("application_name")
+		if !strings.EqualFold(filter.Application, id) && !strings.EqualFold(filter.Application, name) {
+			return false
+		}
+	}
+
+	return true
+}
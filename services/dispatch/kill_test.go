@@ -0,0 +1,63 @@
+package dispatch
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+// TestResetSequence checks the sequence numbers used to reset a session
+func TestResetSequence(t *testing.T) {
+	sess := new(Session)
+
+	if _, found := sess.resetSequence(StreamClientToServer); found {
+		t.Errorf("Found a sequence number before any packets")
+	}
+
+	// the client SYN uses one sequence number
+	sess.updateSequence(&NfqueueMessage{ClientToServer: true, TCPLayer: &layers.TCP{Seq: 1000, SYN: true}})
+	if seq, _ := sess.resetSequence(StreamClientToServer); seq != 1001 {
+		t.Errorf("Wrong server reset sequence %d", seq)
+	}
+
+	// we only know what the client expects from its acknowledgement until the server sends something
+	sess.updateSequence(&NfqueueMessage{ClientToServer: true, TCPLayer: &layers.TCP{Seq: 1001, ACK: true, Ack: 5001, BaseLayer: layers.BaseLayer{Payload: []byte("hello")}}})
+	if seq, _ := sess.resetSequence(StreamClientToServer); seq != 1006 {
+		t.Errorf("Wrong server reset sequence %d", seq)
+	}
+	if seq, found := sess.resetSequence(StreamServerToClient); !found || seq != 5001 {
+		t.Errorf("Wrong client reset sequence %d", seq)
+	}
+
+	sess.updateSequence(&NfqueueMessage{ClientToServer: false, TCPLayer: &layers.TCP{Seq: 5001, ACK: true, Ack: 1006, BaseLayer: layers.BaseLayer{Payload: []byte("hi")}}})
+	if seq, _ := sess.resetSequence(StreamServerToClient); seq != 5003 {
+		t.Errorf("Wrong client reset sequence %d", seq)
+	}
+}
+
+// TestKillFilter checks the session selection for KillSessions
+func TestKillFilter(t *testing.T) {
+	sess := new(Session)
+	sess.attachments = make(map[string]interface{})
+	sess.clientSideTuple = Tuple{ClientAddress: net.ParseIP("192.168.1.100"), ServerAddress: net.ParseIP("10.1.1.1")}
+	sess.attachments["application_id"] = "YOUTUBE"
+	sess.attachments["application_name"] = "YouTube"
+
+	tests := []struct {
+		filter KillFilter
+		match  bool
+	}{
+		{KillFilter{ClientAddress: net.ParseIP("192.168.1.100")}, true},
+		{KillFilter{ClientAddress: net.ParseIP("192.168.1.101")}, false},
+		{KillFilter{Application: "youtube"}, true},
+		{KillFilter{Application: "NETFLIX"}, false},
+		{KillFilter{ClientAddress: net.ParseIP("192.168.1.100"), Application: "NETFLIX"}, false},
+	}
+
+	for _, test := range tests {
+		if test.filter.matches(sess) != test.match {
+			t.Errorf("Filter %v should have returned %v", test.filter, test.match)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package dispatch
+
+import (
+	"sync"
+	"time"
+
+	"github.com/untangle/packetd/services/clock"
+	"github.com/untangle/packetd/services/logger"
+)
+
+// SessionStartHandlerFunction defines a pointer to a session start callback function
+type SessionStartHandlerFunction func(*SessionStartMessage)
+
+// SessionEndHandlerFunction defines a pointer to a session end callback function
+type SessionEndHandlerFunction func(*SessionEndMessage)
+
+// SessionStartMessage is passed to session start subscribers exactly once for each session
+// when the first packet creates the session. The subscribers are called before the nfqueue
+// subscribers see the first packet so anything they attach to the session is available.
+type SessionStartMessage struct {
+	Session   *Session
+	StartTime time.Time
+}
+
+// SessionEndMessage is passed to session end subscribers exactly once for each session
+// when it is removed from the session table. The counters are the final values from
+// the conntrack entry when available, otherwise they are the totals seen by nfqueue.
+type SessionEndMessage struct {
+	Session       *Session
+	EndTime       time.Time
+	ClientBytes   uint64
+	ServerBytes   uint64
+	TotalBytes    uint64
+	ClientPackets uint64
+	ServerPackets uint64
+	TotalPackets  uint64
+}
+
+// finishSession notifies the session end subscribers the first time it is called for a session
+func (sess *Session) finishSession() {
+	if !sess.setFinished() {
+		return
+	}
+
+	// the subscribers are called on a goroutine because we are often
+	// called while holding the session or conntrack table locks
+	go func() {
+		callSessionEndSubscribers(createSessionEndMessage(sess))
+	}()
+}
+
+// createSessionEndMessage creates the session end message with the final counters for a session
+func createSessionEndMessage(sess *Session) *SessionEndMessage {
+	mess := new(SessionEndMessage)
+	mess.Session = sess
+	mess.EndTime = clock.Now()
+
+	conntrack := sess.GetConntrackPointer()
+	if conntrack == nil {
+		mess.TotalBytes = sess.GetByteCount()
+		mess.TotalPackets = sess.GetPacketCount()
+		return mess
+	}
+
+	conntrack.Guardian.RLock()
+	mess.ClientBytes = conntrack.ClientBytes
+	mess.ServerBytes = conntrack.ServerBytes
+	mess.TotalBytes = conntrack.TotalBytes
+	mess.ClientPackets = conntrack.ClientPackets
+	mess.ServerPackets = conntrack.ServerPackets
+	mess.TotalPackets = conntrack.TotalPackets
+	conntrack.Guardian.RUnlock()
+	return mess
+}
+
+// callSessionStartSubscribers calls all the session start subscribers in priority order
+func callSessionStartSubscribers(sess *Session) {
+	mess := &SessionStartMessage{Session: sess, StartTime: sess.GetCreationTime()}
+
+	sessionStartSubMutex.Lock()
+	sublist := make(map[string]SubscriptionHolder)
+	for key, val := range sessionStartSubList {
+		sublist[key] = val
+	}
+	sessionStartSubMutex.Unlock()
+
+	if logger.IsTraceEnabled() {
+		logger.Trace("session start event[%d]: %v\n", sess.GetConntrackID(), sess.GetClientSideTuple())
+	}
+
+	callLifecycleSubscribers(MetricsSessionStart, sublist, func(val SubscriptionHolder) { val.SessionStartFunc(mess) })
+}
+
+// callSessionEndSubscribers calls all the session end subscribers in priority order
+func callSessionEndSubscribers(mess *SessionEndMessage) {
+	sessionEndSubMutex.Lock()
+	sublist := make(map[string]SubscriptionHolder)
+	for key, val := range sessionEndSubList {
+		sublist[key] = val
+	}
+	sessionEndSubMutex.Unlock()
+
+	if logger.IsTraceEnabled() {
+		logger.Trace("session end event[%d]: %v\n", mess.Session.GetConntrackID(), mess.Session.GetClientSideTuple())
+	}
+
+	callLifecycleSubscribers(MetricsSessionEnd, sublist, func(val SubscriptionHolder) { val.SessionEndFunc(mess) })
+}
+
+// callLifecycleSubscribers calls the argumented function for each session start or end
+// subscriber in priority order and waits for each priority to finish before starting the next
+func callLifecycleSubscribers(kind string, sublist map[string]SubscriptionHolder, function func(SubscriptionHolder)) {
+	// We loop and increment the priority until all subscriptions have been called
+	subtotal := len(sublist)
+	subcount := 0
+	priority := 0
+
+	for subcount != subtotal {
+		timeoutTimer := time.NewTimer(maxSubscriberTime)
+		var wg sync.WaitGroup
+		var calls []*subscriberCall
+
+		// Call all of the subscribed handlers for the current priority
+		for key, val := range sublist {
+			if val.Priority != priority {
+				continue
+			}
+			call := &subscriberCall{owner: key}
+			calls = append(calls, call)
+			wg.Add(1)
+			go func(val SubscriptionHolder, call *subscriberCall) {
+				callSubscriber(kind, call, func() { function(val) })
+				wg.Done()
+			}(val, call)
+			subcount++
+		}
+
+		// Wait for all of this priority to finish or the subscriber timeout
+		c := make(chan bool)
+		go func() {
+			defer close(c)
+			wg.Wait()
+		}()
+		select {
+		case <-timeoutTimer.C:
+			logger.Crit("%OC|Timeout while waiting for %s subscribers:%v\n", "timeout_"+kind, 0, kind, recordTimeouts(kind, calls))
+		case <-c:
+			timeoutTimer.Stop()
+		}
+
+		// Increment the priority and keep looping until we've called all subscribers
+		priority++
+		if priority > 100 {
+			logger.Err("%OC|Priority > 100 Constraint failed! %d %d %d %v", kind+"_priority_constraint", 0, subcount, subtotal, priority, sublist)
+			panic("Constraint failed - infinite loop detected")
+		}
+	}
+}
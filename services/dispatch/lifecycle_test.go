@@ -0,0 +1,49 @@
+package dispatch
+
+import (
+	"sync"
+	"testing"
+)
+
+// TestSessionStartPriority checks that session start subscribers are called once
+// in priority order and see the attachments of the subscribers before them
+func TestSessionStartPriority(t *testing.T) {
+	sessionStartSubList = make(map[string]SubscriptionHolder)
+	defer func() { sessionStartSubList = nil }()
+
+	var order []string
+	var locker sync.Mutex
+
+	record := func(name string) SessionStartHandlerFunction {
+		return func(mess *SessionStartMessage) {
+			locker.Lock()
+			order = append(order, name)
+			locker.Unlock()
+			mess.Session.PutAttachment(name, true)
+		}
+	}
+
+	InsertSessionStartSubscription("last", 2, func(mess *SessionStartMessage) {
+		if mess.Session.GetAttachment("first") == nil {
+			t.Errorf("Attachment from the first subscriber is missing")
+		}
+		record("last")(mess)
+	})
+	InsertSessionStartSubscription("first", 0, record("first"))
+	InsertSessionStartSubscription("middle", 1, record("middle"))
+
+	sess := new(Session)
+	sess.attachments = make(map[string]interface{})
+	callSessionStartSubscribers(sess)
+
+	if len(order) != 3 || order[0] != "first" || order[1] != "middle" || order[2] != "last" {
+		t.Errorf("Subscribers called in the wrong order: %v", order)
+	}
+
+	RemoveSubscriptions("middle")
+	order = nil
+	callSessionStartSubscribers(sess)
+	if len(order) != 2 {
+		t.Errorf("Removed subscriber was called: %v", order)
+	}
+}
@@ -0,0 +1,206 @@
+package dispatch
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MetricsNfqueue is the metrics type for nfqueue subscribers
+const MetricsNfqueue = "nfqueue"
+
+// MetricsConntrack is the metrics type for conntrack subscribers
+const MetricsConntrack = "conntrack"
+
+// MetricsNetlogger is the metrics type for netlogger subscribers
+const MetricsNetlogger = "netlogger"
+
+// MetricsAttachment is the metrics type for attachment change subscribers
+const MetricsAttachment = "attachment"
+
+// MetricsSessionStart is the metrics type for session start subscribers
+const MetricsSessionStart = "session_start"
+
+// MetricsSessionEnd is the metrics type for session end subscribers
+const MetricsSessionEnd = "session_end"
+
+// MetricsHistogramLimits are the upper limits in microseconds of the latency histogram
+// buckets. The last bucket in the histogram counts the calls that took longer. This is an
+// array so the number of buckets is fixed when the histogram is sized.
+var MetricsHistogramLimits = [...]int64{10, 100, 1000, 10000, 100000, 1000000}
+
+// SubscriberMetrics holds the performance metrics for one subscriber of one event type
+type SubscriberMetrics struct {
+	Owner             string   `json:"owner"`
+	Type              string   `json:"type"`
+	Calls             uint64   `json:"calls"`
+	Releases          uint64   `json:"releases"`
+	Timeouts          uint64   `json:"timeouts"`
+	TotalMicroseconds uint64   `json:"total_microseconds"`
+	MaxMicroseconds   uint64   `json:"max_microseconds"`
+	Histogram         []uint64 `json:"histogram"`
+}
+
+// subscriberMetric stores the counters for a subscriber. The values are only
+// accessed atomically so the 64 bit fields must be first for alignment.
+type subscriberMetric struct {
+	calls     uint64
+	releases  uint64
+	timeouts  uint64
+	totalTime uint64
+	maxTime   uint64
+	histogram [len(MetricsHistogramLimits) + 1]uint64
+	owner     string
+	kind      string
+}
+
+// subscriberCall tracks a call to a conntrack, netlogger, lifecycle, or attachment subscriber so we
+// can tell which subscribers didn't finish when the timeout is reached
+type subscriberCall struct {
+	finished uint32
+	owner    string
+}
+
+var metricsTable = make(map[string]*subscriberMetric)
+var metricsMutex sync.RWMutex
+
+// findMetric returns the metric for the argumented type and owner, creating it if needed
+func findMetric(kind string, owner string) *subscriberMetric {
+	key := kind + ":" + owner
+
+	metricsMutex.RLock()
+	metric, found := metricsTable[key]
+	metricsMutex.RUnlock()
+
+	if found {
+		return metric
+	}
+
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+
+	metric, found = metricsTable[key]
+	if !found {
+		metric = &subscriberMetric{owner: owner, kind: kind}
+		metricsTable[key] = metric
+	}
+	return metric
+}
+
+// recordSubscriberCall records a subscriber call and how long it took
+func recordSubscriberCall(kind string, owner string, elapsed time.Duration) {
+	metric := findMetric(kind, owner)
+	micros := uint64(elapsed / time.Microsecond)
+
+	atomic.AddUint64(&metric.calls, 1)
+	atomic.AddUint64(&metric.totalTime, micros)
+
+	for {
+		current := atomic.LoadUint64(&metric.maxTime)
+		if micros <= current || atomic.CompareAndSwapUint64(&metric.maxTime, current, micros) {
+			break
+		}
+	}
+
+	bucket := len(MetricsHistogramLimits)
+	for index, limit := range MetricsHistogramLimits {
+		if int64(micros) <= limit {
+			bucket = index
+			break
+		}
+	}
+	atomic.AddUint64(&metric.histogram[bucket], 1)
+}
+
+// recordSubscriberRelease records a subscriber releasing a session
+func recordSubscriberRelease(kind string, owner string) {
+	atomic.AddUint64(&findMetric(kind, owner).releases, 1)
+}
+
+// recordSubscriberTimeout records a subscriber that didn't finish in time
+func recordSubscriberTimeout(kind string, owner string) {
+	atomic.AddUint64(&findMetric(kind, owner).timeouts, 1)
+}
+
+// callSubscriber calls a conntrack, netlogger, lifecycle, or attachment subscriber and records the metrics
+func callSubscriber(kind string, call *subscriberCall, function func()) {
+	start := time.Now()
+	function()
+	atomic.StoreUint32(&call.finished, 1)
+	recordSubscriberCall(kind, call.owner, time.Since(start))
+}
+
+// recordTimeouts records a timeout for each call that didn't finish and returns their names
+func recordTimeouts(kind string, calls []*subscriberCall) []string {
+	var names []string
+
+	for _, call := range calls {
+		if atomic.LoadUint32(&call.finished) != 0 {
+			continue
+		}
+		recordSubscriberTimeout(kind, call.owner)
+		names = append(names, call.owner)
+	}
+	return names
+}
+
+// GetSubscriberMetrics returns the metrics for all subscribers sorted by type and owner
+func GetSubscriberMetrics() []SubscriberMetrics {
+	var list []SubscriberMetrics
+
+	metricsMutex.RLock()
+	for _, metric := range metricsTable {
+		item := SubscriberMetrics{
+			Owner:             metric.owner,
+			Type:              metric.kind,
+			Calls:             atomic.LoadUint64(&metric.calls),
+			Releases:          atomic.LoadUint64(&metric.releases),
+			Timeouts:          atomic.LoadUint64(&metric.timeouts),
+			TotalMicroseconds: atomic.LoadUint64(&metric.totalTime),
+			MaxMicroseconds:   atomic.LoadUint64(&metric.maxTime),
+			Histogram:         make([]uint64, len(metric.histogram)),
+		}
+		for index := range metric.histogram {
+			item.Histogram[index] = atomic.LoadUint64(&metric.histogram[index])
+		}
+		list = append(list, item)
+	}
+	metricsMutex.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Type != list[j].Type {
+			return list[i].Type < list[j].Type
+		}
+		return list[i].Owner < list[j].Owner
+	})
+	return list
+}
+
+// GenerateMetricsReport is called to create a dynamic HTTP page that shows the subscriber metrics
+func GenerateMetricsReport(buffer *bytes.Buffer) {
+	buffer.WriteString("<TABLE BORDER=2 CELLPADDING=4 BGCOLOR=#EEEEEE>\r\n")
+	buffer.WriteString(fmt.Sprintf("<TR><TH COLSPAN=%d>Subscriber Metrics</TH></TR>\r\n", 7+len(MetricsHistogramLimits)+1))
+	buffer.WriteString("<TR><TD><B>Type</B></TD><TD><B>Owner</B></TD><TD><B>Calls</B></TD><TD><B>Releases</B></TD><TD><B>Timeouts</B></TD><TD><B>Average</B></TD><TD><B>Max</B></TD>")
+	for _, limit := range MetricsHistogramLimits {
+		buffer.WriteString(fmt.Sprintf("<TD><B>&lt;= %dus</B></TD>", limit))
+	}
+	buffer.WriteString("<TD><B>Slower</B></TD></TR>\r\n")
+
+	for _, item := range GetSubscriberMetrics() {
+		var average uint64
+		if item.Calls != 0 {
+			average = item.TotalMicroseconds / item.Calls
+		}
+		buffer.WriteString(fmt.Sprintf("<TR><TD><TT>%s</TT></TD><TD><TT>%s</TT></TD><TD><TT>%d</TT></TD><TD><TT>%d</TT></TD><TD><TT>%d</TT></TD><TD><TT>%dus</TT></TD><TD><TT>%dus</TT></TD>",
+			item.Type, item.Owner, item.Calls, item.Releases, item.Timeouts, average, item.MaxMicroseconds))
+		for _, count := range item.Histogram {
+			buffer.WriteString(fmt.Sprintf("<TD><TT>%d</TT></TD>", count))
+		}
+		buffer.WriteString("</TR>\r\n")
+	}
+
+	buffer.WriteString("</TABLE>\r\n")
+}
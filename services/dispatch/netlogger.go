@@ -1,6 +1,7 @@
 package dispatch
 
 import (
+	"net"
 	"strings"
 	"sync"
 	"time"
@@ -49,10 +50,21 @@ func netloggerCallback(version uint8,
 	netlogger.Prefix = strings.Replace(prefix, "'", "\"", -1)
 	netlogger.Sessptr = findSession(ctid)
 
+	// the log message may not include the conntrack ID so try the tuple
+	if netlogger.Sessptr == nil {
+		netlogger.Sessptr = findNetloggerSession(protocol, srcAddress, dstAddress, srcPort, dstPort)
+	}
+
 	logger.Trace("netlogger event: %v \n", netlogger)
 
 	// We loop and increment the priority until all subscriptions have been called
-	sublist := netloggerSubList
+	netloggerSubMutex.Lock()
+	sublist := make(map[string]SubscriptionHolder)
+	for key, val := range netloggerSubList {
+		sublist[key] = val
+	}
+	netloggerSubMutex.Unlock()
+
 	subtotal := len(sublist)
 	subcount := 0
 	priority := 0
@@ -60,6 +72,7 @@ func netloggerCallback(version uint8,
 	for subcount != subtotal {
 		timeoutTimer := time.NewTimer(maxSubscriberTime)
 		var wg sync.WaitGroup
+		var calls []*subscriberCall
 
 		// Call all of the subscribed handlers for the current priority
 		for key, val := range sublist {
@@ -67,12 +80,14 @@ func netloggerCallback(version uint8,
 				continue
 			}
 			logger.Debug("Calling netlogger APP:%s PRIORITY:%d\n", key, priority)
+			call := &subscriberCall{owner: key}
+			calls = append(calls, call)
 			wg.Add(1)
-			go func(val SubscriptionHolder, wg *sync.WaitGroup, key string, priority int) {
+			go func(val SubscriptionHolder, wg *sync.WaitGroup, call *subscriberCall, priority int) {
 				defer wg.Done()
-				val.NetloggerFunc(&netlogger)
-				logger.Debug("Finished netlogger APP:%s PRIORITY:%d\n", key, priority)
-			}(val, &wg, key, priority)
+				callSubscriber(MetricsNetlogger, call, func() { val.NetloggerFunc(&netlogger) })
+				logger.Debug("Finished netlogger APP:%s PRIORITY:%d\n", call.owner, priority)
+			}(val, &wg, call, priority)
 			subcount++
 
 		}
@@ -86,7 +101,7 @@ func netloggerCallback(version uint8,
 		}(c, &wg)
 		select {
 		case <-timeoutTimer.C:
-			logger.Crit("%OC|Timeout while waiting for netlogger subcriber:%s\n", "timeout_netlogger", 0)
+			logger.Crit("%OC|Timeout while waiting for netlogger subscribers:%v\n", "timeout_netlogger", 0, recordTimeouts(MetricsNetlogger, calls))
 		case <-c:
 			timeoutTimer.Stop()
 		}
@@ -99,3 +114,41 @@ func netloggerCallback(version uint8,
 		}
 	}
 }
+
+// findNetloggerSession finds the session for a log message using the addresses and ports.
+// We don't know which side of the NAT the message was logged on or which direction the
+// logged packet was travelling so we try both tuples forward and reversed.
+func findNetloggerSession(protocol uint8, srcAddress string, dstAddress string, srcPort uint16, dstPort uint16) *Session {
+	var tuple Tuple
+
+	tuple.Protocol = protocol
+	tuple.ClientAddress = net.ParseIP(srcAddress)
+	tuple.ClientPort = srcPort
+	tuple.ServerAddress = net.ParseIP(dstAddress)
+	tuple.ServerPort = dstPort
+
+	if tuple.ClientAddress == nil || tuple.ServerAddress == nil {
+		return nil
+	}
+
+	session := FindSessionByClientTuple(tuple)
+	if session == nil {
+		session = FindSessionByServerTuple(tuple)
+	}
+	if session != nil {
+		return session
+	}
+
+	var reverse Tuple
+	reverse.Protocol = protocol
+	reverse.ClientAddress = tuple.ServerAddress
+	reverse.ClientPort = tuple.ServerPort
+	reverse.ServerAddress = tuple.ClientAddress
+	reverse.ServerPort = tuple.ClientPort
+
+	session = FindSessionByClientTuple(reverse)
+	if session == nil {
+		session = FindSessionByServerTuple(reverse)
+	}
+	return session
+}
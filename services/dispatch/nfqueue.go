@@ -1,20 +1,40 @@
 package dispatch
 
 import (
+	"fmt"
+	"sort"
 	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
+	"github.com/untangle/packetd/services/clock"
 	"github.com/untangle/packetd/services/dict"
+	"github.com/untangle/packetd/services/kernel"
 	"github.com/untangle/packetd/services/logger"
 )
 
+// BypassAttachment is the attachment and dictionary field set when packetd stops queueing a session
+const BypassAttachment = "bypass_packetd"
+
 // NfDrop is NF_DROP constant
 const NfDrop = 0
 
 // NfAccept is the NF_ACCEPT constant
 const NfAccept = 1
 
+// VerdictAccept lets the packet continue (this is the default)
+const VerdictAccept = 0
+
+// VerdictDrop silently discards the packet
+const VerdictDrop = 1
+
+// VerdictRejectReset discards the packet and sends a TCP reset to the sender
+// Non-TCP packets are rejected with ICMP instead
+const VerdictRejectReset = 2
+
+// VerdictRejectICMP discards the packet and sends an ICMP administratively prohibited to the sender
+const VerdictRejectICMP = 3
+
 //NfqueueHandlerFunction defines a pointer to a nfqueue callback function
 type NfqueueHandlerFunction func(NfqueueMessage, uint32, bool) NfqueueResult
 
@@ -32,18 +52,35 @@ type NfqueueMessage struct {
 	TCPLayer       *layers.TCP
 	UDPLayer       *layers.UDP
 	ICMPv4Layer    *layers.ICMPv4
+	ICMPv6Layer    *layers.ICMPv6
 	Payload        []byte
+	Stream         *TCPStream
+	Reassembled    bool
 }
 
 // NfqueueResult returns status and other information from a subscription handler function
+// The zero value accepts the packet and leaves the marks unchanged. Results are combined in
+// priority order. The first subscriber to return something other than VerdictAccept decides
+// the fate of the packet and subscribers at later priorities are not called. Marks are
+// applied in priority order by replacing the bits in the mask with the bits from the value.
+// If the mask is zero the value is OR'ed with the existing mark. A subscriber can replace
+// the packet by returning the complete modified IP packet in PacketData. Subscribers at
+// later priorities will see the modified packet, and the lengths and checksums are fixed
+// before the packet is returned to the kernel.
 type NfqueueResult struct {
 	SessionRelease bool
+	Verdict        int
+	PacketMark     uint32
+	PacketMarkMask uint32
+	ConnMark       uint32
+	ConnMarkMask   uint32
+	PacketData     []byte
 }
 
 // subscriberResult returns status and other information from a subscription handler function
 type subscriberResult struct {
-	owner          string
-	sessionRelease bool
+	owner  string
+	result NfqueueResult
 }
 
 // ReleaseSession is called by a subscriber to stop receiving traffic for a session
@@ -62,16 +99,24 @@ func ReleaseSession(session *Session, owner string) {
 	if origLen != len {
 		logger.Debug("Removing %s session nfqueue subscription for session %d\n", owner, session.GetConntrackID())
 	}
+	session.subLocker.Unlock()
+
 	if len == 0 {
 		logger.Debug("Zero subscribers reached - settings bypass_packetd=true for session %d\n", session.GetConntrackID())
-		dict.AddSessionEntry(session.GetConntrackID(), "bypass_packetd", true)
+		bypassSession(session)
 	}
-	session.subLocker.Unlock()
+}
+
+// bypassSession sets bypass_packetd in the dictionary so nftables stops queueing the
+// traffic of the session, and in the session attachments so the status API shows it
+func bypassSession(session *Session) {
+	dict.AddSessionEntry(session.GetConntrackID(), BypassAttachment, true)
+	session.PutAttachment(BypassAttachment, true)
 }
 
 // nfqueueCallback is the callback for the packet
 // return the mark to set on the packet
-func nfqueueCallback(ctid uint32, family uint32, packet gopacket.Packet, packetLength int, pmark uint32) int {
+func nfqueueCallback(ctid uint32, family uint32, packet gopacket.Packet, packetLength int, pmark uint32) kernel.NfqueueVerdict {
 	var mess NfqueueMessage
 	//printSessionTable()
 
@@ -80,54 +125,35 @@ func nfqueueCallback(ctid uint32, family uint32, packet gopacket.Packet, packetL
 	mess.PacketMark = pmark
 	mess.Length = packetLength
 
-	// get the IPv4 and IPv6 layers
-	ip4Layer := mess.Packet.Layer(layers.LayerTypeIPv4)
-	ip6Layer := mess.Packet.Layer(layers.LayerTypeIPv6)
+	// when defragmentation is enabled we accept fragments until we have them all and
+	// then the subscribers see the reassembled packet instead of the final fragment
+	if defragEnabled {
+		whole, mark := defragmentPacket(packet, pmark)
+		if whole == nil {
+			return acceptVerdict(pmark)
+		}
+		// the verdict is for the final fragment so it keeps its own mark in pmark while the
+		// subscribers see the mark of the first fragment which has the new session bit
+		if whole != packet {
+			mess.Packet = whole
+			mess.PacketMark = mark
+			mess.Length = len(whole.Data())
+			mess.Reassembled = true
+		}
+	}
 
-	if ip4Layer != nil {
-		mess.IP4Layer = ip4Layer.(*layers.IPv4)
-		mess.MsgTuple.Protocol = uint8(mess.IP4Layer.Protocol)
-		mess.MsgTuple.ClientAddress = dupIP(mess.IP4Layer.SrcIP)
-		mess.MsgTuple.ServerAddress = dupIP(mess.IP4Layer.DstIP)
-	} else if ip6Layer != nil {
-		mess.IP6Layer = ip6Layer.(*layers.IPv6)
-		mess.MsgTuple.Protocol = uint8(mess.IP6Layer.NextHeader)
-		mess.MsgTuple.ClientAddress = dupIP(mess.IP6Layer.SrcIP)
-		mess.MsgTuple.ServerAddress = dupIP(mess.IP6Layer.DstIP)
-	} else {
-		return NfAccept
+	if !decodeNfqueueMessage(&mess) {
+		return acceptVerdict(pmark)
 	}
 
 	// we shouldn't be queueing loopback packets
 	// if we catch one throw a warning
 	if mess.MsgTuple.ClientAddress.IsLoopback() || mess.MsgTuple.ServerAddress.IsLoopback() {
 		logger.Warn("nfqueue event for loopback packet: %v\n", mess.MsgTuple)
-		return NfAccept
+		return acceptVerdict(pmark)
 	}
 
-	newSession := ((pmark & 0x10000000) != 0)
-
-	// get the TCP layer
-	tcpLayer := mess.Packet.Layer(layers.LayerTypeTCP)
-	if tcpLayer != nil {
-		mess.TCPLayer = tcpLayer.(*layers.TCP)
-		mess.MsgTuple.ClientPort = uint16(mess.TCPLayer.SrcPort)
-		mess.MsgTuple.ServerPort = uint16(mess.TCPLayer.DstPort)
-	}
-
-	// get the UDP layer
-	udpLayer := mess.Packet.Layer(layers.LayerTypeUDP)
-	if udpLayer != nil {
-		mess.UDPLayer = udpLayer.(*layers.UDP)
-		mess.MsgTuple.ClientPort = uint16(mess.UDPLayer.SrcPort)
-		mess.MsgTuple.ServerPort = uint16(mess.UDPLayer.DstPort)
-	}
-
-	// get the Application layer
-	appLayer := mess.Packet.ApplicationLayer()
-	if appLayer != nil {
-		mess.Payload = appLayer.Payload()
-	}
+	newSession := ((mess.PacketMark & 0x10000000) != 0)
 
 	if logger.IsTraceEnabled() {
 		logger.Trace("nfqueue event[%d]: %v 0x%08x\n", ctid, mess.MsgTuple, pmark)
@@ -135,6 +161,17 @@ func nfqueueCallback(ctid uint32, family uint32, packet gopacket.Packet, packetL
 
 	session := findSession(ctid)
 
+	if session == nil && !newSession {
+		// this may be a session that was saved before a restart and has
+		// not been matched with the conntrack dump yet
+		if restored := restoreSession(ctid, mess.MsgTuple); restored != nil {
+			if conntrack, found := findConntrack(ctid); found {
+				linkRestoredSession(restored, conntrack)
+			}
+			return acceptVerdict(pmark)
+		}
+	}
+
 	if session == nil {
 		if !newSession {
 			// If we did not find the session in the session table, and this isn't a new packet
@@ -150,7 +187,7 @@ func nfqueueCallback(ctid uint32, family uint32, packet gopacket.Packet, packetL
 			}
 
 			dict.AddSessionEntry(ctid, "bypass_packetd", true)
-			return NfAccept
+			return acceptVerdict(pmark)
 		}
 		session = createSession(mess, ctid)
 		mess.Session = session
@@ -216,100 +253,247 @@ func nfqueueCallback(ctid uint32, family uint32, packet gopacket.Packet, packetL
 
 	// if this is a new session set the client side interface index and type
 	if newSession {
-		session.SetClientInterfaceID(uint8((pmark & 0x000000FF)))
-		session.SetClientInterfaceType(uint8((pmark & 0x03000000) >> 24))
+		session.SetClientInterfaceID(uint8((mess.PacketMark & 0x000000FF)))
+		session.SetClientInterfaceType(uint8((mess.PacketMark & 0x03000000) >> 24))
 	}
 
 	// if this is a server-to-client packet and the server interface info is not
 	// set yet, we can set it now (normally this is set during the conntrack new event)
 	// but in some cases we get the response packet first
 	if !mess.ClientToServer && session.GetServerInterfaceID() == 0 {
-		session.SetServerInterfaceID(uint8((pmark & 0x000000FF)))
-		session.SetServerInterfaceType(uint8((pmark & 0x03000000) >> 24))
+		session.SetServerInterfaceID(uint8((mess.PacketMark & 0x000000FF)))
+		session.SetServerInterfaceType(uint8((mess.PacketMark & 0x03000000) >> 24))
 	}
 
 	// Update some accounting bits
-	session.SetLastActivity(time.Now())
+	session.SetLastActivity(clock.Now())
 	session.AddPacketCount(1)
 	session.AddByteCount(uint64(mess.Length))
 	session.AddEventCount(1)
 
+	// let the session start subscribers see the new session before any nfqueue subscribers
+	// they run on the packet path so anything slow like a network lookup must be done in the background
+	if newSession {
+		callSessionStartSubscribers(session)
+	}
+
+	// add the packet to the reassembled stream if anyone wants it
+	updateStream(session, &mess)
+	session.updateSequence(&mess)
+
 	// call the subscribers
 	return callSubscribers(ctid, session, mess, pmark, newSession)
 }
 
+// decodeNfqueueMessage extracts the layers and the tuple from the packet in the message
+// and returns false if the packet is not IPv4 or IPv6
+func decodeNfqueueMessage(mess *NfqueueMessage) bool {
+	mess.IP4Layer = nil
+	mess.IP6Layer = nil
+	mess.TCPLayer = nil
+	mess.UDPLayer = nil
+	mess.ICMPv4Layer = nil
+	mess.ICMPv6Layer = nil
+	mess.Payload = nil
+	mess.MsgTuple.ClientPort = 0
+	mess.MsgTuple.ServerPort = 0
+
+	// get the IPv4 and IPv6 layers
+	ip4Layer := mess.Packet.Layer(layers.LayerTypeIPv4)
+	ip6Layer := mess.Packet.Layer(layers.LayerTypeIPv6)
+
+	if ip4Layer != nil {
+		mess.IP4Layer = ip4Layer.(*layers.IPv4)
+		mess.MsgTuple.Protocol = uint8(mess.IP4Layer.Protocol)
+		mess.MsgTuple.ClientAddress = dupIP(mess.IP4Layer.SrcIP)
+		mess.MsgTuple.ServerAddress = dupIP(mess.IP4Layer.DstIP)
+	} else if ip6Layer != nil {
+		mess.IP6Layer = ip6Layer.(*layers.IPv6)
+		mess.MsgTuple.Protocol = findIPv6Protocol(mess.Packet.Data())
+		mess.MsgTuple.ClientAddress = dupIP(mess.IP6Layer.SrcIP)
+		mess.MsgTuple.ServerAddress = dupIP(mess.IP6Layer.DstIP)
+	} else {
+		return false
+	}
+
+	// get the TCP layer
+	tcpLayer := mess.Packet.Layer(layers.LayerTypeTCP)
+	if tcpLayer != nil {
+		mess.TCPLayer = tcpLayer.(*layers.TCP)
+		mess.MsgTuple.ClientPort = uint16(mess.TCPLayer.SrcPort)
+		mess.MsgTuple.ServerPort = uint16(mess.TCPLayer.DstPort)
+	}
+
+	// get the UDP layer
+	udpLayer := mess.Packet.Layer(layers.LayerTypeUDP)
+	if udpLayer != nil {
+		mess.UDPLayer = udpLayer.(*layers.UDP)
+		mess.MsgTuple.ClientPort = uint16(mess.UDPLayer.SrcPort)
+		mess.MsgTuple.ServerPort = uint16(mess.UDPLayer.DstPort)
+	}
+
+	// get the ICMP layers
+	icmp4Layer := mess.Packet.Layer(layers.LayerTypeICMPv4)
+	if icmp4Layer != nil {
+		mess.ICMPv4Layer = icmp4Layer.(*layers.ICMPv4)
+	}
+
+	icmp6Layer := mess.Packet.Layer(layers.LayerTypeICMPv6)
+	if icmp6Layer != nil {
+		mess.ICMPv6Layer = icmp6Layer.(*layers.ICMPv6)
+	}
+
+	// get the Application layer
+	appLayer := mess.Packet.ApplicationLayer()
+	if appLayer != nil {
+		mess.Payload = appLayer.Payload()
+	}
+
+	return true
+}
+
+// findIPv6Protocol walks the IPv6 extension headers in a raw packet and returns the upper
+// layer protocol. If the headers are truncated we return the last next header value we found.
+func findIPv6Protocol(data []byte) uint8 {
+	if len(data) < 40 {
+		return 0
+	}
+
+	next := data[6]
+	offset := 40
+
+	for {
+		var length int
+
+		switch layers.IPProtocol(next) {
+		case layers.IPProtocolIPv6HopByHop, layers.IPProtocolIPv6Routing, layers.IPProtocolIPv6Destination:
+			if offset+2 > len(data) {
+				return next
+			}
+			length = (int(data[offset+1]) + 1) * 8
+		case layers.IPProtocolIPv6Fragment:
+			if offset+2 > len(data) {
+				return next
+			}
+			length = 8
+		case layers.IPProtocolAH:
+			if offset+2 > len(data) {
+				return next
+			}
+			length = (int(data[offset+1]) + 2) * 4
+		default:
+			return next
+		}
+
+		next = data[offset]
+		offset += length
+	}
+}
+
 // callSubscribers calls all the nfqueue message subscribers (plugins)
 // and returns a verdict and the new mark
-func callSubscribers(ctid uint32, session *Session, mess NfqueueMessage, pmark uint32, newSession bool) int {
-	resultsChannel := make(chan subscriberResult)
-
+func callSubscribers(ctid uint32, session *Session, mess NfqueueMessage, pmark uint32, newSession bool) kernel.NfqueueVerdict {
 	// We loop and increment the priority until all subscriptions have been called
 	sublist := MirrorNfqueueSubscriptions(session)
 	subtotal := len(sublist)
 
 	// If there are no subscribers anymore, just release now
 	if subtotal == 0 {
-		dict.AddSessionEntry(session.GetConntrackID(), "bypass_packetd", true)
-		return NfAccept
+		bypassSession(session)
+		return acceptVerdict(pmark)
 	}
 
+	// every subscriber writes exactly one result so a subscriber that finishes
+	// after we stop waiting for it will never block on the channel
+	resultsChannel := make(chan subscriberResult, subtotal)
+
 	subcount := 0
 	priority := 0
+	verdict := VerdictAccept
+	packetMark := pmark
+	var connMark uint32
+	var connMask uint32
+	var packetData []byte
 
 	for subcount != subtotal {
-		// Counts the total number of calls made for each priority so we know
-		// how many NfqueueResult's to read from the result channel
-		hitcount := 0
+		// Tracks the subscribers called for each priority so we know
+		// which NfqueueResult's to read from the result channel
+		var pending []string
 
 		// Call all of the subscribed handlers for the current priority
 		for key, val := range sublist {
 			if val.Priority != priority {
 				continue
 			}
-			// handle each subscriber on a goroutine
-			go func(key string, val SubscriptionHolder, pri int) {
-				if logger.IsTraceEnabled() {
-					logger.Trace("Calling nfqueue PLUGIN:%s PRI:%d CTID:%d\n", key, pri, ctid)
-				}
+			subcount++
 
-				timeoutTimer := time.NewTimer(maxSubscriberTime)
-				c := make(chan subscriberResult, 1)
-
-				// call the subscriber hook on another goroutine so we can timeout while waiting for the result
-				go func() {
-					result := val.NfqueueFunc(mess, ctid, newSession)
-					stat := timeoutTimer.Stop()
-					// if we stopped the timer then stat will be true and we need to write the subscriber result
-					// to the channel, otherwise don't bother since a release was written by the timeout handler
-					if stat == true {
-						c <- subscriberResult{owner: key, sessionRelease: result.SessionRelease}
-					}
-				}()
-
-				// wait for the subscriber to finish or the timeout to trigger
-				select {
-				case result := <-c:
-					// put what the subscriber returned in the result channel
-					resultsChannel <- result
-				case <-timeoutTimer.C:
-					// the subscriber took too long so put a release in the result channel on behalf of the subscriber
-					logger.Crit("%OC|Timeout while processing nfqueue - subscriber:%s\n", "timeout_nfqueue_"+key, 0, key)
-					resultsChannel <- subscriberResult{owner: key, sessionRelease: true}
+			// skip subscribers that don't want this packet and release
+			// those that will never be interested in the session
+			if val.NfqueueFilter != nil {
+				match, release := val.NfqueueFilter.checkFilter(session, mess, newSession)
+				if release {
+					recordSubscriberRelease(MetricsNfqueue, key)
+					ReleaseSession(session, key)
 				}
-			}(key, val, priority)
-			hitcount++
-			subcount++
+				if !match {
+					continue
+				}
+			}
+
+			// pass each subscriber call to the worker pool
+			if logger.IsTraceEnabled() {
+				logger.Trace("Calling nfqueue PLUGIN:%s PRI:%d CTID:%d\n", key, priority, ctid)
+			}
+			submitSubscriberTask(&subscriberTask{owner: key, holder: val, mess: mess, ctid: ctid, newSession: newSession, results: resultsChannel})
+			pending = append(pending, key)
 		}
 
 		// get the results for each called subscriber and remove the session
 		// subscription for any that set the SessionRelease flag
-		for i := 0; i < hitcount; i++ {
-			select {
-			case result := <-resultsChannel:
-				if result.sessionRelease {
-					ReleaseSession(session, result.owner)
+		results := collectResults(resultsChannel, pending)
+		for _, result := range results {
+			if result.result.SessionRelease {
+				recordSubscriberRelease(MetricsNfqueue, result.owner)
+				ReleaseSession(session, result.owner)
+			}
+		}
+
+		// subscribers at the same priority run in parallel so we sort
+		// by owner to combine their results in a predictable order
+		sort.Slice(results, func(i, j int) bool { return results[i].owner < results[j].owner })
+		changed := false
+		for _, item := range results {
+			if item.result.PacketData != nil {
+				if changed {
+					logger.Warn("Ignoring packet changes from %s for session %d\n", item.owner, ctid)
+				} else {
+					packetData = item.result.PacketData
+					changed = true
 				}
 			}
+			if verdict == VerdictAccept && item.result.Verdict != VerdictAccept {
+				logger.Debug("Subscriber %s returned verdict %d for session %d\n", item.owner, item.result.Verdict, ctid)
+				verdict = item.result.Verdict
+			}
+			packetMark = mergeMark(packetMark, item.result.PacketMark, item.result.PacketMarkMask)
+			connMark = mergeMark(connMark, item.result.ConnMark, item.result.ConnMarkMask)
+			if item.result.ConnMarkMask != 0 {
+				connMask |= item.result.ConnMarkMask
+			} else {
+				connMask |= item.result.ConnMark
+			}
+		}
+
+		// the packet is not going anywhere so there is no reason to call anyone else
+		if verdict != VerdictAccept {
+			break
+		}
+
+		// let the subscribers at later priorities see the modified packet
+		if changed {
+			mess.Packet = decodePacket(packetData)
+			mess.Length = len(packetData)
+			decodeNfqueueMessage(&mess)
 		}
 
 		// Increment the priority and keep looping until we've called all subscribers
@@ -320,8 +504,106 @@ func callSubscribers(ctid uint32, session *Session, mess NfqueueMessage, pmark u
 		}
 	}
 
-	// return the updated mark to be set on the packet
-	return NfAccept
+	if connMask != 0 {
+		err := UpdateConnmark(ctid, connMask, connMark)
+		if err != nil {
+			logger.Debug("%v\n", err)
+		}
+	}
+
+	// return the verdict and the updated mark to be set on the packet
+	switch verdict {
+	case VerdictDrop:
+		return kernel.NfqueueVerdict{Verdict: NfDrop, Mark: packetMark, Reject: kernel.RejectNone}
+	case VerdictRejectReset:
+		return kernel.NfqueueVerdict{Verdict: NfDrop, Mark: packetMark, Reject: kernel.RejectReset}
+	case VerdictRejectICMP:
+		return kernel.NfqueueVerdict{Verdict: NfDrop, Mark: packetMark, Reject: kernel.RejectICMP}
+	}
+	// we can't replace a fragment with a modified version of the reassembled packet
+	if packetData != nil && mess.Reassembled {
+		logger.Warn("Ignoring changes to reassembled packet for session %d\n", ctid)
+		packetData = nil
+	}
+
+	return kernel.NfqueueVerdict{Verdict: NfAccept, Mark: packetMark, Data: packetData}
+}
+
+// decodePacket creates a gopacket from raw IPv4 or IPv6 packet data
+func decodePacket(data []byte) gopacket.Packet {
+	if len(data) > 0 && data[0]&0xF0 == 0x40 {
+		return gopacket.NewPacket(data, layers.LayerTypeIPv4, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	}
+	return gopacket.NewPacket(data, layers.LayerTypeIPv6, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+}
+
+// ClonePacket returns a private copy of a packet that a subscriber can modify without
+// affecting the packet seen by other subscribers. Use SerializePacket to get the raw
+// data after changing the layers.
+func ClonePacket(packet gopacket.Packet) gopacket.Packet {
+	data := make([]byte, len(packet.Data()))
+	copy(data, packet.Data())
+	return decodePacket(data)
+}
+
+// SerializePacket returns the raw data for a packet after the network and transport layers
+// have been modified. The transport payload is copied unchanged. Lengths and checksums are
+// recalculated so the result can be returned in NfqueueResult.PacketData.
+func SerializePacket(packet gopacket.Packet) ([]byte, error) {
+	var list []gopacket.SerializableLayer
+	var network gopacket.NetworkLayer
+
+	for _, layer := range packet.Layers() {
+		item, ok := layer.(gopacket.SerializableLayer)
+		if !ok {
+			return nil, fmt.Errorf("Unable to serialize %v layer", layer.LayerType())
+		}
+		list = append(list, item)
+
+		transport := true
+		switch layer.LayerType() {
+		case layers.LayerTypeIPv4, layers.LayerTypeIPv6:
+			network = layer.(gopacket.NetworkLayer)
+			transport = false
+		case layers.LayerTypeTCP:
+			layer.(*layers.TCP).SetNetworkLayerForChecksum(network)
+		case layers.LayerTypeUDP:
+			layer.(*layers.UDP).SetNetworkLayerForChecksum(network)
+		case layers.LayerTypeICMPv6:
+			layer.(*layers.ICMPv6).SetNetworkLayerForChecksum(network)
+		case layers.LayerTypeICMPv4:
+		default:
+			transport = false
+		}
+
+		// once we have the transport layer everything else is payload
+		if transport {
+			list = append(list, gopacket.Payload(layer.LayerPayload()))
+			break
+		}
+	}
+
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	err := gopacket.SerializeLayers(buffer, options, list...)
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// acceptVerdict returns the verdict that accepts a packet with the argumented mark
+func acceptVerdict(pmark uint32) kernel.NfqueueVerdict {
+	return kernel.NfqueueVerdict{Verdict: NfAccept, Mark: pmark}
+}
+
+// mergeMark replaces the bits in mask with the bits from value
+// if the mask is zero the value is OR'ed with the mark
+func mergeMark(mark uint32, value uint32, mask uint32) uint32 {
+	if mask == 0 {
+		return mark | value
+	}
+	return (mark &^ mask) | (value & mask)
 }
 
 // createSession creates a new session and inserts the forward mapping
@@ -330,11 +612,11 @@ func createSession(mess NfqueueMessage, ctid uint32) *Session {
 	session := new(Session)
 	session.SetSessionID(nextSessionID())
 	session.SetConntrackID(ctid)
-	session.SetCreationTime(time.Now())
+	session.SetCreationTime(clock.Now())
 	session.SetPacketCount(1)
 	session.SetByteCount(uint64(mess.Length))
 	session.SetEventCount(1)
-	session.SetLastActivity(time.Now())
+	session.SetLastActivity(clock.Now())
 	session.SetClientSideTuple(mess.MsgTuple)
 	session.SetFamily(uint8(mess.Family))
 	session.SetConntrackConfirmed(false)
@@ -346,5 +628,5 @@ func createSession(mess NfqueueMessage, ctid uint32) *Session {
 
 // getMicroseconds returns the current clock in microseconds
 func getMicroseconds() int64 {
-	return time.Now().UnixNano() / int64(time.Microsecond)
+	return clock.Now().UnixNano() / int64(time.Microsecond)
 }
@@ -0,0 +1,75 @@
+package dispatch
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// TestIPv6ExtensionHeaders makes sure the tuple has the real protocol and ports
+// when the packet has IPv6 extension headers
+func TestIPv6ExtensionHeaders(t *testing.T) {
+	var mess NfqueueMessage
+
+	udp := &layers.UDP{SrcPort: 5353, DstPort: 5000}
+	ip6 := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolUDP, SrcIP: net.ParseIP("2001:db8::1"), DstIP: net.ParseIP("2001:db8::2")}
+	udp.SetNetworkLayerForChecksum(ip6)
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	gopacket.SerializeLayers(buffer, options, udp, gopacket.Payload([]byte("hello")))
+	transport := buffer.Bytes()
+
+	// hop-by-hop and destination options headers with PadN options
+	extensions := []byte{
+		byte(layers.IPProtocolIPv6Destination), 0, 1, 4, 0, 0, 0, 0,
+		byte(layers.IPProtocolUDP), 0, 1, 4, 0, 0, 0, 0,
+	}
+
+	header := make([]byte, 40)
+	header[0] = 0x60
+	length := len(extensions) + len(transport)
+	header[4] = byte(length >> 8)
+	header[5] = byte(length)
+	header[6] = byte(layers.IPProtocolIPv6HopByHop)
+	header[7] = 64
+	copy(header[8:24], ip6.SrcIP)
+	copy(header[24:40], ip6.DstIP)
+
+	data := append(append(header, extensions...), transport...)
+	mess.Packet = decodePacket(data)
+	if !decodeNfqueueMessage(&mess) {
+		t.Fatalf("Unable to decode IPv6 packet")
+	}
+
+	if mess.MsgTuple.Protocol != uint8(layers.IPProtocolUDP) {
+		t.Errorf("Protocol %d != %d", mess.MsgTuple.Protocol, layers.IPProtocolUDP)
+	}
+	if mess.MsgTuple.ClientPort != 5353 || mess.MsgTuple.ServerPort != 5000 {
+		t.Errorf("Unexpected ports %d %d", mess.MsgTuple.ClientPort, mess.MsgTuple.ServerPort)
+	}
+}
+
+// TestICMPv6Layer makes sure the ICMPv6 layer is set for ICMPv6 packets
+func TestICMPv6Layer(t *testing.T) {
+	var mess NfqueueMessage
+
+	ip6 := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolICMPv6, SrcIP: net.ParseIP("2001:db8::1"), DstIP: net.ParseIP("2001:db8::2")}
+	icmp := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeEchoRequest, 0)}
+	icmp.SetNetworkLayerForChecksum(ip6)
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	gopacket.SerializeLayers(buffer, options, ip6, icmp, &layers.ICMPv6Echo{Identifier: 1, SeqNumber: 1})
+
+	mess.Packet = decodePacket(buffer.Bytes())
+	if !decodeNfqueueMessage(&mess) {
+		t.Fatalf("Unable to decode IPv6 packet")
+	}
+	if mess.ICMPv6Layer == nil {
+		t.Fatalf("ICMPv6 layer not found")
+	}
+	if mess.MsgTuple.Protocol != uint8(layers.IPProtocolICMPv6) {
+		t.Errorf("Protocol %d != %d", mess.MsgTuple.Protocol, layers.IPProtocolICMPv6)
+	}
+}
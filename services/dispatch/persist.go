@@ -0,0 +1,254 @@
+package dispatch
+
+import (
+	"encoding"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/untangle/packetd/services/clock"
+	"github.com/untangle/packetd/services/logger"
+)
+
+// sessionStateFile is where the session table is saved so it can be restored after a restart
+const sessionStateFile = "/tmp/packetd_sessions.json"
+
+// sessionSaveInterval is the number of cleaner task passes between periodic saves
+const sessionSaveInterval = 5
+
+// savedSession holds the state of a session that is saved across restarts
+type savedSession struct {
+	SessionID           int64                      `json:"session_id"`
+	ConntrackID         uint32                     `json:"conntrack_id"`
+	Family              uint8                      `json:"family"`
+	CreationTime        time.Time                  `json:"creation_time"`
+	ClientSideTuple     Tuple                      `json:"client_side_tuple"`
+	ServerSideTuple     Tuple                      `json:"server_side_tuple"`
+	ClientInterfaceID   uint8                      `json:"client_interface_id"`
+	ClientInterfaceType uint8                      `json:"client_interface_type"`
+	ServerInterfaceID   uint8                      `json:"server_interface_id"`
+	ServerInterfaceType uint8                      `json:"server_interface_type"`
+	PacketCount         uint64                     `json:"packet_count"`
+	ByteCount           uint64                     `json:"byte_count"`
+	Attachments         map[string]json.RawMessage `json:"attachments"`
+}
+
+// savedState is the content of the session state file
+type savedState struct {
+	SaveTime time.Time       `json:"save_time"`
+	Sessions []*savedSession `json:"sessions"`
+}
+
+// restoredSessions holds the saved sessions waiting to be matched with a conntrack entry
+var restoredSessions map[uint32]*savedSession
+var restoredSessionsMutex sync.Mutex
+
+var textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+// persistentType returns true if attachments of the argumented type can be saved and
+// restored without losing anything. Complicated values like certificates are left behind.
+func persistentType(kind reflect.Type) bool {
+	switch kind.Kind() {
+	case reflect.Bool, reflect.String, reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return kind.Implements(textMarshalerType) && reflect.PtrTo(kind).Implements(textUnmarshalerType)
+}
+
+// createSavedSession returns the saved state of a session including
+// the declared attachments that can be restored
+func createSavedSession(sess *Session) *savedSession {
+	saved := new(savedSession)
+	saved.SessionID = sess.GetSessionID()
+	saved.ConntrackID = sess.GetConntrackID()
+	saved.Family = sess.GetFamily()
+	saved.CreationTime = sess.GetCreationTime()
+	saved.ClientSideTuple = sess.GetClientSideTuple()
+	saved.ServerSideTuple = sess.GetServerSideTuple()
+	saved.ClientInterfaceID = sess.GetClientInterfaceID()
+	saved.ClientInterfaceType = sess.GetClientInterfaceType()
+	saved.ServerInterfaceID = sess.GetServerInterfaceID()
+	saved.ServerInterfaceType = sess.GetServerInterfaceType()
+	saved.PacketCount = sess.GetPacketCount()
+	saved.ByteCount = sess.GetByteCount()
+	saved.Attachments = make(map[string]json.RawMessage)
+
+	for name, value := range sess.GetAllAttachments() {
+		attachmentSchemaMutex.RLock()
+		schema := attachmentSchema[name]
+		attachmentSchemaMutex.RUnlock()
+		if schema == nil || value == nil || !persistentType(schema.valueType) {
+			continue
+		}
+		data, err := json.Marshal(value)
+		if err != nil {
+			logger.Debug("Unable to save attachment %s: %v\n", name, err)
+			continue
+		}
+		saved.Attachments[name] = data
+	}
+
+	return saved
+}
+
+// createRestoredSession creates a session from the saved state. Attachments are
+// decoded using their declared type and any that are no longer declared are dropped.
+func createRestoredSession(saved *savedSession) *Session {
+	session := new(Session)
+	session.SetSessionID(saved.SessionID)
+	session.SetConntrackID(saved.ConntrackID)
+	session.SetFamily(saved.Family)
+	session.SetCreationTime(saved.CreationTime)
+	session.SetClientSideTuple(saved.ClientSideTuple)
+	session.SetServerSideTuple(saved.ServerSideTuple)
+	session.SetClientInterfaceID(saved.ClientInterfaceID)
+	session.SetClientInterfaceType(saved.ClientInterfaceType)
+	session.SetServerInterfaceID(saved.ServerInterfaceID)
+	session.SetServerInterfaceType(saved.ServerInterfaceType)
+	session.SetPacketCount(saved.PacketCount)
+	session.SetByteCount(saved.ByteCount)
+	session.SetLastActivity(clock.Now())
+	session.attachments = make(map[string]interface{})
+
+	for name, data := range saved.Attachments {
+		attachmentSchemaMutex.RLock()
+		schema := attachmentSchema[name]
+		attachmentSchemaMutex.RUnlock()
+		if schema == nil || !persistentType(schema.valueType) {
+			continue
+		}
+		value := reflect.New(schema.valueType)
+		if err := json.Unmarshal(data, value.Interface()); err != nil {
+			logger.Debug("Unable to restore attachment %s: %v\n", name, err)
+			continue
+		}
+		session.attachments[name] = value.Elem().Interface()
+	}
+
+	return session
+}
+
+// writeSessionState writes the state of the argumented sessions to a file
+func writeSessionState(filename string, sessions []*Session) error {
+	state := savedState{SaveTime: time.Now()}
+	for _, sess := range sessions {
+		state.Sessions = append(state.Sessions, createSavedSession(sess))
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first so a crash never leaves a partial file behind
+	err = ioutil.WriteFile(filename+".tmp", data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(filename+".tmp", filename)
+}
+
+// readSessionState reads the saved sessions from a file
+func readSessionState(filename string) ([]*savedSession, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var state savedState
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return nil, err
+	}
+	return state.Sessions, nil
+}
+
+// saveSessions saves the conntrack confirmed sessions so they can be restored after a restart
+func saveSessions() {
+	var sessions []*Session
+
+	for _, sess := range sessionTable.list() {
+		if sess.GetConntrackConfirmed() {
+			sessions = append(sessions, sess)
+		}
+	}
+
+	err := writeSessionState(sessionStateFile, sessions)
+	if err != nil {
+		logger.Warn("Unable to save sessions: %v\n", err)
+		return
+	}
+	logger.Debug("Saved %d sessions\n", len(sessions))
+}
+
+// loadSessions loads the sessions saved by a previous instance. They are held until the
+// conntrack dump or a packet finds the matching conntrack entry. The state file is removed
+// so the saved sessions are only ever used once.
+func loadSessions() {
+	saved, err := readSessionState(sessionStateFile)
+	os.Remove(sessionStateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warn("Unable to load saved sessions: %v\n", err)
+		}
+		return
+	}
+
+	restoredSessionsMutex.Lock()
+	restoredSessions = make(map[uint32]*savedSession, len(saved))
+	for _, item := range saved {
+		restoredSessions[item.ConntrackID] = item
+	}
+	restoredSessionsMutex.Unlock()
+
+	logger.Info("Loaded %d saved sessions\n", len(saved))
+}
+
+// discardRestoredSessions forgets any saved sessions that did not match a conntrack entry
+func discardRestoredSessions() {
+	restoredSessionsMutex.Lock()
+	count := len(restoredSessions)
+	restoredSessions = nil
+	restoredSessionsMutex.Unlock()
+
+	if count != 0 {
+		logger.Info("Discarded %d saved sessions that no longer exist\n", count)
+	}
+}
+
+// restoreSession returns the saved session for the argumented ctid if the tuple matches
+// the saved session in either direction. The session is inserted into the session table
+// without any nfqueue subscriptions since the plugins have missed the start of the session.
+func restoreSession(ctid uint32, tuple Tuple) *Session {
+	restoredSessionsMutex.Lock()
+	saved := restoredSessions[ctid]
+	if saved == nil || !(saved.ClientSideTuple.Equal(tuple) || saved.ClientSideTuple.EqualReverse(tuple)) {
+		restoredSessionsMutex.Unlock()
+		return nil
+	}
+	delete(restoredSessions, ctid)
+	restoredSessionsMutex.Unlock()
+
+	session := createRestoredSession(saved)
+	session.SetConntrackConfirmed(true)
+	insertSessionTable(ctid, session)
+	bypassSession(session)
+
+	logger.Debug("%OC|Restored session %d %v\n", "session_restored", 0, saved.SessionID, saved.ClientSideTuple)
+	return session
+}
+
+// linkRestoredSession connects a restored session with its conntrack entry
+func linkRestoredSession(session *Session, conntrack *Conntrack) {
+	session.SetConntrackPointer(conntrack)
+	conntrack.Guardian.Lock()
+	conntrack.Session = session
+	conntrack.SessionID = session.GetSessionID()
+	conntrack.Guardian.Unlock()
+}
@@ -0,0 +1,75 @@
+package dispatch
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestSessionState checks that sessions and their attachments survive a save and restore
+func TestSessionState(t *testing.T) {
+	directory, err := ioutil.TempDir("", "packetd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(directory)
+
+	DeclareAttachment("test", "test_string", "", "test string")
+	DeclareAttachment("test", "test_count", int32(0), "test count")
+	DeclareAttachment("test", "test_address", net.IP{}, "test address")
+	DeclareAttachment("test", "test_time", time.Time{}, "test time")
+	DeclareAttachment("test", "test_certificate", &x509.Certificate{}, "test certificate")
+
+	stamp := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	tuple := Tuple{Protocol: 6, ClientAddress: net.ParseIP("192.168.1.100"), ClientPort: 40000, ServerAddress: net.ParseIP("10.1.1.1"), ServerPort: 443}
+
+	sess := new(Session)
+	sess.SetSessionID(1234)
+	sess.SetConntrackID(99)
+	sess.SetClientSideTuple(tuple)
+	sess.SetCreationTime(stamp)
+	sess.attachments = map[string]interface{}{
+		"test_string":      "hello",
+		"test_count":       int32(7),
+		"test_address":     net.ParseIP("8.8.8.8"),
+		"test_time":        stamp,
+		"test_certificate": &x509.Certificate{},
+		"test_undeclared":  "lost",
+	}
+
+	filename := filepath.Join(directory, "sessions.json")
+	if err := writeSessionState(filename, []*Session{sess}); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := readSessionState(filename)
+	if err != nil || len(saved) != 1 {
+		t.Fatalf("Unable to read the saved sessions: %v %v", saved, err)
+	}
+
+	restored := createRestoredSession(saved[0])
+	if restored.GetSessionID() != 1234 || restored.GetConntrackID() != 99 || !restored.GetClientSideTuple().Equal(tuple) {
+		t.Errorf("Wrong restored session: %d %d %v", restored.GetSessionID(), restored.GetConntrackID(), restored.GetClientSideTuple())
+	}
+	if !restored.GetCreationTime().Equal(stamp) {
+		t.Errorf("Wrong creation time: %v", restored.GetCreationTime())
+	}
+	if value, _ := restored.GetAttachmentString("test_string"); value != "hello" {
+		t.Errorf("Wrong test_string: %v", value)
+	}
+	if value := restored.GetAttachment("test_count"); value != int32(7) {
+		t.Errorf("Wrong test_count: %#v", value)
+	}
+	if value, ok := restored.GetAttachment("test_address").(net.IP); !ok || !value.Equal(net.ParseIP("8.8.8.8")) {
+		t.Errorf("Wrong test_address: %#v", restored.GetAttachment("test_address"))
+	}
+	if value, _ := restored.GetAttachmentTime("test_time"); !value.Equal(stamp) {
+		t.Errorf("Wrong test_time: %v", value)
+	}
+	if restored.GetAttachment("test_certificate") != nil || restored.GetAttachment("test_undeclared") != nil {
+		t.Errorf("Attachments that can't be restored were restored")
+	}
+}
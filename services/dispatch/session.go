@@ -5,6 +5,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/untangle/packetd/services/clock"
 	"github.com/untangle/packetd/services/dict"
 	"github.com/untangle/packetd/services/logger"
 	"github.com/untangle/packetd/services/overseer"
@@ -66,6 +67,9 @@ type Session struct {
 	// family stores the family indicator of the session
 	family uint32
 
+	// finished is set once the session end subscribers have been notified
+	finished uint32
+
 	// conntrackConfirmed is true if this session has been confirmed by conntrack. false otherwise
 	// A session becomes confirmed by conntrack once its packet reaches the final CONNTRACK_CONFIRM
 	// priority in netfilter, and we get an conntrack "NEW" event for it.
@@ -87,57 +91,22 @@ type Session struct {
 	// used to keep track of the last session activity
 	lastActivityTime time.Time
 	lastActivityLock sync.RWMutex
+
+	// stream holds the reassembled TCP data when a subscriber wants it
+	stream     *TCPStream
+	streamLock sync.RWMutex
+
+	// sequence holds the last TCP sequence numbers seen by nfqueue
+	sequence     tcpSequence
+	sequenceLock sync.Mutex
 }
 
 // sessionTable is the global session table
-var sessionTable map[uint32]*Session
-
-// sessionMutex is the lock for sessionTable
-var sessionMutex sync.RWMutex
+var sessionTable sessionShardTable
 
 // sessionIndex stores the next available unique SessionID
 var sessionIndex int64
 
-// PutAttachment is used to safely add an attachment to a session object
-func (sess *Session) PutAttachment(name string, value interface{}) {
-	sess.attachmentLock.Lock()
-	sess.attachments[name] = value
-	sess.attachmentLock.Unlock()
-}
-
-// GetAttachment is used to safely get an attachment from a session object
-func (sess *Session) GetAttachment(name string) interface{} {
-	sess.attachmentLock.RLock()
-	value := sess.attachments[name]
-	sess.attachmentLock.RUnlock()
-	return value
-}
-
-// DeleteAttachment is used to safely delete an attachment from a session object
-func (sess *Session) DeleteAttachment(name string) bool {
-	sess.attachmentLock.Lock()
-	value := sess.attachments[name]
-	delete(sess.attachments, name)
-	sess.attachmentLock.Unlock()
-
-	if value == nil {
-		return false
-	}
-
-	return true
-}
-
-// LockAttachments locks the attatchments mutex and returns the attachment map to the caller
-func (sess *Session) LockAttachments() map[string]interface{} {
-	sess.attachmentLock.Lock()
-	return (sess.attachments)
-}
-
-// UnlockAttachments unlocks the attachments mutex
-func (sess *Session) UnlockAttachments() {
-	sess.attachmentLock.Unlock()
-}
-
 // GetSessionID gets the session ID
 func (sess *Session) GetSessionID() int64 {
 	return atomic.LoadInt64(&sess.sessionID)
@@ -171,8 +140,10 @@ func (sess *Session) GetClientSideTuple() Tuple {
 // SetClientSideTuple sets the client side Tuple
 func (sess *Session) SetClientSideTuple(tuple Tuple) {
 	sess.clientSideLock.Lock()
+	previous := sess.clientSideTuple
 	sess.clientSideTuple = tuple
 	sess.clientSideLock.Unlock()
+	sessionTable.updateIndex(&sessionTable.byClient, sess, previous, tuple)
 }
 
 // GetServerSideTuple gets the server side Tuple
@@ -186,8 +157,10 @@ func (sess *Session) GetServerSideTuple() Tuple {
 // SetServerSideTuple sets the server side Tuple
 func (sess *Session) SetServerSideTuple(tuple Tuple) {
 	sess.serverSideLock.Lock()
+	previous := sess.serverSideTuple
 	sess.serverSideTuple = tuple
 	sess.serverSideLock.Unlock()
+	sessionTable.updateIndex(&sessionTable.byServer, sess, previous, tuple)
 }
 
 // GetServerInterfaceID gets the server interface ID
@@ -345,6 +318,11 @@ func (sess *Session) SetConntrackConfirmed(argument bool) {
 	}
 }
 
+// setFinished sets the finished flag and returns true if it was not already set
+func (sess *Session) setFinished() bool {
+	return atomic.CompareAndSwapUint32(&sess.finished, 0, 1)
+}
+
 // GetConntrackPointer gets the conntrack pointer
 func (sess *Session) GetConntrackPointer() *Conntrack {
 	sess.conntrackLock.RLock()
@@ -371,106 +349,146 @@ func (sess *Session) SetFamily(value uint8) uint8 {
 	return value
 }
 
+// GetTCPStream gets the reassembled TCP stream or nil if no subscriber wants it
+func (sess *Session) GetTCPStream() *TCPStream {
+	sess.streamLock.RLock()
+	defer sess.streamLock.RUnlock()
+	return sess.stream
+}
+
+// setTCPStream sets the reassembled TCP stream
+func (sess *Session) setTCPStream(stream *TCPStream) {
+	sess.streamLock.Lock()
+	sess.stream = stream
+	sess.streamLock.Unlock()
+}
+
 // removeFromSessionTable removes the session from the session table
 // it does a sanity check to make sure the session in question
 // is actually in the table
 func (sess *Session) removeFromSessionTable() {
-	sessionMutex.Lock()
-	sessInTable, found := sessionTable[sess.GetConntrackID()]
-	if found && sess == sessInTable {
-		delete(sessionTable, sess.GetConntrackID())
-	}
-	sessionMutex.Unlock()
+	sessionTable.remove(sess.GetConntrackID(), sess)
+	sess.finishSession()
 }
 
 // flushDict flushes the dict for the session
 // it does a sanity check to make sure it ows its ctid
 // by doing a lookup in the session table
 func (sess *Session) flushDict() {
-	sessionMutex.Lock()
-	sessInTable, found := sessionTable[sess.GetConntrackID()]
-	if found && sess == sessInTable {
-		dict.DeleteSession(sess.GetConntrackID())
+	ctid := sess.GetConntrackID()
+	shard := sessionTable.getShard(ctid)
+	shard.locker.Lock()
+	if shard.table[ctid] == sess {
+		dict.DeleteSession(ctid)
 	}
-	sessionMutex.Unlock()
+	shard.locker.Unlock()
 }
 
 // nextSessionID returns the next sequential session ID value
 func nextSessionID() int64 {
-	var value int64
-	sessionMutex.Lock()
-	value = sessionIndex
-	sessionIndex++
-
-	if sessionIndex < 0 {
-		sessionIndex = 1
+	for {
+		value := atomic.LoadInt64(&sessionIndex)
+		next := value + 1
+		if next < 0 {
+			next = 1
+		}
+		if atomic.CompareAndSwapInt64(&sessionIndex, value, next) {
+			return value
+		}
 	}
-
-	sessionMutex.Unlock()
-	return (value)
 }
 
 // findSession searches for an sess in the session table
 func findSession(ctid uint32) *Session {
-	sessionMutex.RLock()
-	sess, status := sessionTable[ctid]
-	logger.Trace("Lookup session index %v -> %v\n", ctid, status)
-	sessionMutex.RUnlock()
-	if status == false {
-		return nil
-	}
+	sess := sessionTable.find(ctid)
+	logger.Trace("Lookup session index %v -> %v\n", ctid, sess != nil)
 	return sess
 }
 
+// FindSession returns the session for the argumented conntrack ID or nil if not found
+func FindSession(ctid uint32) *Session {
+	return findSession(ctid)
+}
+
+// FindSessionByClientTuple returns the session with the argumented client side (pre-NAT)
+// tuple or nil if not found. Packets from the server have the reverse of this tuple.
+func FindSessionByClientTuple(tuple Tuple) *Session {
+	return sessionTable.byClient.find(tupleKey(tuple))
+}
+
+// FindSessionByServerTuple returns the session with the argumented server side (post-NAT)
+// tuple or nil if not found. The server side tuple is not known until conntrack confirms
+// the session.
+func FindSessionByServerTuple(tuple Tuple) *Session {
+	return sessionTable.byServer.find(tupleKey(tuple))
+}
+
+// FindSessionByID returns the session with the argumented session ID or nil if not found
+func FindSessionByID(sessionID int64) *Session {
+	return sessionTable.byID.find(sessionID)
+}
+
 // insertSessionTable adds an sess to the session table
 func insertSessionTable(ctid uint32, sess *Session) {
 	logger.Trace("Insert session index %v -> %v\n", ctid, sess.GetClientSideTuple())
-	sessionMutex.Lock()
-	if sessionTable[ctid] != nil {
+	previous := sessionTable.insert(ctid, sess)
+	if previous != nil {
 		logger.Warn("Overriding previous session: %v\n", ctid)
-		delete(sessionTable, ctid)
+		previous.finishSession()
 	}
-	sessionTable[ctid] = sess
-	sessionMutex.Unlock()
 	dict.AddSessionEntry(sess.GetConntrackID(), "session_id", sess.GetSessionID())
 }
 
 // cleanSessionTable cleans the session table by removing stale entries
+// Each shard is cleaned separately so only a small part of the table is locked at a time
 func cleanSessionTable() {
-	sessionMutex.Lock()
-	defer sessionMutex.Unlock()
+	for x := range sessionTable.shards {
+		cleanSessionShard(&sessionTable.shards[x])
+	}
+}
+
+// cleanSessionShard removes the stale sessions from a session table shard
+func cleanSessionShard(shard *sessionShard) {
+	var stale []*Session
 
-	for ctid, session := range sessionTable {
+	shard.locker.Lock()
+	for ctid, session := range shard.table {
 		// Having stale sessions is normal if sessions get blocked. Their conntrack is
 		// never get confirmed and thus there is never a delete conntrack event so we
 		// clean those session up quickly to keep the dict from getting huge.
 		// However, if we find a a stale conntrack-confirmed session that is bad.
 		if session.GetConntrackConfirmed() {
 			// We use 10000 seconds for confirmed sessions because 7440 is the established idle tcp timeout default
-			if time.Now().Sub(session.GetLastActivity()) > 10000*time.Second {
-				logger.Err("%OC|Removing stale (%v) session [%v] %v\n", "stale_session_removed", 0, time.Now().Sub(session.GetLastActivity()), ctid, session.GetClientSideTuple())
+			if clock.Since(session.GetLastActivity()) > 10000*time.Second {
+				logger.Err("%OC|Removing stale (%v) session [%v] %v\n", "stale_session_removed", 0, clock.Since(session.GetLastActivity()), ctid, session.GetClientSideTuple())
 				dict.DeleteSession(ctid)
-				delete(sessionTable, ctid)
+				delete(shard.table, ctid)
+				stale = append(stale, session)
 			}
 		} else {
 			// We remove unconfirmed sessions after 60 seconds to keep things lean and clean
-			if time.Now().Sub(session.GetLastActivity()) > 60*time.Second {
+			if clock.Since(session.GetLastActivity()) > 60*time.Second {
 				if logger.IsTraceEnabled() {
-					logger.Err("Removing unconfirmed (%v) session [%v] %v\n", time.Now().Sub(session.GetLastActivity()), ctid, session.GetClientSideTuple())
+					logger.Err("Removing unconfirmed (%v) session [%v] %v\n", clock.Since(session.GetLastActivity()), ctid, session.GetClientSideTuple())
 				}
 				overseer.AddCounter("unconfirmed_session_removed", 1)
 				dict.DeleteSession(ctid)
-				delete(sessionTable, ctid)
+				delete(shard.table, ctid)
+				stale = append(stale, session)
 			}
 		}
 	}
+	shard.locker.Unlock()
+
+	for _, session := range stale {
+		sessionTable.removeIndexes(session)
+		session.finishSession()
+	}
 }
 
 // printSessionTable prints the session table
 func printSessionTable() {
-	sessionMutex.RLock()
-	defer sessionMutex.RUnlock()
-	for k, v := range sessionTable {
-		logger.Debug("Session[%v] = %s\n", k, v.GetClientSideTuple().String())
+	for _, v := range sessionTable.list() {
+		logger.Debug("Session[%v] = %s\n", v.GetConntrackID(), v.GetClientSideTuple().String())
 	}
 }
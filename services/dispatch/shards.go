@@ -0,0 +1,171 @@
+package dispatch
+
+import (
+	"sync"
+)
+
+// tableShardCount is the number of shards in the session and conntrack tables
+// and must be a power of two
+const tableShardCount = 64
+
+// tableShardBits is log2 of tableShardCount
+const tableShardBits = 6
+
+// sessionShard is a single shard of the session table
+type sessionShard struct {
+	table  map[uint32]*Session
+	locker sync.RWMutex
+}
+
+// sessionShardTable is the session table split into shards by conntrack ID so
+// lookups and changes for different sessions don't contend for the same lock.
+// It also maintains secondary indexes by client and server tuple and session ID.
+type sessionShardTable struct {
+	shards   [tableShardCount]sessionShard
+	byClient tupleIndex
+	byServer tupleIndex
+	byID     sessionIDIndex
+}
+
+// conntrackShard is a single shard of the conntrack table
+type conntrackShard struct {
+	table  map[uint32]*Conntrack
+	locker sync.RWMutex
+}
+
+// conntrackShardTable is the conntrack table split into shards by conntrack ID
+type conntrackShardTable struct {
+	shards [tableShardCount]conntrackShard
+}
+
+// shardIndex returns the shard for a conntrack ID. The kernel doesn't promise anything
+// about how the ID values are distributed so we mix the bits with a multiplicative hash.
+func shardIndex(ctid uint32) uint32 {
+	return (ctid * 2654435761) >> (32 - tableShardBits)
+}
+
+// initialize creates empty maps for all of the session shards
+func (st *sessionShardTable) initialize() {
+	for x := range st.shards {
+		st.shards[x].locker.Lock()
+		st.shards[x].table = make(map[uint32]*Session)
+		st.shards[x].locker.Unlock()
+	}
+	st.byClient.initialize()
+	st.byServer.initialize()
+	st.byID.initialize()
+}
+
+// getShard returns the shard for the argumented conntrack ID
+func (st *sessionShardTable) getShard(ctid uint32) *sessionShard {
+	return &st.shards[shardIndex(ctid)]
+}
+
+// find returns the session for the argumented conntrack ID or nil if not found
+func (st *sessionShardTable) find(ctid uint32) *Session {
+	shard := st.getShard(ctid)
+	shard.locker.RLock()
+	sess := shard.table[ctid]
+	shard.locker.RUnlock()
+	return sess
+}
+
+// insert adds a session to the table and returns the session it replaced or nil
+func (st *sessionShardTable) insert(ctid uint32, sess *Session) *Session {
+	shard := st.getShard(ctid)
+	shard.locker.Lock()
+	previous := shard.table[ctid]
+	shard.table[ctid] = sess
+	st.addIndexes(sess)
+	shard.locker.Unlock()
+
+	if previous != nil && previous != sess {
+		st.removeIndexes(previous)
+	}
+	return previous
+}
+
+// remove removes the argumented session from the table but only if it is the session
+// currently stored for the conntrack ID. It returns true if the session was removed.
+func (st *sessionShardTable) remove(ctid uint32, sess *Session) bool {
+	shard := st.getShard(ctid)
+	shard.locker.Lock()
+	if shard.table[ctid] != sess {
+		shard.locker.Unlock()
+		return false
+	}
+	delete(shard.table, ctid)
+	shard.locker.Unlock()
+
+	st.removeIndexes(sess)
+	return true
+}
+
+// list returns all of the sessions in the table
+func (st *sessionShardTable) list() []*Session {
+	var sessions []*Session
+
+	for x := range st.shards {
+		shard := &st.shards[x]
+		shard.locker.RLock()
+		for _, sess := range shard.table {
+			sessions = append(sessions, sess)
+		}
+		shard.locker.RUnlock()
+	}
+	return sessions
+}
+
+// initialize creates empty maps for all of the conntrack shards
+func (ct *conntrackShardTable) initialize() {
+	for x := range ct.shards {
+		ct.shards[x].locker.Lock()
+		ct.shards[x].table = make(map[uint32]*Conntrack)
+		ct.shards[x].locker.Unlock()
+	}
+}
+
+// getShard returns the shard for the argumented conntrack ID
+func (ct *conntrackShardTable) getShard(ctid uint32) *conntrackShard {
+	return &ct.shards[shardIndex(ctid)]
+}
+
+// find returns the conntrack entry for the argumented conntrack ID or nil if not found
+func (ct *conntrackShardTable) find(ctid uint32) *Conntrack {
+	shard := ct.getShard(ctid)
+	shard.locker.RLock()
+	entry := shard.table[ctid]
+	shard.locker.RUnlock()
+	return entry
+}
+
+// insert adds a conntrack entry to the table replacing any existing entry
+func (ct *conntrackShardTable) insert(ctid uint32, entry *Conntrack) {
+	shard := ct.getShard(ctid)
+	shard.locker.Lock()
+	shard.table[ctid] = entry
+	shard.locker.Unlock()
+}
+
+// remove removes the entry for the argumented conntrack ID from the table
+func (ct *conntrackShardTable) remove(ctid uint32) {
+	shard := ct.getShard(ctid)
+	shard.locker.Lock()
+	delete(shard.table, ctid)
+	shard.locker.Unlock()
+}
+
+// copy returns a copy of the table with the same entry pointers
+func (ct *conntrackShardTable) copy() map[uint32]*Conntrack {
+	newMap := make(map[uint32]*Conntrack)
+
+	for x := range ct.shards {
+		shard := &ct.shards[x]
+		shard.locker.RLock()
+		for ctid, entry := range shard.table {
+			newMap[ctid] = entry
+		}
+		shard.locker.RUnlock()
+	}
+	return newMap
+}
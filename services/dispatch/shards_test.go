@@ -0,0 +1,185 @@
+package dispatch
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// singleLockTable is the session table the way it was before sharding
+// with a single map and a single lock, used for comparison
+type singleLockTable struct {
+	table  map[uint32]*Session
+	locker sync.RWMutex
+	index  int64
+}
+
+func (st *singleLockTable) find(ctid uint32) *Session {
+	st.locker.RLock()
+	sess := st.table[ctid]
+	st.locker.RUnlock()
+	return sess
+}
+
+func (st *singleLockTable) insert(ctid uint32, sess *Session) {
+	st.locker.Lock()
+	st.table[ctid] = sess
+	st.locker.Unlock()
+}
+
+func (st *singleLockTable) remove(ctid uint32, sess *Session) {
+	st.locker.Lock()
+	if st.table[ctid] == sess {
+		delete(st.table, ctid)
+	}
+	st.locker.Unlock()
+}
+
+func (st *singleLockTable) nextSessionID() int64 {
+	st.locker.Lock()
+	value := st.index
+	st.index++
+	st.locker.Unlock()
+	return value
+}
+
+// tableBenchmarkSize is the number of sessions in the tables for the benchmarks
+const tableBenchmarkSize = 16384
+
+// runTableBenchmark simulates the table operations for packet processing with mostly
+// lookups and an occasional new session replacing an old one
+func runTableBenchmark(b *testing.B, find func(uint32) *Session, insert func(uint32, *Session), remove func(uint32, *Session)) {
+	var seed int64
+
+	sessions := make([]*Session, tableBenchmarkSize)
+	for x := range sessions {
+		sessions[x] = new(Session)
+		sessions[x].SetConntrackID(uint32(x * 8))
+		insert(uint32(x*8), sessions[x])
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		random := rand.New(rand.NewSource(atomic.AddInt64(&seed, 1)))
+		for pb.Next() {
+			index := random.Intn(tableBenchmarkSize)
+			ctid := uint32(index * 8)
+			if random.Intn(10) != 0 {
+				find(ctid)
+				continue
+			}
+			sess := find(ctid)
+			if sess != nil {
+				remove(ctid, sess)
+				insert(ctid, sess)
+			}
+		}
+	})
+}
+
+// BenchmarkSingleLockTable measures the single lock session table under contention
+func BenchmarkSingleLockTable(b *testing.B) {
+	table := &singleLockTable{table: make(map[uint32]*Session)}
+	runTableBenchmark(b, table.find, table.insert, table.remove)
+}
+
+// BenchmarkShardedTable measures the sharded session table under contention
+func BenchmarkShardedTable(b *testing.B) {
+	table := new(sessionShardTable)
+	table.initialize()
+	runTableBenchmark(b, table.find, func(ctid uint32, sess *Session) { table.insert(ctid, sess) }, func(ctid uint32, sess *Session) { table.remove(ctid, sess) })
+}
+
+// BenchmarkSingleLockSessionID measures session ID generation with a lock
+func BenchmarkSingleLockSessionID(b *testing.B) {
+	table := &singleLockTable{table: make(map[uint32]*Session)}
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			table.nextSessionID()
+		}
+	})
+}
+
+// BenchmarkSessionID measures the lock free session ID generation
+func BenchmarkSessionID(b *testing.B) {
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			nextSessionID()
+		}
+	})
+}
+
+// TestShardIndex makes sure sequential and aligned conntrack IDs are spread across all shards
+func TestShardIndex(t *testing.T) {
+	for _, step := range []uint32{1, 8, 64, 256} {
+		counts := make([]int, tableShardCount)
+		for x := uint32(0); x < tableShardCount*64; x++ {
+			counts[shardIndex(x*step)]++
+		}
+		for index, count := range counts {
+			if count == 0 {
+				t.Errorf("Shard %d is empty for step %d", index, step)
+			}
+		}
+	}
+}
+
+// TestSessionIndexes makes sure the secondary indexes follow the session table
+func TestSessionIndexes(t *testing.T) {
+	table := new(sessionShardTable)
+	table.initialize()
+
+	client := Tuple{Protocol: 6, ClientAddress: net.IP{192, 168, 1, 100}, ClientPort: 40000, ServerAddress: net.IP{1, 2, 3, 4}, ServerPort: 443}
+	server := Tuple{Protocol: 6, ClientAddress: net.IP{10, 0, 0, 1}, ClientPort: 50000, ServerAddress: net.IP{1, 2, 3, 4}, ServerPort: 443}
+
+	first := new(Session)
+	first.SetConntrackID(100)
+	first.SetSessionID(1)
+	first.SetClientSideTuple(client)
+	table.insert(100, first)
+
+	if table.byClient.find(tupleKey(client)) != first || table.byID.find(1) != first {
+		t.Fatalf("Session not found in the indexes after insert")
+	}
+
+	first.serverSideTuple = server
+	table.updateIndex(&table.byServer, first, Tuple{}, server)
+	if table.byServer.find(tupleKey(server)) != first {
+		t.Fatalf("Session not found by server tuple after update")
+	}
+
+	// a new session with the same conntrack ID and client tuple replaces the first one
+	second := new(Session)
+	second.SetConntrackID(100)
+	second.SetSessionID(2)
+	second.SetClientSideTuple(client)
+	table.insert(100, second)
+
+	if table.byClient.find(tupleKey(client)) != second {
+		t.Errorf("Replaced session still found by client tuple")
+	}
+	if table.byID.find(1) != nil || table.byServer.find(tupleKey(server)) != nil {
+		t.Errorf("Replaced session still in the indexes")
+	}
+
+	// removing the replaced session must not touch the new one
+	table.remove(100, first)
+	if table.byID.find(2) != second {
+		t.Errorf("Removing a replaced session removed the new session")
+	}
+
+	table.remove(100, second)
+	if table.byClient.find(tupleKey(client)) != nil || table.byID.find(2) != nil {
+		t.Errorf("Session still in the indexes after remove")
+	}
+
+	// changing the tuple of a session that isn't in the table must not index it
+	second.serverSideTuple = server
+	table.updateIndex(&table.byServer, second, Tuple{}, server)
+	if table.byServer.find(tupleKey(server)) != nil {
+		t.Errorf("Removed session was indexed by server tuple")
+	}
+}
@@ -0,0 +1,196 @@
+package dispatch
+
+import (
+	"sync"
+
+	"github.com/google/gopacket/layers"
+)
+
+// StreamClientToServer selects the data sent from the client to the server
+const StreamClientToServer = 0
+
+// StreamServerToClient selects the data sent from the server to the client
+const StreamServerToClient = 1
+
+// streamDataLimit is the maximum number of bytes we reassemble in each direction
+const streamDataLimit = 32768
+
+// streamSegmentLimit is the maximum number of out of order segments we hold in each direction
+const streamSegmentLimit = 32
+
+// streamDirection holds the reassembled data for one direction of a TCP session
+type streamDirection struct {
+	started  bool
+	nextSeq  uint32
+	data     []byte
+	segments map[uint32][]byte
+	held     int
+	full     bool
+}
+
+// TCPStream holds the reassembled data for both directions of a TCP session. Data is
+// collected from the start of each direction until the limit is reached. Retransmitted
+// data is ignored and segments that arrive out of order are held until the missing data
+// arrives. Subscribers opt in by setting ReassembleStream in their NfqueueFilter and
+// read the data using the Stream in the NfqueueMessage.
+type TCPStream struct {
+	directions [2]streamDirection
+	locker     sync.Mutex
+}
+
+// Data returns the contiguous data received so far in the argumented direction. The
+// returned slice must not be modified.
+func (ts *TCPStream) Data(direction int) []byte {
+	ts.locker.Lock()
+	defer ts.locker.Unlock()
+	dir := &ts.directions[direction]
+	return dir.data[:len(dir.data):len(dir.data)]
+}
+
+// Full returns true if the data limit has been reached in the argumented direction
+// and no more data will be added
+func (ts *TCPStream) Full(direction int) bool {
+	ts.locker.Lock()
+	defer ts.locker.Unlock()
+	return ts.directions[direction].full
+}
+
+// addSegment adds a TCP segment to the stream
+func (ts *TCPStream) addSegment(direction int, tcp *layers.TCP, payload []byte) {
+	ts.locker.Lock()
+	defer ts.locker.Unlock()
+
+	dir := &ts.directions[direction]
+	if dir.full {
+		return
+	}
+
+	// the SYN uses a sequence number so the data starts at the next one, and if we
+	// didn't see the SYN we just start with the first segment we get
+	if !dir.started {
+		dir.started = true
+		dir.nextSeq = tcp.Seq
+		if tcp.SYN {
+			dir.nextSeq++
+		}
+	}
+
+	if len(payload) == 0 {
+		return
+	}
+
+	seq := tcp.Seq
+	if tcp.SYN {
+		seq++
+	}
+
+	// segments from the future are held until the data before them arrives
+	if int32(seq-dir.nextSeq) > 0 {
+		dir.holdSegment(seq, payload)
+		return
+	}
+
+	dir.appendSegment(seq, payload)
+
+	// add any held segments that are now contiguous with the data
+	for len(dir.segments) != 0 && !dir.full {
+		found := false
+		for held, data := range dir.segments {
+			if int32(held-dir.nextSeq) > 0 {
+				continue
+			}
+			delete(dir.segments, held)
+			dir.held -= len(data)
+			dir.appendSegment(held, data)
+			found = true
+			break
+		}
+		if !found {
+			break
+		}
+	}
+
+	if dir.full {
+		dir.segments = nil
+		dir.held = 0
+	}
+}
+
+// appendSegment adds the part of a segment that we don't already have to the data
+func (dir *streamDirection) appendSegment(seq uint32, payload []byte) {
+	overlap := int(dir.nextSeq - seq)
+	if overlap >= len(payload) {
+		return
+	}
+	payload = payload[overlap:]
+
+	if len(dir.data)+len(payload) >= streamDataLimit {
+		payload = payload[:streamDataLimit-len(dir.data)]
+		dir.full = true
+	}
+
+	dir.data = append(dir.data, payload...)
+	dir.nextSeq += uint32(len(payload))
+}
+
+// holdSegment makes a copy of a segment that arrived out of order
+func (dir *streamDirection) holdSegment(seq uint32, payload []byte) {
+	if dir.segments == nil {
+		dir.segments = make(map[uint32][]byte)
+	}
+
+	previous, found := dir.segments[seq]
+	if found && len(previous) >= len(payload) {
+		return
+	}
+
+	if len(dir.segments) >= streamSegmentLimit || dir.held+len(payload)-len(previous) > streamDataLimit {
+		return
+	}
+
+	dir.segments[seq] = append([]byte(nil), payload...)
+	dir.held += len(payload) - len(previous)
+}
+
+// wantsStream returns true if any of the session subscribers want the TCP stream
+func (sess *Session) wantsStream() bool {
+	sess.subLocker.RLock()
+	defer sess.subLocker.RUnlock()
+
+	for _, holder := range sess.subscriptions {
+		if holder.NfqueueFilter != nil && holder.NfqueueFilter.ReassembleStream {
+			return true
+		}
+	}
+	return false
+}
+
+// updateStream adds the packet data to the session stream when a subscriber wants it and
+// discards the stream once the subscribers that want it have released the session
+func updateStream(session *Session, mess *NfqueueMessage) {
+	if mess.TCPLayer == nil {
+		return
+	}
+
+	stream := session.GetTCPStream()
+
+	if !session.wantsStream() {
+		if stream != nil {
+			session.setTCPStream(nil)
+		}
+		return
+	}
+
+	if stream == nil {
+		stream = new(TCPStream)
+		session.setTCPStream(stream)
+	}
+
+	direction := StreamServerToClient
+	if mess.ClientToServer {
+		direction = StreamClientToServer
+	}
+
+	stream.addSegment(direction, mess.TCPLayer, mess.Payload)
+	mess.Stream = stream
+}
@@ -0,0 +1,64 @@
+package dispatch
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+)
+
+// TestStreamReassembly checks out of order, retransmitted, and overlapping segments
+func TestStreamReassembly(t *testing.T) {
+	stream := new(TCPStream)
+
+	stream.addSegment(StreamClientToServer, &layers.TCP{Seq: 999, SYN: true}, nil)
+	stream.addSegment(StreamClientToServer, &layers.TCP{Seq: 1006}, []byte("world"))
+	stream.addSegment(StreamClientToServer, &layers.TCP{Seq: 1011}, []byte("!"))
+	if len(stream.Data(StreamClientToServer)) != 0 {
+		t.Fatalf("Out of order data was added before the gap was filled")
+	}
+
+	stream.addSegment(StreamClientToServer, &layers.TCP{Seq: 1000}, []byte("hello "))
+	stream.addSegment(StreamClientToServer, &layers.TCP{Seq: 1000}, []byte("hello "))
+	stream.addSegment(StreamClientToServer, &layers.TCP{Seq: 1009}, []byte("ld! again"))
+
+	data := stream.Data(StreamClientToServer)
+	if !bytes.Equal(data, []byte("hello world! again")) {
+		t.Errorf("Unexpected stream data: %q", data)
+	}
+
+	if len(stream.Data(StreamServerToClient)) != 0 {
+		t.Errorf("Client data was added to the server direction")
+	}
+}
+
+// TestStreamLimit checks that the stream stops growing at the limit
+func TestStreamLimit(t *testing.T) {
+	stream := new(TCPStream)
+	segment := make([]byte, 1000)
+
+	for seq := uint32(0); seq < streamDataLimit*2; seq += uint32(len(segment)) {
+		stream.addSegment(StreamServerToClient, &layers.TCP{Seq: seq}, segment)
+	}
+
+	if len(stream.Data(StreamServerToClient)) != streamDataLimit {
+		t.Errorf("Stream length %d != %d", len(stream.Data(StreamServerToClient)), streamDataLimit)
+	}
+	if !stream.Full(StreamServerToClient) {
+		t.Errorf("Stream not marked full")
+	}
+}
+
+// TestStreamWrap checks reassembly across the sequence number wrap
+func TestStreamWrap(t *testing.T) {
+	stream := new(TCPStream)
+
+	stream.addSegment(StreamClientToServer, &layers.TCP{Seq: 0xFFFFFFFE}, []byte("ab"))
+	stream.addSegment(StreamClientToServer, &layers.TCP{Seq: 2}, []byte("ef"))
+	stream.addSegment(StreamClientToServer, &layers.TCP{Seq: 0}, []byte("cd"))
+
+	data := stream.Data(StreamClientToServer)
+	if !bytes.Equal(data, []byte("abcdef")) {
+		t.Errorf("Unexpected stream data: %q", data)
+	}
+}
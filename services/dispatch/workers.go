@@ -0,0 +1,126 @@
+package dispatch
+
+import (
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+)
+
+// subscriberTask holds the details of a single nfqueue subscriber call
+type subscriberTask struct {
+	owner      string
+	holder     SubscriptionHolder
+	mess       NfqueueMessage
+	ctid       uint32
+	newSession bool
+	results    chan subscriberResult
+}
+
+// subscriberWorkerCount is the number of workers that call nfqueue subscribers
+var subscriberWorkerCount = 64
+
+// subscriberTasks is used to pass calls to idle workers
+var subscriberTasks chan *subscriberTask
+
+// subscriberOverflow limits the number of extra goroutines used when all of the workers are busy
+var subscriberOverflow chan struct{}
+
+// SetSubscriberWorkers sets the number of workers used to call nfqueue subscribers
+func SetSubscriberWorkers(value int) {
+	if value < 1 {
+		value = 1
+	}
+	subscriberWorkerCount = value
+}
+
+// startSubscriberWorkers creates the subscriber worker pool
+func startSubscriberWorkers(count int) {
+	// the channel is not buffered so a send only succeeds when a worker is idle
+	subscriberTasks = make(chan *subscriberTask)
+	subscriberOverflow = make(chan struct{}, count)
+	for x := 0; x < count; x++ {
+		go subscriberWorker()
+	}
+}
+
+// subscriberWorker calls the subscribers passed to a worker
+func subscriberWorker() {
+	for task := range subscriberTasks {
+		task.run()
+	}
+}
+
+// submitSubscriberTask passes a subscriber call to an idle worker. If all of the workers are
+// busy, usually because some subscribers are slow, we use a goroutine so the call isn't delayed.
+// There can be as many of those goroutines as workers and beyond that we wait for either an
+// idle worker or a goroutine to finish so the number of calls in progress is always bounded.
+func submitSubscriberTask(task *subscriberTask) {
+	select {
+	case subscriberTasks <- task:
+		return
+	default:
+	}
+
+	select {
+	case subscriberTasks <- task:
+	case subscriberOverflow <- struct{}{}:
+		go func() {
+			task.run()
+			<-subscriberOverflow
+		}()
+	}
+}
+
+// run calls the subscriber and writes the result to the results channel
+func (task *subscriberTask) run() {
+	start := time.Now()
+	result := task.holder.NfqueueFunc(task.mess, task.ctid, task.newSession)
+	recordSubscriberCall(MetricsNfqueue, task.owner, time.Since(start))
+	task.results <- subscriberResult{owner: task.owner, result: result}
+}
+
+// collectResults waits for the results from the pending subscribers. Subscribers that
+// don't finish in time get a release on their behalf, and anything they return later
+// is ignored.
+func collectResults(resultsChannel chan subscriberResult, pending []string) []subscriberResult {
+	results := make([]subscriberResult, 0, len(pending))
+	if len(pending) == 0 {
+		return results
+	}
+
+	timeoutTimer := time.NewTimer(maxSubscriberTime)
+	defer timeoutTimer.Stop()
+
+	for len(pending) != 0 {
+		select {
+		case result := <-resultsChannel:
+			index := findPending(pending, result.owner)
+			if index < 0 {
+				// a late result from a subscriber that already timed out
+				continue
+			}
+			pending = append(pending[:index], pending[index+1:]...)
+			results = append(results, result)
+		case <-timeoutTimer.C:
+			// the subscribers took too long so put a release in the results on their behalf
+			for _, key := range pending {
+				logger.Crit("%OC|Timeout while processing nfqueue - subscriber:%s\n", "timeout_nfqueue_"+key, 0, key)
+				recordSubscriberTimeout(MetricsNfqueue, key)
+				results = append(results, subscriberResult{owner: key, result: NfqueueResult{SessionRelease: true}})
+			}
+			pending = nil
+		}
+	}
+
+	return results
+}
+
+// findPending returns the index of the owner in the pending list or -1 if not found
+func findPending(pending []string, owner string) int {
+	for index, item := range pending {
+		if item == owner {
+			return index
+		}
+	}
+	return -1
+}
@@ -0,0 +1,116 @@
+package dispatch
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// benchmarkWorkers makes sure the subscriber workers are only started once
+var benchmarkWorkers sync.Once
+
+// benchmarkPriorities are the priorities for the benchmark subscribers which
+// roughly match the plugins that are normally active
+var benchmarkPriorities = []int{1, 2, 2, 2, 2, 2, 3, 4}
+
+// createBenchmarkMessage creates an nfqueue message with a UDP packet
+func createBenchmarkMessage() NfqueueMessage {
+	var mess NfqueueMessage
+
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.IP{192, 168, 1, 100}, DstIP: net.IP{8, 8, 8, 8}}
+	udp := &layers.UDP{SrcPort: 12345, DstPort: 53}
+	udp.SetNetworkLayerForChecksum(ip)
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	gopacket.SerializeLayers(buffer, options, ip, udp, gopacket.Payload(make([]byte, 64)))
+
+	mess.Packet = decodePacket(buffer.Bytes())
+	mess.Length = len(buffer.Bytes())
+	mess.Family = 2
+	decodeNfqueueMessage(&mess)
+	return mess
+}
+
+// createBenchmarkSubscriptions creates the subscriptions for the benchmarks
+func createBenchmarkSubscriptions() map[string]SubscriptionHolder {
+	sublist := make(map[string]SubscriptionHolder)
+	for index, priority := range benchmarkPriorities {
+		owner := "bench" + strconv.Itoa(index)
+		sublist[owner] = SubscriptionHolder{
+			Owner:    owner,
+			Priority: priority,
+			NfqueueFunc: func(mess NfqueueMessage, ctid uint32, newSession bool) NfqueueResult {
+				var result NfqueueResult
+				if mess.UDPLayer != nil && mess.UDPLayer.DstPort == 53 {
+					result.PacketMark = 0x00000100
+				}
+				return result
+			},
+		}
+	}
+	return sublist
+}
+
+// runPacketBenchmark runs the argumented function for many packets in parallel and reports packets per second
+func runPacketBenchmark(b *testing.B, handler func(ctid uint32)) {
+	var ctid uint32
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+	b.RunParallel(func(pb *testing.PB) {
+		id := atomic.AddUint32(&ctid, 1)
+		for pb.Next() {
+			handler(id)
+		}
+	})
+	b.StopTimer()
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "packets/s")
+}
+
+// BenchmarkCallSubscribers measures the complete subscriber dispatch for a session
+func BenchmarkCallSubscribers(b *testing.B) {
+	mess := createBenchmarkMessage()
+	benchmarkWorkers.Do(func() { startSubscriberWorkers(subscriberWorkerCount) })
+
+	session := new(Session)
+	session.SetClientSideTuple(mess.MsgTuple)
+	session.subscriptions = createBenchmarkSubscriptions()
+	mess.Session = session
+	mess.ClientToServer = true
+
+	runPacketBenchmark(b, func(ctid uint32) {
+		callSubscribers(ctid, session, mess, 0, false)
+	})
+}
+
+// BenchmarkCallSubscribersSlow measures the subscriber dispatch when one subscriber is slow
+// enough to keep the workers busy so some calls use the overflow goroutines
+func BenchmarkCallSubscribersSlow(b *testing.B) {
+	mess := createBenchmarkMessage()
+	benchmarkWorkers.Do(func() { startSubscriberWorkers(subscriberWorkerCount) })
+
+	session := new(Session)
+	session.SetClientSideTuple(mess.MsgTuple)
+	session.subscriptions = createBenchmarkSubscriptions()
+	session.subscriptions["slow"] = SubscriptionHolder{
+		Owner:    "slow",
+		Priority: 1,
+		NfqueueFunc: func(mess NfqueueMessage, ctid uint32, newSession bool) NfqueueResult {
+			time.Sleep(100 * time.Microsecond)
+			return NfqueueResult{}
+		},
+	}
+	mess.Session = session
+	mess.ClientToServer = true
+
+	runPacketBenchmark(b, func(ctid uint32) {
+		callSubscribers(ctid, session, mess, 0, false)
+	})
+}
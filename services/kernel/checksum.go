@@ -0,0 +1,140 @@
+package kernel
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// fixPacket updates the length fields and recalculates the IP, TCP, UDP, and ICMP
+// checksums for a raw IPv4 or IPv6 packet that has been modified
+func fixPacket(data []byte) error {
+	var protocol byte
+	var offset int
+	var pseudo uint32
+
+	if len(data) < 20 {
+		return errors.New("Packet too short")
+	}
+
+	switch data[0] >> 4 {
+	case 4:
+		offset = int(data[0]&0x0F) * 4
+		if offset < 20 || offset > len(data) {
+			return errors.New("Invalid IPv4 header length")
+		}
+		binary.BigEndian.PutUint16(data[2:], uint16(len(data)))
+		data[10] = 0
+		data[11] = 0
+		binary.BigEndian.PutUint16(data[10:], finishChecksum(sumBytes(data[:offset], 0)))
+
+		// fragments don't have the whole transport segment so we leave them alone
+		if binary.BigEndian.Uint16(data[6:])&0x3FFF != 0 {
+			return nil
+		}
+
+		protocol = data[9]
+		pseudo = sumBytes(data[12:20], 0)
+	case 6:
+		if len(data) < 40 {
+			return errors.New("Invalid IPv6 header length")
+		}
+		binary.BigEndian.PutUint16(data[4:], uint16(len(data)-40))
+		protocol, offset = findTransport(data)
+		if offset < 0 {
+			return nil
+		}
+		pseudo = sumBytes(data[8:40], 0)
+	default:
+		return errors.New("Unknown IP version")
+	}
+
+	segment := data[offset:]
+	pseudo += uint32(protocol) + uint32(len(segment))
+
+	switch protocol {
+	case 6: // TCP
+		if len(segment) < 20 {
+			return errors.New("Invalid TCP header length")
+		}
+		segment[16] = 0
+		segment[17] = 0
+		binary.BigEndian.PutUint16(segment[16:], finishChecksum(sumBytes(segment, pseudo)))
+	case 17: // UDP
+		if len(segment) < 8 {
+			return errors.New("Invalid UDP header length")
+		}
+		binary.BigEndian.PutUint16(segment[4:], uint16(len(segment)))
+		segment[6] = 0
+		segment[7] = 0
+		check := finishChecksum(sumBytes(segment, pseudo))
+		if check == 0 {
+			check = 0xFFFF
+		}
+		binary.BigEndian.PutUint16(segment[6:], check)
+	case 1: // ICMP
+		if len(segment) < 4 {
+			return errors.New("Invalid ICMP header length")
+		}
+		segment[2] = 0
+		segment[3] = 0
+		binary.BigEndian.PutUint16(segment[2:], finishChecksum(sumBytes(segment, 0)))
+	case 58: // ICMPv6
+		if len(segment) < 4 {
+			return errors.New("Invalid ICMPv6 header length")
+		}
+		segment[2] = 0
+		segment[3] = 0
+		binary.BigEndian.PutUint16(segment[2:], finishChecksum(sumBytes(segment, pseudo)))
+	}
+
+	return nil
+}
+
+// findTransport walks the IPv6 extension headers and returns the transport
+// protocol and offset, or an offset of -1 for fragments and unknown headers
+func findTransport(data []byte) (byte, int) {
+	protocol := data[6]
+	offset := 40
+
+	for {
+		switch protocol {
+		case 0, 43, 60: // hop-by-hop, routing, destination options
+			if offset+8 > len(data) {
+				return protocol, -1
+			}
+			protocol, offset = data[offset], offset+(int(data[offset+1])+1)*8
+		case 51: // authentication header
+			if offset+8 > len(data) {
+				return protocol, -1
+			}
+			protocol, offset = data[offset], offset+(int(data[offset+1])+2)*4
+		case 44: // fragment
+			return protocol, -1
+		default:
+			if offset > len(data) {
+				return protocol, -1
+			}
+			return protocol, offset
+		}
+	}
+}
+
+// sumBytes adds the argumented data to a ones complement checksum
+func sumBytes(data []byte, sum uint32) uint32 {
+	size := len(data) &^ 1
+	for i := 0; i < size; i += 2 {
+		sum += uint32(data[i])<<8 | uint32(data[i+1])
+	}
+	if len(data)&1 != 0 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	return sum
+}
+
+// finishChecksum folds the carries and returns the ones complement of the sum
+func finishChecksum(sum uint32) uint16 {
+	for sum > 0xFFFF {
+		sum = (sum >> 16) + (sum & 0xFFFF)
+	}
+	return ^uint16(sum)
+}
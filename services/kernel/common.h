@@ -17,6 +17,7 @@
 #include <fcntl.h>
 #include <poll.h>
 #include <time.h>
+#include <pthread.h>
 #include <arpa/inet.h>
 #include <netinet/ip.h>
 #include <netinet/ip6.h>
@@ -33,6 +34,9 @@
 
 #define LOG_TRACE	LOG_DEBUG+1
 
+/* conntrack labels are a 128 bit bitmask */
+#define CONNTRACK_LABEL_BYTES 16
+
 /*
  * We have a single set of variables for the orig and repl source and
  * destination addresses that are large enough to hold either an IPv4
@@ -86,6 +90,36 @@ struct netlogger_info {
 	char			prefix[256];
 };
 
+/*
+ * The filters and limits for warehouse traffic capture. The origins
+ * string lists the record types to capture (Q C L) and zero values
+ * in the other fields mean no filter or no limit.
+ */
+struct warehouse_options {
+	char			origins[4];
+	u_int8_t		family;
+	u_int8_t		protocol;
+	u_int16_t		port;
+	char			host[16];
+	u_int32_t		ctid;
+	u_int64_t		max_size;
+	u_int32_t		max_duration;
+	u_int32_t		max_files;
+};
+
+/*
+ * The totals for the current warehouse traffic capture
+ */
+struct warehouse_status {
+	u_int64_t		bytes;
+	u_int64_t		records;
+	u_int64_t		file_bytes;
+	u_int64_t		file_records;
+	u_int64_t		filtered;
+	u_int32_t		files;
+	u_int32_t		active;
+};
+
 struct nfq_data {
 	struct nfattr	**data;
 };
@@ -97,6 +131,7 @@ struct nflog_data {
 extern void go_nfqueue_callback(uint32_t mark,unsigned char* data,int len,uint32_t ctid,uint32_t nfid,uint32_t family,char* memory,int playflag,int index);
 extern void go_netlogger_callback(struct netlogger_info* info,int playflag);
 extern void go_conntrack_callback(struct conntrack_info* info,int playflag);
+extern void go_playback_clock(u_int64_t stamp_sec,u_int32_t stamp_nsec);
 
 extern void go_child_startup(void);
 extern void go_child_shutdown(void);
@@ -126,17 +161,23 @@ int get_warehouse_speed(void);
 void set_warehouse_speed(int value);
 void start_warehouse_capture(void);
 void close_warehouse_capture(void);
+void set_warehouse_options(struct warehouse_options *options);
+void get_warehouse_status(struct warehouse_status *status);
 
 int conntrack_startup(void);
 void conntrack_shutdown(void);
 int conntrack_thread(void);
 void conntrack_dump(void);
-int conntrack_update_mark(uint32_t ctid, uint32_t mask, uint32_t value);
+int conntrack_update_mark(struct conntrack_info *info, uint32_t mask, uint32_t value, uint32_t *result);
+int conntrack_update_labels(struct conntrack_info *info, const unsigned char *value, const unsigned char *mask);
+int conntrack_delete_entry(struct conntrack_info *info);
 
 int nfq_get_ct_info(struct nfq_data *nfad, unsigned char **data);
 uint32_t nfq_get_conntrack_id(struct nfq_data *nfad, int l3num);
 int netq_callback(struct nfq_q_handle *qh,struct nfgenmsg *nfmsg,struct nfq_data *nfad,void *data);
-int nfqueue_set_verdict(int index, uint32_t nfid, uint32_t verdict);
+int nfqueue_set_verdict(int index, uint32_t nfid, uint32_t verdict, uint32_t mark, uint32_t length, unsigned char *data);
+int nfqueue_get_queue_number(int index);
+int nfqueue_get_queue_maxlen(void);
 int nfqueue_startup(int index);
 void nfqueue_shutdown(int index);
 int nfqueue_thread(int index);
@@ -10,6 +10,9 @@
 #include "common.h"
 
 static struct nfct_handle	*nfcth;
+static struct nfct_handle	*nfupdh;
+static pthread_mutex_t		update_lock = PTHREAD_MUTEX_INITIALIZER;
+static pthread_mutex_t		dump_lock = PTHREAD_MUTEX_INITIALIZER;
 static u_int64_t			tracker_error;
 static u_int64_t			tracker_unknown;
 static u_int64_t			tracker_garbage;
@@ -17,8 +20,8 @@ static char                 *logsrc = "conntrack";
 
 struct update_mark_args {
 	uint32_t	ctid;
-	uint32_t	mask;
-	uint32_t	val;
+	uint32_t	mark;
+	int			found;
 };
 
 #define BUFFER_SIZE 1024*1024*8
@@ -115,48 +118,72 @@ static int conntrack_callback(enum nf_conntrack_msg_type type,struct nf_conntrac
 
 int conntrack_startup(void)
 {
-	int		ret;
+	struct nfct_handle	*handle;
+	int					ret;
 
 	// Open a netlink conntrack handle. The header file defines
 	// NFCT_ALL_CT_GROUPS but we really only care about new and
 	// destroy so we subscribe to just those ignoring update
-	nfcth = nfct_open(CONNTRACK,NF_NETLINK_CONNTRACK_NEW | NF_NETLINK_CONNTRACK_DESTROY);
+	handle = nfct_open(CONNTRACK,NF_NETLINK_CONNTRACK_NEW | NF_NETLINK_CONNTRACK_DESTROY);
 
-	if (nfcth == NULL) {
+	if (handle == NULL) {
 		logmessage(LOG_ERR,logsrc,"Error %d returned from nfct_open()\n",errno);
 		set_shutdown_flag();
 		return(1);
 	}
 
-    ret = nfnl_rcvbufsiz(nfct_nfnlh(nfcth), BUFFER_SIZE);
+    ret = nfnl_rcvbufsiz(nfct_nfnlh(handle), BUFFER_SIZE);
     logmessage(LOG_DEBUG,logsrc,"Buffer size set to %d\n", ret);
 
 	// register the conntrack callback
-	ret = nfct_callback_register(nfcth,NFCT_T_ALL,conntrack_callback,NULL);
+	ret = nfct_callback_register(handle,NFCT_T_ALL,conntrack_callback,NULL);
 
 	if (ret != 0) {
 		logmessage(LOG_ERR,logsrc,"Error %d returned from nfct_callback_register()\n",errno);
+		nfct_close(handle);
 		set_shutdown_flag();
 		return(2);
 	}
 
+	// publish the handle for conntrack_dump once it is ready
+	pthread_mutex_lock(&dump_lock);
+	nfcth = handle;
+	pthread_mutex_unlock(&dump_lock);
+
+	// Open a second handle with no event subscriptions that we use
+	// for queries so they don't get mixed up with the event stream
+	nfupdh = nfct_open(CONNTRACK,0);
+
+	if (nfupdh == NULL) {
+		logmessage(LOG_ERR,logsrc,"Error %d returned from nfct_open(update)\n",errno);
+		set_shutdown_flag();
+		return(3);
+	}
+
 	return(0);
 }
 
 void conntrack_shutdown(void)
 {
-	if (nfcth == NULL) return;
-
+	pthread_mutex_lock(&dump_lock);
     struct nfct_handle* ptr = nfcth;
 
 	// clear our conntrack handle
     nfcth = NULL;
+	pthread_mutex_unlock(&dump_lock);
+
+	if (ptr == NULL) return;
 
 	// unregister the callback handler
 	nfct_callback_unregister(ptr);
 
 	// close the conntrack netlink handler
 	nfct_close(ptr);
+
+	pthread_mutex_lock(&update_lock);
+	if (nfupdh != NULL) nfct_close(nfupdh);
+	nfupdh = NULL;
+	pthread_mutex_unlock(&update_lock);
 }
 
 int conntrack_thread(void)
@@ -178,6 +205,10 @@ int conntrack_thread(void)
 
 	go_child_startup();
 
+	// start with a dump now that the handle is open so dispatch can
+	// match any sessions that were saved before a restart
+	conntrack_dump();
+
 	// set the file descriptor to non-blocking mode
 	sock = nfct_fd(nfcth);
 	fcntl(sock, F_SETFL, O_NONBLOCK);
@@ -212,9 +243,208 @@ void conntrack_dump(void)
 	u_int32_t	family;
 	int			ret;
 
-	if (nfcth == NULL) return;
+	pthread_mutex_lock(&dump_lock);
+
+	if (nfcth == NULL) {
+		pthread_mutex_unlock(&dump_lock);
+		return;
+	}
 
 	family = AF_UNSPEC;
 	ret = nfct_send(nfcth,NFCT_Q_DUMP,&family);
+	pthread_mutex_unlock(&dump_lock);
 	if (ret < 0) logmessage(LOG_WARNING,logsrc,"nfct_send() result:%d errno:%d\n",ret,errno);
 }
+
+static int update_mark_callback(enum nf_conntrack_msg_type type,struct nf_conntrack *ct,void *data)
+{
+	struct update_mark_args		*args = (struct update_mark_args *)data;
+
+	// make sure the entry is the one we were asked to update and not
+	// a different connection that has since reused the same tuple
+	if (nfct_get_attr_u32(ct,ATTR_ID) != args->ctid) return(NFCT_CB_CONTINUE);
+
+	args->mark = nfct_get_attr_u32(ct,ATTR_MARK);
+	args->found = 1;
+	return(NFCT_CB_STOP);
+}
+
+/*
+ * Netlink can only find a conntrack entry by tuple so we create an
+ * entry with the original direction tuple from the conntrack_info
+ * structure and use it to get and update the real entry.
+ */
+static struct nf_conntrack *conntrack_create_query(struct conntrack_info *info)
+{
+	struct nf_conntrack			*ct;
+
+	ct = nfct_new();
+
+	if (ct == NULL) {
+		logmessage(LOG_WARNING,logsrc,"Error calling nfct_new()\n");
+		return(NULL);
+	}
+
+	nfct_set_attr_u8(ct,ATTR_ORIG_L3PROTO,info->family);
+	nfct_set_attr_u8(ct,ATTR_ORIG_L4PROTO,info->orig_proto);
+
+	if (info->family == AF_INET) {
+		nfct_set_attr(ct,ATTR_ORIG_IPV4_SRC,info->orig_saddr);
+		nfct_set_attr(ct,ATTR_ORIG_IPV4_DST,info->orig_daddr);
+	} else {
+		nfct_set_attr(ct,ATTR_ORIG_IPV6_SRC,info->orig_saddr);
+		nfct_set_attr(ct,ATTR_ORIG_IPV6_DST,info->orig_daddr);
+	}
+
+	nfct_set_attr_u16(ct,ATTR_ORIG_PORT_SRC,htobe16(info->orig_sport));
+	nfct_set_attr_u16(ct,ATTR_ORIG_PORT_DST,htobe16(info->orig_dport));
+
+	return(ct);
+}
+
+/*
+ * Finds the entry for the query and makes sure it has the id we expect.
+ * The caller must hold the update_lock.
+ */
+static int conntrack_find_entry(struct nf_conntrack *ct,struct update_mark_args *args)
+{
+	int							ret;
+
+	if (nfupdh == NULL) return(-1);
+
+	nfct_callback_register(nfupdh,NFCT_T_ALL,update_mark_callback,args);
+	ret = nfct_query(nfupdh,NFCT_Q_GET,ct);
+	nfct_callback_unregister(nfupdh);
+
+	if (ret == 0 && args->found == 0) ret = -1;
+	return(ret);
+}
+
+/*
+ * We get the current mark, replace the bits in mask with those from value,
+ * write the new mark back to the entry, and return the new mark in result.
+ */
+int conntrack_update_mark(struct conntrack_info *info, uint32_t mask, uint32_t value, uint32_t *result)
+{
+	struct update_mark_args		args;
+	struct nf_conntrack			*ct;
+	int							ret;
+
+	ct = conntrack_create_query(info);
+	if (ct == NULL) return(-1);
+
+	memset(&args,0,sizeof(args));
+	args.ctid = info->conn_id;
+
+	pthread_mutex_lock(&update_lock);
+
+	ret = conntrack_find_entry(ct,&args);
+
+	if (ret == 0) {
+		args.mark = (args.mark & ~mask) | (value & mask);
+		nfct_set_attr_u32(ct,ATTR_ID,info->conn_id);
+		nfct_set_attr_u32(ct,ATTR_MARK,args.mark);
+		ret = nfct_query(nfupdh,NFCT_Q_UPDATE,ct);
+	}
+
+	pthread_mutex_unlock(&update_lock);
+	nfct_destroy(ct);
+
+	if (ret != 0) logmessage(LOG_DEBUG,logsrc,"Unable to update mark for ctid %u errno:%d\n",info->conn_id,errno);
+	else *result = args.mark;
+	return(ret);
+}
+
+/*
+ * The labels and mask are CONNTRACK_LABEL_BYTES long with label bit zero in the
+ * low order bit of the first byte. The kernel replaces the label bits that are
+ * set in mask with those from value and leaves the others unchanged.
+ */
+int conntrack_update_labels(struct conntrack_info *info, const unsigned char *value, const unsigned char *mask)
+{
+	struct update_mark_args		args;
+	struct nf_conntrack			*ct;
+	struct nfct_bitmask			*labels;
+	struct nfct_bitmask			*bits;
+	int							ret,error,x;
+
+	ct = conntrack_create_query(info);
+	if (ct == NULL) return(-1);
+
+	labels = nfct_bitmask_new((CONNTRACK_LABEL_BYTES * 8) - 1);
+	bits = nfct_bitmask_new((CONNTRACK_LABEL_BYTES * 8) - 1);
+
+	if (labels == NULL || bits == NULL) {
+		logmessage(LOG_WARNING,logsrc,"Error calling nfct_bitmask_new()\n");
+		if (labels != NULL) nfct_bitmask_destroy(labels);
+		if (bits != NULL) nfct_bitmask_destroy(bits);
+		nfct_destroy(ct);
+		return(-1);
+	}
+
+	for(x = 0;x < (CONNTRACK_LABEL_BYTES * 8);x++) {
+		if ((mask[x / 8] & (1 << (x % 8))) == 0) continue;
+		nfct_bitmask_set_bit(bits,x);
+		if (value[x / 8] & (1 << (x % 8))) nfct_bitmask_set_bit(labels,x);
+	}
+
+	memset(&args,0,sizeof(args));
+	args.ctid = info->conn_id;
+
+	pthread_mutex_lock(&update_lock);
+
+	errno = 0;
+	ret = conntrack_find_entry(ct,&args);
+
+	// the conntrack entry owns the bitmasks once they are set
+	nfct_set_attr(ct,ATTR_CONNLABELS,labels);
+	nfct_set_attr(ct,ATTR_CONNLABELS_MASK,bits);
+
+	if (ret == 0) {
+		nfct_set_attr_u32(ct,ATTR_ID,info->conn_id);
+		ret = nfct_query(nfupdh,NFCT_Q_UPDATE,ct);
+	}
+
+	// save errno for the caller before the cleanup and logging can change it
+	// the kernel returns ENOSPC when the entry has no connlabel extension
+	error = errno;
+	if (ret != 0 && error == 0) error = ENOENT;
+
+	pthread_mutex_unlock(&update_lock);
+	nfct_destroy(ct);
+
+	if (ret != 0) logmessage(LOG_DEBUG,logsrc,"Unable to update labels for ctid %u errno:%d\n",info->conn_id,error);
+	errno = error;
+	return(ret);
+}
+
+/*
+ * Deletes the conntrack entry so the kernel stops tracking the connection.
+ */
+int conntrack_delete_entry(struct conntrack_info *info)
+{
+	struct update_mark_args		args;
+	struct nf_conntrack			*ct;
+	int							ret;
+
+	ct = conntrack_create_query(info);
+	if (ct == NULL) return(-1);
+
+	memset(&args,0,sizeof(args));
+	args.ctid = info->conn_id;
+
+	pthread_mutex_lock(&update_lock);
+
+	ret = conntrack_find_entry(ct,&args);
+
+	if (ret == 0) {
+		nfct_set_attr_u32(ct,ATTR_ID,info->conn_id);
+		ret = nfct_query(nfupdh,NFCT_Q_DESTROY,ct);
+	}
+
+	pthread_mutex_unlock(&update_lock);
+	nfct_destroy(ct);
+
+	if (ret != 0) logmessage(LOG_DEBUG,logsrc,"Unable to delete ctid %u errno:%d\n",info->conn_id,errno);
+	return(ret);
+}
@@ -8,6 +8,7 @@ package kernel
 import "C"
 
 import (
+	"fmt"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -23,7 +24,15 @@ import (
 type ConntrackCallback func(uint32, uint32, uint8, uint8, uint8, net.IP, net.IP, uint16, uint16, net.IP, net.IP, uint16, uint16, uint64, uint64, uint64, uint64, uint64, uint64, uint32, uint8)
 
 // NfqueueCallback is a function to handle nfqueue events
-type NfqueueCallback func(uint32, uint32, gopacket.Packet, int, uint32) int
+type NfqueueCallback func(uint32, uint32, gopacket.Packet, int, uint32) NfqueueVerdict
+
+// NfqueueVerdict is returned by the nfqueue callback to tell us what to do with a packet
+type NfqueueVerdict struct {
+	Verdict uint32 // NF_ACCEPT or NF_DROP
+	Mark    uint32 // the mark to set on the packet
+	Reject  int    // RejectNone, RejectReset, or RejectICMP for dropped packets
+	Data    []byte // the modified packet or nil to leave the packet unchanged
+}
 
 // NetloggerCallback is a function to handle netlogger events
 type NetloggerCallback func(uint8, uint8, uint16, uint8, uint8, string, string, uint16, uint16, uint32, uint32, string)
@@ -71,6 +80,8 @@ func StartCallbacks(numNfqueueThreads int, intervalSeconds int) {
 	}
 
 	if FlagNoNfqueue == false {
+		startNfqueueWorkers(numNfqueueThreads)
+		go overloadTask(numNfqueueThreads)
 		for x := 0; x < numNfqueueThreads; x++ {
 			go func(x C.int) {
 				//runtime.LockOSThread()
@@ -168,8 +179,10 @@ func GetBypassFlag() int {
 	return int(C.get_bypass_flag())
 }
 
-// SetBypassFlag flag sets the live traffic bypass flag
+// SetBypassFlag flag sets the live traffic bypass flag. This overrides
+// any bypass that was set automatically for overload protection.
 func SetBypassFlag(value int) {
+	clearOverload()
 	C.set_bypass_flag(C.int(value))
 }
 
@@ -203,6 +216,133 @@ func CloseWarehouseCapture() {
 	C.close_warehouse_capture()
 }
 
+// WarehouseCaptureOptions holds the filters and limits for a warehouse traffic capture.
+// Zero values mean no filter or no limit. The size and duration limits apply to each
+// file and are checked as records are written. When MaxFiles is more than one the
+// capture rotates across that many files, otherwise it finishes at the first limit.
+type WarehouseCaptureOptions struct {
+	Origins     string        // the record origins to capture from Q C and L or empty for all
+	Host        net.IP        // capture only traffic to or from this address
+	Port        uint16        // capture only traffic to or from this port
+	Protocol    uint8         // capture only this IP protocol
+	Ctid        uint32        // capture only this conntrack ID
+	MaxSize     uint64        // the maximum size of each capture file in bytes
+	MaxDuration time.Duration // the maximum time to write each capture file
+	MaxFiles    uint32        // the number of files to rotate across
+}
+
+// WarehouseCaptureStatus holds the totals for the current or last warehouse traffic capture
+type WarehouseCaptureStatus struct {
+	Active      bool   `json:"active"`
+	Bytes       uint64 `json:"bytes"`
+	Records     uint64 `json:"records"`
+	FileBytes   uint64 `json:"file_bytes"`
+	FileRecords uint64 `json:"file_records"`
+	Filtered    uint64 `json:"filtered"`
+	Files       uint32 `json:"files"`
+}
+
+// SetWarehouseCaptureOptions sets the filters and limits used by the warehouse traffic capture
+func SetWarehouseCaptureOptions(options WarehouseCaptureOptions) {
+	var info C.struct_warehouse_options
+
+	origins := (*[4]byte)(unsafe.Pointer(&info.origins))
+	copy(origins[:], options.Origins)
+
+	if address := options.Host.To4(); address != nil {
+		info.family = C.AF_INET
+		copy((*[16]byte)(unsafe.Pointer(&info.host))[:], address)
+	} else if address := options.Host.To16(); address != nil {
+		info.family = C.AF_INET6
+		copy((*[16]byte)(unsafe.Pointer(&info.host))[:], address)
+	}
+
+	info.protocol = C.u_int8_t(options.Protocol)
+	info.port = C.u_int16_t(options.Port)
+	info.ctid = C.u_int32_t(options.Ctid)
+	info.max_size = C.u_int64_t(options.MaxSize)
+	info.max_duration = C.u_int32_t(options.MaxDuration / time.Second)
+	info.max_files = C.u_int32_t(options.MaxFiles)
+	C.set_warehouse_options(&info)
+}
+
+// GetWarehouseCaptureStatus returns the totals for the current or last warehouse traffic capture
+func GetWarehouseCaptureStatus() WarehouseCaptureStatus {
+	var info C.struct_warehouse_status
+
+	C.get_warehouse_status(&info)
+	return WarehouseCaptureStatus{
+		Active:      info.active != 0,
+		Bytes:       uint64(info.bytes),
+		Records:     uint64(info.records),
+		FileBytes:   uint64(info.file_bytes),
+		FileRecords: uint64(info.file_records),
+		Filtered:    uint64(info.filtered),
+		Files:       uint32(info.files),
+	}
+}
+
+// ConnLabelBytes is the size of the conntrack labels bitmask
+const ConnLabelBytes = C.CONNTRACK_LABEL_BYTES
+
+// UpdateConnmark changes the bits in mask of the connmark for the conntrack entry with the
+// argumented ctid and returns the new connmark. Netlink can only find conntrack entries by
+// tuple so the caller must also provide the original direction tuple. ICMP entries are not supported.
+func UpdateConnmark(ctid uint32, family uint8, protocol uint8, client net.IP, server net.IP, clientPort uint16, serverPort uint16, mask uint32, value uint32) (uint32, error) {
+	var result C.uint32_t
+
+	info := createConntrackQuery(ctid, family, protocol, client, server, clientPort, serverPort)
+	ret := C.conntrack_update_mark(&info, C.uint32_t(mask), C.uint32_t(value), &result)
+	if ret != 0 {
+		return 0, fmt.Errorf("Unable to update connmark for ctid %d", ctid)
+	}
+	return uint32(result), nil
+}
+
+// UpdateConnlabels changes the bits in mask of the conntrack labels for the conntrack entry
+// with the argumented ctid. Label bit zero is the low order bit of the first byte. Like
+// UpdateConnmark the caller must provide the original direction tuple. The entry only has
+// labels if a rule referencing ct label was loaded when it was created.
+func UpdateConnlabels(ctid uint32, family uint8, protocol uint8, client net.IP, server net.IP, clientPort uint16, serverPort uint16, mask [ConnLabelBytes]byte, value [ConnLabelBytes]byte) error {
+	info := createConntrackQuery(ctid, family, protocol, client, server, clientPort, serverPort)
+	ret, err := C.conntrack_update_labels(&info, (*C.uchar)(unsafe.Pointer(&value[0])), (*C.uchar)(unsafe.Pointer(&mask[0])))
+	if ret != 0 {
+		return fmt.Errorf("Unable to update conntrack labels for ctid %d: %v", ctid, err)
+	}
+	return nil
+}
+
+// DeleteConntrack deletes the conntrack entry with the argumented ctid. Like UpdateConnmark
+// the caller must provide the original direction tuple.
+func DeleteConntrack(ctid uint32, family uint8, protocol uint8, client net.IP, server net.IP, clientPort uint16, serverPort uint16) error {
+	info := createConntrackQuery(ctid, family, protocol, client, server, clientPort, serverPort)
+	ret := C.conntrack_delete_entry(&info)
+	if ret != 0 {
+		return fmt.Errorf("Unable to delete conntrack for ctid %d", ctid)
+	}
+	return nil
+}
+
+// createConntrackQuery creates the conntrack_info used to find a conntrack entry by tuple
+func createConntrackQuery(ctid uint32, family uint8, protocol uint8, client net.IP, server net.IP, clientPort uint16, serverPort uint16) C.struct_conntrack_info {
+	var info C.struct_conntrack_info
+
+	info.conn_id = C.u_int32_t(ctid)
+	info.family = C.u_int8_t(family)
+	info.orig_proto = C.u_int8_t(protocol)
+	info.orig_sport = C.u_int16_t(clientPort)
+	info.orig_dport = C.u_int16_t(serverPort)
+
+	if family == C.AF_INET {
+		copy((*[16]byte)(unsafe.Pointer(&info.orig_saddr))[:], client.To4())
+		copy((*[16]byte)(unsafe.Pointer(&info.orig_daddr))[:], server.To4())
+	} else {
+		copy((*[16]byte)(unsafe.Pointer(&info.orig_saddr))[:], client.To16())
+		copy((*[16]byte)(unsafe.Pointer(&info.orig_daddr))[:], server.To16())
+	}
+	return info
+}
+
 // RegisterConntrackCallback registers the global conntrack callback for handling conntrack events
 func RegisterConntrackCallback(cb ConntrackCallback) {
 	conntrackCallback = cb
@@ -235,7 +375,7 @@ func go_set_shutdown_flag() {
 func go_nfqueue_callback(mark C.uint32_t, data *C.uchar, size C.int, ctid C.uint32_t, nfid C.uint32_t, family C.uint32_t, buffer *C.char, playflag C.int, index C.int) {
 	if nfqueueCallback == nil {
 		logger.Warn("No queue callback registered. Ignoring packet.\n")
-		C.nfqueue_set_verdict(index, nfid, C.NF_ACCEPT)
+		C.nfqueue_set_verdict(index, nfid, C.NF_ACCEPT, mark, 0, nil)
 		C.nfqueue_free_buffer(buffer)
 		return
 	}
@@ -245,52 +385,74 @@ func go_nfqueue_callback(mark C.uint32_t, data *C.uchar, size C.int, ctid C.uint
 		nfCleanTracker[uint32(C.int(ctid))] = true
 	}
 
-	f := func(mark C.uint32_t, data *C.uchar, size C.int, ctid C.uint32_t, nfid C.uint32_t, family C.uint32_t, buffer *C.char) {
-
-		var packet gopacket.Packet
-		var packetLength int
-		var conntrackID uint32 = uint32(C.int(ctid))
-		var pmark uint32 = uint32(C.int(mark))
-		var fam uint32 = uint32(C.int(family))
-
-		// create a Go pointer and gopacket from the packet data
-		pointer := (*[0xFFFF]byte)(unsafe.Pointer(data))[:int(size):int(size)]
-
-		if pointer[0]&0xF0 == 0x40 {
-			packet = gopacket.NewPacket(pointer, layers.LayerTypeIPv4, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
-		} else {
-			packet = gopacket.NewPacket(pointer, layers.LayerTypeIPv6, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
-		}
-
-		packetLength = int(size)
-
-		verdict := nfqueueCallback(conntrackID, fam, packet, packetLength, pmark)
-		if playflag == 0 {
-			C.nfqueue_set_verdict(index, nfid, C.uint32_t(verdict))
-		}
-		C.nfqueue_free_buffer(buffer)
-
-	}
+	task := nfqueueTask{mark: mark, data: data, size: size, ctid: ctid, nfid: nfid, family: family, buffer: buffer, index: index, received: time.Now()}
 
 	// if playflag != 0 then we are doing a warehouse recording playback
 	// in this case we often speed up these playbacks, and as such
-	// if we launch this asynchronously and return the next packet will
+	// if we hand this to a worker and return the next packet will
 	// immediately be handled. This means we essentially handle all packets
 	// simultaneously which means the plugins will get all the packets
 	// out of order depending on the scheduler. If in a playback
 	// call synchronously to ensure the packets come in the correct order
 
-	// if this is not a playback, handle this packet is a goroutine
-	// and return the main thread immediately so it can handle more packets
+	// if this is not a playback, pass the packet to the queue worker for the
+	// session and return the main thread immediately so it can handle more packets
 	if playflag != 0 {
-		f(mark, data, size, ctid, nfid, family, buffer)
+		handleNfqueueTask(task, playflag)
 	} else {
-		go f(mark, data, size, ctid, nfid, family, buffer)
+		submitNfqueueTask(task)
 	}
 
 	return
 }
 
+// handleNfqueueTask passes a packet to the nfqueue callback and sets the verdict
+func handleNfqueueTask(task nfqueueTask, playflag C.int) {
+	var packet gopacket.Packet
+	var packetLength int
+	var conntrackID uint32 = uint32(C.int(task.ctid))
+	var pmark uint32 = uint32(C.int(task.mark))
+	var fam uint32 = uint32(C.int(task.family))
+
+	// create a Go pointer and gopacket from the packet data
+	pointer := (*[0xFFFF]byte)(unsafe.Pointer(task.data))[:int(task.size):int(task.size)]
+
+	if pointer[0]&0xF0 == 0x40 {
+		packet = gopacket.NewPacket(pointer, layers.LayerTypeIPv4, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	} else {
+		packet = gopacket.NewPacket(pointer, layers.LayerTypeIPv6, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	}
+
+	packetLength = int(task.size)
+
+	verdict := nfqueueCallback(conntrackID, fam, packet, packetLength, pmark)
+	if playflag == 0 {
+		// the reject must be built before the buffer is released
+		if verdict.Verdict == C.NF_DROP && verdict.Reject != RejectNone {
+			sendReject(packet, verdict.Reject)
+		}
+		if verdict.Verdict == C.NF_ACCEPT && len(verdict.Data) != 0 {
+			setModifiedVerdict(task.index, task.nfid, verdict)
+		} else {
+			C.nfqueue_set_verdict(task.index, task.nfid, C.uint32_t(verdict.Verdict), C.uint32_t(verdict.Mark), 0, nil)
+		}
+	}
+	C.nfqueue_free_buffer(task.buffer)
+}
+
+// setModifiedVerdict fixes the lengths and checksums of a modified packet
+// and passes it back to the kernel along with the verdict. If the packet
+// can not be fixed the original packet is passed with the plain verdict.
+func setModifiedVerdict(index C.int, nfid C.uint32_t, verdict NfqueueVerdict) {
+	err := fixPacket(verdict.Data)
+	if err != nil {
+		logger.Warn("Unable to fix modified packet: %v\n", err)
+		C.nfqueue_set_verdict(index, nfid, C.uint32_t(verdict.Verdict), C.uint32_t(verdict.Mark), 0, nil)
+		return
+	}
+	C.nfqueue_set_verdict(index, nfid, C.uint32_t(verdict.Verdict), C.uint32_t(verdict.Mark), C.uint32_t(len(verdict.Data)), (*C.uchar)(unsafe.Pointer(&verdict.Data[0])))
+}
+
 //export go_conntrack_callback
 func go_conntrack_callback(info *C.struct_conntrack_info, playflag C.int) {
 	var ctid uint32
@@ -409,6 +571,11 @@ func go_netlogger_callback(info *C.struct_netlogger_info, playflag C.int) {
 	netloggerCallback(version, protocol, icmpType, srcInterface, dstInterface, srcAddress, dstAddress, srcPort, dstPort, mark, ctid, prefix)
 }
 
+//export go_playback_clock
+func go_playback_clock(sec C.u_int64_t, nsec C.u_int32_t) {
+	advancePlaybackClock(int64(sec)*1000000000 + int64(nsec))
+}
+
 //export go_child_startup
 func go_child_startup() {
 	childsync.Add(1)
@@ -430,6 +597,7 @@ func go_child_message(level C.int, source *C.char, message *C.char) {
 func conntrackTask(intervalSeconds int) {
 	var counter int
 
+	// the first dump is sent by conntrack_thread once the handle is open
 	for {
 		select {
 		case <-shutdownConntrackTask:
@@ -453,12 +621,19 @@ func timeUntilNextMin() time.Duration {
 	return duration
 }
 
-// WarehousePlaybackFile plays a warehouse capture file and returns the list of netfilter
-// conntrack sessions that were detected so the caller can clean them up
+// WarehousePlaybackFile plays a warehouse, pcap, or pcapng capture file and returns the list
+// of netfilter conntrack sessions that were detected so the caller can clean them up
 func WarehousePlaybackFile(nflist map[uint32]bool, ctlist map[uint32]bool) {
 	nfCleanTracker = nflist
 	ctCleanTracker = ctlist
-	C.warehouse_playback()
+	filename := C.GoString(C.get_warehouse_file())
+	resetPlaybackClock()
+	if isPacketFilePlayback(filename) {
+		playbackPacketFile(filename)
+		C.set_warehouse_flag('I')
+	} else {
+		C.warehouse_playback()
+	}
 	nfCleanTracker = nil
 	ctCleanTracker = nil
 }
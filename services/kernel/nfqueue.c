@@ -111,7 +111,7 @@ int netq_callback(struct nfq_q_handle *qh,struct nfgenmsg *nfmsg,struct nfq_data
             ip_addr.s_addr = iphead->daddr;
             logmessage(LOG_DEBUG,logsrc,"Error: dst IP: %s\n", inet_ntoa(ip_addr));
         }
-		nfqueue_set_verdict(index, nfid, NF_ACCEPT);
+		nfqueue_set_verdict(index, nfid, NF_ACCEPT, mark, 0, NULL);
         nfqueue_free_buffer(buff);
         return 0;
     }
@@ -119,24 +119,34 @@ int netq_callback(struct nfq_q_handle *qh,struct nfgenmsg *nfmsg,struct nfq_data
 	if (get_warehouse_flag() == 'C') warehouse_capture('Q',rawpkt,rawlen,mark,ctid,nfid,family);
 
 	if (get_bypass_flag() == 0) go_nfqueue_callback(mark,rawpkt,rawlen,ctid,nfid,family,buff,0,index);
-	else nfqueue_set_verdict(index, nfid, NF_ACCEPT);
+	else nfqueue_set_verdict(index, nfid, NF_ACCEPT, mark, 0, NULL);
 
 	return(0);
 }
 
-int nfqueue_set_verdict(int index, uint32_t nfid, uint32_t verdict)
+int nfqueue_set_verdict(int index, uint32_t nfid, uint32_t verdict, uint32_t mark, uint32_t length, unsigned char *data)
 {
     if (nfqqh[index] == NULL)
         return -1;
 
-	int ret = nfq_set_verdict(nfqqh[index],nfid,verdict,0,NULL);
+	int ret = nfq_set_verdict2(nfqqh[index],nfid,verdict,mark,length,data);
     if (ret < 1) {
-        logmessage(LOG_ERR,logsrc,"nfq_set_verdict(): %s\n",strerror(errno));
+        logmessage(LOG_ERR,logsrc,"nfq_set_verdict2(): %s\n",strerror(errno));
     }
 
     return ret;
 }
 
+int nfqueue_get_queue_number(int index)
+{
+	return(cfg_net_queue + index);
+}
+
+int nfqueue_get_queue_maxlen(void)
+{
+	return(cfg_net_maxlen);
+}
+
 int nfqueue_startup(int index)
 {
 	int		ret;
@@ -189,7 +199,7 @@ int nfqueue_startup(int index)
 		return(6);
 	}
 
-	// set flag so we also get the conntrack info for each packet
+	// set flag so the kernel accepts packets instead of dropping them when the queue is full
 	ret = nfq_set_queue_flags(nfqqh[index],NFQA_CFG_F_FAIL_OPEN,NFQA_CFG_F_FAIL_OPEN);
 	if (ret < 0) {
 		logmessage(LOG_ERR,logsrc,"Error returned from nfq_set_queue_flags(NFQA_CFG_F_FAIL_OPEN)\n");
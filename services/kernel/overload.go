@@ -0,0 +1,205 @@
+package kernel
+
+/*
+#include "common.h"
+*/
+import "C"
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+)
+
+// OverloadStatus holds the current state of the nfqueue overload protection
+type OverloadStatus struct {
+	Enabled        bool      `json:"enabled"`
+	Active         bool      `json:"active"`
+	ActiveSince    time.Time `json:"active_since"`
+	TriggerCount   uint64    `json:"trigger_count"`
+	LatencyLimit   int64     `json:"latency_limit_microseconds"`
+	Latency        int64     `json:"latency_microseconds"`
+	WorkerBacklog  int64     `json:"worker_backlog"`
+	WorkerCapacity int64     `json:"worker_capacity"`
+	KernelBacklog  int64     `json:"kernel_backlog"`
+	KernelCapacity int64     `json:"kernel_capacity"`
+	KernelDropped  int64     `json:"kernel_dropped"`
+}
+
+// overloadCheckInterval is how often we check the queue depth and verdict latency
+const overloadCheckInterval = 250 * time.Millisecond
+
+// overloadHighWater is the percentage of the worker or kernel queue capacity
+// that will trigger the bypass even if the latency is still acceptable
+const overloadHighWater = 75
+
+// overloadLowWater is the percentage of the worker and kernel queue capacity
+// the backlog must drop below before we clear the bypass
+const overloadLowWater = 10
+
+// overloadRecoveryChecks is the number of consecutive checks that must be below the
+// low water marks and half the latency limit before we clear the bypass
+const overloadRecoveryChecks = 8
+
+// overloadHoldTime is the minimum time we leave the bypass set once triggered
+const overloadHoldTime = 5 * time.Second
+
+// overloadLatency is the verdict latency that triggers the bypass or zero to disable
+var overloadLatency = 500 * time.Millisecond
+
+// nfqueueBacklog is the number of packets waiting for or being handled by workers
+var nfqueueBacklog int64
+
+// verdictLatencyMax is the largest verdict latency in nanoseconds since the last check
+var verdictLatencyMax int64
+
+var overloadStatus OverloadStatus
+var overloadCalmCount int
+var overloadMutex sync.Mutex
+
+// SetOverloadLatency sets the verdict latency that will trigger the automatic
+// traffic bypass. A value of zero disables the overload protection.
+func SetOverloadLatency(value time.Duration) {
+	overloadMutex.Lock()
+	overloadLatency = value
+	overloadMutex.Unlock()
+}
+
+// GetOverloadStatus returns the current state of the overload protection
+func GetOverloadStatus() OverloadStatus {
+	overloadMutex.Lock()
+	defer overloadMutex.Unlock()
+	return overloadStatus
+}
+
+// recordVerdictLatency records the time between receiving a packet and setting the verdict
+func recordVerdictLatency(elapsed time.Duration) {
+	value := int64(elapsed)
+	for {
+		current := atomic.LoadInt64(&verdictLatencyMax)
+		if value <= current || atomic.CompareAndSwapInt64(&verdictLatencyMax, current, value) {
+			return
+		}
+	}
+}
+
+// overloadTask periodically checks for overload until shutdown
+func overloadTask(queueCount int) {
+	ticker := time.NewTicker(overloadCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-GetShutdownChannel():
+			logger.Info("Shutdown nfqueue overload task\n")
+			return
+		case <-ticker.C:
+			checkOverload(queueCount)
+		}
+	}
+}
+
+// checkOverload sets the bypass flag when the verdict latency or the queue backlog
+// gets too high, and clears it once things have been calm for a while. We only
+// clear a bypass we set ourselves, and we don't do anything while a bypass that
+// was set manually is active.
+func checkOverload(queueCount int) {
+	latency := time.Duration(atomic.SwapInt64(&verdictLatencyMax, 0))
+	backlog := atomic.LoadInt64(&nfqueueBacklog)
+	kernelBacklog, kernelDropped := readQueueStats(queueCount)
+	workerCapacity := int64(queueCount * nfqueueWorkerCount * nfqueueTaskDepth)
+	kernelCapacity := int64(queueCount * int(C.nfqueue_get_queue_maxlen()))
+
+	overloadMutex.Lock()
+	defer overloadMutex.Unlock()
+
+	overloadStatus.Enabled = (overloadLatency != 0)
+	overloadStatus.LatencyLimit = int64(overloadLatency / time.Microsecond)
+	overloadStatus.Latency = int64(latency / time.Microsecond)
+	overloadStatus.WorkerBacklog = backlog
+	overloadStatus.WorkerCapacity = workerCapacity
+	overloadStatus.KernelBacklog = kernelBacklog
+	overloadStatus.KernelCapacity = kernelCapacity
+	overloadStatus.KernelDropped = kernelDropped
+
+	if overloadLatency == 0 {
+		return
+	}
+
+	if !overloadStatus.Active {
+		if GetBypassFlag() != 0 {
+			return
+		}
+		if latency < overloadLatency && backlog*100 < workerCapacity*overloadHighWater && kernelBacklog*100 < kernelCapacity*overloadHighWater {
+			return
+		}
+		C.set_bypass_flag(1)
+		overloadStatus.Active = true
+		overloadStatus.ActiveSince = time.Now()
+		overloadStatus.TriggerCount++
+		overloadCalmCount = 0
+		logger.Alert("%OC|Overload detected - latency:%v backlog:%d kernel:%d - enabling traffic bypass\n", "nfqueue_overload_bypass", 0, latency, backlog, kernelBacklog)
+		return
+	}
+
+	if latency < overloadLatency/2 && backlog*100 <= workerCapacity*overloadLowWater && kernelBacklog*100 <= kernelCapacity*overloadLowWater {
+		overloadCalmCount++
+	} else {
+		overloadCalmCount = 0
+	}
+
+	if overloadCalmCount < overloadRecoveryChecks || time.Since(overloadStatus.ActiveSince) < overloadHoldTime {
+		return
+	}
+
+	C.set_bypass_flag(0)
+	overloadStatus.Active = false
+	logger.Notice("%OC|Overload cleared after %v - disabling traffic bypass\n", "nfqueue_overload_clear", 0, time.Since(overloadStatus.ActiveSince).Round(time.Millisecond))
+}
+
+// clearOverload forgets about a bypass we set so a manual change to the bypass flag takes over
+func clearOverload() {
+	overloadMutex.Lock()
+	overloadStatus.Active = false
+	overloadMutex.Unlock()
+}
+
+// readQueueStats returns the number of packets waiting in the kernel queues and the
+// total number of packets dropped for our queues. Each line in the file has the
+// queue_number peer_portid queue_total copy_mode copy_range queue_dropped user_dropped
+// id_sequence and 1
+func readQueueStats(queueCount int) (int64, int64) {
+	var backlog int64
+	var dropped int64
+
+	file, err := os.Open("/proc/net/netfilter/nfnetlink_queue")
+	if err != nil {
+		return 0, 0
+	}
+	defer file.Close()
+
+	first := int64(C.nfqueue_get_queue_number(0))
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 7 {
+			continue
+		}
+		queue, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil || queue < first || queue >= first+int64(queueCount) {
+			continue
+		}
+		total, _ := strconv.ParseInt(fields[2], 10, 64)
+		queueDropped, _ := strconv.ParseInt(fields[5], 10, 64)
+		userDropped, _ := strconv.ParseInt(fields[6], 10, 64)
+		backlog += total
+		dropped += queueDropped + userDropped
+	}
+	return backlog, dropped
+}
@@ -0,0 +1,346 @@
+package kernel
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// The pcap and pcapng link types we can play back
+const (
+	linkTypeNull      = 0
+	linkTypeEthernet  = 1
+	linkTypeRaw       = 101
+	linkTypeLinuxSLL  = 113
+	linkTypeIPv4      = 228
+	linkTypeIPv6      = 229
+	linkTypeLinuxSLL2 = 276
+)
+
+// The pcapng blocks that hold packets
+const (
+	pcapngObsoletePacket = 0x00000002
+	pcapngSimplePacket   = 0x00000003
+)
+
+// capturePacket is a single packet read from a pcap or pcapng file
+type capturePacket struct {
+	stamp    int64 // nanoseconds since the epoch
+	linkType uint32
+	data     []byte
+}
+
+// packetFileReader returns the packets from a pcap or pcapng file
+type packetFileReader interface {
+	next() (*capturePacket, error)
+}
+
+// isPacketFile returns true if the argumented file header is from a pcap or pcapng file
+func isPacketFile(header []byte) bool {
+	if len(header) < 4 {
+		return false
+	}
+	switch binary.LittleEndian.Uint32(header) {
+	case 0xA1B2C3D4, 0xD4C3B2A1, 0xA1B23C4D, 0x4D3CB2A1, pcapngSectionHeader:
+		return true
+	}
+	return false
+}
+
+// newPacketFileReader returns a reader for the pcap or pcapng file
+func newPacketFileReader(input io.Reader) (packetFileReader, error) {
+	buffered := bufio.NewReader(input)
+	magic, err := buffered.Peek(4)
+	if err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(magic) == pcapngSectionHeader {
+		return &pcapngReader{input: buffered}, nil
+	}
+	return newPcapReader(buffered)
+}
+
+// pcapReader reads the classic pcap file format
+type pcapReader struct {
+	input    io.Reader
+	order    binary.ByteOrder
+	nanos    bool
+	linkType uint32
+}
+
+// newPcapReader reads the pcap file header
+func newPcapReader(input io.Reader) (*pcapReader, error) {
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(input, header); err != nil {
+		return nil, fmt.Errorf("Unable to read pcap file header: %v", err)
+	}
+
+	reader := &pcapReader{input: input}
+	switch binary.LittleEndian.Uint32(header) {
+	case 0xA1B2C3D4:
+		reader.order = binary.LittleEndian
+	case 0xD4C3B2A1:
+		reader.order = binary.BigEndian
+	case 0xA1B23C4D:
+		reader.order = binary.LittleEndian
+		reader.nanos = true
+	case 0x4D3CB2A1:
+		reader.order = binary.BigEndian
+		reader.nanos = true
+	default:
+		return nil, fmt.Errorf("Invalid pcap file signature")
+	}
+	reader.linkType = reader.order.Uint32(header[20:24]) & 0x0FFFFFFF
+	return reader, nil
+}
+
+// next returns the next packet from the pcap file or io.EOF
+func (reader *pcapReader) next() (*capturePacket, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader.input, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("Truncated pcap record header")
+		}
+		return nil, err
+	}
+
+	packet := &capturePacket{linkType: reader.linkType}
+	fraction := int64(reader.order.Uint32(header[4:8]))
+	if !reader.nanos {
+		fraction *= 1000
+	}
+	packet.stamp = int64(reader.order.Uint32(header[0:4]))*1000000000 + fraction
+
+	length := reader.order.Uint32(header[8:12])
+	if length > 0x40000 {
+		return nil, fmt.Errorf("Invalid pcap record length %d", length)
+	}
+	packet.data = make([]byte, length)
+	if _, err := io.ReadFull(reader.input, packet.data); err != nil {
+		return nil, fmt.Errorf("Truncated pcap record: %v", err)
+	}
+	return packet, nil
+}
+
+// pcapngInterface holds the details of a pcapng interface we need to decode packets
+type pcapngInterface struct {
+	linkType uint32
+	// units is the number of timestamp units in one second
+	units float64
+}
+
+// pcapngReader reads the pcapng file format
+type pcapngReader struct {
+	input      io.Reader
+	order      binary.ByteOrder
+	interfaces []pcapngInterface
+}
+
+// next returns the next packet from the pcapng file or io.EOF. Blocks that
+// don't hold packets are skipped.
+func (reader *pcapngReader) next() (*capturePacket, error) {
+	for {
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(reader.input, header); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return nil, fmt.Errorf("Truncated pcapng block header")
+			}
+			return nil, err
+		}
+
+		// the section header sets the byte order for everything that follows
+		blockType := binary.LittleEndian.Uint32(header[0:4])
+		if blockType == pcapngSectionHeader {
+			magic := make([]byte, 4)
+			if _, err := io.ReadFull(reader.input, magic); err != nil {
+				return nil, fmt.Errorf("Truncated pcapng section header")
+			}
+			if binary.LittleEndian.Uint32(magic) == pcapngByteOrderMagic {
+				reader.order = binary.LittleEndian
+			} else {
+				reader.order = binary.BigEndian
+			}
+			reader.interfaces = nil
+			header = append(header, magic...)
+		} else if reader.order == nil {
+			return nil, fmt.Errorf("Invalid pcapng file signature")
+		} else {
+			blockType = reader.order.Uint32(header[0:4])
+		}
+
+		length := reader.order.Uint32(header[4:8])
+		if length < uint32(len(header))+4 || length > 0x40000 || length%4 != 0 {
+			return nil, fmt.Errorf("Invalid pcapng block length %d", length)
+		}
+		body := make([]byte, int(length)-len(header)-4)
+		trailer := make([]byte, 4)
+		if _, err := io.ReadFull(reader.input, body); err != nil {
+			return nil, fmt.Errorf("Truncated pcapng block: %v", err)
+		}
+		if _, err := io.ReadFull(reader.input, trailer); err != nil {
+			return nil, fmt.Errorf("Truncated pcapng block: %v", err)
+		}
+
+		switch blockType {
+		case pcapngInterfaceDesc:
+			reader.addInterface(body)
+		case pcapngEnhancedPacket, pcapngObsoletePacket:
+			if packet := reader.decodePacket(blockType, body); packet != nil {
+				return packet, nil
+			}
+		case pcapngSimplePacket:
+			if len(body) >= 4 && len(reader.interfaces) != 0 {
+				length := reader.order.Uint32(body[0:4])
+				if int(length) > len(body)-4 {
+					length = uint32(len(body) - 4)
+				}
+				return &capturePacket{linkType: reader.interfaces[0].linkType, data: body[4 : 4+length]}, nil
+			}
+		}
+	}
+}
+
+// addInterface adds an interface from an interface description block
+func (reader *pcapngReader) addInterface(body []byte) {
+	if len(body) < 8 {
+		return
+	}
+
+	iface := pcapngInterface{linkType: uint32(reader.order.Uint16(body[0:2])), units: 1000000}
+
+	// look for the timestamp resolution option
+	options := body[8:]
+	for len(options) >= 4 {
+		code := reader.order.Uint16(options[0:2])
+		size := int(reader.order.Uint16(options[2:4]))
+		if code == pcapngOptionEnd || 4+size > len(options) {
+			break
+		}
+		if code == pcapngOptionTimeResolution && size >= 1 {
+			value := options[4]
+			if value&0x80 != 0 {
+				iface.units = math.Pow(2, float64(value&0x7F))
+			} else {
+				iface.units = math.Pow(10, float64(value))
+			}
+		}
+		options = options[(4+size+3)&^3:]
+	}
+
+	reader.interfaces = append(reader.interfaces, iface)
+}
+
+// decodePacket returns the packet in an enhanced packet block or obsolete packet block
+func (reader *pcapngReader) decodePacket(blockType uint32, body []byte) *capturePacket {
+	if len(body) < 20 {
+		return nil
+	}
+
+	var index uint32
+	if blockType == pcapngObsoletePacket {
+		index = uint32(reader.order.Uint16(body[0:2]))
+	} else {
+		index = reader.order.Uint32(body[0:4])
+	}
+	if int(index) >= len(reader.interfaces) {
+		return nil
+	}
+	iface := reader.interfaces[index]
+
+	stamp := uint64(reader.order.Uint32(body[4:8]))<<32 | uint64(reader.order.Uint32(body[8:12]))
+	length := reader.order.Uint32(body[12:16])
+	if int(length) > len(body)-20 {
+		return nil
+	}
+
+	packet := &capturePacket{linkType: iface.linkType, data: body[20 : 20+length]}
+	seconds := stamp / uint64(iface.units)
+	fraction := float64(stamp%uint64(iface.units)) / iface.units
+	packet.stamp = int64(seconds)*1000000000 + int64(fraction*1000000000)
+	return packet
+}
+
+// supportedLinkType returns true if networkPayload can handle the argumented link type
+func supportedLinkType(linkType uint32) bool {
+	switch linkType {
+	case linkTypeNull, linkTypeEthernet, linkTypeRaw, linkTypeLinuxSLL, linkTypeIPv4, linkTypeIPv6, linkTypeLinuxSLL2:
+		return true
+	}
+	return false
+}
+
+// networkPayload returns the IP header and payload of a packet and true, or false
+// if the link type is not supported or the packet is not IPv4 or IPv6. Anything
+// after the length in the IP header such as Ethernet padding is removed.
+func networkPayload(packet *capturePacket) ([]byte, bool) {
+	data := packet.data
+	var etherType uint16
+
+	switch packet.linkType {
+	case linkTypeRaw, linkTypeIPv4, linkTypeIPv6:
+	case linkTypeNull:
+		if len(data) < 4 {
+			return nil, false
+		}
+		data = data[4:]
+	case linkTypeEthernet:
+		if len(data) < 14 {
+			return nil, false
+		}
+		etherType = binary.BigEndian.Uint16(data[12:14])
+		data = data[14:]
+		// skip any VLAN tags
+		for (etherType == 0x8100 || etherType == 0x88A8) && len(data) >= 4 {
+			etherType = binary.BigEndian.Uint16(data[2:4])
+			data = data[4:]
+		}
+		if etherType != 0x0800 && etherType != 0x86DD {
+			return nil, false
+		}
+	case linkTypeLinuxSLL:
+		if len(data) < 16 {
+			return nil, false
+		}
+		etherType = binary.BigEndian.Uint16(data[14:16])
+		data = data[16:]
+		if etherType != 0x0800 && etherType != 0x86DD {
+			return nil, false
+		}
+	case linkTypeLinuxSLL2:
+		if len(data) < 20 {
+			return nil, false
+		}
+		etherType = binary.BigEndian.Uint16(data[0:2])
+		data = data[20:]
+		if etherType != 0x0800 && etherType != 0x86DD {
+			return nil, false
+		}
+	default:
+		return nil, false
+	}
+
+	if len(data) == 0 {
+		return nil, false
+	}
+
+	var length int
+	switch data[0] & 0xF0 {
+	case 0x40:
+		if len(data) >= 20 {
+			length = int(binary.BigEndian.Uint16(data[2:4]))
+		}
+	case 0x60:
+		// a zero payload length is a jumbogram so we leave those alone
+		if len(data) >= 40 && binary.BigEndian.Uint16(data[4:6]) != 0 {
+			length = 40 + int(binary.BigEndian.Uint16(data[4:6]))
+		}
+	default:
+		return nil, false
+	}
+	if length != 0 && length < len(data) {
+		data = data[:length]
+	}
+	return data, true
+}
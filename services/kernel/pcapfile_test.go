@@ -0,0 +1,202 @@
+package kernel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// testIPv4 returns an IPv4 header with the total length set for the argumented payload size
+func testIPv4(payload int) []byte {
+	data := make([]byte, 20+payload)
+	data[0] = 0x45
+	binary.BigEndian.PutUint16(data[2:4], uint16(len(data)))
+	data[9] = 17
+	return data
+}
+
+// testIPv6 returns an IPv6 header with the payload length set for the argumented payload size
+func testIPv6(payload int) []byte {
+	data := make([]byte, 40+payload)
+	data[0] = 0x60
+	binary.BigEndian.PutUint16(data[4:6], uint16(payload))
+	data[6] = 17
+	return data
+}
+
+// testPcapFile returns a pcap file with one packet using the argumented byte order and magic
+func testPcapFile(order binary.ByteOrder, magic uint32, seconds uint32, fraction uint32, packet []byte) []byte {
+	data := make([]byte, 40)
+	order.PutUint32(data[0:4], magic)
+	order.PutUint16(data[4:6], 2)
+	order.PutUint16(data[6:8], 4)
+	order.PutUint32(data[16:20], 0xFFFF)
+	order.PutUint32(data[20:24], linkTypeEthernet)
+	order.PutUint32(data[24:28], seconds)
+	order.PutUint32(data[28:32], fraction)
+	order.PutUint32(data[32:36], uint32(len(packet)))
+	order.PutUint32(data[36:40], uint32(len(packet)))
+	return append(data, packet...)
+}
+
+// testPcapngBlock returns a pcapng block using the argumented byte order
+func testPcapngBlock(order binary.ByteOrder, blockType uint32, body []byte) []byte {
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	block := make([]byte, 8, len(body)+12)
+	order.PutUint32(block[0:4], blockType)
+	order.PutUint32(block[4:8], uint32(len(body)+12))
+	block = append(block, body...)
+	block = append(block, 0, 0, 0, 0)
+	order.PutUint32(block[len(block)-4:], uint32(len(block)))
+	return block
+}
+
+// testPcapngFile returns a pcapng file with one interface and one enhanced packet using the
+// argumented byte order. The timestamp resolution option is only written when resolution is not zero.
+func testPcapngFile(order binary.ByteOrder, resolution byte, stamp uint64, packet []byte) []byte {
+	section := make([]byte, 16)
+	order.PutUint32(section[0:4], pcapngByteOrderMagic)
+	order.PutUint16(section[4:6], 1)
+	order.PutUint64(section[8:16], 0xFFFFFFFFFFFFFFFF)
+	file := testPcapngBlock(order, pcapngSectionHeader, section)
+
+	iface := make([]byte, 8)
+	order.PutUint16(iface[0:2], linkTypeEthernet)
+	order.PutUint32(iface[4:8], 0xFFFF)
+	if resolution != 0 {
+		option := make([]byte, 8)
+		order.PutUint16(option[0:2], pcapngOptionTimeResolution)
+		order.PutUint16(option[2:4], 1)
+		option[4] = resolution
+		iface = append(iface, option...)
+		iface = append(iface, 0, 0, 0, 0)
+	}
+	file = append(file, testPcapngBlock(order, pcapngInterfaceDesc, iface)...)
+
+	body := make([]byte, 20)
+	order.PutUint32(body[4:8], uint32(stamp>>32))
+	order.PutUint32(body[8:12], uint32(stamp))
+	order.PutUint32(body[12:16], uint32(len(packet)))
+	order.PutUint32(body[16:20], uint32(len(packet)))
+	body = append(body, packet...)
+	return append(file, testPcapngBlock(order, pcapngEnhancedPacket, body)...)
+}
+
+// TestPacketFileReaders checks the timestamps and data of the pcap and pcapng readers
+// with both byte orders and all of the timestamp resolutions
+func TestPacketFileReaders(t *testing.T) {
+	packet := []byte{0xDE, 0xAD, 0xBE, 0xEF, 0x01}
+
+	tests := []struct {
+		name  string
+		file  []byte
+		stamp int64
+	}{
+		{"pcap little endian", testPcapFile(binary.LittleEndian, 0xA1B2C3D4, 100, 250, packet), 100000250000},
+		{"pcap big endian", testPcapFile(binary.BigEndian, 0xA1B2C3D4, 100, 250, packet), 100000250000},
+		{"pcap nanosecond little endian", testPcapFile(binary.LittleEndian, 0xA1B23C4D, 100, 250, packet), 100000000250},
+		{"pcap nanosecond big endian", testPcapFile(binary.BigEndian, 0xA1B23C4D, 100, 250, packet), 100000000250},
+		{"pcapng default resolution", testPcapngFile(binary.LittleEndian, 0, 100000250, packet), 100000250000},
+		{"pcapng big endian", testPcapngFile(binary.BigEndian, 0, 100000250, packet), 100000250000},
+		{"pcapng nanosecond resolution", testPcapngFile(binary.LittleEndian, 9, 100000000250, packet), 100000000250},
+		{"pcapng millisecond big endian", testPcapngFile(binary.BigEndian, 3, 100250, packet), 100250000000},
+		{"pcapng binary resolution", testPcapngFile(binary.LittleEndian, 0x83, 802, packet), 100250000000},
+	}
+
+	for _, test := range tests {
+		reader, err := newPacketFileReader(bytes.NewReader(test.file))
+		if err != nil {
+			t.Errorf("%s: newPacketFileReader failed: %v", test.name, err)
+			continue
+		}
+		result, err := reader.next()
+		if err != nil {
+			t.Errorf("%s: next failed: %v", test.name, err)
+			continue
+		}
+		if result.stamp != test.stamp || result.linkType != linkTypeEthernet || !bytes.Equal(result.data, packet) {
+			t.Errorf("%s: unexpected packet %d %d %x", test.name, result.stamp, result.linkType, result.data)
+		}
+		if _, err = reader.next(); err != io.EOF {
+			t.Errorf("%s: expected io.EOF after the last packet: %v", test.name, err)
+		}
+	}
+
+	if _, err := newPacketFileReader(bytes.NewReader([]byte("not a capture file at all"))); err == nil {
+		t.Errorf("Expected an error for an invalid file signature")
+	}
+}
+
+// TestNetworkPayload checks the link layer headers are removed and the IP packet is trimmed to its length
+func TestNetworkPayload(t *testing.T) {
+	ip4 := testIPv4(8)
+	ip6 := testIPv6(8)
+	padding := make([]byte, 6)
+
+	ethernet := func(etherType uint16, tags ...uint16) []byte {
+		data := make([]byte, 12)
+		for _, tag := range tags {
+			data = append(data, byte(tag>>8), byte(tag), 0x00, 0x64)
+		}
+		return append(data, byte(etherType>>8), byte(etherType))
+	}
+	linuxSLL := func(etherType uint16) []byte {
+		data := make([]byte, 14)
+		return append(data, byte(etherType>>8), byte(etherType))
+	}
+	linuxSLL2 := func(etherType uint16) []byte {
+		data := make([]byte, 20)
+		data[0] = byte(etherType >> 8)
+		data[1] = byte(etherType)
+		return data
+	}
+	join := func(parts ...[]byte) []byte {
+		var data []byte
+		for _, part := range parts {
+			data = append(data, part...)
+		}
+		return data
+	}
+
+	// a jumbogram has a zero payload length so nothing is trimmed
+	jumbo := testIPv6(8)
+	binary.BigEndian.PutUint16(jumbo[4:6], 0)
+
+	tests := []struct {
+		name     string
+		linkType uint32
+		data     []byte
+		payload  []byte
+	}{
+		{"raw ipv4", linkTypeRaw, ip4, ip4},
+		{"raw ipv4 with trailer", linkTypeRaw, join(ip4, padding), ip4},
+		{"ipv6 link type", linkTypeIPv6, join(ip6, padding), ip6},
+		{"null", linkTypeNull, join([]byte{2, 0, 0, 0}, ip4), ip4},
+		{"ethernet ipv4 with padding", linkTypeEthernet, join(ethernet(0x0800), ip4, padding), ip4},
+		{"ethernet ipv6", linkTypeEthernet, join(ethernet(0x86DD), ip6), ip6},
+		{"ethernet vlan", linkTypeEthernet, join(ethernet(0x0800, 0x8100), ip4, padding), ip4},
+		{"ethernet qinq", linkTypeEthernet, join(ethernet(0x86DD, 0x88A8, 0x8100), ip6, padding), ip6},
+		{"ethernet arp", linkTypeEthernet, join(ethernet(0x0806), ip4), nil},
+		{"linux sll ipv4", linkTypeLinuxSLL, join(linuxSLL(0x0800), ip4, padding), ip4},
+		{"linux sll ipv6", linkTypeLinuxSLL, join(linuxSLL(0x86DD), ip6, padding), ip6},
+		{"linux sll arp", linkTypeLinuxSLL, join(linuxSLL(0x0806), ip4), nil},
+		{"linux sll2 ipv4", linkTypeLinuxSLL2, join(linuxSLL2(0x0800), ip4, padding), ip4},
+		{"linux sll2 ipv6", linkTypeLinuxSLL2, join(linuxSLL2(0x86DD), ip6), ip6},
+		{"linux sll2 arp", linkTypeLinuxSLL2, join(linuxSLL2(0x0806), ip4), nil},
+		{"truncated linux sll2", linkTypeLinuxSLL2, linuxSLL2(0x0800)[:12], nil},
+		{"truncated ethernet", linkTypeEthernet, ethernet(0x0800)[:10], nil},
+		{"not ip", linkTypeRaw, []byte{0x12, 0x34}, nil},
+		{"unsupported link type", pcapngLinkTypeUser0, ip4, nil},
+		{"ipv6 jumbogram", linkTypeRaw, jumbo, jumbo},
+	}
+
+	for _, test := range tests {
+		payload, ok := networkPayload(&capturePacket{linkType: test.linkType, data: test.data})
+		if ok != (test.payload != nil) || !bytes.Equal(payload, test.payload) {
+			t.Errorf("%s: networkPayload returned %x %v expected %x", test.name, payload, ok, test.payload)
+		}
+	}
+}
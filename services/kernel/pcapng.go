@@ -0,0 +1,184 @@
+package kernel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/untangle/packetd/services/warehouse"
+)
+
+// The pcapng block types and options we use
+const (
+	pcapngSectionHeader        = 0x0A0D0D0A
+	pcapngInterfaceDesc        = 0x00000001
+	pcapngEnhancedPacket       = 0x00000006
+	pcapngByteOrderMagic       = 0x1A2B3C4D
+	pcapngOptionEnd            = 0
+	pcapngOptionComment        = 1
+	pcapngOptionInterfaceName  = 2
+	pcapngOptionUserAppl       = 4
+	pcapngOptionTimeResolution = 9
+	pcapngOptionCustomBinary   = 2989
+	pcapngLinkTypeRaw          = 101
+	pcapngLinkTypeUser0        = 147
+)
+
+// The interfaces in the pcapng files we write
+const (
+	pcapngPacketInterface   = 0
+	pcapngMetadataInterface = 1
+)
+
+// PcapngEnterpriseNumber is the Private Enterprise Number written in the custom options
+// that hold packetd metadata. We don't have an assigned number so the reserved value
+// zero is used which readers will show as unknown custom data.
+const PcapngEnterpriseNumber = 0
+
+// PcapngWriter writes warehouse records to a pcapng file. The nfqueue records are
+// written as enhanced packet blocks on the raw IP interface with the mark, ctid, nfid,
+// and family in a comment and a custom option. The conntrack and netlogger records are
+// written as enhanced packet blocks on a second user link type interface where the
+// packet is the warehouse record header and data and the comment describes the event.
+type PcapngWriter struct {
+	output io.Writer
+}
+
+// NewPcapngWriter writes the section header and the interface descriptions
+func NewPcapngWriter(output io.Writer) (*PcapngWriter, error) {
+	writer := &PcapngWriter{output: output}
+
+	section := make([]byte, 16)
+	binary.LittleEndian.PutUint32(section[0:4], pcapngByteOrderMagic)
+	binary.LittleEndian.PutUint16(section[4:6], 1)
+	binary.LittleEndian.PutUint16(section[6:8], 0)
+	// the section length is not known
+	binary.LittleEndian.PutUint64(section[8:16], 0xFFFFFFFFFFFFFFFF)
+	section = appendPcapngOption(section, pcapngOptionUserAppl, []byte("packetd"))
+	section = appendPcapngOption(section, pcapngOptionEnd, nil)
+	if err := writer.writeBlock(pcapngSectionHeader, section); err != nil {
+		return nil, err
+	}
+
+	// nfqueue packets start with the IP header and the timestamps are in nanoseconds
+	iface := make([]byte, 8)
+	binary.LittleEndian.PutUint16(iface[0:2], pcapngLinkTypeRaw)
+	binary.LittleEndian.PutUint32(iface[4:8], 0xFFFF)
+	iface = appendPcapngOption(iface, pcapngOptionInterfaceName, []byte("nfqueue"))
+	iface = appendPcapngOption(iface, pcapngOptionTimeResolution, []byte{9})
+	iface = appendPcapngOption(iface, pcapngOptionEnd, nil)
+	if err := writer.writeBlock(pcapngInterfaceDesc, iface); err != nil {
+		return nil, err
+	}
+
+	// conntrack and netlogger events are warehouse records that only packetd can decode
+	iface = make([]byte, 8)
+	binary.LittleEndian.PutUint16(iface[0:2], pcapngLinkTypeUser0)
+	binary.LittleEndian.PutUint32(iface[4:8], 0xFFFF)
+	iface = appendPcapngOption(iface, pcapngOptionInterfaceName, []byte("events"))
+	iface = appendPcapngOption(iface, pcapngOptionTimeResolution, []byte{9})
+	iface = appendPcapngOption(iface, pcapngOptionEnd, nil)
+	if err := writer.writeBlock(pcapngInterfaceDesc, iface); err != nil {
+		return nil, err
+	}
+
+	return writer, nil
+}
+
+// WriteRecord writes a warehouse record as an enhanced packet block
+func (writer *PcapngWriter) WriteRecord(record *warehouse.Record) error {
+	if record.Origin == warehouse.Nfqueue {
+		body := enhancedPacketBody(pcapngPacketInterface, record.Stamp(), record.Data)
+
+		custom := make([]byte, 20)
+		binary.LittleEndian.PutUint32(custom[0:4], PcapngEnterpriseNumber)
+		binary.LittleEndian.PutUint32(custom[4:8], record.Mark)
+		binary.LittleEndian.PutUint32(custom[8:12], record.Ctid)
+		binary.LittleEndian.PutUint32(custom[12:16], record.Nfid)
+		binary.LittleEndian.PutUint32(custom[16:20], record.Family)
+
+		body = appendPcapngOption(body, pcapngOptionComment, []byte(fmt.Sprintf("mark=0x%08x ctid=%d nfid=%d family=%d", record.Mark, record.Ctid, record.Nfid, record.Family)))
+		body = appendPcapngOption(body, pcapngOptionCustomBinary, custom)
+		body = appendPcapngOption(body, pcapngOptionEnd, nil)
+		return writer.writeBlock(pcapngEnhancedPacket, body)
+	}
+
+	// the packet is the warehouse record header followed by the record
+	body := enhancedPacketBody(pcapngMetadataInterface, record.Stamp(), append(record.Header(), record.Data...))
+	body = appendPcapngOption(body, pcapngOptionComment, []byte(record.String()))
+	body = appendPcapngOption(body, pcapngOptionEnd, nil)
+	return writer.writeBlock(pcapngEnhancedPacket, body)
+}
+
+// enhancedPacketBody returns the enhanced packet block body for the argumented interface,
+// timestamp in nanoseconds, and packet data without any options
+func enhancedPacketBody(iface uint32, stamp uint64, data []byte) []byte {
+	body := make([]byte, 20)
+	binary.LittleEndian.PutUint32(body[0:4], iface)
+	binary.LittleEndian.PutUint32(body[4:8], uint32(stamp>>32))
+	binary.LittleEndian.PutUint32(body[8:12], uint32(stamp))
+	binary.LittleEndian.PutUint32(body[12:16], uint32(len(data)))
+	binary.LittleEndian.PutUint32(body[16:20], uint32(len(data)))
+	body = append(body, data...)
+	return padPcapng(body)
+}
+
+// writeBlock writes a pcapng block with the argumented type and body
+func (writer *PcapngWriter) writeBlock(blockType uint32, body []byte) error {
+	length := uint32(len(body) + 12)
+	block := make([]byte, 8, length)
+	binary.LittleEndian.PutUint32(block[0:4], blockType)
+	binary.LittleEndian.PutUint32(block[4:8], length)
+	block = append(block, body...)
+	block = append(block, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(block[length-4:], length)
+	_, err := writer.output.Write(block)
+	return err
+}
+
+// appendPcapngOption appends an option with the value padded to 32 bits
+func appendPcapngOption(body []byte, code uint16, value []byte) []byte {
+	option := make([]byte, 4)
+	binary.LittleEndian.PutUint16(option[0:2], code)
+	binary.LittleEndian.PutUint16(option[2:4], uint16(len(value)))
+	body = append(body, option...)
+	body = append(body, value...)
+	return padPcapng(body)
+}
+
+// padPcapng pads the argumented data to a multiple of 32 bits
+func padPcapng(data []byte) []byte {
+	for len(data)%4 != 0 {
+		data = append(data, 0)
+	}
+	return data
+}
+
+// ConvertWarehouseToPcapng reads a warehouse capture and writes all of the records to a
+// pcapng file. It returns the number of records written.
+func ConvertWarehouseToPcapng(input io.Reader, output io.Writer) (int, error) {
+	reader, err := warehouse.NewReader(input)
+	if err != nil {
+		return 0, err
+	}
+
+	writer, err := NewPcapngWriter(output)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+		if err = writer.WriteRecord(record); err != nil {
+			return count, err
+		}
+		count++
+	}
+}
@@ -0,0 +1,69 @@
+package kernel
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/untangle/packetd/services/warehouse"
+)
+
+// TestPcapngRoundTrip writes warehouse records with PcapngWriter and reads them back with pcapngReader
+func TestPcapngRoundTrip(t *testing.T) {
+	packet := &warehouse.Record{
+		Origin:    warehouse.Nfqueue,
+		StampSec:  1234,
+		StampNsec: 567890123,
+		Mark:      0x10000000,
+		Ctid:      42,
+		Nfid:      7,
+		Family:    2,
+		Data:      []byte{0x45, 0x00, 0x00, 0x15, 0, 0, 0, 0, 64, 17, 0, 0, 10, 0, 0, 1, 10, 0, 0, 2, 0xFF},
+	}
+	event := &warehouse.Record{
+		Origin:    warehouse.Conntrack,
+		StampSec:  1235,
+		StampNsec: 1,
+		Ctid:      42,
+		Data:      (&warehouse.ConntrackInfo{ConnID: 42, MsgType: 'N', Family: 2, Protocol: 17}).Bytes(),
+	}
+
+	var buffer bytes.Buffer
+	writer, err := NewPcapngWriter(&buffer)
+	if err != nil {
+		t.Fatalf("NewPcapngWriter failed: %v", err)
+	}
+	for _, record := range []*warehouse.Record{packet, event} {
+		if err = writer.WriteRecord(record); err != nil {
+			t.Fatalf("WriteRecord failed: %v", err)
+		}
+	}
+
+	reader, err := newPacketFileReader(&buffer)
+	if err != nil {
+		t.Fatalf("newPacketFileReader failed: %v", err)
+	}
+
+	result, err := reader.next()
+	if err != nil {
+		t.Fatalf("Unable to read the nfqueue packet: %v", err)
+	}
+	if result.linkType != linkTypeRaw || result.stamp != int64(packet.Stamp()) || !bytes.Equal(result.data, packet.Data) {
+		t.Errorf("Unexpected nfqueue packet: %d %d %x", result.linkType, result.stamp, result.data)
+	}
+
+	result, err = reader.next()
+	if err != nil {
+		t.Fatalf("Unable to read the conntrack event: %v", err)
+	}
+	if result.linkType != pcapngLinkTypeUser0 || result.stamp != int64(event.Stamp()) || !bytes.Equal(result.data, append(event.Header(), event.Data...)) {
+		t.Errorf("Unexpected conntrack event: %d %d %x", result.linkType, result.stamp, result.data)
+	}
+	if _, found := networkPayload(result); found {
+		t.Errorf("The conntrack event should not be played back as a packet")
+	}
+
+	if _, err = reader.next(); err != io.EOF {
+		t.Errorf("Expected io.EOF after the last record: %v", err)
+	}
+}
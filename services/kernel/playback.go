@@ -0,0 +1,401 @@
+package kernel
+
+/*
+#include "common.h"
+*/
+import "C"
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/untangle/packetd/services/clock"
+	"github.com/untangle/packetd/services/logger"
+)
+
+// playbackUpdateInterval is how often in capture time we create conntrack update events
+const playbackUpdateInterval = 60 * int64(time.Second)
+
+// playbackNewSession is the mark bit that tells dispatch a packet starts a new session
+const playbackNewSession = 0x10000000
+
+// playbackIDFlag is set in the conntrack ID of all playback sessions to match the warehouse playback
+const playbackIDFlag = 0xF0000000
+
+// The conntrack TCP states we create for playback flows
+const (
+	tcpStateSynSent     = 1
+	tcpStateSynRecv     = 2
+	tcpStateEstablished = 3
+	tcpStateFinWait     = 4
+	tcpStateClose       = 8
+)
+
+// playbackFlow tracks a flow seen during a pcap playback so we can create conntrack events for it
+type playbackFlow struct {
+	ctid          uint32
+	family        uint8
+	protocol      uint8
+	client        net.IP
+	server        net.IP
+	clientPort    uint16
+	serverPort    uint16
+	clientBytes   uint64
+	serverBytes   uint64
+	clientPackets uint64
+	serverPackets uint64
+	start         int64
+	last          int64
+	tcpState      uint8
+	clientFin     bool
+	serverFin     bool
+	closed        bool
+	active        bool
+}
+
+// playbackPacketInfo holds the fields of a packet we use to track flows
+type playbackPacketInfo struct {
+	family     uint8
+	protocol   uint8
+	source     net.IP
+	dest       net.IP
+	sourcePort uint16
+	destPort   uint16
+	tcp        *layers.TCP
+}
+
+// playbackClockBase is the timestamp of the first record in the current playback or
+// -1 before the first record. Every playback starts the virtual clock at the epoch
+// and moves it by the time since the first record so warehouse, pcap, and pcapng
+// captures are all replayed the same way regardless of their timestamp source.
+var playbackClockBase int64 = -1
+
+// resetPlaybackClock puts the virtual clock back to the epoch before a playback
+func resetPlaybackClock() {
+	playbackClockBase = -1
+	clock.Reset(clock.Epoch)
+}
+
+// advancePlaybackClock moves the virtual clock to the argumented record timestamp in nanoseconds
+func advancePlaybackClock(stamp int64) {
+	if playbackClockBase < 0 {
+		playbackClockBase = stamp
+	}
+	clock.Advance(clock.Epoch.Add(time.Duration(stamp - playbackClockBase)))
+}
+
+// packetPlayback holds the state of a pcap or pcapng playback
+type packetPlayback struct {
+	flows       map[string]*playbackFlow
+	nextID      uint32
+	lastUpdate  int64
+	unsupported map[uint32]bool
+}
+
+// isPacketFilePlayback returns true if the playback file is a pcap or pcapng file
+func isPacketFilePlayback(filename string) bool {
+	file, err := os.Open(filename)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	header := make([]byte, 4)
+	if _, err := file.Read(header); err != nil {
+		return false
+	}
+	return isPacketFile(header)
+}
+
+// playbackPacketFile plays a pcap or pcapng file through the nfqueue callback. We create
+// conntrack IDs and the conntrack NEW, UPDATE and DELETE events from the flows in the
+// capture and set the new session bit in the mark of the first packet of each flow.
+func playbackPacketFile(filename string) {
+	file, err := os.Open(filename)
+	if err != nil {
+		logger.Warn("Unable to playback %s\n", filename)
+		return
+	}
+	defer file.Close()
+
+	reader, err := newPacketFileReader(file)
+	if err != nil {
+		logger.Warn("Unable to playback %s: %v\n", filename, err)
+		return
+	}
+
+	speed := int64(C.get_warehouse_speed())
+	logger.Info("Beginning packet playback %s speed %d%%\n", filename, speed)
+
+	playback := &packetPlayback{flows: make(map[string]*playbackFlow), unsupported: make(map[uint32]bool)}
+	var last int64
+	var count int
+
+	for C.get_shutdown_flag() == 0 {
+		packet, err := reader.next()
+		if err != nil {
+			if err != io.EOF {
+				logger.Warn("Error reading %s: %v\n", filename, err)
+			}
+			break
+		}
+
+		// pause for the time between packets adjusted for the speed as a percentage
+		if speed > 0 && last != 0 && packet.stamp > last {
+			time.Sleep(time.Duration((packet.stamp - last) * 100 / speed))
+		}
+		if packet.stamp != 0 {
+			last = packet.stamp
+		}
+
+		// let the virtual clock catch up with the packet before we pass it along
+		advancePlaybackClock(packet.stamp)
+
+		if playback.handlePacket(packet) {
+			count++
+		}
+	}
+
+	// finish all of the flows that are left
+	for key, flow := range playback.flows {
+		playback.sendConntrack('D', flow)
+		delete(playback.flows, key)
+	}
+
+	logger.Info("Finished packet playback %s with %d packets\n", filename, count)
+}
+
+// handlePacket passes a packet from the capture to the nfqueue callback along with the
+// conntrack events for the flow. It returns false if the packet was skipped.
+func (playback *packetPlayback) handlePacket(capture *capturePacket) bool {
+	// the event records in our own pcapng captures are skipped quietly
+	if !supportedLinkType(capture.linkType) && capture.linkType != pcapngLinkTypeUser0 && !playback.unsupported[capture.linkType] {
+		playback.unsupported[capture.linkType] = true
+		logger.Warn("Skipping packets with unsupported link type %d\n", capture.linkType)
+	}
+
+	data, ok := networkPayload(capture)
+	if !ok {
+		return false
+	}
+
+	// copy the data since the subscribers may keep the packet
+	data = append([]byte(nil), data...)
+
+	var packet gopacket.Packet
+	if data[0]&0xF0 == 0x40 {
+		packet = gopacket.NewPacket(data, layers.LayerTypeIPv4, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	} else {
+		packet = gopacket.NewPacket(data, layers.LayerTypeIPv6, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	}
+
+	info, ok := getPlaybackPacketInfo(packet)
+	if !ok {
+		return false
+	}
+
+	playback.checkUpdates(capture.stamp)
+
+	var mark uint32
+	flow, clientToServer := playback.findFlow(info)
+
+	// a SYN on a closed TCP flow is a new connection that reused the tuple
+	if flow != nil && flow.closed && info.tcp != nil && info.tcp.SYN && !info.tcp.ACK {
+		playback.removeFlow(flow)
+		flow = nil
+	}
+
+	if flow == nil {
+		flow = playback.createFlow(info, capture.stamp)
+		clientToServer = true
+		mark = playbackNewSession
+	}
+
+	flow.update(info, clientToServer, len(data), capture.stamp)
+
+	if nfCleanTracker != nil {
+		nfCleanTracker[flow.ctid] = true
+	}
+	if nfqueueCallback != nil {
+		nfqueueCallback(flow.ctid, uint32(info.family), packet, len(data), mark)
+	}
+
+	// conntrack confirms the new entry after the first packet is accepted
+	if mark != 0 {
+		playback.sendConntrack('N', flow)
+	}
+	return true
+}
+
+// getPlaybackPacketInfo returns the addresses, ports, and protocol of a packet
+func getPlaybackPacketInfo(packet gopacket.Packet) (*playbackPacketInfo, bool) {
+	info := new(playbackPacketInfo)
+
+	if ip4, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4); ok {
+		info.family = C.AF_INET
+		info.protocol = uint8(ip4.Protocol)
+		info.source = ip4.SrcIP.To4()
+		info.dest = ip4.DstIP.To4()
+	} else if ip6, ok := packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6); ok {
+		info.family = C.AF_INET6
+		info.protocol = uint8(ip6.NextHeader)
+		info.source = ip6.SrcIP.To16()
+		info.dest = ip6.DstIP.To16()
+	} else {
+		return nil, false
+	}
+
+	if tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP); ok {
+		info.protocol = uint8(layers.IPProtocolTCP)
+		info.sourcePort = uint16(tcp.SrcPort)
+		info.destPort = uint16(tcp.DstPort)
+		info.tcp = tcp
+	} else if udp, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP); ok {
+		info.protocol = uint8(layers.IPProtocolUDP)
+		info.sourcePort = uint16(udp.SrcPort)
+		info.destPort = uint16(udp.DstPort)
+	}
+
+	return info, true
+}
+
+// playbackFlowKey returns the key for a flow in the direction of the argumented packet
+func playbackFlowKey(protocol uint8, source net.IP, sourcePort uint16, dest net.IP, destPort uint16) string {
+	return fmt.Sprintf("%d|%s|%d|%s|%d", protocol, source, sourcePort, dest, destPort)
+}
+
+// findFlow returns the flow for a packet and true if the packet is from the client
+func (playback *packetPlayback) findFlow(info *playbackPacketInfo) (*playbackFlow, bool) {
+	if flow := playback.flows[playbackFlowKey(info.protocol, info.source, info.sourcePort, info.dest, info.destPort)]; flow != nil {
+		return flow, true
+	}
+	if flow := playback.flows[playbackFlowKey(info.protocol, info.dest, info.destPort, info.source, info.sourcePort)]; flow != nil {
+		return flow, false
+	}
+	return nil, false
+}
+
+// createFlow creates a flow with the sender of the argumented packet as the client
+func (playback *packetPlayback) createFlow(info *playbackPacketInfo, stamp int64) *playbackFlow {
+	playback.nextID++
+
+	flow := new(playbackFlow)
+	flow.ctid = (playback.nextID & ^uint32(playbackIDFlag)) | playbackIDFlag
+	flow.family = info.family
+	flow.protocol = info.protocol
+	flow.client = info.source
+	flow.server = info.dest
+	flow.clientPort = info.sourcePort
+	flow.serverPort = info.destPort
+	flow.start = stamp
+
+	playback.flows[playbackFlowKey(flow.protocol, flow.client, flow.clientPort, flow.server, flow.serverPort)] = flow
+	return flow
+}
+
+// removeFlow sends the conntrack delete event for a flow and forgets about it
+func (playback *packetPlayback) removeFlow(flow *playbackFlow) {
+	playback.sendConntrack('D', flow)
+	delete(playback.flows, playbackFlowKey(flow.protocol, flow.client, flow.clientPort, flow.server, flow.serverPort))
+}
+
+// update adds a packet to the flow counters and tracks the TCP state
+func (flow *playbackFlow) update(info *playbackPacketInfo, clientToServer bool, length int, stamp int64) {
+	if clientToServer {
+		flow.clientBytes += uint64(length)
+		flow.clientPackets++
+	} else {
+		flow.serverBytes += uint64(length)
+		flow.serverPackets++
+	}
+	flow.last = stamp
+	flow.active = true
+
+	tcp := info.tcp
+	if tcp == nil {
+		return
+	}
+
+	switch {
+	case tcp.RST:
+		flow.tcpState = tcpStateClose
+		flow.closed = true
+	case tcp.FIN:
+		if clientToServer {
+			flow.clientFin = true
+		} else {
+			flow.serverFin = true
+		}
+		flow.tcpState = tcpStateFinWait
+		flow.closed = flow.clientFin && flow.serverFin
+	case tcp.SYN && !tcp.ACK:
+		flow.tcpState = tcpStateSynSent
+	case tcp.SYN && tcp.ACK:
+		flow.tcpState = tcpStateSynRecv
+	case flow.tcpState < tcpStateEstablished:
+		flow.tcpState = tcpStateEstablished
+	}
+}
+
+// timeout returns the conntrack timeout we report for a flow
+func (flow *playbackFlow) timeout() uint32 {
+	switch {
+	case flow.protocol == uint8(layers.IPProtocolTCP) && flow.tcpState == tcpStateEstablished:
+		return 7440
+	case flow.protocol == uint8(layers.IPProtocolTCP):
+		return 120
+	case flow.protocol == uint8(layers.IPProtocolUDP):
+		return 180
+	}
+	return 30
+}
+
+// checkUpdates sends the conntrack update events for the active flows once every update
+// interval of capture time and removes the flows that are closed or have timed out
+func (playback *packetPlayback) checkUpdates(stamp int64) {
+	if playback.lastUpdate == 0 || stamp < playback.lastUpdate {
+		playback.lastUpdate = stamp
+		return
+	}
+	if stamp-playback.lastUpdate < playbackUpdateInterval {
+		return
+	}
+	playback.lastUpdate = stamp
+
+	for _, flow := range playback.flows {
+		if flow.closed || stamp-flow.last > int64(flow.timeout())*int64(time.Second) {
+			playback.removeFlow(flow)
+			continue
+		}
+		if flow.active {
+			playback.sendConntrack('U', flow)
+			flow.active = false
+		}
+	}
+}
+
+// sendConntrack passes a conntrack event for the flow to the conntrack callback
+func (playback *packetPlayback) sendConntrack(eventType uint8, flow *playbackFlow) {
+	if ctCleanTracker != nil {
+		ctCleanTracker[flow.ctid] = true
+	}
+	if conntrackCallback == nil {
+		return
+	}
+
+	var stop uint64
+	if eventType == 'D' {
+		stop = uint64(flow.last)
+	}
+
+	conntrackCallback(flow.ctid, 0, flow.family, eventType, flow.protocol,
+		flow.client, flow.server, flow.clientPort, flow.serverPort,
+		flow.client, flow.server, flow.clientPort, flow.serverPort,
+		flow.clientBytes, flow.serverBytes, flow.clientPackets, flow.serverPackets,
+		uint64(flow.start), stop, flow.timeout(), flow.tcpState)
+}
@@ -0,0 +1,193 @@
+package kernel
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/untangle/packetd/services/logger"
+)
+
+// RejectNone means a dropped packet is silently discarded
+const RejectNone = 0
+
+// RejectReset means a TCP reset is sent for dropped TCP packets
+// Other protocols get an ICMP unreachable instead
+const RejectReset = 1
+
+// RejectICMP means an ICMP administratively prohibited is sent for dropped packets
+const RejectICMP = 2
+
+// rejectMark is set on packets we send so the packetd-output chain doesn't queue them
+const rejectMark = 0x20000000
+
+// sendReject builds and sends a reject response to the source of the argumented packet
+func sendReject(packet gopacket.Packet, mode int) {
+	var data []byte
+	var err error
+
+	ip4Layer := packet.Layer(layers.LayerTypeIPv4)
+	ip6Layer := packet.Layer(layers.LayerTypeIPv6)
+	tcpLayer := packet.Layer(layers.LayerTypeTCP)
+
+	// never respond to ICMP or to a reset
+	if packet.Layer(layers.LayerTypeICMPv4) != nil || packet.Layer(layers.LayerTypeICMPv6) != nil {
+		return
+	}
+	if tcpLayer != nil && tcpLayer.(*layers.TCP).RST {
+		return
+	}
+
+	if tcpLayer != nil && mode == RejectReset {
+		data, err = buildReset(ip4Layer, ip6Layer, tcpLayer.(*layers.TCP))
+	} else {
+		data, err = buildUnreachable(ip4Layer, ip6Layer, packet.Data())
+	}
+
+	if err != nil {
+		logger.Warn("Unable to build reject packet: %v\n", err)
+		return
+	}
+
+	if ip4Layer != nil {
+		err = sendRawPacket(syscall.AF_INET, ip4Layer.(*layers.IPv4).SrcIP, data)
+	} else {
+		err = sendRawPacket(syscall.AF_INET6, ip6Layer.(*layers.IPv6).SrcIP, data)
+	}
+
+	if err != nil {
+		logger.Warn("Unable to send reject packet: %v\n", err)
+	}
+}
+
+// buildReset creates a TCP reset in response to the argumented TCP segment
+func buildReset(ip4Layer gopacket.Layer, ip6Layer gopacket.Layer, tcp *layers.TCP) ([]byte, error) {
+	reset := &layers.TCP{
+		SrcPort: tcp.DstPort,
+		DstPort: tcp.SrcPort,
+		RST:     true,
+	}
+
+	// RFC 793 - if the segment has an ACK the reset takes its sequence number
+	// from the ACK field, otherwise we acknowledge everything in the segment
+	if tcp.ACK {
+		reset.Seq = tcp.Ack
+	} else {
+		reset.ACK = true
+		reset.Ack = tcp.Seq + uint32(len(tcp.Payload))
+		if tcp.SYN {
+			reset.Ack++
+		}
+		if tcp.FIN {
+			reset.Ack++
+		}
+	}
+
+	if ip4Layer != nil {
+		orig := ip4Layer.(*layers.IPv4)
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: orig.DstIP, DstIP: orig.SrcIP}
+		reset.SetNetworkLayerForChecksum(ip)
+		return serializeLayers(ip, reset)
+	}
+
+	orig := ip6Layer.(*layers.IPv6)
+	ip := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolTCP, SrcIP: orig.DstIP, DstIP: orig.SrcIP}
+	reset.SetNetworkLayerForChecksum(ip)
+	return serializeLayers(ip, reset)
+}
+
+// SendReset sends a TCP reset with the argumented sequence number from the source to the destination.
+// It is used to tear down active sessions so the addresses and ports must be those the
+// destination expects to see on packets for the session.
+func SendReset(source net.IP, destination net.IP, sourcePort uint16, destinationPort uint16, seq uint32) error {
+	var data []byte
+	var err error
+
+	reset := &layers.TCP{
+		SrcPort: layers.TCPPort(sourcePort),
+		DstPort: layers.TCPPort(destinationPort),
+		Seq:     seq,
+		RST:     true,
+	}
+
+	if source.To4() != nil {
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: source.To4(), DstIP: destination.To4()}
+		reset.SetNetworkLayerForChecksum(ip)
+		if data, err = serializeLayers(ip, reset); err != nil {
+			return err
+		}
+		return sendRawPacket(syscall.AF_INET, destination, data)
+	}
+
+	ip := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolTCP, SrcIP: source, DstIP: destination}
+	reset.SetNetworkLayerForChecksum(ip)
+	if data, err = serializeLayers(ip, reset); err != nil {
+		return err
+	}
+	return sendRawPacket(syscall.AF_INET6, destination, data)
+}
+
+// buildUnreachable creates an ICMP administratively prohibited message for the argumented packet
+func buildUnreachable(ip4Layer gopacket.Layer, ip6Layer gopacket.Layer, data []byte) ([]byte, error) {
+	if ip4Layer != nil {
+		orig := ip4Layer.(*layers.IPv4)
+		// include the original IP header and the first 8 bytes of the payload
+		size := int(orig.IHL)*4 + 8
+		if size > len(data) {
+			size = len(data)
+		}
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolICMPv4, SrcIP: orig.DstIP, DstIP: orig.SrcIP}
+		icmp := &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeCommAdminProhibited)}
+		return serializeLayers(ip, icmp, gopacket.Payload(data[:size]))
+	}
+
+	orig := ip6Layer.(*layers.IPv6)
+	// include as much of the original packet as will fit in the minimum IPv6 MTU
+	// leaving room for the IPv6 header, the ICMPv6 header, and the unused field
+	size := 1280 - 48
+	if size > len(data) {
+		size = len(data)
+	}
+	payload := make([]byte, 4+size)
+	copy(payload[4:], data[:size])
+	ip := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolICMPv6, SrcIP: orig.DstIP, DstIP: orig.SrcIP}
+	icmp := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeDestinationUnreachable, layers.ICMPv6CodeAdminProhibited)}
+	icmp.SetNetworkLayerForChecksum(ip)
+	return serializeLayers(ip, icmp, gopacket.Payload(payload))
+}
+
+// serializeLayers creates the raw packet from the argumented layers
+func serializeLayers(list ...gopacket.SerializableLayer) ([]byte, error) {
+	buffer := gopacket.NewSerializeBuffer()
+	options := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	err := gopacket.SerializeLayers(buffer, options, list...)
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// sendRawPacket sends a complete IP packet using a raw socket
+func sendRawPacket(family int, destination net.IP, data []byte) error {
+	sock, err := syscall.Socket(family, syscall.SOCK_RAW, syscall.IPPROTO_RAW)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(sock)
+
+	err = syscall.SetsockoptInt(sock, syscall.SOL_SOCKET, syscall.SO_MARK, rejectMark)
+	if err != nil {
+		return err
+	}
+
+	if family == syscall.AF_INET {
+		var addr syscall.SockaddrInet4
+		copy(addr.Addr[:], destination.To4())
+		return syscall.Sendto(sock, data, 0, &addr)
+	}
+
+	var addr syscall.SockaddrInet6
+	copy(addr.Addr[:], destination.To16())
+	return syscall.Sendto(sock, data, 0, &addr)
+}
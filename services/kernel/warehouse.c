@@ -17,6 +17,10 @@ const uint		majorVersion = 3;
 const uint		minorVersion = 0;
 
 static FILE		*capfile = NULL;
+static pthread_mutex_t	caplock = PTHREAD_MUTEX_INITIALIZER;
+static struct warehouse_options	capoptions;
+static struct warehouse_status	capstatus;
+static struct timespec	capstart;
 
 struct file_header {
 	char			description[48];
@@ -36,17 +40,33 @@ struct data_header {
 	u_int32_t		family;
 };
 
-void start_warehouse_capture(void)
+void set_warehouse_options(struct warehouse_options *options)
 {
-	struct file_header		header;
+	pthread_mutex_lock(&caplock);
+	memcpy(&capoptions,options,sizeof(capoptions));
+	pthread_mutex_unlock(&caplock);
+}
 
-	logmessage(LOG_INFO,logsrc,"Beginning capture %s\n",get_warehouse_file());
+void get_warehouse_status(struct warehouse_status *status)
+{
+	pthread_mutex_lock(&caplock);
+	memcpy(status,&capstatus,sizeof(capstatus));
+	status->active = (capfile != NULL);
+	pthread_mutex_unlock(&caplock);
+}
 
-	// if the capture file is already open close it first
-	if (capfile != NULL) fclose(capfile);
+// open_capture_file creates the capture file and writes the file header
+// but the caller must be holding the capture lock
+static int open_capture_file(void)
+{
+	struct file_header		header;
 
 	// create the capture file
 	capfile = fopen(get_warehouse_file(),"wb");
+	if (capfile == NULL) {
+		logmessage(LOG_ERR,logsrc,"Unable to create capture file %s\n",get_warehouse_file());
+		return(1);
+	}
 
 	// create the file header and write it to the capture file
 	memset(&header,0,sizeof(header));
@@ -55,24 +75,220 @@ void start_warehouse_capture(void)
 	header.majver = majorVersion;
 	header.minver = minorVersion;
 	fwrite(&header,sizeof(header),1,capfile);
+
+	clock_gettime(CLOCK_MONOTONIC,&capstart);
+	capstatus.file_bytes = sizeof(header);
+	capstatus.file_records = 0;
+	capstatus.bytes += sizeof(header);
+	capstatus.files++;
+	return(0);
+}
+
+// rotate_capture_file closes the current capture file and shifts the older files so the
+// newest is always filename.1 and the oldest beyond max_files is removed. If rotation
+// is not enabled the capture is finished. The caller must be holding the capture lock.
+static void rotate_capture_file(void)
+{
+	char		source[1024];
+	char		target[1024];
+	char		*filename;
+	u_int32_t	x;
+
+	filename = get_warehouse_file();
+	fclose(capfile);
+	capfile = NULL;
+
+	if (capoptions.max_files < 2) {
+		logmessage(LOG_INFO,logsrc,"Finished capture %s at limit\n",filename);
+		set_warehouse_flag('I');
+		return;
+	}
+
+	for (x = capoptions.max_files - 1;x > 1;x--) {
+		snprintf(source,sizeof(source),"%s.%u",filename,x - 1);
+		snprintf(target,sizeof(target),"%s.%u",filename,x);
+		rename(source,target);
+	}
+
+	snprintf(target,sizeof(target),"%s.1",filename);
+	rename(filename,target);
+
+	logmessage(LOG_DEBUG,logsrc,"Rotating capture %s\n",filename);
+	if (open_capture_file() != 0) set_warehouse_flag('I');
+}
+
+// match_address returns non-zero if the argumented address matches the host filter
+static int match_address(int family,const void *address)
+{
+	if (family != capoptions.family) return(0);
+	if (family == AF_INET) return(memcmp(address,capoptions.host,4) == 0);
+	return(memcmp(address,capoptions.host,16) == 0);
+}
+
+// match_string_address returns non-zero if the argumented address string matches the host filter
+static int match_string_address(const char *address)
+{
+	char		buffer[16];
+
+	if (capoptions.family == AF_INET && inet_pton(AF_INET,address,buffer) == 1) return(match_address(AF_INET,buffer));
+	if (capoptions.family == AF_INET6 && inet_pton(AF_INET6,address,buffer) == 1) return(match_address(AF_INET6,buffer));
+	return(0);
+}
+
+// match_nfqueue returns non-zero if the raw packet matches the capture filters
+static int match_nfqueue(const unsigned char *buffer,uint32_t length)
+{
+	const unsigned char	*saddr,*daddr,*ports;
+	int					family,protocol;
+	uint32_t			offset;
+
+	if (length < 1) return(0);
+
+	if ((buffer[0] >> 4) == 4) {
+		if (length < sizeof(struct iphdr)) return(0);
+		family = AF_INET;
+		protocol = ((struct iphdr *)buffer)->protocol;
+		saddr = (const unsigned char *)&((struct iphdr *)buffer)->saddr;
+		daddr = (const unsigned char *)&((struct iphdr *)buffer)->daddr;
+		offset = ((struct iphdr *)buffer)->ihl * 4;
+	} else if ((buffer[0] >> 4) == 6) {
+		if (length < sizeof(struct ip6_hdr)) return(0);
+		family = AF_INET6;
+		protocol = ((struct ip6_hdr *)buffer)->ip6_nxt;
+		saddr = (const unsigned char *)&((struct ip6_hdr *)buffer)->ip6_src;
+		daddr = (const unsigned char *)&((struct ip6_hdr *)buffer)->ip6_dst;
+		offset = sizeof(struct ip6_hdr);
+	} else {
+		return(0);
+	}
+
+	if (capoptions.protocol != 0 && capoptions.protocol != protocol) return(0);
+	if (capoptions.family != 0 && !match_address(family,saddr) && !match_address(family,daddr)) return(0);
+
+	if (capoptions.port != 0) {
+		if (protocol != IPPROTO_TCP && protocol != IPPROTO_UDP) return(0);
+		if (length < offset + 4) return(0);
+		ports = buffer + offset;
+		if (capoptions.port != ((ports[0] << 8) | ports[1]) && capoptions.port != ((ports[2] << 8) | ports[3])) return(0);
+	}
+
+	return(1);
+}
+
+// match_conntrack returns non-zero if the conntrack event matches the capture filters
+static int match_conntrack(const struct conntrack_info *info)
+{
+	if (capoptions.ctid != 0 && capoptions.ctid != info->conn_id) return(0);
+	if (capoptions.protocol != 0 && capoptions.protocol != info->orig_proto) return(0);
+
+	if (capoptions.family != 0) {
+		if (!match_address(info->family,info->orig_saddr) && !match_address(info->family,info->orig_daddr) &&
+			!match_address(info->family,info->repl_saddr) && !match_address(info->family,info->repl_daddr)) return(0);
+	}
+
+	if (capoptions.port != 0) {
+		if (capoptions.port != info->orig_sport && capoptions.port != info->orig_dport &&
+			capoptions.port != info->repl_sport && capoptions.port != info->repl_dport) return(0);
+	}
+
+	return(1);
+}
+
+// match_netlogger returns non-zero if the netlogger event matches the capture filters
+static int match_netlogger(const struct netlogger_info *info)
+{
+	if (capoptions.ctid != 0 && capoptions.ctid != info->ctid) return(0);
+	if (capoptions.protocol != 0 && capoptions.protocol != info->protocol) return(0);
+	if (capoptions.family != 0 && !match_string_address(info->src_addr) && !match_string_address(info->dst_addr)) return(0);
+	if (capoptions.port != 0 && capoptions.port != info->src_port && capoptions.port != info->dst_port) return(0);
+	return(1);
+}
+
+// match_capture returns non-zero if the record should be written to the capture file
+static int match_capture(const char origin,void *buffer,uint32_t length,uint32_t ctid)
+{
+	if (capoptions.origins[0] != 0 && memchr(capoptions.origins,origin,sizeof(capoptions.origins)) == NULL) return(0);
+
+	switch(origin)
+	{
+		case 'Q':
+			if (capoptions.ctid != 0 && capoptions.ctid != ctid) return(0);
+			return(match_nfqueue(buffer,length));
+		case 'C':
+			if (length < sizeof(struct conntrack_info)) return(0);
+			return(match_conntrack(buffer));
+		case 'L':
+			if (length < sizeof(struct netlogger_info)) return(0);
+			return(match_netlogger(buffer));
+	}
+
+	return(0);
+}
+
+void start_warehouse_capture(void)
+{
+	logmessage(LOG_INFO,logsrc,"Beginning capture %s\n",get_warehouse_file());
+
+	pthread_mutex_lock(&caplock);
+
+	// if the capture file is already open close it first
+	if (capfile != NULL) fclose(capfile);
+	capfile = NULL;
+
+	memset(&capstatus,0,sizeof(capstatus));
+	open_capture_file();
+
+	pthread_mutex_unlock(&caplock);
 }
 
 void close_warehouse_capture(void)
 {
 	logmessage(LOG_INFO,logsrc,"Finished capture %s\n",get_warehouse_file());
+
+	pthread_mutex_lock(&caplock);
 	if (capfile != NULL) fclose(capfile);
 	capfile = NULL;
+	pthread_mutex_unlock(&caplock);
 }
 
 void warehouse_capture(const char origin,void *buffer,uint32_t length,uint32_t mark,uint32_t ctid,uint32_t nfid,uint32_t family)
 {
 	struct data_header		dh;
 	struct timespec			now;
+	u_int64_t				size;
 
 	if (get_shutdown_flag() != 0) return;
-	if (capfile == NULL) return;
+
+	pthread_mutex_lock(&caplock);
+
+	if (capfile == NULL) {
+		pthread_mutex_unlock(&caplock);
+		return;
+	}
+
+	if (match_capture(origin,buffer,length,ctid) == 0) {
+		capstatus.filtered++;
+		pthread_mutex_unlock(&caplock);
+		return;
+	}
 
 	clock_gettime(CLOCK_MONOTONIC,&now);
+	size = sizeof(dh) + length;
+
+	// start a new file or finish the capture when this record would go past the size or duration
+	// limit but always write at least one record to each file so a large record can't stall the capture
+	if (capstatus.file_records != 0) {
+		if ((capoptions.max_size != 0 && capstatus.file_bytes + size > capoptions.max_size) ||
+			(capoptions.max_duration != 0 && now.tv_sec - capstart.tv_sec >= capoptions.max_duration)) {
+			rotate_capture_file();
+			if (capfile == NULL) {
+				pthread_mutex_unlock(&caplock);
+				return;
+			}
+		}
+	}
+
+	memset(&dh,0,sizeof(dh));
 	dh.stamp_sec = now.tv_sec;
 	dh.stamp_nsec = now.tv_nsec;
 	dh.origin = origin;
@@ -83,6 +299,13 @@ void warehouse_capture(const char origin,void *buffer,uint32_t length,uint32_t m
 	dh.family = family;
 	fwrite(&dh,sizeof(dh),1,capfile);
 	fwrite(buffer,length,1,capfile);
+
+	capstatus.bytes += size;
+	capstatus.records++;
+	capstatus.file_bytes += size;
+	capstatus.file_records++;
+
+	pthread_mutex_unlock(&caplock);
 }
 
 void warehouse_playback(void)
@@ -202,6 +425,9 @@ void warehouse_playback(void)
 			nanosleep(&pause,&remain);
 		}
 
+		// let the virtual clock catch up with the record before we pass it along
+		go_playback_clock(dh.stamp_sec,dh.stamp_nsec);
+
 		switch(dh.origin)
 		{
 			case 'Q':
@@ -0,0 +1,139 @@
+package kernel
+
+/*
+#include "common.h"
+*/
+import "C"
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/untangle/packetd/services/logger"
+)
+
+// nfqueueTask holds a packet received from a queue while it waits for a worker
+type nfqueueTask struct {
+	mark     C.uint32_t
+	data     *C.uchar
+	size     C.int
+	ctid     C.uint32_t
+	nfid     C.uint32_t
+	family   C.uint32_t
+	buffer   *C.char
+	index    C.int
+	received time.Time
+}
+
+// nfqueueTaskDepth is the number of packets each worker can have waiting
+// When the workers fall behind the queue thread blocks and the kernel holds
+// additional packets in the netfilter queue
+const nfqueueTaskDepth = 1024
+
+// nfqueueWorkerCount is the number of workers for each queue
+var nfqueueWorkerCount = 4
+
+// nfqueueSession holds the packets of a session waiting for a worker in the order they arrived
+type nfqueueSession struct {
+	ctid  C.uint32_t
+	tasks []nfqueueTask
+}
+
+// nfqueuePool schedules the packets of a queue on its workers. Each session with
+// packets waiting is on the ready list at most once and a worker handles one packet
+// and puts the session back at the end of the list if it has more, so the packets
+// of a session are always handled in order and one at a time while the other
+// sessions are free to use the other workers. A session that is slow only holds up
+// its own packets unless every worker is busy with a slow session, in which case
+// all of the traffic on the queue waits for up to maxSubscriberTime in dispatch.
+type nfqueuePool struct {
+	mutex    sync.Mutex
+	ready    *sync.Cond
+	space    *sync.Cond
+	sessions map[C.uint32_t]*nfqueueSession
+	waiting  []*nfqueueSession
+	pending  int
+	limit    int
+}
+
+// nfqueuePools holds the worker pool for each queue
+var nfqueuePools []*nfqueuePool
+
+// SetNfqueueWorkers sets the number of packet workers for each nfqueue
+func SetNfqueueWorkers(value int) {
+	if value < 1 {
+		value = 1
+	}
+	nfqueueWorkerCount = value
+}
+
+// startNfqueueWorkers creates the workers for the argumented number of queues
+func startNfqueueWorkers(queueCount int) {
+	nfqueuePools = make([]*nfqueuePool, queueCount)
+	for x := 0; x < queueCount; x++ {
+		pool := &nfqueuePool{sessions: make(map[C.uint32_t]*nfqueueSession), limit: nfqueueTaskDepth * nfqueueWorkerCount}
+		pool.ready = sync.NewCond(&pool.mutex)
+		pool.space = sync.NewCond(&pool.mutex)
+		nfqueuePools[x] = pool
+		for y := 0; y < nfqueueWorkerCount; y++ {
+			go pool.worker()
+		}
+	}
+	logger.Info("Started %d nfqueue workers for each of %d queues\n", nfqueueWorkerCount, queueCount)
+}
+
+// submitNfqueueTask passes a packet to the worker pool for the queue. Packets with the
+// same conntrack ID are handled in the order they arrive.
+func submitNfqueueTask(task nfqueueTask) {
+	pool := nfqueuePools[int(task.index)]
+	atomic.AddInt64(&nfqueueBacklog, 1)
+
+	pool.mutex.Lock()
+	for pool.pending >= pool.limit {
+		pool.space.Wait()
+	}
+	pool.pending++
+
+	// a session already in the table is waiting or being handled and will be put back on the ready list
+	session := pool.sessions[task.ctid]
+	if session == nil {
+		session = &nfqueueSession{ctid: task.ctid}
+		pool.sessions[task.ctid] = session
+		pool.waiting = append(pool.waiting, session)
+		pool.ready.Signal()
+	}
+	session.tasks = append(session.tasks, task)
+	pool.mutex.Unlock()
+}
+
+// worker handles the next packet of the sessions on the ready list
+func (pool *nfqueuePool) worker() {
+	pool.mutex.Lock()
+	for {
+		for len(pool.waiting) == 0 {
+			pool.ready.Wait()
+		}
+		session := pool.waiting[0]
+		pool.waiting[0] = nil
+		pool.waiting = pool.waiting[1:]
+		task := session.tasks[0]
+		pool.mutex.Unlock()
+
+		handleNfqueueTask(task, 0)
+		recordVerdictLatency(time.Since(task.received))
+		atomic.AddInt64(&nfqueueBacklog, -1)
+
+		pool.mutex.Lock()
+		session.tasks[0] = nfqueueTask{}
+		session.tasks = session.tasks[1:]
+		if len(session.tasks) == 0 {
+			delete(pool.sessions, session.ctid)
+		} else {
+			pool.waiting = append(pool.waiting, session)
+			pool.ready.Signal()
+		}
+		pool.pending--
+		pool.space.Signal()
+	}
+}
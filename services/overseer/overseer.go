@@ -19,6 +19,11 @@ import (
 var counterTable map[string]*int64
 var counterMutex sync.RWMutex
 
+// Other services can register functions that add their own sections to the
+// report since most of them can't be imported here without a cycle.
+var reportTable = make(map[string]func(*bytes.Buffer))
+var reportMutex sync.Mutex
+
 // Startup is called to handle service startup
 func Startup() {
 	counterTable = make(map[string]*int64)
@@ -104,8 +109,45 @@ func GetCounter(name string) int64 {
 	return 0
 }
 
+// RegisterReport adds a named function that is called to append a section to the report
+func RegisterReport(name string, generator func(*bytes.Buffer)) {
+	reportMutex.Lock()
+	reportTable[name] = generator
+	reportMutex.Unlock()
+}
+
+// UnregisterReport removes a function added with RegisterReport
+func UnregisterReport(name string) {
+	reportMutex.Lock()
+	delete(reportTable, name)
+	reportMutex.Unlock()
+}
+
 // GenerateReport is called to create a dynamic HTTP page that shows all named counters
+// followed by the sections from the registered report functions
 func GenerateReport(buffer *bytes.Buffer) {
+	generateCounterReport(buffer)
+
+	reportMutex.Lock()
+	namelist := make([]string, 0, len(reportTable))
+	for name := range reportTable {
+		namelist = append(namelist, name)
+	}
+	sort.Strings(namelist)
+	generators := make([]func(*bytes.Buffer), 0, len(namelist))
+	for _, name := range namelist {
+		generators = append(generators, reportTable[name])
+	}
+	reportMutex.Unlock()
+
+	for _, generator := range generators {
+		buffer.WriteString("<BR><BR>\r\n")
+		generator(buffer)
+	}
+}
+
+// generateCounterReport creates the table of named counters
+func generateCounterReport(buffer *bytes.Buffer) {
 	counterMutex.RLock()
 	defer counterMutex.RUnlock()
 
@@ -0,0 +1,294 @@
+// Package pluginmanager provides the registry for packetd plugins
+// Plugins register themselves from their init function and the plugin
+// manager decides which ones to start based on the settings and the
+// command line. Individual plugins can be stopped and started at runtime.
+package pluginmanager
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"syscall"
+
+	"github.com/untangle/packetd/services/dispatch"
+	"github.com/untangle/packetd/services/logger"
+	"github.com/untangle/packetd/services/settings"
+)
+
+// Plugin is the interface implemented by all packetd plugins
+type Plugin interface {
+	Name() string
+	Startup()
+	Shutdown()
+}
+
+// SignalHandler is implemented by plugins that want to receive system signals
+type SignalHandler interface {
+	Signal(syscall.Signal)
+}
+
+// ReloadHandler is implemented by plugins that can reload their configuration
+type ReloadHandler interface {
+	Reload()
+}
+
+// PluginFunctions implements the Plugin interface for plugins that provide
+// package level functions. The SignalFunc and ReloadFunc are optional.
+type PluginFunctions struct {
+	PluginName   string
+	StartupFunc  func()
+	ShutdownFunc func()
+	SignalFunc   func(syscall.Signal)
+	ReloadFunc   func()
+}
+
+// PluginStatus describes the state of a registered plugin
+type PluginStatus struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+	Running bool   `json:"running"`
+}
+
+// pluginHolder stores a registered plugin and its state
+type pluginHolder struct {
+	plugin  Plugin
+	running bool
+	locker  sync.Mutex
+}
+
+var pluginTable = make(map[string]*pluginHolder)
+var pluginMutex sync.RWMutex
+
+var selectedList []string
+var disabledList []string
+
+// Name returns the plugin name
+func (pf *PluginFunctions) Name() string {
+	return pf.PluginName
+}
+
+// Startup calls the plugin startup function
+func (pf *PluginFunctions) Startup() {
+	pf.StartupFunc()
+}
+
+// Shutdown calls the plugin shutdown function
+func (pf *PluginFunctions) Shutdown() {
+	pf.ShutdownFunc()
+}
+
+// Signal calls the plugin signal function if one was provided
+func (pf *PluginFunctions) Signal(message syscall.Signal) {
+	if pf.SignalFunc != nil {
+		pf.SignalFunc(message)
+	}
+}
+
+// Reload calls the plugin reload function if one was provided
+func (pf *PluginFunctions) Reload() {
+	if pf.ReloadFunc != nil {
+		pf.ReloadFunc()
+	}
+}
+
+// Register adds a plugin to the registry. It should be called from the plugin init function.
+func Register(plugin Plugin) {
+	pluginMutex.Lock()
+	defer pluginMutex.Unlock()
+
+	if _, existing := pluginTable[plugin.Name()]; existing {
+		panic("DUPLICATE PLUGIN REGISTRATION DETECTED!")
+	}
+	pluginTable[plugin.Name()] = &pluginHolder{plugin: plugin}
+}
+
+// SetSelection sets the plugins selected on the command line. When selected is not
+// empty only those plugins are started. Plugins in the disabled list are never started.
+func SetSelection(selected []string, disabled []string) {
+	selectedList = selected
+	disabledList = disabled
+}
+
+// StartPlugins starts all of the enabled plugins (in parallel)
+func StartPlugins() {
+	var wg sync.WaitGroup
+
+	for _, name := range getPluginNames() {
+		if !isPluginEnabled(name) {
+			logger.Info("Plugin %s is disabled\n", name)
+			continue
+		}
+		wg.Add(1)
+		go func(name string) {
+			StartPlugin(name)
+			wg.Done()
+		}(name)
+	}
+
+	wg.Wait()
+}
+
+// StopPlugins stops all of the running plugins (in parallel)
+func StopPlugins() {
+	var wg sync.WaitGroup
+
+	for _, name := range getPluginNames() {
+		wg.Add(1)
+		go func(name string) {
+			StopPlugin(name)
+			wg.Done()
+		}(name)
+	}
+
+	wg.Wait()
+}
+
+// SignalPlugins signals all running plugins with a signal handler (in parallel)
+func SignalPlugins(message syscall.Signal) {
+	var wg sync.WaitGroup
+
+	for _, name := range getPluginNames() {
+		holder := findPlugin(name)
+		handler, ok := holder.plugin.(SignalHandler)
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(holder *pluginHolder, handler SignalHandler) {
+			holder.locker.Lock()
+			if holder.running {
+				handler.Signal(message)
+			}
+			holder.locker.Unlock()
+			wg.Done()
+		}(holder, handler)
+	}
+
+	wg.Wait()
+}
+
+// StartPlugin starts the named plugin if it is not already running
+func StartPlugin(name string) error {
+	holder := findPlugin(name)
+	if holder == nil {
+		return errors.New("Unknown plugin: " + name)
+	}
+
+	holder.locker.Lock()
+	defer holder.locker.Unlock()
+
+	if holder.running {
+		return nil
+	}
+	holder.plugin.Startup()
+	holder.running = true
+	return nil
+}
+
+// StopPlugin stops the named plugin and removes all of its dispatch subscriptions
+func StopPlugin(name string) error {
+	holder := findPlugin(name)
+	if holder == nil {
+		return errors.New("Unknown plugin: " + name)
+	}
+
+	holder.locker.Lock()
+	defer holder.locker.Unlock()
+
+	if !holder.running {
+		return nil
+	}
+
+	// remove the subscriptions first so the plugin doesn't get called while shutting down
+	dispatch.RemoveSubscriptions(name)
+	holder.plugin.Shutdown()
+	holder.running = false
+	return nil
+}
+
+// ReloadPlugin asks the named plugin to reload its configuration
+func ReloadPlugin(name string) error {
+	holder := findPlugin(name)
+	if holder == nil {
+		return errors.New("Unknown plugin: " + name)
+	}
+
+	handler, ok := holder.plugin.(ReloadHandler)
+	if !ok {
+		return errors.New("Plugin does not support reload: " + name)
+	}
+
+	holder.locker.Lock()
+	defer holder.locker.Unlock()
+
+	if !holder.running {
+		return errors.New("Plugin is not running: " + name)
+	}
+	handler.Reload()
+	return nil
+}
+
+// GetPluginStatus returns the status of all registered plugins
+func GetPluginStatus() []PluginStatus {
+	var list []PluginStatus
+
+	for _, name := range getPluginNames() {
+		holder := findPlugin(name)
+		holder.locker.Lock()
+		list = append(list, PluginStatus{Name: name, Enabled: isPluginEnabled(name), Running: holder.running})
+		holder.locker.Unlock()
+	}
+	return list
+}
+
+// findPlugin returns the holder for the named plugin or nil if not found
+func findPlugin(name string) *pluginHolder {
+	pluginMutex.RLock()
+	defer pluginMutex.RUnlock()
+	return pluginTable[name]
+}
+
+// getPluginNames returns the sorted list of registered plugin names
+func getPluginNames() []string {
+	var names []string
+
+	pluginMutex.RLock()
+	for name := range pluginTable {
+		names = append(names, name)
+	}
+	pluginMutex.RUnlock()
+
+	sort.Strings(names)
+	return names
+}
+
+// isPluginEnabled returns true if the named plugin should be started. The command line
+// takes precedence over the packetd/plugins settings where a plugin can be disabled by
+// setting its name to false. Plugins are enabled by default.
+func isPluginEnabled(name string) bool {
+	for _, item := range disabledList {
+		if item == name {
+			return false
+		}
+	}
+
+	if len(selectedList) != 0 {
+		for _, item := range selectedList {
+			if item == name {
+				return true
+			}
+		}
+		return false
+	}
+
+	value, err := settings.GetSettings([]string{"packetd", "plugins", name})
+	if err != nil {
+		return true
+	}
+
+	enabled, ok := value.(bool)
+	if ok && !enabled {
+		return false
+	}
+	return true
+}
@@ -662,6 +662,21 @@ func cleanupQuery(query *Query) {
 	logger.Debug("cleanupQuery(%d) finished\n", query.ID)
 }
 
+// addMissingColumn adds a column to an existing table if the table doesn't have it yet
+func addMissingColumn(table string, column string, kind string) {
+	var count int
+
+	err := dbMain.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM pragma_table_info('%s') WHERE name = '%s'", table, column)).Scan(&count)
+	if err != nil || count != 0 {
+		return
+	}
+
+	_, err = dbMain.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, kind))
+	if err != nil {
+		logger.Err("Failed to add column %s to %s: %s\n", column, table, err.Error())
+	}
+}
+
 // createTables builds the reports.db tables and indexes
 func createTables() {
 	var err error
@@ -721,12 +736,28 @@ func createTables() {
 			client_hops integer,
 			server_hops integer,
 			client_dns_hint text,
-			server_dns_hint text)`)
+			server_dns_hint text,
+			bytes int8,
+			client_bytes int8,
+			server_bytes int8,
+			packets int8,
+			client_packets int8,
+			server_packets int8,
+			killed_by text)`)
 
 	if err != nil {
 		logger.Err("Failed to create table: %s\n", err.Error())
 	}
 
+	// add columns that are missing from tables created by an older version
+	addMissingColumn("sessions", "bytes", "int8")
+	addMissingColumn("sessions", "client_bytes", "int8")
+	addMissingColumn("sessions", "server_bytes", "int8")
+	addMissingColumn("sessions", "packets", "int8")
+	addMissingColumn("sessions", "client_packets", "int8")
+	addMissingColumn("sessions", "server_packets", "int8")
+	addMissingColumn("sessions", "killed_by", "text")
+
 	_, err = dbMain.Exec(`CREATE INDEX IF NOT EXISTS idx_sessions_time_stamp ON sessions (time_stamp DESC)`)
 	if err != nil {
 		logger.Err("Failed to create index: %s\n", err.Error())
@@ -320,21 +320,10 @@ func authLogout(c *gin.Context) {
 
 // authStatus returns (via a json http reply) the auth status of the current session
 func authStatus(c *gin.Context) {
-	// if the setup wizard is not completed, auth is not required - return fake user
-	if !isSetupWizardCompleted() {
-		c.JSON(http.StatusOK, map[string]string{"username": "setup"})
-		return
-	}
-
-	// if connection is from a local root process
-	if checkAuthLocal(c) {
-		c.JSON(http.StatusOK, map[string]string{"username": "localroot"})
-		return
-	}
-
-	// if connection is from command center
-	if checkCommandCenterToken(c) {
-		c.JSON(http.StatusOK, map[string]string{"username": "command-center"})
+	// setup, local root, and command center requests are authorized without a login
+	builtin := builtinUsername(c)
+	if builtin != "" {
+		c.JSON(http.StatusOK, map[string]string{"username": builtin})
 		return
 	}
 
@@ -577,3 +566,39 @@ func setAuthSession(c *gin.Context, username string, password string) bool {
 
 	return false
 }
+
+// builtinUsername returns the name of the builtin user for requests that are
+// authorized without a login or an empty string when a login is required
+func builtinUsername(c *gin.Context) string {
+	// if the setup wizard is not completed, auth is not required - return fake user
+	if !isSetupWizardCompleted() {
+		return "setup"
+	}
+
+	// if connection is from a local root process
+	if checkAuthLocal(c) {
+		return "localroot"
+	}
+
+	// if connection is from command center
+	if checkCommandCenterToken(c) {
+		return "command-center"
+	}
+
+	return ""
+}
+
+// getUsername returns the name of the authenticated user for the request
+// using the same identities as the auth status handler
+func getUsername(c *gin.Context) string {
+	builtin := builtinUsername(c)
+	if builtin != "" {
+		return builtin
+	}
+
+	user := sessions.Default(c).Get("username")
+	if user == nil {
+		return "unknown"
+	}
+	return fmt.Sprintf("%v", user)
+}
@@ -0,0 +1,102 @@
+package restd
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/untangle/packetd/services/kernel"
+	"github.com/untangle/packetd/services/warehouse"
+)
+
+// captureValue returns a capture option from the request as a string. Numbers are
+// accepted as JSON numbers or strings.
+func captureValue(data map[string]interface{}, name string) (string, bool) {
+	value, found := data[name]
+	if !found || value == nil {
+		return "", false
+	}
+	switch item := value.(type) {
+	case string:
+		item = strings.TrimSpace(item)
+		return item, item != ""
+	case float64:
+		return strconv.FormatFloat(item, 'f', -1, 64), true
+	}
+	return fmt.Sprint(value), true
+}
+
+// parseCaptureOptions returns the warehouse capture filters and limits from a capture request.
+// The types option is a comma separated list of nfqueue, conntrack, and netlogger. The host,
+// port, protocol, and ctid options filter the records and max_size (bytes), max_duration
+// (seconds), and max_files limit the capture files.
+func parseCaptureOptions(data map[string]interface{}) (kernel.WarehouseCaptureOptions, error) {
+	var options kernel.WarehouseCaptureOptions
+
+	if value, found := captureValue(data, "types"); found {
+		origins, err := warehouse.ParseOrigins(value)
+		if err != nil {
+			return options, err
+		}
+		options.Origins = origins
+	}
+
+	if value, found := captureValue(data, "host"); found {
+		options.Host = net.ParseIP(value)
+		if options.Host == nil {
+			return options, fmt.Errorf("Invalid host: %s", value)
+		}
+	}
+
+	if value, found := captureValue(data, "port"); found {
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil || port == 0 {
+			return options, fmt.Errorf("Invalid port: %s", value)
+		}
+		options.Port = uint16(port)
+	}
+
+	if value, found := captureValue(data, "protocol"); found {
+		protocol, err := warehouse.ParseProtocol(value)
+		if err != nil {
+			return options, err
+		}
+		options.Protocol = protocol
+	}
+
+	if value, found := captureValue(data, "ctid"); found {
+		ctid, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return options, fmt.Errorf("Invalid ctid: %s", value)
+		}
+		options.Ctid = uint32(ctid)
+	}
+
+	if value, found := captureValue(data, "max_size"); found {
+		size, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return options, fmt.Errorf("Invalid max_size: %s", value)
+		}
+		options.MaxSize = size
+	}
+
+	if value, found := captureValue(data, "max_duration"); found {
+		seconds, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return options, fmt.Errorf("Invalid max_duration: %s", value)
+		}
+		options.MaxDuration = time.Duration(seconds) * time.Second
+	}
+
+	if value, found := captureValue(data, "max_files"); found {
+		files, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return options, fmt.Errorf("Invalid max_files: %s", value)
+		}
+		options.MaxFiles = uint32(files)
+	}
+
+	return options, nil
+}
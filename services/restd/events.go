@@ -0,0 +1,283 @@
+package restd
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/untangle/packetd/services/dispatch"
+	"github.com/untangle/packetd/services/logger"
+)
+
+// The session event types sent by the event stream
+const (
+	eventSessionNew    = "session_new"
+	eventSessionUpdate = "session_update"
+	eventAttachment    = "attachment"
+	eventSessionEnd    = "session_end"
+	eventDropped       = "dropped"
+)
+
+// eventOwner is the owner of the dispatch subscriptions used to feed the event stream
+const eventOwner = "restd_events"
+
+// eventQueueSize is the number of events buffered for each client. Events are
+// dropped when a client falls this far behind so a slow client can never block
+// the dispatch subscribers.
+const eventQueueSize = 1024
+
+// eventKeepaliveInterval is how often a comment is sent to idle clients
+const eventKeepaliveInterval = 30 * time.Second
+
+// sessionEvent is a single event in the session event stream
+type sessionEvent struct {
+	name   string
+	fields map[string]interface{}
+}
+
+// eventClient holds the queue and filters of a single event stream client
+type eventClient struct {
+	queue   chan *sessionEvent
+	types   map[string]bool
+	query   *sessionQuery
+	dropped uint64
+}
+
+var eventClients = make(map[*eventClient]bool)
+var eventClientsMutex sync.RWMutex
+
+// statusEvents is the RESTD /api/status/events handler. It streams session events to
+// the client as Server-Sent Events. The types query parameter is a comma separated list
+// of the event types to send and defaults to all of them. The other query parameters are
+// the same filters and field selection used by /api/status/sessions. When the client
+// can't keep up events are discarded and a dropped event reports how many were lost.
+func statusEvents(c *gin.Context) {
+	logger.Debug("statusEvents()\n")
+
+	values := c.Request.URL.Query()
+	types := values.Get("types")
+	values.Del("types")
+
+	query, err := parseSessionQuery(values)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	client := new(eventClient)
+	client.queue = make(chan *sessionEvent, eventQueueSize)
+	client.query = query
+	if types != "" {
+		client.types = make(map[string]bool)
+		for _, item := range strings.Split(types, ",") {
+			switch item = strings.TrimSpace(item); item {
+			case eventSessionNew, eventSessionUpdate, eventAttachment, eventSessionEnd:
+				client.types[item] = true
+			default:
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event type: " + item})
+				return
+			}
+		}
+	}
+
+	addEventClient(client)
+	defer removeEventClient(client)
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+
+	keepalive := time.NewTicker(eventKeepaliveInterval)
+	defer keepalive.Stop()
+	done := c.Request.Context().Done()
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-done:
+			return false
+		case <-keepalive.C:
+			_, err := io.WriteString(w, ": keepalive\n\n")
+			return err == nil
+		case event := <-client.queue:
+			if dropped := atomic.SwapUint64(&client.dropped, 0); dropped != 0 {
+				c.SSEvent(eventDropped, gin.H{"count": dropped})
+			}
+			c.SSEvent(event.name, client.query.selectFields(event.fields))
+			return true
+		}
+	})
+}
+
+// addEventClient adds an event stream client and subscribes to the
+// dispatch events when it is the first client
+func addEventClient(client *eventClient) {
+	eventClientsMutex.Lock()
+	defer eventClientsMutex.Unlock()
+
+	if len(eventClients) == 0 {
+		dispatch.InsertSessionStartSubscription(eventOwner, dispatch.EventStreamPriority, eventSessionStartHandler)
+		dispatch.InsertConntrackSubscription(eventOwner, dispatch.EventStreamPriority, eventConntrackHandler)
+		dispatch.InsertAttachmentSubscription(eventOwner, dispatch.EventStreamPriority, nil, eventAttachmentHandler)
+		dispatch.InsertSessionEndSubscription(eventOwner, dispatch.EventStreamPriority, eventSessionEndHandler)
+	}
+	eventClients[client] = true
+}
+
+// removeEventClient removes an event stream client and removes the
+// dispatch subscriptions when it was the last client
+func removeEventClient(client *eventClient) {
+	eventClientsMutex.Lock()
+	defer eventClientsMutex.Unlock()
+
+	delete(eventClients, client)
+	if len(eventClients) == 0 {
+		dispatch.RemoveSubscriptions(eventOwner)
+	}
+}
+
+// publishEvent queues an event for every client that wants it. Events for clients
+// whose queue is full are counted and discarded instead of waiting.
+func publishEvent(event *sessionEvent) {
+	eventClientsMutex.RLock()
+	defer eventClientsMutex.RUnlock()
+
+	for client := range eventClients {
+		if client.types != nil && !client.types[event.name] {
+			continue
+		}
+		if !client.query.matches(event.fields) {
+			continue
+		}
+		select {
+		case client.queue <- event:
+		default:
+			atomic.AddUint64(&client.dropped, 1)
+			logger.Debug("%OC|Dropping %s event for slow client\n", "restd_event_dropped", 0, event.name)
+		}
+	}
+}
+
+// eventSessionStartHandler publishes the session_new events
+func eventSessionStartHandler(mess *dispatch.SessionStartMessage) {
+	fields := sessionEventFields(mess.Session)
+	if fields == nil {
+		return
+	}
+	fields["time_stamp"] = mess.StartTime
+	publishEvent(&sessionEvent{name: eventSessionNew, fields: fields})
+}
+
+// eventConntrackHandler publishes the session_update events with the
+// counters and rates calculated for each conntrack update
+func eventConntrackHandler(eventType int, conntrack *dispatch.Conntrack) {
+	if eventType != 'U' {
+		return
+	}
+
+	conntrack.Guardian.RLock()
+	fields := parseConntrack(conntrack)
+	session := conntrack.Session
+	if fields != nil {
+		fields["client_byte_rate"] = conntrack.ClientByteRate
+		fields["server_byte_rate"] = conntrack.ServerByteRate
+		fields["byte_rate"] = conntrack.TotalByteRate
+		fields["client_packet_rate"] = conntrack.ClientPacketRate
+		fields["server_packet_rate"] = conntrack.ServerPacketRate
+		fields["packet_rate"] = conntrack.TotalPacketRate
+	}
+	conntrack.Guardian.RUnlock()
+
+	if fields == nil {
+		return
+	}
+	if session != nil {
+		mergeAttachments(fields, session.GetAllAttachments())
+	}
+	publishEvent(&sessionEvent{name: eventSessionUpdate, fields: fields})
+}
+
+// eventAttachmentHandler publishes the attachment change events
+func eventAttachmentHandler(mess *dispatch.AttachmentChangeMessage) {
+	fields := sessionEventFields(mess.Session)
+	if fields == nil {
+		return
+	}
+	fields["attachment"] = mess.Name
+	fields["previous"] = eventValue(mess.Previous)
+	fields["value"] = eventValue(mess.Value)
+	publishEvent(&sessionEvent{name: eventAttachment, fields: fields})
+}
+
+// eventSessionEndHandler publishes the session_end events with the final counters
+func eventSessionEndHandler(mess *dispatch.SessionEndMessage) {
+	fields := sessionEventFields(mess.Session)
+	if fields == nil {
+		return
+	}
+	fields["time_stamp"] = mess.EndTime
+	fields["bytes"] = mess.TotalBytes
+	fields["client_bytes"] = mess.ClientBytes
+	fields["server_bytes"] = mess.ServerBytes
+	fields["packets"] = mess.TotalPackets
+	fields["client_packets"] = mess.ClientPackets
+	fields["server_packets"] = mess.ServerPackets
+	publishEvent(&sessionEvent{name: eventSessionEnd, fields: fields})
+}
+
+// sessionEventFields returns the fields that identify a session in the session events
+// using the same names as /api/status/sessions. It returns nil for loopback sessions.
+func sessionEventFields(session *dispatch.Session) map[string]interface{} {
+	clientSide := session.GetClientSideTuple()
+	if clientSide.ClientAddress.IsLoopback() || clientSide.ServerAddress.IsLoopback() {
+		return nil
+	}
+	serverSide := session.GetServerSideTuple()
+
+	fields := make(map[string]interface{})
+	fields["session_id"] = session.GetSessionID()
+	fields["conntrack_id"] = session.GetConntrackID()
+	fields["family"] = session.GetFamily()
+	fields["ip_protocol"] = clientSide.Protocol
+	fields["client_address"] = clientSide.ClientAddress
+	fields["client_port"] = clientSide.ClientPort
+	fields["server_address"] = clientSide.ServerAddress
+	fields["server_port"] = clientSide.ServerPort
+	if serverSide.ClientAddress != nil {
+		fields["client_address_new"] = serverSide.ClientAddress
+		fields["client_port_new"] = serverSide.ClientPort
+		fields["server_address_new"] = serverSide.ServerAddress
+		fields["server_port_new"] = serverSide.ServerPort
+	}
+	fields["client_interface_id"] = uint32(session.GetClientInterfaceID())
+	fields["client_interface_type"] = uint32(session.GetClientInterfaceType())
+	fields["server_interface_id"] = uint32(session.GetServerInterfaceID())
+	fields["server_interface_type"] = uint32(session.GetServerInterfaceType())
+
+	mergeAttachments(fields, session.GetAllAttachments())
+	return fields
+}
+
+// eventValue returns an attachment value that can be sent in an event. Anything
+// more complicated than a simple value is replaced with the name of its type.
+func eventValue(value interface{}) interface{} {
+	if value == nil || isSimpleValue(value) {
+		return value
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// isSimpleValue returns true for the attachment values that are included in the session fields
+func isSimpleValue(value interface{}) bool {
+	switch value.(type) {
+	case string, bool, net.IP, time.Time:
+		return true
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return true
+	}
+	return false
+}
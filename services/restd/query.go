@@ -0,0 +1,221 @@
+package restd
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/untangle/packetd/services/dispatch"
+)
+
+// sessionFieldNames are the session fields that come from the conntrack entry.
+// The declared attachments are the other session fields that can be filtered.
+var sessionFieldNames = map[string]bool{
+	"conntrack_id": true, "session_id": true, "family": true, "ip_protocol": true,
+	"timeout_seconds": true, "tcp_state": true,
+	"client_address": true, "client_port": true, "server_address": true, "server_port": true,
+	"client_address_new": true, "client_port_new": true, "server_address_new": true, "server_port_new": true,
+	"bytes": true, "client_bytes": true, "server_bytes": true,
+	"packets": true, "client_packets": true, "server_packets": true,
+	"byte_rate": true, "client_byte_rate": true, "server_byte_rate": true,
+	"packet_rate": true, "client_packet_rate": true, "server_packet_rate": true,
+	"timestamp_start": true, "age_milliseconds": true, "mark": true, "priority": true,
+	"client_interface_id": true, "client_interface_type": true,
+	"server_interface_id": true, "server_interface_type": true,
+}
+
+// sessionQuery holds the filter, sort, pagination and field selection query
+// parameters for the sessions status handler. Any query parameter that is not
+// one of the reserved names must be a session field name and is a filter on that
+// field. A filter matches when the field is equal to any of the values ignoring case.
+type sessionQuery struct {
+	filters    map[string][]string
+	sortField  string
+	descending bool
+	limit      int
+	offset     int
+	fields     []string
+}
+
+// parseSessionQuery parses the session query parameters
+func parseSessionQuery(parameters url.Values) (*sessionQuery, error) {
+	var err error
+
+	query := new(sessionQuery)
+	query.filters = make(map[string][]string)
+	query.limit = -1
+
+	for name, values := range parameters {
+		switch name {
+		case "sort":
+			query.sortField = values[0]
+		case "order":
+			switch strings.ToLower(values[0]) {
+			case "asc":
+				query.descending = false
+			case "desc":
+				query.descending = true
+			default:
+				return nil, fmt.Errorf("Invalid order: %s", values[0])
+			}
+		case "limit":
+			query.limit, err = strconv.Atoi(values[0])
+			if err != nil || query.limit < 0 {
+				return nil, fmt.Errorf("Invalid limit: %s", values[0])
+			}
+		case "offset":
+			query.offset, err = strconv.Atoi(values[0])
+			if err != nil || query.offset < 0 {
+				return nil, fmt.Errorf("Invalid offset: %s", values[0])
+			}
+		case "fields":
+			for _, value := range values {
+				for _, field := range strings.Split(value, ",") {
+					if field = strings.TrimSpace(field); field != "" {
+						query.fields = append(query.fields, field)
+					}
+				}
+			}
+		case "_":
+			// cache busting parameter added by some clients
+		default:
+			if !sessionFieldNames[name] && !dispatch.IsAttachmentDeclared(name) {
+				return nil, fmt.Errorf("Invalid filter: %s", name)
+			}
+			query.filters[name] = values
+		}
+	}
+
+	return query, nil
+}
+
+// apply filters, sorts, pages and selects the fields of the argumented sessions.
+// It returns the resulting page of sessions and the number of sessions that
+// matched the filters before paging.
+func (query *sessionQuery) apply(sessions []map[string]interface{}) ([]map[string]interface{}, int) {
+	result := make([]map[string]interface{}, 0, len(sessions))
+	for _, session := range sessions {
+		if query.matches(session) {
+			result = append(result, session)
+		}
+	}
+	total := len(result)
+
+	if query.sortField != "" {
+		sort.SliceStable(result, func(i, j int) bool {
+			first, firstFound := result[i][query.sortField]
+			second, secondFound := result[j][query.sortField]
+			// sessions without the field always go last
+			if !firstFound || !secondFound {
+				return firstFound && !secondFound
+			}
+			if query.descending {
+				return compareValues(second, first) < 0
+			}
+			return compareValues(first, second) < 0
+		})
+	}
+
+	if query.offset >= len(result) {
+		result = result[:0]
+	} else {
+		result = result[query.offset:]
+	}
+	if query.limit >= 0 && query.limit < len(result) {
+		result = result[:query.limit]
+	}
+
+	if len(query.fields) != 0 {
+		for i, session := range result {
+			result[i] = query.selectFields(session)
+		}
+	}
+
+	return result, total
+}
+
+// selectFields returns the session with only the selected fields
+func (query *sessionQuery) selectFields(session map[string]interface{}) map[string]interface{} {
+	if len(query.fields) == 0 {
+		return session
+	}
+	selected := make(map[string]interface{}, len(query.fields))
+	for _, field := range query.fields {
+		if value, found := session[field]; found {
+			selected[field] = value
+		}
+	}
+	return selected
+}
+
+// matches returns true if the session matches all of the filters
+func (query *sessionQuery) matches(session map[string]interface{}) bool {
+	for name, values := range query.filters {
+		value, found := session[name]
+		if !found {
+			return false
+		}
+		text := fmt.Sprint(value)
+		matched := false
+		for _, item := range values {
+			if strings.EqualFold(text, item) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// compareValues compares two session field values numerically if both are
+// numbers and as strings otherwise. It returns -1, 0, or 1.
+func compareValues(first interface{}, second interface{}) int {
+	firstNumber, firstOk := numericValue(first)
+	secondNumber, secondOk := numericValue(second)
+	if firstOk && secondOk {
+		switch {
+		case firstNumber < secondNumber:
+			return -1
+		case firstNumber > secondNumber:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(fmt.Sprint(first), fmt.Sprint(second))
+}
+
+// numericValue returns the value of a number of any type as a float64
+func numericValue(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
@@ -0,0 +1,141 @@
+package restd
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/untangle/packetd/services/dispatch"
+)
+
+func init() {
+	dispatch.DeclareAttachment("sni", "ssl_sni", "", "server name indication")
+}
+
+// TestParseSessionQuery checks the reserved parameters, the filters, and the invalid values
+func TestParseSessionQuery(t *testing.T) {
+	query, err := parseSessionQuery(url.Values{
+		"sort":        {"bytes"},
+		"order":       {"DESC"},
+		"limit":       {"10"},
+		"offset":      {"5"},
+		"fields":      {"session_id, bytes", "ssl_sni"},
+		"ip_protocol": {"6", "17"},
+	})
+	if err != nil {
+		t.Fatalf("parseSessionQuery failed: %v", err)
+	}
+	if query.sortField != "bytes" || !query.descending || query.limit != 10 || query.offset != 5 {
+		t.Errorf("Unexpected sort or paging: %+v", query)
+	}
+	if !reflect.DeepEqual(query.fields, []string{"session_id", "bytes", "ssl_sni"}) {
+		t.Errorf("Unexpected fields: %v", query.fields)
+	}
+	if !reflect.DeepEqual(query.filters, map[string][]string{"ip_protocol": {"6", "17"}}) {
+		t.Errorf("Unexpected filters: %v", query.filters)
+	}
+
+	query, err = parseSessionQuery(url.Values{})
+	if err != nil || query.limit != -1 || query.offset != 0 || query.sortField != "" {
+		t.Errorf("Unexpected defaults: %+v %v", query, err)
+	}
+
+	for _, name := range []string{"order", "limit", "offset"} {
+		if _, err := parseSessionQuery(url.Values{name: {"bogus"}}); err == nil {
+			t.Errorf("Expected an error for an invalid %s", name)
+		}
+	}
+	if _, err := parseSessionQuery(url.Values{"limit": {"-1"}}); err == nil {
+		t.Errorf("Expected an error for a negative limit")
+	}
+	if _, err := parseSessionQuery(url.Values{"bogus_field": {"1"}}); err == nil {
+		t.Errorf("Expected an error for an unknown filter")
+	}
+
+	query, err = parseSessionQuery(url.Values{"_": {"1600000000000"}, "ssl_sni": {"a.example.com"}})
+	if err != nil || !reflect.DeepEqual(query.filters, map[string][]string{"ssl_sni": {"a.example.com"}}) {
+		t.Errorf("Unexpected filters with the cache busting parameter: %+v %v", query, err)
+	}
+}
+
+// TestSessionQueryApply checks the filtering, sorting, paging, and field selection of the sessions
+func TestSessionQueryApply(t *testing.T) {
+	sessions := func() []map[string]interface{} {
+		return []map[string]interface{}{
+			{"session_id": int64(1), "ip_protocol": uint8(6), "bytes": uint64(300), "ssl_sni": "b.example.com"},
+			{"session_id": int64(2), "ip_protocol": uint8(17), "bytes": uint64(20)},
+			{"session_id": int64(3), "ip_protocol": uint8(6), "bytes": uint64(1000), "ssl_sni": "A.example.com"},
+			{"session_id": int64(4), "ip_protocol": uint8(6)},
+		}
+	}
+	ids := func(list []map[string]interface{}) []int64 {
+		var result []int64
+		for _, item := range list {
+			result = append(result, item["session_id"].(int64))
+		}
+		return result
+	}
+
+	tests := []struct {
+		parameters url.Values
+		ids        []int64
+		total      int
+	}{
+		{url.Values{}, []int64{1, 2, 3, 4}, 4},
+		{url.Values{"ip_protocol": {"6"}}, []int64{1, 3, 4}, 3},
+		{url.Values{"ip_protocol": {"6", "17"}}, []int64{1, 2, 3, 4}, 4},
+		{url.Values{"ssl_sni": {"a.EXAMPLE.com"}}, []int64{3}, 1},
+		{url.Values{"ssl_sni": {"c.example.com"}}, nil, 0},
+		{url.Values{"sort": {"bytes"}}, []int64{2, 1, 3, 4}, 4},
+		{url.Values{"sort": {"bytes"}, "order": {"desc"}}, []int64{3, 1, 2, 4}, 4},
+		{url.Values{"sort": {"ssl_sni"}}, []int64{3, 1, 2, 4}, 4},
+		{url.Values{"sort": {"bytes"}, "offset": {"1"}, "limit": {"2"}}, []int64{1, 3}, 4},
+		{url.Values{"offset": {"10"}}, nil, 4},
+		{url.Values{"limit": {"0"}}, nil, 4},
+	}
+
+	for _, test := range tests {
+		query, err := parseSessionQuery(test.parameters)
+		if err != nil {
+			t.Fatalf("parseSessionQuery(%v) failed: %v", test.parameters, err)
+		}
+		result, total := query.apply(sessions())
+		if !reflect.DeepEqual(ids(result), test.ids) || total != test.total {
+			t.Errorf("apply(%v) = %v %d expected %v %d", test.parameters, ids(result), total, test.ids, test.total)
+		}
+	}
+
+	query, _ := parseSessionQuery(url.Values{"fields": {"session_id,ssl_sni"}, "limit": {"2"}})
+	result, _ := query.apply(sessions())
+	expected := []map[string]interface{}{
+		{"session_id": int64(1), "ssl_sni": "b.example.com"},
+		{"session_id": int64(2)},
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Unexpected selected fields: %v", result)
+	}
+}
+
+// TestCompareValues checks the numeric and string comparisons of session field values
+func TestCompareValues(t *testing.T) {
+	tests := []struct {
+		first  interface{}
+		second interface{}
+		result int
+	}{
+		{uint64(9), uint64(10), -1},
+		{int64(10), uint8(9), 1},
+		{float32(1.5), int(1), 1},
+		{uint32(7), float64(7), 0},
+		{"9", "10", 1},
+		{"abc", "abd", -1},
+		{"same", "same", 0},
+		{uint16(10), "9", -1},
+	}
+
+	for _, test := range tests {
+		if result := compareValues(test.first, test.second); result != test.result {
+			t.Errorf("compareValues(%v, %v) = %d expected %d", test.first, test.second, result, test.result)
+		}
+	}
+}
@@ -22,11 +22,13 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/untangle/packetd/services/appclassmanager"
 	"github.com/untangle/packetd/services/certmanager"
+	"github.com/untangle/packetd/services/clock"
 	"github.com/untangle/packetd/services/dispatch"
 	"github.com/untangle/packetd/services/kernel"
 	"github.com/untangle/packetd/services/logger"
 	"github.com/untangle/packetd/services/netspace"
 	"github.com/untangle/packetd/services/overseer"
+	"github.com/untangle/packetd/services/pluginmanager"
 	"github.com/untangle/packetd/services/reports"
 	"github.com/untangle/packetd/services/settings"
 )
@@ -95,11 +97,17 @@ func Startup() {
 	api.POST("/warehouse/playback", warehousePlayback)
 	api.POST("/warehouse/cleanup", warehouseCleanup)
 	api.GET("/warehouse/status", warehouseStatus)
+	api.GET("/control/traffic", trafficStatus)
 	api.POST("/control/traffic", trafficControl)
 
 	api.POST("/netspace/request", netspaceRequest)
 
 	api.GET("/status/sessions", statusSessions)
+	api.DELETE("/status/sessions", killSessions)
+	api.DELETE("/status/sessions/:session_id", killSession)
+	api.GET("/status/events", statusEvents)
+	api.GET("/status/subscribers", statusSubscribers)
+	api.GET("/status/attachments", statusAttachments)
 	api.GET("/status/system", statusSystem)
 	api.GET("/status/hardware", statusHardware)
 	api.GET("/status/upgrade", statusUpgradeAvailable)
@@ -127,6 +135,11 @@ func Startup() {
 	api.GET("/classify/applications", getClassifyAppTable)
 	api.GET("/classify/categories", getClassifyCatTable)
 
+	api.GET("/plugins", getPluginStatus)
+	api.POST("/plugins/:name/start", startPlugin)
+	api.POST("/plugins/:name/stop", stopPlugin)
+	api.POST("/plugins/:name/reload", reloadPlugin)
+
 	api.GET("/logger/:source", loggerHandler)
 	api.GET("/debug", debugHandler)
 	api.POST("/gc", gcHandler)
@@ -365,6 +378,7 @@ func warehousePlayback(c *gin.Context) {
 	var filename string
 	var speedstr string
 	var speedval int
+	var clockstr string
 	var found bool
 	var err error
 
@@ -388,14 +402,31 @@ func warehousePlayback(c *gin.Context) {
 
 	speedstr, found = data["speed"]
 	if found == true {
-		speedval, err = strconv.Atoi(speedstr)
-		if err != nil {
+		if speedstr == "max" {
+			speedval = 0
+		} else if speedval, err = strconv.Atoi(speedstr); err != nil {
 			speedval = 1
 		}
 	} else {
 		speedval = 1
 	}
 
+	// the virtual clock is reset at the start of each playback and driven by the records so replays are reproducible
+	clockstr, found = data["clock"]
+	if found == true {
+		switch clockstr {
+		case "virtual":
+			if !clock.IsVirtual() {
+				clock.EnableVirtual(clock.Epoch)
+			}
+		case "system":
+			clock.DisableVirtual()
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid clock: " + clockstr})
+			return
+		}
+	}
+
 	kernel.SetWarehouseFlag('P')
 	kernel.SetWarehouseFile(filename)
 	kernel.SetWarehouseSpeed(speedval)
@@ -413,7 +444,7 @@ func warehouseCleanup(c *gin.Context) {
 
 func warehouseCapture(c *gin.Context) {
 
-	var data map[string]string
+	var data map[string]interface{}
 	var body []byte
 	var filename string
 	var found bool
@@ -431,17 +462,24 @@ func warehouseCapture(c *gin.Context) {
 		return
 	}
 
-	filename, found = data["filename"]
+	filename, found = captureValue(data, "filename")
 	if found != true {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "filename not specified"})
 		return
 	}
 
+	options, err := parseCaptureOptions(data)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	kernel.SetWarehouseFlag('C')
 	kernel.SetWarehouseFile(filename)
+	kernel.SetWarehouseCaptureOptions(options)
 	kernel.StartWarehouseCapture()
 
-	logger.Info("Beginning capture to file:%s\n", filename)
+	logger.Info("Beginning capture to file:%s options:%+v\n", filename, options)
 
 	c.JSON(http.StatusOK, "Capture started")
 }
@@ -469,7 +507,24 @@ func warehouseStatus(c *gin.Context) {
 		status = "CAPTURE"
 		break
 	}
-	c.JSON(http.StatusOK, status)
+
+	// the plain status string is kept for existing clients and the capture
+	// counters are only included when they are requested
+	if c.Query("capture") != "true" {
+		c.JSON(http.StatusOK, status)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status":  status,
+		"capture": kernel.GetWarehouseCaptureStatus(),
+	})
+}
+
+func trafficStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"bypass":   kernel.GetBypassFlag() != 0,
+		"overload": kernel.GetOverloadStatus(),
+	})
 }
 
 func trafficControl(c *gin.Context) {
@@ -604,6 +659,37 @@ func getClassifyCatTable(c *gin.Context) {
 	return
 }
 
+func getPluginStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, pluginmanager.GetPluginStatus())
+}
+
+func startPlugin(c *gin.Context) {
+	err := pluginmanager.StartPlugin(c.Param("name"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+func stopPlugin(c *gin.Context) {
+	err := pluginmanager.StopPlugin(c.Param("name"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+func reloadPlugin(c *gin.Context) {
+	err := pluginmanager.ReloadPlugin(c.Param("name"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
 func setSettings(c *gin.Context) {
 	var segments []string
 	path := c.Param("path")
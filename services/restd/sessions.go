@@ -1,11 +1,12 @@
 package restd
 
 import (
+	"net"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/untangle/packetd/services/dict"
 	"github.com/untangle/packetd/services/dispatch"
 	"github.com/untangle/packetd/services/logger"
 )
@@ -14,20 +15,92 @@ import (
 func statusSessions(c *gin.Context) {
 	logger.Debug("statusSession()\n")
 
-	sessions, err := getSessions()
+	query, err := parseSessionQuery(c.Request.URL.Query())
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
+	sessions, total := query.apply(getSessions())
+	c.Header("X-Total-Count", strconv.Itoa(total))
 	c.JSON(http.StatusOK, sessions)
 }
 
-// getSessions returns the fully merged list of sessions
-// as a list of map[string]interface{}
-// It reads the session list from /proc/net/nf_conntrack
-// and merges in the values for each session in dict
-func getSessions() ([]map[string]interface{}, error) {
+// killSession is the RESTD DELETE /api/status/sessions/:session_id handler
+// The session is reset as well as killed when the reset query parameter is true
+func killSession(c *gin.Context) {
+	logger.Debug("killSession()\n")
+
+	sessionID, err := strconv.ParseInt(c.Param("session_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session_id"})
+		return
+	}
+
+	session := dispatch.FindSessionByID(sessionID)
+	if session == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+
+	err = dispatch.KillSession(session, c.Query("reset") == "true", getUsername(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"killed": []int64{sessionID}})
+}
+
+// killSessions is the RESTD DELETE /api/status/sessions handler
+// It kills all sessions that match the client_address and application query parameters
+// and at least one of them is required so we never kill every session by mistake
+func killSessions(c *gin.Context) {
+	var filter dispatch.KillFilter
+
+	logger.Debug("killSessions()\n")
+
+	address := c.Query("client_address")
+	if len(address) != 0 {
+		filter.ClientAddress = net.ParseIP(address)
+		if filter.ClientAddress == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid client_address"})
+			return
+		}
+	}
+
+	filter.Application = c.Query("application")
+
+	if filter.ClientAddress == nil && len(filter.Application) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A client_address or application is required"})
+		return
+	}
+
+	killed := dispatch.KillSessions(filter, c.Query("reset") == "true", getUsername(c))
+	if killed == nil {
+		killed = []int64{}
+	}
+	c.JSON(http.StatusOK, gin.H{"killed": killed})
+}
+
+// statusSubscribers is the RESTD /api/status/subscribers handler
+func statusSubscribers(c *gin.Context) {
+	logger.Debug("statusSubscribers()\n")
+
+	c.JSON(http.StatusOK, dispatch.GetSubscriberMetrics())
+}
+
+// statusAttachments is the RESTD /api/status/attachments handler
+func statusAttachments(c *gin.Context) {
+	logger.Debug("statusAttachments()\n")
+
+	c.JSON(http.StatusOK, dispatch.GetAttachmentSchema())
+}
+
+// getSessions returns the list of sessions as a list of map[string]interface{}
+// It reads the conntrack table and merges in the attachments of each session
+// which hold the same values the plugins write to the dict sessions table
+func getSessions() []map[string]interface{} {
 	var sessions []map[string]interface{}
 
 	conntrackTable := dispatch.GetConntrackTable()
@@ -35,60 +108,30 @@ func getSessions() ([]map[string]interface{}, error) {
 	for _, v := range conntrackTable {
 		v.Guardian.RLock()
 		m := parseConntrack(v)
+		session := v.Session
 		v.Guardian.RUnlock()
-		if m != nil {
-			sessions = append(sessions, m)
-		}
-	}
-
-	// build a tuple map to store the sessions
-	tupleMap := make(map[uint32]map[string]interface{})
-	for _, s := range sessions {
-		var ctidx interface{} = s["conntrack_id"]
-		ctid, ok := ctidx.(uint32)
-		if !ok {
-			logger.Warn("Invalid conntrack_id type: %T\n", ctidx)
+		if m == nil {
 			continue
 		}
-		if ctid == 0 {
-			logger.Warn("Invalid conntrack_id: %d\n", ctid)
-			continue
+		if session != nil {
+			mergeAttachments(m, session.GetAllAttachments())
 		}
-		tupleMap[ctid] = s
+		sessions = append(sessions, m)
 	}
 
-	// read the data from dict "sessions" table
-	sessionTable, err := dict.GetSessions()
-	if err != nil {
-		logger.Warn("Unable to get sessions: %v\n", err)
-	}
+	return sessions
+}
 
-	// for all the data in the dict "sessions" table, merge it into the matching tupleMap entries
-	for ctid, session := range sessionTable {
-		_, ok := tupleMap[ctid]
-		if !ok {
-			// matching session not found, continue
+// mergeAttachments adds the simple attachment values that are not already in the session map
+func mergeAttachments(m map[string]interface{}, attachments map[string]interface{}) {
+	for key, value := range attachments {
+		if _, found := m[key]; found {
 			continue
 		}
-
-		// matching session found, merge the (new) values into the map
-		for key, value := range session {
-			_, alreadyFound := tupleMap[ctid][key]
-			if alreadyFound {
-				continue
-			} else {
-				tupleMap[ctid][key] = value
-			}
+		if isSimpleValue(value) {
+			m[key] = value
 		}
 	}
-
-	// return all the merged values from the tupleMap
-	var sessionList []map[string]interface{}
-	for _, v := range tupleMap {
-		sessionList = append(sessionList, v)
-	}
-
-	return sessionList, nil
 }
 
 // parse a line of /proc/net/nf_conntrack and return the info in a map
@@ -132,6 +175,12 @@ func parseConntrack(ct *dispatch.Conntrack) map[string]interface{} {
 	m["packets"] = ct.TotalPackets
 	m["client_packets"] = ct.ClientPackets
 	m["server_packets"] = ct.ServerPackets
+	m["byte_rate"] = uint32(ct.TotalByteRate)
+	m["client_byte_rate"] = uint32(ct.ClientByteRate)
+	m["server_byte_rate"] = uint32(ct.ServerByteRate)
+	m["packet_rate"] = uint32(ct.TotalPacketRate)
+	m["client_packet_rate"] = uint32(ct.ClientPacketRate)
+	m["server_packet_rate"] = uint32(ct.ServerPacketRate)
 
 	m["timestamp_start"] = ct.TimestampStart
 	if ct.TimestampStart != 0 {
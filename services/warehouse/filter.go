@@ -0,0 +1,177 @@
+package warehouse
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// originNames maps the record type names used by the capture API and tools to the record origins
+var originNames = map[string]byte{
+	"nfqueue":   Nfqueue,
+	"conntrack": Conntrack,
+	"netlogger": Netlogger,
+}
+
+// protocolNames maps the protocol names accepted by the filters to IP protocol numbers
+var protocolNames = map[string]uint8{
+	"icmp":   1,
+	"tcp":    6,
+	"udp":    17,
+	"icmpv6": 58,
+}
+
+// Filter selects records from a capture file using the same filters as the
+// warehouse capture in packetd. Zero values mean no filter.
+type Filter struct {
+	Origins  string // the record origins to keep from Q C and L or empty for all
+	Host     net.IP // keep only traffic to or from this address
+	Port     uint16 // keep only traffic to or from this port
+	Protocol uint8  // keep only this IP protocol
+	Ctid     uint32 // keep only this conntrack ID
+}
+
+// ParseOrigins returns the record origins for a comma separated list of nfqueue, conntrack, and netlogger
+func ParseOrigins(value string) (string, error) {
+	var origins string
+	for _, item := range strings.Split(value, ",") {
+		origin, ok := originNames[strings.ToLower(strings.TrimSpace(item))]
+		if !ok {
+			return "", fmt.Errorf("Invalid record type: %s", item)
+		}
+		if strings.IndexByte(origins, origin) < 0 {
+			origins += string(origin)
+		}
+	}
+	return origins, nil
+}
+
+// ParseProtocol returns the IP protocol number for a protocol name or number
+func ParseProtocol(value string) (uint8, error) {
+	if protocol, ok := protocolNames[strings.ToLower(value)]; ok {
+		return protocol, nil
+	}
+	protocol, err := strconv.ParseUint(value, 10, 8)
+	if err != nil || protocol == 0 {
+		return 0, fmt.Errorf("Invalid protocol: %s", value)
+	}
+	return uint8(protocol), nil
+}
+
+// flow holds the fields of a record used by the filters
+type flow struct {
+	ctid      uint32
+	protocol  uint8
+	addresses []net.IP
+	ports     []uint16
+}
+
+// Match returns true if the record passes all of the filters
+func (filter *Filter) Match(record *Record) bool {
+	if filter.Origins != "" && strings.IndexByte(filter.Origins, record.Origin) < 0 {
+		return false
+	}
+
+	// only decode the record when there is a tuple filter
+	if filter.Host == nil && filter.Port == 0 && filter.Protocol == 0 && filter.Ctid == 0 {
+		return true
+	}
+
+	item, ok := recordFlow(record)
+	if !ok {
+		return false
+	}
+
+	if filter.Ctid != 0 && filter.Ctid != item.ctid {
+		return false
+	}
+	if filter.Protocol != 0 && filter.Protocol != item.protocol {
+		return false
+	}
+
+	if filter.Host != nil {
+		found := false
+		for _, address := range item.addresses {
+			if filter.Host.Equal(address) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if filter.Port != 0 {
+		found := false
+		for _, port := range item.ports {
+			if filter.Port == port {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// recordFlow returns the fields of a record used by the filters and false if the record can't be decoded
+func recordFlow(record *Record) (*flow, bool) {
+	switch record.Origin {
+	case Nfqueue:
+		return packetFlow(record.Ctid, record.Data)
+	case Conntrack:
+		info, err := ParseConntrackInfo(record.Data)
+		if err != nil {
+			return nil, false
+		}
+		return &flow{
+			ctid:      info.ConnID,
+			protocol:  info.Protocol,
+			addresses: []net.IP{info.OrigSrc, info.OrigDst, info.ReplSrc, info.ReplDst},
+			ports:     []uint16{info.OrigSrcPort, info.OrigDstPort, info.ReplSrcPort, info.ReplDstPort},
+		}, true
+	case Netlogger:
+		info, err := ParseNetloggerInfo(record.Data)
+		if err != nil {
+			return nil, false
+		}
+		return &flow{
+			ctid:      info.Ctid,
+			protocol:  info.Protocol,
+			addresses: []net.IP{net.ParseIP(info.SrcAddr), net.ParseIP(info.DstAddr)},
+			ports:     []uint16{info.SrcPort, info.DstPort},
+		}, true
+	}
+	return nil, false
+}
+
+// packetFlow returns the fields of the IPv4 or IPv6 packet in an nfqueue record
+func packetFlow(ctid uint32, data []byte) (*flow, bool) {
+	item := &flow{ctid: ctid}
+	var offset int
+
+	switch {
+	case len(data) >= 20 && data[0]>>4 == 4:
+		item.protocol = data[9]
+		item.addresses = []net.IP{net.IP(data[12:16]), net.IP(data[16:20])}
+		offset = int(data[0]&0x0F) * 4
+	case len(data) >= 40 && data[0]>>4 == 6:
+		item.protocol = data[6]
+		item.addresses = []net.IP{net.IP(data[8:24]), net.IP(data[24:40])}
+		offset = 40
+	default:
+		return nil, false
+	}
+
+	// TCP and UDP both start with the source and destination ports
+	if (item.protocol == 6 || item.protocol == 17) && len(data) >= offset+4 {
+		item.ports = []uint16{binary.BigEndian.Uint16(data[offset : offset+2]), binary.BigEndian.Uint16(data[offset+2 : offset+4])}
+	}
+	return item, true
+}
@@ -0,0 +1,189 @@
+package warehouse
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// ConntrackInfoSize and NetloggerInfoSize are the sizes of the conntrack_info and netlogger_info structures
+const (
+	ConntrackInfoSize = 136
+	NetloggerInfoSize = 404
+)
+
+// ConntrackInfo holds the fields of the conntrack_info structure in a conntrack record
+type ConntrackInfo struct {
+	ConnID         uint32
+	MsgType        uint8
+	Family         uint8
+	Protocol       uint8
+	TCPState       uint8
+	OrigSrc        net.IP
+	OrigDst        net.IP
+	ReplSrc        net.IP
+	ReplDst        net.IP
+	OrigSrcPort    uint16
+	OrigDstPort    uint16
+	ReplSrcPort    uint16
+	ReplDstPort    uint16
+	OrigBytes      uint64
+	ReplBytes      uint64
+	OrigPackets    uint64
+	ReplPackets    uint64
+	TimestampStart uint64
+	TimestampStop  uint64
+	Mark           uint32
+	Timeout        uint32
+}
+
+// ParseConntrackInfo returns the conntrack_info structure in the data of a conntrack record
+func ParseConntrackInfo(data []byte) (*ConntrackInfo, error) {
+	if len(data) < ConntrackInfoSize {
+		return nil, fmt.Errorf("Invalid conntrack record length %d", len(data))
+	}
+
+	info := new(ConntrackInfo)
+	info.ConnID = binary.LittleEndian.Uint32(data[0:4])
+	info.MsgType = data[4]
+	info.Family = data[5]
+	info.Protocol = data[6]
+	info.TCPState = data[7]
+
+	address := func(offset int) net.IP {
+		if info.Family == syscall.AF_INET {
+			return append(net.IP(nil), data[offset:offset+4]...)
+		}
+		return append(net.IP(nil), data[offset:offset+16]...)
+	}
+	info.OrigSrc = address(8)
+	info.OrigDst = address(24)
+	info.ReplSrc = address(40)
+	info.ReplDst = address(56)
+
+	info.OrigSrcPort = binary.LittleEndian.Uint16(data[72:74])
+	info.OrigDstPort = binary.LittleEndian.Uint16(data[74:76])
+	info.ReplSrcPort = binary.LittleEndian.Uint16(data[76:78])
+	info.ReplDstPort = binary.LittleEndian.Uint16(data[78:80])
+	info.OrigBytes = binary.LittleEndian.Uint64(data[80:88])
+	info.ReplBytes = binary.LittleEndian.Uint64(data[88:96])
+	info.OrigPackets = binary.LittleEndian.Uint64(data[96:104])
+	info.ReplPackets = binary.LittleEndian.Uint64(data[104:112])
+	info.TimestampStart = binary.LittleEndian.Uint64(data[112:120])
+	info.TimestampStop = binary.LittleEndian.Uint64(data[120:128])
+	info.Mark = binary.LittleEndian.Uint32(data[128:132])
+	info.Timeout = binary.LittleEndian.Uint32(data[132:136])
+	return info, nil
+}
+
+// Bytes returns the conntrack_info structure for use as the data of a conntrack record
+func (info *ConntrackInfo) Bytes() []byte {
+	data := make([]byte, ConntrackInfoSize)
+	binary.LittleEndian.PutUint32(data[0:4], info.ConnID)
+	data[4] = info.MsgType
+	data[5] = info.Family
+	data[6] = info.Protocol
+	data[7] = info.TCPState
+
+	address := func(offset int, value net.IP) {
+		if info.Family == syscall.AF_INET {
+			copy(data[offset:offset+4], value.To4())
+		} else {
+			copy(data[offset:offset+16], value.To16())
+		}
+	}
+	address(8, info.OrigSrc)
+	address(24, info.OrigDst)
+	address(40, info.ReplSrc)
+	address(56, info.ReplDst)
+
+	binary.LittleEndian.PutUint16(data[72:74], info.OrigSrcPort)
+	binary.LittleEndian.PutUint16(data[74:76], info.OrigDstPort)
+	binary.LittleEndian.PutUint16(data[76:78], info.ReplSrcPort)
+	binary.LittleEndian.PutUint16(data[78:80], info.ReplDstPort)
+	binary.LittleEndian.PutUint64(data[80:88], info.OrigBytes)
+	binary.LittleEndian.PutUint64(data[88:96], info.ReplBytes)
+	binary.LittleEndian.PutUint64(data[96:104], info.OrigPackets)
+	binary.LittleEndian.PutUint64(data[104:112], info.ReplPackets)
+	binary.LittleEndian.PutUint64(data[112:120], info.TimestampStart)
+	binary.LittleEndian.PutUint64(data[120:128], info.TimestampStop)
+	binary.LittleEndian.PutUint32(data[128:132], info.Mark)
+	binary.LittleEndian.PutUint32(data[132:136], info.Timeout)
+	return data
+}
+
+// String returns a human readable description of the conntrack event
+func (info *ConntrackInfo) String() string {
+	return fmt.Sprintf("conntrack %c ctid=%d family=%d protocol=%d tcp_state=%d orig=%s reply=%s bytes=%d/%d packets=%d/%d mark=0x%08x timeout=%d",
+		info.MsgType, info.ConnID, info.Family, info.Protocol, info.TCPState,
+		net.JoinHostPort(info.OrigSrc.String(), fmt.Sprint(info.OrigSrcPort))+"->"+net.JoinHostPort(info.OrigDst.String(), fmt.Sprint(info.OrigDstPort)),
+		net.JoinHostPort(info.ReplSrc.String(), fmt.Sprint(info.ReplSrcPort))+"->"+net.JoinHostPort(info.ReplDst.String(), fmt.Sprint(info.ReplDstPort)),
+		info.OrigBytes, info.ReplBytes, info.OrigPackets, info.ReplPackets, info.Mark, info.Timeout)
+}
+
+// NetloggerInfo holds the fields of the netlogger_info structure in a netlogger record
+type NetloggerInfo struct {
+	Version  uint8
+	Protocol uint8
+	IcmpType uint16
+	SrcIntf  uint8
+	DstIntf  uint8
+	SrcAddr  string
+	DstAddr  string
+	SrcPort  uint16
+	DstPort  uint16
+	Mark     uint32
+	Ctid     uint32
+	Prefix   string
+}
+
+// ParseNetloggerInfo returns the netlogger_info structure in the data of a netlogger record
+func ParseNetloggerInfo(data []byte) (*NetloggerInfo, error) {
+	if len(data) < NetloggerInfoSize {
+		return nil, fmt.Errorf("Invalid netlogger record length %d", len(data))
+	}
+
+	info := new(NetloggerInfo)
+	info.Version = data[0]
+	info.Protocol = data[1]
+	info.IcmpType = binary.LittleEndian.Uint16(data[2:4])
+	info.SrcIntf = data[4]
+	info.DstIntf = data[5]
+	info.SrcAddr = cString(data[6:70])
+	info.DstAddr = cString(data[70:134])
+	info.SrcPort = binary.LittleEndian.Uint16(data[134:136])
+	info.DstPort = binary.LittleEndian.Uint16(data[136:138])
+	info.Mark = binary.LittleEndian.Uint32(data[140:144])
+	info.Ctid = binary.LittleEndian.Uint32(data[144:148])
+	info.Prefix = cString(data[148:404])
+	return info, nil
+}
+
+// Bytes returns the netlogger_info structure for use as the data of a netlogger record.
+// Strings that don't fit are truncated so they are always null terminated.
+func (info *NetloggerInfo) Bytes() []byte {
+	data := make([]byte, NetloggerInfoSize)
+	data[0] = info.Version
+	data[1] = info.Protocol
+	binary.LittleEndian.PutUint16(data[2:4], info.IcmpType)
+	data[4] = info.SrcIntf
+	data[5] = info.DstIntf
+	copy(data[6:69], info.SrcAddr)
+	copy(data[70:133], info.DstAddr)
+	binary.LittleEndian.PutUint16(data[134:136], info.SrcPort)
+	binary.LittleEndian.PutUint16(data[136:138], info.DstPort)
+	binary.LittleEndian.PutUint32(data[140:144], info.Mark)
+	binary.LittleEndian.PutUint32(data[144:148], info.Ctid)
+	copy(data[148:403], info.Prefix)
+	return data
+}
+
+// String returns a human readable description of the netlogger event
+func (info *NetloggerInfo) String() string {
+	return fmt.Sprintf("netlogger version=%d protocol=%d icmp_type=%d src_intf=%d dst_intf=%d %s->%s mark=0x%08x ctid=%d prefix=%q",
+		info.Version, info.Protocol, info.IcmpType, info.SrcIntf, info.DstIntf,
+		net.JoinHostPort(info.SrcAddr, fmt.Sprint(info.SrcPort)),
+		net.JoinHostPort(info.DstAddr, fmt.Sprint(info.DstPort)),
+		info.Mark, info.Ctid, info.Prefix)
+}
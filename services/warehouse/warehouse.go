@@ -0,0 +1,209 @@
+// Package warehouse reads and writes the traffic capture files created by the
+// packetd warehouse so captures can be inspected and created without the kernel
+// package or the netfilter libraries.
+package warehouse
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// The warehouse file format is written by warehouse.c using the native structure layout.
+// These definitions match the layout on the little endian 64 bit and ARM platforms we
+// run on where 64 bit values are aligned on 8 byte boundaries.
+
+// Signature is the signature at the start of every warehouse capture file
+const Signature = "UTPDCF"
+
+// MajorVersion and MinorVersion are the capture file version we understand
+const (
+	MajorVersion = 3
+	MinorVersion = 0
+)
+
+// DefaultDescription is the description written in the header by packetd
+const DefaultDescription = "Untangle Packet Daemon Traffic Capture\r\n"
+
+// The record origin values
+const (
+	Nfqueue   = 'Q'
+	Conntrack = 'C'
+	Netlogger = 'L'
+)
+
+// FileHeaderSize and DataHeaderSize are the sizes of the file_header and data_header structures
+const (
+	FileHeaderSize = 64
+	DataHeaderSize = 40
+)
+
+// the largest record warehouse.c will play back
+const maxRecordLength = 0xFFFF
+
+// Record is a single nfqueue, conntrack, or netlogger record from a warehouse
+// capture file. The timestamp comes from CLOCK_MONOTONIC so it is only meaningful
+// relative to the other records in the same capture.
+type Record struct {
+	Origin    byte
+	StampSec  uint64
+	StampNsec uint32
+	Mark      uint32
+	Ctid      uint32
+	Nfid      uint32
+	Family    uint32
+	Data      []byte
+}
+
+// Stamp returns the record timestamp in nanoseconds
+func (record *Record) Stamp() uint64 {
+	return record.StampSec*1000000000 + uint64(record.StampNsec)
+}
+
+// Size returns the number of bytes the record uses in a capture file
+func (record *Record) Size() int {
+	return DataHeaderSize + len(record.Data)
+}
+
+// Header returns the data_header structure for the record
+func (record *Record) Header() []byte {
+	header := make([]byte, DataHeaderSize)
+	header[0] = record.Origin
+	binary.LittleEndian.PutUint64(header[8:16], record.StampSec)
+	binary.LittleEndian.PutUint32(header[16:20], record.StampNsec)
+	binary.LittleEndian.PutUint32(header[20:24], uint32(len(record.Data)))
+	binary.LittleEndian.PutUint32(header[24:28], record.Mark)
+	binary.LittleEndian.PutUint32(header[28:32], record.Ctid)
+	binary.LittleEndian.PutUint32(header[32:36], record.Nfid)
+	binary.LittleEndian.PutUint32(header[36:40], record.Family)
+	return header
+}
+
+// String returns a human readable description of the record
+func (record *Record) String() string {
+	switch record.Origin {
+	case Nfqueue:
+		return fmt.Sprintf("nfqueue mark=0x%08x ctid=%d nfid=%d family=%d length=%d", record.Mark, record.Ctid, record.Nfid, record.Family, len(record.Data))
+	case Conntrack:
+		info, err := ParseConntrackInfo(record.Data)
+		if err != nil {
+			return fmt.Sprintf("conntrack invalid length=%d", len(record.Data))
+		}
+		return info.String()
+	case Netlogger:
+		info, err := ParseNetloggerInfo(record.Data)
+		if err != nil {
+			return fmt.Sprintf("netlogger invalid length=%d", len(record.Data))
+		}
+		return info.String()
+	}
+	return fmt.Sprintf("unknown origin %q length=%d", record.Origin, len(record.Data))
+}
+
+// Reader reads the records from a warehouse capture file
+type Reader struct {
+	input        io.Reader
+	Description  string
+	MajorVersion uint32
+	MinorVersion uint32
+}
+
+// NewReader reads and checks the file header of a warehouse capture file
+func NewReader(input io.Reader) (*Reader, error) {
+	header := make([]byte, FileHeaderSize)
+	if _, err := io.ReadFull(input, header); err != nil {
+		return nil, fmt.Errorf("Unable to read warehouse file header: %v", err)
+	}
+
+	if !bytes.HasPrefix(header[48:56], []byte(Signature)) {
+		return nil, fmt.Errorf("Invalid warehouse file signature")
+	}
+
+	reader := new(Reader)
+	reader.input = input
+	reader.Description = strings.TrimRight(cString(header[0:48]), "\r\n")
+	reader.MajorVersion = binary.LittleEndian.Uint32(header[56:60])
+	reader.MinorVersion = binary.LittleEndian.Uint32(header[60:64])
+
+	if reader.MajorVersion != MajorVersion || reader.MinorVersion != MinorVersion {
+		return nil, fmt.Errorf("Invalid warehouse file version %d.%d", reader.MajorVersion, reader.MinorVersion)
+	}
+	return reader, nil
+}
+
+// Next returns the next record from the capture file or io.EOF when there are no more
+func (reader *Reader) Next() (*Record, error) {
+	header := make([]byte, DataHeaderSize)
+	if _, err := io.ReadFull(reader.input, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("Truncated warehouse record header")
+		}
+		return nil, err
+	}
+
+	record := new(Record)
+	record.Origin = header[0]
+	record.StampSec = binary.LittleEndian.Uint64(header[8:16])
+	record.StampNsec = binary.LittleEndian.Uint32(header[16:20])
+	length := binary.LittleEndian.Uint32(header[20:24])
+	record.Mark = binary.LittleEndian.Uint32(header[24:28])
+	record.Ctid = binary.LittleEndian.Uint32(header[28:32])
+	record.Nfid = binary.LittleEndian.Uint32(header[32:36])
+	record.Family = binary.LittleEndian.Uint32(header[36:40])
+
+	// same sanity check as the playback in warehouse.c
+	if length < 0x0001 || length > maxRecordLength {
+		return nil, fmt.Errorf("Invalid warehouse record length %d", length)
+	}
+
+	record.Data = make([]byte, length)
+	if _, err := io.ReadFull(reader.input, record.Data); err != nil {
+		return nil, fmt.Errorf("Truncated warehouse record: %v", err)
+	}
+	return record, nil
+}
+
+// Writer writes records to a warehouse capture file
+type Writer struct {
+	output io.Writer
+}
+
+// NewWriter writes the file header for the current version with the argumented
+// description which is truncated to fit in the header
+func NewWriter(output io.Writer, description string) (*Writer, error) {
+	header := make([]byte, FileHeaderSize)
+	if len(description) > 47 {
+		description = description[:47]
+	}
+	copy(header[0:48], description)
+	copy(header[48:56], Signature)
+	binary.LittleEndian.PutUint32(header[56:60], MajorVersion)
+	binary.LittleEndian.PutUint32(header[60:64], MinorVersion)
+
+	if _, err := output.Write(header); err != nil {
+		return nil, err
+	}
+	return &Writer{output: output}, nil
+}
+
+// Write writes a record to the capture file
+func (writer *Writer) Write(record *Record) error {
+	if len(record.Data) < 0x0001 || len(record.Data) > maxRecordLength {
+		return fmt.Errorf("Invalid warehouse record length %d", len(record.Data))
+	}
+	if _, err := writer.output.Write(record.Header()); err != nil {
+		return err
+	}
+	_, err := writer.output.Write(record.Data)
+	return err
+}
+
+// cString returns the string in a null terminated character array
+func cString(data []byte) string {
+	if index := bytes.IndexByte(data, 0); index >= 0 {
+		data = data[:index]
+	}
+	return string(data)
+}
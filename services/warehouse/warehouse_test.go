@@ -0,0 +1,129 @@
+package warehouse
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+// TestReadWrite checks that records written with the writer are read back unchanged
+// and that the filters select the expected records
+func TestReadWrite(t *testing.T) {
+	conntrack := &ConntrackInfo{
+		ConnID:      1234,
+		MsgType:     'N',
+		Family:      2,
+		Protocol:    6,
+		OrigSrc:     net.ParseIP("192.168.1.100").To4(),
+		OrigDst:     net.ParseIP("10.1.1.1").To4(),
+		ReplSrc:     net.ParseIP("10.1.1.1").To4(),
+		ReplDst:     net.ParseIP("192.168.1.100").To4(),
+		OrigSrcPort: 40000,
+		OrigDstPort: 443,
+		ReplSrcPort: 443,
+		ReplDstPort: 40000,
+		OrigBytes:   60,
+		Timeout:     120,
+	}
+	netlogger := &NetloggerInfo{Version: 4, Protocol: 17, SrcAddr: "192.168.1.100", DstAddr: "8.8.8.8", SrcPort: 5353, DstPort: 53, Ctid: 99, Prefix: "test"}
+
+	// a UDP packet from 192.168.1.100:5353 to 8.8.8.8:53
+	packet := []byte{0x45, 0, 0, 28, 0, 0, 0, 0, 64, 17, 0, 0, 192, 168, 1, 100, 8, 8, 8, 8, 0x14, 0xE9, 0, 53, 0, 8, 0, 0}
+
+	records := []*Record{
+		{Origin: Conntrack, StampSec: 10, StampNsec: 1, Family: 2, Data: conntrack.Bytes()},
+		{Origin: Nfqueue, StampSec: 10, StampNsec: 2, Mark: 0x100, Ctid: 99, Nfid: 7, Family: 2, Data: packet},
+		{Origin: Netlogger, StampSec: 11, StampNsec: 0, Family: 2, Data: netlogger.Bytes()},
+	}
+
+	var buffer bytes.Buffer
+	writer, err := NewWriter(&buffer, DefaultDescription)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range records {
+		if err := writer.Write(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reader, err := NewReader(bytes.NewReader(buffer.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reader.Description != "Untangle Packet Daemon Traffic Capture" {
+		t.Errorf("Wrong description: %q", reader.Description)
+	}
+
+	var found []*Record
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		found = append(found, record)
+	}
+	if len(found) != len(records) {
+		t.Fatalf("Read %d records instead of %d", len(found), len(records))
+	}
+	for x, record := range found {
+		if record.String() != records[x].String() || record.Stamp() != records[x].Stamp() || !bytes.Equal(record.Data, records[x].Data) {
+			t.Errorf("Wrong record %d: %s", x, record)
+		}
+	}
+
+	info, err := ParseConntrackInfo(found[0].Data)
+	if err != nil || info.ConnID != 1234 || !info.OrigDst.Equal(net.ParseIP("10.1.1.1")) || info.OrigDstPort != 443 {
+		t.Errorf("Wrong conntrack info: %v %v", info, err)
+	}
+
+	filters := []struct {
+		filter Filter
+		match  []bool
+	}{
+		{Filter{}, []bool{true, true, true}},
+		{Filter{Origins: "QL"}, []bool{false, true, true}},
+		{Filter{Host: net.ParseIP("8.8.8.8")}, []bool{false, true, true}},
+		{Filter{Port: 443}, []bool{true, false, false}},
+		{Filter{Protocol: 17}, []bool{false, true, true}},
+		{Filter{Ctid: 99}, []bool{false, true, true}},
+		{Filter{Ctid: 1234, Port: 40000}, []bool{true, false, false}},
+	}
+	for _, item := range filters {
+		for x, record := range found {
+			if item.filter.Match(record) != item.match[x] {
+				t.Errorf("Filter %+v returned %v for record %d", item.filter, !item.match[x], x)
+			}
+		}
+	}
+
+	// records that can't be decoded only pass when there is no tuple filter
+	garbage := &Record{Origin: Nfqueue, Data: []byte{0xFF, 0xFF}}
+	if !(&Filter{Origins: "Q"}).Match(garbage) || (&Filter{Protocol: 6}).Match(garbage) {
+		t.Errorf("Wrong filter result for a record that can't be decoded")
+	}
+}
+
+// TestVersion checks that files with the wrong signature or version are rejected
+func TestVersion(t *testing.T) {
+	var buffer bytes.Buffer
+	if _, err := NewWriter(&buffer, DefaultDescription); err != nil {
+		t.Fatal(err)
+	}
+
+	header := buffer.Bytes()
+	binary.LittleEndian.PutUint32(header[56:60], 2)
+	if _, err := NewReader(bytes.NewReader(header)); err == nil {
+		t.Errorf("Version 2.0 file was accepted")
+	}
+
+	copy(header[48:56], "BADSIG")
+	if _, err := NewReader(bytes.NewReader(header)); err == nil {
+		t.Errorf("File with an invalid signature was accepted")
+	}
+}
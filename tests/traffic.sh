@@ -30,6 +30,9 @@ curl -X POST -s -o - -H 'Content-Type: application/json; charset=utf-8' -d '{"fi
 # the cleanup function to purge sessions and free memory allocated during playback.
 curl -X GET -s -o - http://localhost/api/warehouse/status
 
+# Get the warehouse status along with the bytes and records written by the capture
+curl -X GET -s -o - http://localhost/api/warehouse/status?capture=true
+
 # Cleanup after traffic playback
 curl -X POST -s -o - -H 'Content-Type: application/json; charset=utf-8' http://localhost/api/warehouse/cleanup
 